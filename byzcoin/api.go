@@ -69,9 +69,12 @@ func (c *Client) AddTransaction(tx ClientTransaction) (*AddTxResponse, error) {
 }
 
 // AddTransactionAndWait adds a transaction and will wait for it to be included
-// in the ledger, up to a maximum of wait block intervals. It does not return
-// any feedback on the transaction. The Client's Roster and ID should be
-// initialized before calling this method (see NewClientFromConfig).
+// in the ledger, up to a maximum of wait block intervals. If wait is bigger
+// than 0 and the transaction has been refused, the reply is returned
+// together with an error holding the reason of the refusal, so that callers
+// only checking the error don't take the transaction as accepted. The
+// Client's Roster and ID should be initialized before calling this method
+// (see NewClientFromConfig).
 func (c *Client) AddTransactionAndWait(tx ClientTransaction, wait int) (*AddTxResponse, error) {
 	reply := &AddTxResponse{}
 	err := c.SendProtobuf(c.Roster.List[0], &AddTxRequest{
@@ -83,6 +86,151 @@ func (c *Client) AddTransactionAndWait(tx ClientTransaction, wait int) (*AddTxRe
 	if err != nil {
 		return nil, err
 	}
+	if wait > 0 && !reply.Accepted {
+		return reply, errors.New("transaction is in block, but got refused: " + reply.Error)
+	}
+	return reply, nil
+}
+
+// ListInstances returns one page of the instances of the given contract,
+// controlled by the given darc. An empty contractID or a nil darcID don't
+// restrict the list. To get the first page, cursor must be nil, for the
+// following pages, it must be the NextCursor of the previous page. The
+// Client's Roster and ID should be initialized before calling this method
+// (see NewClientFromConfig).
+func (c *Client) ListInstances(contractID string, darcID darc.ID, cursor []byte) (*ListInstancesResponse, error) {
+	reply := &ListInstancesResponse{}
+	err := c.SendProtobuf(c.Roster.List[0], &ListInstances{
+		Version:     CurrentVersion,
+		SkipchainID: c.ID,
+		ContractID:  contractID,
+		DarcID:      darcID,
+		Cursor:      cursor,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// GetInstanceHistory returns the successive states of the instance, in the
+// order of the blocks that changed it. It requests all the pages of the
+// history, starting with the latest one. The Client's Roster and ID should
+// be initialized before calling this method (see NewClientFromConfig).
+func (c *Client) GetInstanceHistory(id InstanceID) (*GetInstanceHistoryResponse, error) {
+	history := &GetInstanceHistoryResponse{}
+	before := 0
+	for {
+		reply := &GetInstanceHistoryResponse{}
+		err := c.SendProtobuf(c.Roster.List[0], &GetInstanceHistory{
+			Version:     CurrentVersion,
+			SkipchainID: c.ID,
+			InstanceID:  id,
+			Before:      before,
+		}, reply)
+		if err != nil {
+			return nil, err
+		}
+		reply.Changes = append(reply.Changes, history.Changes...)
+		history = reply
+		if reply.NextBefore == 0 {
+			return history, nil
+		}
+		before = reply.NextBefore
+	}
+}
+
+// GetDarcHistory returns the successive versions of the darc, with the
+// signers of their evolutions and the changes of their rules. It requests
+// all the pages of the history, starting with the latest one.
+func (c *Client) GetDarcHistory(baseID darc.ID) (*GetDarcHistoryResponse, error) {
+	history := &GetDarcHistoryResponse{}
+	before := 0
+	for {
+		reply := &GetDarcHistoryResponse{}
+		err := c.SendProtobuf(c.Roster.List[0], &GetDarcHistory{
+			Version:     CurrentVersion,
+			SkipchainID: c.ID,
+			BaseID:      baseID,
+			Before:      before,
+		}, reply)
+		if err != nil {
+			return nil, err
+		}
+		reply.Versions = append(reply.Versions, history.Versions...)
+		history = reply
+		if reply.NextBefore == 0 {
+			return history, nil
+		}
+		before = reply.NextBefore
+	}
+}
+
+// GetAuthorizations returns the minimal combinations of identities that
+// can perform the action on the instance, together with warnings about the
+// delegations that could not be followed.
+func (c *Client) GetAuthorizations(id InstanceID, action string) (*GetAuthorizationsResponse, error) {
+	reply := &GetAuthorizationsResponse{}
+	err := c.SendProtobuf(c.Roster.List[0], &GetAuthorizations{
+		Version:     CurrentVersion,
+		SkipchainID: c.ID,
+		InstanceID:  id,
+		Action:      action,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// GetSnapshot returns a snapshot of the latest state of the collection. The
+// caller should check it with GetSnapshotResponse.Verify before using it.
+// The Client's Roster and ID should be initialized before calling this
+// method (see NewClientFromConfig).
+func (c *Client) GetSnapshot() (*GetSnapshotResponse, error) {
+	reply := &GetSnapshotResponse{}
+	err := c.SendProtobuf(c.Roster.List[0], &GetSnapshot{
+		Version:     CurrentVersion,
+		SkipchainID: c.ID,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// SimulateTransaction runs the transaction against the latest state of the
+// ledger, without adding it, and returns the state changes it would create
+// or the error of the failing instruction. The Client's Roster and ID
+// should be initialized before calling this method (see
+// NewClientFromConfig).
+func (c *Client) SimulateTransaction(tx ClientTransaction) (*SimulateTxResponse, error) {
+	reply := &SimulateTxResponse{}
+	err := c.SendProtobuf(c.Roster.List[0], &SimulateTxRequest{
+		Version:     CurrentVersion,
+		SkipchainID: c.ID,
+		Transaction: tx,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// GetTxStatus returns the status of the transaction whose instructions
+// have the given hash (see Instructions.Hash). It returns an error if the
+// transaction is not yet in a block. The Client's Roster and ID should be
+// initialized before calling this method (see NewClientFromConfig).
+func (c *Client) GetTxStatus(txHash []byte) (*GetTxStatusResponse, error) {
+	reply := &GetTxStatusResponse{}
+	err := c.SendProtobuf(c.Roster.List[0], &GetTxStatus{
+		Version:     CurrentVersion,
+		SkipchainID: c.ID,
+		TxHash:      txHash,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
 	return reply, nil
 }
 
@@ -104,6 +252,125 @@ func (c *Client) GetProof(key []byte) (*GetProofResponse, error) {
 	return reply, nil
 }
 
+// GetProofs returns a single proof of the existence or the absence of all
+// the keys, which is smaller than the proofs of every key. It sends a
+// message to the node on index 0 of the roster. The Client's Roster and ID
+// should be initialized before calling this method (see
+// NewClientFromConfig).
+func (c *Client) GetProofs(keys ...[]byte) (*GetProofsResponse, error) {
+	reply := &GetProofsResponse{}
+	err := c.SendProtobuf(c.Roster.List[0], &GetProofs{
+		Version: CurrentVersion,
+		ID:      c.ID,
+		Keys:    keys,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// GetProofAt returns a proof for the key against the state of the
+// collection after the block with the given index. The proof ends at that
+// block, whose header holds the collection root the proof is verified
+// against. The Client's Roster and ID should be initialized before calling
+// this method (see NewClientFromConfig).
+func (c *Client) GetProofAt(key []byte, index int) (*GetProofResponse, error) {
+	sb, err := skipchain.NewClient().GetSingleBlockByIndex(&c.Roster, c.ID, index)
+	if err != nil {
+		return nil, err
+	}
+	reply := &GetProofResponse{}
+	err = c.SendProtobuf(c.Roster.List[0], &GetProof{
+		Version: CurrentVersion,
+		ID:      c.ID,
+		Key:     key,
+		BlockID: sb.Hash,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// GetSignerCounters returns the latest counters of the given identities,
+// which are given in their string representation. The next instruction
+// signed by one of them needs to use the returned counter plus one. The
+// Client's Roster and ID should be initialized before calling this method
+// (see NewClientFromConfig).
+func (c *Client) GetSignerCounters(ids ...string) (*GetSignerCountersResponse, error) {
+	reply := &GetSignerCountersResponse{}
+	err := c.SendProtobuf(c.Roster.List[0], &GetSignerCounters{
+		Version:     CurrentVersion,
+		SignerIDs:   ids,
+		SkipchainID: c.ID,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Query asks the contract of the instance to answer the query with the
+// given name and arguments. The proof in the reply shows the state of the
+// instance the query ran against. The Client's Roster and ID should be
+// initialized before calling this method (see NewClientFromConfig).
+func (c *Client) Query(id InstanceID, name string, args Arguments) (*QueryResponse, error) {
+	reply := &QueryResponse{}
+	err := c.SendProtobuf(c.Roster.List[0], &Query{
+		Version:     CurrentVersion,
+		SkipchainID: c.ID,
+		InstanceID:  id,
+		Name:        name,
+		Args:        args,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// StreamTransactions opens a stream to the node on index 0 of the roster and
+// calls handler for every new block that is added to the ledger. If the
+// stream fails or is closed by the node, handler is called once with the
+// error and StreamTransactions returns. Closing done closes the connections
+// of the client, which ends the stream without calling handler; done can be
+// nil if the stream is never stopped. The Client's Roster and ID should be
+// initialized before calling this method (see NewClientFromConfig).
+func (c *Client) StreamTransactions(handler func(StreamingResponse, error), done <-chan bool) error {
+	conn, err := c.Stream(c.Roster.List[0], &StreamingRequest{
+		ID: c.ID,
+	})
+	if err != nil {
+		return err
+	}
+	stopped := make(chan bool)
+	defer close(stopped)
+	go func() {
+		select {
+		case <-done:
+			c.Close()
+		case <-stopped:
+		}
+	}()
+	for {
+		resp := StreamingResponse{}
+		if err := conn.ReadMessage(&resp); err != nil {
+			select {
+			case <-done:
+			default:
+				handler(StreamingResponse{}, err)
+			}
+			return nil
+		}
+		// Empty responses only keep the stream alive.
+		if resp.BlockID == nil {
+			continue
+		}
+		handler(resp, nil)
+	}
+}
+
 // GetGenDarc uses the GetProof method to fetch the latest version of the
 // Genesis Darc from ByzCoin and parses it.
 func (c *Client) GetGenDarc() (*darc.Darc, error) {
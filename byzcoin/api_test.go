@@ -59,3 +59,78 @@ func TestClient_GetProof(t *testing.T) {
 	require.Equal(t, k, newId)
 	require.Equal(t, value, vs[0])
 }
+
+func TestClient_StreamTransactions(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	servers, roster, _ := l.GenTree(3, true)
+	registerDummy(servers)
+	defer l.CloseAll()
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	msg, err := DefaultGenesisMsg(CurrentVersion, roster, []string{"spawn:dummy"}, signer.Identity())
+	require.Nil(t, err)
+	msg.BlockInterval = 100 * time.Millisecond
+	d := msg.GenesisDarc
+
+	c, _, err := NewLedger(msg, false)
+	require.Nil(t, err)
+
+	oldKeepAlive := streamingKeepAlive
+	defer func() {
+		streamingKeepAlive = oldKeepAlive
+	}()
+	streamingKeepAlive = msg.BlockInterval
+
+	done := make(chan StreamingResponse, 1)
+	stop := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		c2 := NewClient(c.ID, c.Roster)
+		c2.StreamTransactions(func(resp StreamingResponse, err error) {
+			if err != nil {
+				return
+			}
+			select {
+			case done <- resp:
+			default:
+			}
+		}, stop)
+		close(stopped)
+	}()
+	// Give the stream some time to be set up.
+	time.Sleep(msg.BlockInterval)
+
+	tx, err := createOneClientTx(d.GetBaseID(), dummyContract, []byte{1, 2, 3}, signer)
+	require.Nil(t, err)
+	_, err = c.AddTransaction(tx)
+	require.Nil(t, err)
+
+	select {
+	case resp := <-done:
+		require.Equal(t, 1, resp.Index)
+		require.Equal(t, 1, len(resp.TxResults))
+		require.True(t, resp.TxResults[0].Accepted)
+		require.Equal(t, tx.Instructions.Hash(), resp.TxResults[0].ClientTransaction.Instructions.Hash())
+	case <-time.After(10 * msg.BlockInterval):
+		t.Fatal("didn't get a streamed block in time")
+	}
+
+	// Stopping the stream removes the listener from the node.
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(10 * msg.BlockInterval):
+		t.Fatal("stream didn't stop in time")
+	}
+	service := l.GetServices(servers, ByzCoinID)[0].(*Service)
+	for i := 0; i < 10; i++ {
+		service.streamingMan.Lock()
+		listeners := len(service.streamingMan.listeners)
+		service.streamingMan.Unlock()
+		if listeners == 0 {
+			return
+		}
+		time.Sleep(msg.BlockInterval)
+	}
+	t.Fatal("listener of the stream was not removed")
+}
@@ -0,0 +1,111 @@
+package byzcoin
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dedis/cothority/byzcoin/darc"
+)
+
+// AttributeFn evaluates the condition attr:name=value of a darc rule for the
+// instruction being verified. The name is the one the function is registered
+// with, and value is given as is. cdb is the CollectionView given to the
+// contract.
+type AttributeFn func(cdb CollectionView, inst Instruction, value string) (bool, error)
+
+var attributes = map[string]AttributeFn{
+	"contract": attributeContract,
+	"instance": attributeInstance,
+}
+var attributesMutex sync.Mutex
+
+// RegisterAttribute adds an attribute that darc rules can use as
+// attr:name=value. Contracts usually register their attributes in their
+// init function. The names of the attributes are global, so an existing
+// attribute cannot be registered again.
+func RegisterAttribute(name string, f AttributeFn) error {
+	attributesMutex.Lock()
+	defer attributesMutex.Unlock()
+	if _, exists := attributes[name]; exists {
+		return errors.New("attribute " + name + " is already registered")
+	}
+	attributes[name] = f
+	return nil
+}
+
+// attributeContract is true if the instruction is executed by the contract
+// given as value. For a spawn instruction this is the contract that is
+// spawned, else the contract of the instance.
+func attributeContract(cdb CollectionView, inst Instruction, value string) (bool, error) {
+	if inst.GetType() == SpawnType {
+		return inst.Spawn.ContractID == value, nil
+	}
+	_, cid, _, err := cdb.GetValues(inst.InstanceID.Slice())
+	if err != nil {
+		return false, err
+	}
+	return cid == value, nil
+}
+
+// attributeInstance is true if the instruction is sent to the instance
+// whose ID in hex is given as value.
+func attributeInstance(cdb CollectionView, inst Instruction, value string) (bool, error) {
+	return inst.InstanceID.String() == value, nil
+}
+
+// darcAttributes returns the interpreters of the conditions that darc rules
+// can use besides identities:
+//  - before:<unix> is true if the block is older than the given Unix time
+//    in seconds
+//  - after:<unix> is true if the block is at least as recent as the given
+//    Unix time in seconds
+//  - attr:<name>=<value> calls the attribute registered with
+//    RegisterAttribute under name
+// The time of the block is the timestamp of the previous block, so that all
+// the nodes use the same time. It is only known to contracts called by
+// ByzCoin.
+func darcAttributes(cdb CollectionView, inst Instruction) darc.AttrInterpreters {
+	blockTime := func(value string) (int64, int64, error) {
+		t, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, 0, errors.New("invalid time " + value + ": " + err.Error())
+		}
+		_, timestamp, err := GetBlockInfo(cdb)
+		if err != nil {
+			return 0, 0, err
+		}
+		return time.Unix(0, timestamp).Unix(), t, nil
+	}
+	return darc.AttrInterpreters{
+		"before": func(value string) (bool, error) {
+			now, t, err := blockTime(value)
+			if err != nil {
+				return false, err
+			}
+			return now < t, nil
+		},
+		"after": func(value string) (bool, error) {
+			now, t, err := blockTime(value)
+			if err != nil {
+				return false, err
+			}
+			return now >= t, nil
+		},
+		"attr": func(value string) (bool, error) {
+			kv := strings.SplitN(value, "=", 2)
+			if len(kv) != 2 {
+				return false, errors.New("attribute " + value + " has no value")
+			}
+			attributesMutex.Lock()
+			f, ok := attributes[kv[0]]
+			attributesMutex.Unlock()
+			if !ok {
+				return false, errors.New("unknown attribute " + kv[0])
+			}
+			return f(cdb, inst, kv[1])
+		},
+	}
+}
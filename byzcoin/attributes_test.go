@@ -0,0 +1,56 @@
+package byzcoin
+
+import (
+	"testing"
+
+	"github.com/dedis/cothority/byzcoin/collection"
+	"github.com/dedis/cothority/byzcoin/darc"
+	"github.com/dedis/cothority/byzcoin/darc/expression"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttributes(t *testing.T) {
+	require.NotNil(t, RegisterAttribute("contract", attributeContract))
+	require.Nil(t, RegisterAttribute("test_attr", func(cdb CollectionView, inst Instruction, value string) (bool, error) {
+		return string(inst.Spawn.Args.Search("attr")) == value, nil
+	}))
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	ids := []darc.Identity{signer.Identity()}
+	d := darc.NewDarc(darc.InitRules(ids, ids), []byte("attributes"))
+	id := signer.Identity().String()
+	rules := map[string]string{
+		"spawn:attr":    id + " & attr:contract=attr & attr:test_attr=yes",
+		"spawn:other":   id + " & attr:contract=attr",
+		"spawn:unknown": id + " & attr:unknown=yes",
+		"spawn:time":    id + " & before:1546300800",
+	}
+	for action, expr := range rules {
+		require.Nil(t, d.Rules.AddRule(darc.Action(action), expression.Expr(expr)))
+	}
+	dBuf, err := d.ToProto()
+	require.Nil(t, err)
+	dID := NewInstanceID(d.GetBaseID())
+	c := collection.New(collection.Data{}, collection.Data{}, collection.Data{})
+	sc := NewStateChange(Create, dID, ContractDarcID, dBuf, d.GetBaseID())
+	require.Nil(t, storeInColl(c, &sc))
+	coll := &roCollection{c}
+
+	verify := func(contractID, attr string) error {
+		instr := Instruction{
+			InstanceID: dID,
+			Spawn: &Spawn{
+				ContractID: contractID,
+				Args:       Arguments{{Name: "attr", Value: []byte(attr)}},
+			},
+		}
+		require.Nil(t, instr.SignBy(d.GetBaseID(), signer))
+		return instr.VerifyDarcSignature(coll)
+	}
+	require.Nil(t, verify("attr", "yes"))
+	require.NotNil(t, verify("attr", "no"))
+	require.NotNil(t, verify("other", ""))
+	require.NotNil(t, verify("unknown", ""))
+	// The time of the block is only known to contracts called by ByzCoin.
+	require.NotNil(t, verify("time", ""))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/bcadmin/lib"
+	"github.com/dedis/protobuf"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+func printConfig(c *cli.Context, config *byzcoin.ChainConfig) error {
+	roster := rosterToStrings(&config.Roster)
+	if outputJSON {
+		return printJSON(c, struct {
+			BlockInterval string
+			MaxBlockSize  int
+			Roster        []string
+		}{config.BlockInterval.String(), config.MaxBlockSize, roster})
+	}
+	fmt.Fprintln(c.App.Writer, "Block interval:", config.BlockInterval)
+	fmt.Fprintln(c.App.Writer, "Max block size:", config.MaxBlockSize)
+	fmt.Fprintln(c.App.Writer, "Roster:", strings.Join(roster, ", "))
+	return nil
+}
+
+func configShow(c *cli.Context) error {
+	_, cl, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	config, err := cl.GetChainConfig()
+	if err != nil {
+		return err
+	}
+	return printConfig(c, config)
+}
+
+// configUpdate sends an update_config instruction to the genesis darc. A new
+// roster is also stored in the ByzCoin config, so that the next commands
+// talk to the new nodes.
+func configUpdate(c *cli.Context) error {
+	cfg, cl, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	signer, err := loadSigner(c, cfg)
+	if err != nil {
+		return err
+	}
+
+	config, err := cl.GetChainConfig()
+	if err != nil {
+		return err
+	}
+	changed := false
+	if c.IsSet("interval") {
+		config.BlockInterval = c.Duration("interval")
+		changed = true
+	}
+	if c.IsSet("blocksize") {
+		config.MaxBlockSize = c.Int("blocksize")
+		changed = true
+	}
+	if fn := c.String("roster"); fn != "" {
+		in, err := os.Open(fn)
+		if err != nil {
+			return fmt.Errorf("Could not open roster %v: %v", fn, err)
+		}
+		r, err := readRoster(in)
+		in.Close()
+		if err != nil {
+			return err
+		}
+		config.Roster = *r
+		changed = true
+	}
+	if !changed {
+		return errors.New("need at least one of --interval, --blocksize or --roster")
+	}
+
+	configBuf, err := protobuf.Encode(config)
+	if err != nil {
+		return err
+	}
+	gd, err := cl.GetGenDarc()
+	if err != nil {
+		return err
+	}
+	err = sendInvoke(cl, byzcoin.NewInstanceID(nil), gd.GetBaseID(), *signer,
+		"update_config", byzcoin.Arguments{{Name: "config", Value: configBuf}})
+	if err != nil {
+		return err
+	}
+
+	if c.String("roster") != "" {
+		cfg.Roster = config.Roster
+		_, err = lib.SaveConfig(cfg)
+		if err != nil {
+			return err
+		}
+	}
+	return printConfig(c, config)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/darc"
+	"github.com/dedis/cothority/byzcoin/darc/expression"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+// darcOutput is the JSON representation of a darc.
+type darcOutput struct {
+	ID          string
+	BaseID      string
+	Version     uint64
+	Description string
+	Rules       []ruleOutput
+}
+
+type ruleOutput struct {
+	Action     string
+	Expression string
+}
+
+func newDarcOutput(d *darc.Darc) darcOutput {
+	out := darcOutput{
+		ID:          fmt.Sprintf("%x", d.GetID()),
+		BaseID:      fmt.Sprintf("%x", d.GetBaseID()),
+		Version:     d.Version,
+		Description: string(d.Description),
+		Rules:       []ruleOutput{},
+	}
+	for _, r := range d.Rules.List {
+		out.Rules = append(out.Rules, ruleOutput{string(r.Action), string(r.Expr)})
+	}
+	return out
+}
+
+func printDarc(c *cli.Context, d *darc.Darc) error {
+	if outputJSON {
+		return printJSON(c, newDarcOutput(d))
+	}
+	fmt.Fprintln(c.App.Writer, d)
+	return nil
+}
+
+func darcShow(c *cli.Context) error {
+	_, cl, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	d, err := getDarc(cl, c.String("darc"))
+	if err != nil {
+		return err
+	}
+	return printDarc(c, d)
+}
+
+func darcRuleAdd(c *cli.Context) error {
+	expr, err := exprFromFlags(c)
+	if err != nil {
+		return err
+	}
+	return evolveRules(c, func(r *darc.Rules, a darc.Action) error {
+		return r.AddRule(a, expr)
+	})
+}
+
+func darcRuleUpdate(c *cli.Context) error {
+	expr, err := exprFromFlags(c)
+	if err != nil {
+		return err
+	}
+	return evolveRules(c, func(r *darc.Rules, a darc.Action) error {
+		return r.UpdateRule(a, expr)
+	})
+}
+
+func darcRuleRemove(c *cli.Context) error {
+	return evolveRules(c, func(r *darc.Rules, a darc.Action) error {
+		return r.DeleteRules(a)
+	})
+}
+
+func darcIdentityAdd(c *cli.Context) error {
+	id := c.String("identity")
+	if id == "" {
+		return errors.New("--identity flag is required")
+	}
+	return evolveRules(c, func(r *darc.Rules, a darc.Action) error {
+		expr, err := addIdentity(r.Get(a), id)
+		if err != nil {
+			return err
+		}
+		return r.UpdateRule(a, expr)
+	})
+}
+
+func darcIdentityRemove(c *cli.Context) error {
+	id := c.String("identity")
+	if id == "" {
+		return errors.New("--identity flag is required")
+	}
+	return evolveRules(c, func(r *darc.Rules, a darc.Action) error {
+		expr, err := removeIdentity(r.Get(a), id)
+		if err != nil {
+			return err
+		}
+		return r.UpdateRule(a, expr)
+	})
+}
+
+func darcHistory(c *cli.Context) error {
+	_, cl, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	d, err := getDarc(cl, c.String("darc"))
+	if err != nil {
+		return err
+	}
+
+	resp, err := cl.GetDarcHistory(d.GetBaseID())
+	if err != nil {
+		return err
+	}
+
+	type versionOutput struct {
+		Version    uint64
+		BlockIndex int
+		Time       string
+		Signers    []string
+		Changes    []string
+	}
+	versions := []versionOutput{}
+	for _, v := range resp.Versions {
+		out := versionOutput{
+			Version:    v.Darc.Version,
+			BlockIndex: v.BlockIndex,
+			Time:       time.Unix(0, v.Timestamp).UTC().Format(time.RFC3339),
+			Signers:    []string{},
+			Changes:    []string{},
+		}
+		for _, s := range v.Signers {
+			out.Signers = append(out.Signers, s.String())
+		}
+		for _, change := range v.Changes {
+			out.Changes = append(out.Changes, change.String())
+		}
+		versions = append(versions, out)
+	}
+	if outputJSON {
+		return printJSON(c, struct {
+			FirstBlock int
+			Versions   []versionOutput
+		}{resp.FirstBlock, versions})
+	}
+
+	if resp.FirstBlock > 0 {
+		fmt.Fprintf(c.App.Writer, "The versions before block %d are unknown to the node.\n", resp.FirstBlock)
+	}
+	for _, v := range versions {
+		fmt.Fprintf(c.App.Writer, "Version %d - block %d at %s\n", v.Version, v.BlockIndex, v.Time)
+		if len(v.Signers) > 0 {
+			fmt.Fprintln(c.App.Writer, "Signers:", strings.Join(v.Signers, ", "))
+		}
+		for _, change := range v.Changes {
+			fmt.Fprintln(c.App.Writer, "\t"+change)
+		}
+	}
+	return nil
+}
+
+// evolveRules evolves the darc given by the --darc flag with the update of
+// the rule of the action given as argument, and prints the new darc.
+func evolveRules(c *cli.Context, update func(*darc.Rules, darc.Action) error) error {
+	if c.NArg() == 0 {
+		return errors.New("need the action of the rule, e.g. spawn:contractName")
+	}
+	action := darc.Action(c.Args().First())
+
+	cfg, cl, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	signer, err := loadSigner(c, cfg)
+	if err != nil {
+		return err
+	}
+	d, err := getDarc(cl, c.String("darc"))
+	if err != nil {
+		return err
+	}
+
+	d2, err := evolveDarc(cl, d, *signer, func(r *darc.Rules) error {
+		return update(r, action)
+	})
+	if err != nil {
+		return err
+	}
+	return printDarc(c, d2)
+}
+
+// evolveDarc sends the next version of the darc, with the rules changed by
+// update, and waits for it to be included in a block.
+func evolveDarc(cl *byzcoin.Client, d *darc.Darc, signer darc.Signer, update func(*darc.Rules) error) (*darc.Darc, error) {
+	d2 := d.Copy()
+	err := d2.EvolveFrom(d)
+	if err != nil {
+		return nil, err
+	}
+	err = update(&d2.Rules)
+	if err != nil {
+		return nil, err
+	}
+
+	d2Buf, err := d2.ToProto()
+	if err != nil {
+		return nil, err
+	}
+	err = sendInvoke(cl, byzcoin.NewInstanceID(d2.GetBaseID()), d2.GetBaseID(), signer,
+		"evolve", byzcoin.Arguments{{Name: "darc", Value: d2Buf}})
+	if err != nil {
+		return nil, err
+	}
+	return d2, nil
+}
+
+// getDarc returns the latest version of the darc with the base ID in hex,
+// or the genesis darc if the ID is empty.
+func getDarc(cl *byzcoin.Client, baseID string) (*darc.Darc, error) {
+	if baseID == "" {
+		return cl.GetGenDarc()
+	}
+	id, err := hex.DecodeString(baseID)
+	if err != nil {
+		return nil, errors.New("invalid darc ID: " + err.Error())
+	}
+	p, err := cl.GetProof(id)
+	if err != nil {
+		return nil, err
+	}
+	if !p.Proof.InclusionProof.Match() {
+		return nil, errors.New("cannot find darc " + baseID)
+	}
+	_, vs, err := p.Proof.KeyValue()
+	if err != nil {
+		return nil, err
+	}
+	if len(vs) < 2 {
+		return nil, errors.New("not enough records")
+	}
+	if string(vs[1]) != byzcoin.ContractDarcID {
+		return nil, errors.New("expected contract to be darc but got: " + string(vs[1]))
+	}
+	return darc.NewFromProtobuf(vs[0])
+}
+
+// isIdentityList returns the identities of an expression that is a list of
+// identities joined by |, or false if the expression is anything else.
+func isIdentityList(expr expression.Expr) ([]string, bool) {
+	var ids []string
+	for _, id := range strings.Split(string(expr), "|") {
+		id = strings.TrimSpace(id)
+		if id == "" || strings.ContainsAny(id, "&()[]/ ") {
+			return nil, false
+		}
+		ids = append(ids, id)
+	}
+	return ids, true
+}
+
+// addIdentity returns the expression that is true if expr is true or if the
+// identity signed.
+func addIdentity(expr expression.Expr, id string) (expression.Expr, error) {
+	if expr == nil {
+		return nil, errors.New("the rule does not exist")
+	}
+	ids, ok := isIdentityList(expr)
+	if !ok {
+		return expression.Expr("(" + string(expr) + ") | " + id), nil
+	}
+	for _, i := range ids {
+		if i == id {
+			return nil, errors.New("the identity is already in the rule")
+		}
+	}
+	return expression.InitOrExpr(append(ids, id)...), nil
+}
+
+// removeIdentity removes the identity from an expression that is a list of
+// identities joined by |. Other expressions must be replaced with
+// "darc rule update".
+func removeIdentity(expr expression.Expr, id string) (expression.Expr, error) {
+	if expr == nil {
+		return nil, errors.New("the rule does not exist")
+	}
+	ids, ok := isIdentityList(expr)
+	if !ok {
+		return nil, errors.New("can only remove an identity from a list of identities joined by |")
+	}
+	var rest []string
+	for _, i := range ids {
+		if i != id {
+			rest = append(rest, i)
+		}
+	}
+	if len(rest) == len(ids) {
+		return nil, errors.New("the identity is not in the rule")
+	}
+	if len(rest) == 0 {
+		return nil, errors.New("cannot remove the last identity, remove the rule instead")
+	}
+	return expression.InitOrExpr(rest...), nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/dedis/cothority/byzcoin"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+// instanceOutput is the JSON representation of an instance.
+type instanceOutput struct {
+	InstanceID string
+	ContractID string
+	DarcID     string
+	Value      string
+}
+
+func newInstanceOutput(inst byzcoin.Instance) instanceOutput {
+	return instanceOutput{
+		InstanceID: inst.InstanceID.String(),
+		ContractID: inst.ContractID,
+		DarcID:     fmt.Sprintf("%x", inst.DarcID),
+		Value:      fmt.Sprintf("%x", inst.Value),
+	}
+}
+
+func instanceList(c *cli.Context) error {
+	_, cl, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	darcID, err := hex.DecodeString(c.String("darc"))
+	if err != nil {
+		return errors.New("invalid darc ID: " + err.Error())
+	}
+	if len(darcID) == 0 {
+		darcID = nil
+	}
+
+	instances := []instanceOutput{}
+	var cursor []byte
+	for {
+		resp, err := cl.ListInstances(c.String("contract"), darcID, cursor)
+		if err != nil {
+			return err
+		}
+		for _, inst := range resp.Instances {
+			instances = append(instances, newInstanceOutput(inst))
+		}
+		if len(resp.NextCursor) == 0 {
+			break
+		}
+		cursor = resp.NextCursor
+	}
+
+	if outputJSON {
+		return printJSON(c, instances)
+	}
+	for _, inst := range instances {
+		fmt.Fprintf(c.App.Writer, "%s %s darc:%s\n", inst.InstanceID, inst.ContractID, inst.DarcID)
+	}
+	return nil
+}
+
+func instanceShow(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return errors.New("need the ID of the instance in hex")
+	}
+	_, cl, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	id, err := hex.DecodeString(c.Args().First())
+	if err != nil || len(id) != len(byzcoin.InstanceID{}) {
+		return errors.New("invalid instance ID")
+	}
+
+	p, err := cl.GetProof(id)
+	if err != nil {
+		return err
+	}
+	if !p.Proof.InclusionProof.Match() {
+		return errors.New("cannot find instance " + c.Args().First())
+	}
+	_, vs, err := p.Proof.KeyValue()
+	if err != nil {
+		return err
+	}
+	if len(vs) < 3 {
+		return errors.New("not enough records")
+	}
+	inst := newInstanceOutput(byzcoin.Instance{
+		InstanceID: byzcoin.NewInstanceID(id),
+		ContractID: string(vs[1]),
+		DarcID:     vs[2],
+		Value:      vs[0],
+	})
+
+	if outputJSON {
+		return printJSON(c, inst)
+	}
+	fmt.Fprintln(c.App.Writer, "Instance:", inst.InstanceID)
+	fmt.Fprintln(c.App.Writer, "Contract:", inst.ContractID)
+	fmt.Fprintln(c.App.Writer, "Darc:", inst.DarcID)
+	fmt.Fprintln(c.App.Writer, "Value:", inst.Value)
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/dedis/cothority/byzcoin/bcadmin/lib"
+	"github.com/dedis/cothority/byzcoin/darc"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+func keyList(c *cli.Context) error {
+	ids, err := lib.ListKeys()
+	if err != nil {
+		return err
+	}
+	out := []string{}
+	for _, id := range ids {
+		out = append(out, id.String())
+	}
+	if outputJSON {
+		return printJSON(c, out)
+	}
+	for _, id := range out {
+		fmt.Fprintln(c.App.Writer, id)
+	}
+	return nil
+}
+
+func keyExport(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return errors.New("need the identity of the key")
+	}
+	id, err := darc.ParseIdentity(c.Args().First())
+	if err != nil {
+		return err
+	}
+	buf, err := lib.ExportKey(id)
+	if err != nil {
+		return err
+	}
+	if outputJSON {
+		return printJSON(c, struct {
+			Identity string
+			Key      string
+		}{id.String(), hex.EncodeToString(buf)})
+	}
+	fmt.Fprintln(c.App.Writer, hex.EncodeToString(buf))
+	return nil
+}
+
+func keyImport(c *cli.Context) error {
+	key := c.Args().First()
+	if key == "" {
+		buf, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		key = string(buf)
+	}
+	buf, err := hex.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return errors.New("invalid key: " + err.Error())
+	}
+	signer, err := lib.ImportKey(buf)
+	if err != nil {
+		return err
+	}
+	if outputJSON {
+		return printJSON(c, struct{ Identity string }{signer.Identity().String()})
+	}
+	fmt.Fprintln(c.App.Writer, "Imported the key of", signer.Identity())
+	return nil
+}
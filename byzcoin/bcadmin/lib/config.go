@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -31,9 +32,7 @@ type Config struct {
 // LoadKey returns the signer of a given identity. It searches it in the ConfigPath.
 func LoadKey(id darc.Identity) (*darc.Signer, error) {
 	// Find private key file.
-	fn := fmt.Sprintf("key-%s.cfg", id)
-	fn = filepath.Join(ConfigPath, fn)
-	return LoadSigner(fn)
+	return LoadSigner(keyFile(id))
 }
 
 // LoadSigner loads a signer from a file given by fn.
@@ -42,19 +41,54 @@ func LoadSigner(fn string) (*darc.Signer, error) {
 	if err != nil {
 		return nil, err
 	}
+	return decodeSigner(buf)
+}
 
-	var signer darc.Signer
-	err = protobuf.DecodeWithConstructors(buf, &signer,
-		network.DefaultConstructors(cothority.Suite))
-	return &signer, err
+// ListKeys returns the identities of all the signers stored in the
+// ConfigPath.
+func ListKeys() ([]darc.Identity, error) {
+	files, err := filepath.Glob(filepath.Join(ConfigPath, "key-*.cfg"))
+	if err != nil {
+		return nil, err
+	}
+	var ids []darc.Identity
+	for _, fn := range files {
+		signer, err := LoadSigner(fn)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %v: %v", fn, err)
+		}
+		ids = append(ids, signer.Identity())
+	}
+	return ids, nil
+}
+
+// ExportKey returns the signer of the given identity, encoded the same way
+// as in its file. It can be given to ImportKey on another machine.
+func ExportKey(id darc.Identity) ([]byte, error) {
+	return ioutil.ReadFile(keyFile(id))
+}
+
+// ImportKey decodes a signer returned by ExportKey and stores it in the
+// ConfigPath. It refuses to overwrite a stored signer.
+func ImportKey(buf []byte) (*darc.Signer, error) {
+	signer, err := decodeSigner(buf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %v", err)
+	}
+	if signer.Type() < 0 {
+		return nil, errors.New("invalid key: unknown signer type")
+	}
+	if _, err := os.Stat(keyFile(signer.Identity())); err == nil {
+		return nil, fmt.Errorf("the key of %s already exists", signer.Identity())
+	}
+	return signer, SaveKey(*signer)
 }
 
 // SaveKey stores a signer in a file.
 func SaveKey(signer darc.Signer) error {
 	os.MkdirAll(ConfigPath, 0755)
 
-	fn := fmt.Sprintf("key-%s.cfg", signer.Identity())
-	fn = filepath.Join(ConfigPath, fn)
+	fn := keyFile(signer.Identity())
 
 	// perms = 0400 because there is key material inside this file.
 	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0400)
@@ -109,3 +143,14 @@ func LoadConfig(file string) (cfg Config, cl *byzcoin.Client, err error) {
 	cl = byzcoin.NewClient(cfg.ByzCoinID, cfg.Roster)
 	return
 }
+
+func keyFile(id darc.Identity) string {
+	return filepath.Join(ConfigPath, fmt.Sprintf("key-%s.cfg", id))
+}
+
+func decodeSigner(buf []byte) (*darc.Signer, error) {
+	var signer darc.Signer
+	err := protobuf.DecodeWithConstructors(buf, &signer,
+		network.DefaultConstructors(cothority.Suite))
+	return &signer, err
+}
@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/darc"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// UnsignedTx is a transaction that is signed offline. It is created by a
+// machine connected to ByzCoin, with the identities of all the signers of
+// every instruction, because they are part of the signed digest. It holds
+// the darcs of the instructions, so that the signers can check the rules
+// and sign without contacting ByzCoin. Once every signer signed, possibly
+// in separate copies that are merged, the transaction can be submitted.
+type UnsignedTx struct {
+	// ByzCoinID is the ledger the transaction is meant for.
+	ByzCoinID skipchain.SkipBlockID
+	// Transaction holds the instructions, with empty signatures for the
+	// signers that didn't sign yet.
+	Transaction byzcoin.ClientTransaction
+	// Darcs holds the darc controlling every instruction, in the same
+	// order as the instructions.
+	Darcs []darc.Darc
+}
+
+// LoadTx reads an unsigned transaction from a file.
+func LoadTx(fn string) (*UnsignedTx, error) {
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	tx := &UnsignedTx{}
+	err = protobuf.DecodeWithConstructors(buf, tx,
+		network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, err
+	}
+	if len(tx.Darcs) != len(tx.Transaction.Instructions) {
+		return nil, errors.New("the transaction needs one darc per instruction")
+	}
+	return tx, nil
+}
+
+// SaveTx writes an unsigned transaction to a file.
+func SaveTx(fn string, tx *UnsignedTx) error {
+	buf, err := protobuf.Encode(tx)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fn, buf, 0644)
+}
+
+// Sign adds the signatures of the signers to all the instructions where
+// they are one of the identities. It returns an error if a signer cannot
+// sign any instruction.
+func (tx *UnsignedTx) Sign(signers ...darc.Signer) error {
+	for _, signer := range signers {
+		id := signer.Identity()
+		signed := false
+		for i := range tx.Transaction.Instructions {
+			instr := &tx.Transaction.Instructions[i]
+			if signatureIndex(*instr, id) < 0 {
+				continue
+			}
+			err := instr.SignWith(tx.Darcs[i].GetBaseID(), signer)
+			if err != nil {
+				return err
+			}
+			signed = true
+		}
+		if !signed {
+			return fmt.Errorf("%s is not a signer of the transaction", id)
+		}
+	}
+	return nil
+}
+
+// Merge copies into tx the signatures of other, which must be a copy of
+// the same transaction, signed by other signers.
+func (tx *UnsignedTx) Merge(other *UnsignedTx) error {
+	if !bytes.Equal(tx.ByzCoinID, other.ByzCoinID) {
+		return errors.New("the transactions are for different ledgers")
+	}
+	instrs := tx.Transaction.Instructions
+	if len(instrs) != len(other.Transaction.Instructions) {
+		return errors.New("the transactions have different instructions")
+	}
+	for i := range instrs {
+		o := other.Transaction.Instructions[i]
+		if !bytes.Equal(instrs[i].Hash(), o.Hash()) || len(instrs[i].Signatures) != len(o.Signatures) {
+			return errors.New("the transactions have different instructions")
+		}
+		for j, sig := range o.Signatures {
+			if !sig.Signer.Equal(&instrs[i].Signatures[j].Signer) {
+				return errors.New("the transactions have different signers")
+			}
+			if len(sig.Signature) > 0 {
+				instrs[i].Signatures[j].Signature = sig.Signature
+			}
+		}
+	}
+	return nil
+}
+
+// Missing returns the identities that still have to sign, for every
+// instruction.
+func (tx *UnsignedTx) Missing() [][]darc.Identity {
+	missing := make([][]darc.Identity, len(tx.Transaction.Instructions))
+	for i, instr := range tx.Transaction.Instructions {
+		for _, sig := range instr.Signatures {
+			if len(sig.Signature) == 0 {
+				missing[i] = append(missing[i], sig.Signer)
+			}
+		}
+	}
+	return missing
+}
+
+// IsSigned returns true if all the signers of all the instructions signed.
+func (tx *UnsignedTx) IsSigned() bool {
+	for _, m := range tx.Missing() {
+		if len(m) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func signatureIndex(instr byzcoin.Instruction, id darc.Identity) int {
+	for i, sig := range instr.Signatures {
+		if sig.Signer.Equal(&id) {
+			return i
+		}
+	}
+	return -1
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -12,6 +13,7 @@ import (
 	"github.com/dedis/cothority/byzcoin"
 	"github.com/dedis/cothority/byzcoin/bcadmin/lib"
 	"github.com/dedis/cothority/byzcoin/darc"
+	"github.com/dedis/cothority/byzcoin/darc/expression"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/app"
 	"github.com/dedis/onet/cfgpath"
@@ -24,6 +26,33 @@ func init() {
 	network.RegisterMessages(&darc.Darc{}, &darc.Identity{}, &darc.Signer{})
 }
 
+var bcFlag = cli.StringFlag{
+	Name:   "bc",
+	EnvVar: "BC",
+	Usage:  "the ByzCoin config to use",
+}
+
+var darcFlag = cli.StringFlag{
+	Name:  "darc",
+	Usage: "the base ID of the darc in hex, the genesis darc if not given",
+}
+
+var signFlag = cli.StringFlag{
+	Name:  "sign",
+	Usage: "the identity of the key signing the transaction, the admin identity of the config if not given",
+}
+
+var identityFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "identity",
+		Usage: "the identity of the signer who will be allowed to access the contract (e.g. ed25519:a35020c70b8d735...0357))",
+	},
+	cli.IntFlag{
+		Name:  "threshold",
+		Usage: "if given, the identity is a comma-separated list, of which at least this number of signers is needed",
+	},
+}
+
 var cmds = cli.Commands{
 	{
 		Name:    "create",
@@ -46,36 +75,265 @@ var cmds = cli.Commands{
 		Name:    "show",
 		Usage:   "show the config, contact ByzCoin to get Genesis Darc ID",
 		Aliases: []string{"s"},
-		Flags: []cli.Flag{
-			cli.StringFlag{
-				Name:   "bc",
-				EnvVar: "BC",
-				Usage:  "the ByzCoin config to use",
-			},
-		},
-		Action: show,
+		Flags:   []cli.Flag{bcFlag},
+		Action:  show,
 	},
 	{
 		Name:    "add",
 		Usage:   "add a rule and signer to the base darc",
 		Aliases: []string{"a"},
-		Flags: []cli.Flag{
-			cli.StringFlag{
-				Name:   "bc",
-				EnvVar: "BC",
-				Usage:  "the ByzCoin config to use",
+		Flags:   append([]cli.Flag{bcFlag}, identityFlags...),
+		Action:  add,
+	},
+	{
+		Name:  "darc",
+		Usage: "inspect and evolve darcs",
+		Subcommands: cli.Commands{
+			{
+				Name:   "show",
+				Usage:  "show the latest version of a darc",
+				Flags:  []cli.Flag{bcFlag, darcFlag},
+				Action: darcShow,
 			},
-			cli.StringFlag{
+			{
+				Name:  "rule",
+				Usage: "add, update or remove the rules of a darc",
+				Subcommands: cli.Commands{
+					{
+						Name:      "add",
+						Usage:     "add a rule to the darc",
+						ArgsUsage: "action",
+						Flags:     append([]cli.Flag{bcFlag, darcFlag, signFlag}, identityFlags...),
+						Action:    darcRuleAdd,
+					},
+					{
+						Name:      "update",
+						Usage:     "replace the expression of a rule of the darc",
+						ArgsUsage: "action",
+						Flags:     append([]cli.Flag{bcFlag, darcFlag, signFlag}, identityFlags...),
+						Action:    darcRuleUpdate,
+					},
+					{
+						Name:      "remove",
+						Usage:     "remove a rule from the darc",
+						ArgsUsage: "action",
+						Flags:     []cli.Flag{bcFlag, darcFlag, signFlag},
+						Action:    darcRuleRemove,
+					},
+				},
+			},
+			{
 				Name:  "identity",
-				Usage: "the identity of the signer who will be allowed to access the contract (e.g. ed25519:a35020c70b8d735...0357))",
+				Usage: "add or remove an identity from a rule of a darc",
+				Subcommands: cli.Commands{
+					{
+						Name:      "add",
+						Usage:     "allow the identity to sign for the action, besides the current signers",
+						ArgsUsage: "action",
+						Flags:     []cli.Flag{bcFlag, darcFlag, signFlag, identityFlags[0]},
+						Action:    darcIdentityAdd,
+					},
+					{
+						Name:      "remove",
+						Usage:     "remove the identity from a rule that is a list of identities joined by |",
+						ArgsUsage: "action",
+						Flags:     []cli.Flag{bcFlag, darcFlag, signFlag, identityFlags[0]},
+						Action:    darcIdentityRemove,
+					},
+				},
+			},
+			{
+				Name:   "history",
+				Usage:  "show the versions of a darc, who evolved them and how their rules changed",
+				Flags:  []cli.Flag{bcFlag, darcFlag},
+				Action: darcHistory,
+			},
+		},
+	},
+	{
+		Name:  "config",
+		Usage: "inspect and update the configuration of the ledger",
+		Subcommands: cli.Commands{
+			{
+				Name:   "show",
+				Usage:  "show the block interval, the maximal block size and the roster",
+				Flags:  []cli.Flag{bcFlag},
+				Action: configShow,
+			},
+			{
+				Name:  "update",
+				Usage: "update the configuration, only the given values are changed",
+				Flags: []cli.Flag{bcFlag, signFlag,
+					cli.DurationFlag{
+						Name:  "interval",
+						Usage: "the new block interval",
+					},
+					cli.IntFlag{
+						Name:  "blocksize",
+						Usage: "the new maximal block size in bytes",
+					},
+					cli.StringFlag{
+						Name:  "roster",
+						Usage: "a file with the new roster of the cothority hosting the ledger",
+					},
+				},
+				Action: configUpdate,
+			},
+		},
+	},
+	{
+		Name:  "instance",
+		Usage: "list and inspect the instances of contracts",
+		Subcommands: cli.Commands{
+			{
+				Name:  "list",
+				Usage: "list the instances, sorted by their ID",
+				Flags: []cli.Flag{bcFlag,
+					cli.StringFlag{
+						Name:  "contract",
+						Usage: "only list the instances of this contract",
+					},
+					cli.StringFlag{
+						Name:  "darc",
+						Usage: "only list the instances controlled by the darc with this ID in hex",
+					},
+				},
+				Action: instanceList,
+			},
+			{
+				Name:      "show",
+				Usage:     "show the contract, the darc and the value of an instance",
+				ArgsUsage: "instanceID",
+				Flags:     []cli.Flag{bcFlag},
+				Action:    instanceShow,
+			},
+		},
+	},
+	{
+		Name:  "tx",
+		Usage: "build transactions online, sign them offline and submit them",
+		Subcommands: cli.Commands{
+			{
+				Name:  "create",
+				Usage: "create a transaction file with one instruction, or add one to it",
+				Flags: []cli.Flag{bcFlag,
+					cli.StringFlag{
+						Name:  "out",
+						Usage: "the transaction file",
+					},
+					cli.BoolFlag{
+						Name:  "append",
+						Usage: "add the instruction to the transaction in the file, which must not be signed yet",
+					},
+					cli.StringFlag{
+						Name:  "instance",
+						Usage: "the ID of the instance in hex, the genesis darc if not given",
+					},
+					cli.StringFlag{
+						Name:  "spawn",
+						Usage: "the contract of the instance to spawn",
+					},
+					cli.StringFlag{
+						Name:  "invoke",
+						Usage: "the command to invoke on the instance",
+					},
+					cli.BoolFlag{
+						Name:  "delete",
+						Usage: "delete the instance",
+					},
+					cli.StringSliceFlag{
+						Name:  "arg",
+						Usage: "an argument of the instruction as name=value, can be repeated",
+					},
+					cli.StringSliceFlag{
+						Name:  "arghex",
+						Usage: "an argument of the instruction as name=hex, can be repeated",
+					},
+					cli.StringSliceFlag{
+						Name:  "signer",
+						Usage: "the identity of a signer of the instruction, can be repeated, the admin identity if not given",
+					},
+					cli.BoolFlag{
+						Name:  "counters",
+						Usage: "protect the instruction against replays with the counters of the signers",
+					},
+				},
+				Action: txCreate,
+			},
+			{
+				Name:      "show",
+				Usage:     "show the instructions of a transaction file and who still needs to sign them",
+				ArgsUsage: "file",
+				Action:    txShow,
+			},
+			{
+				Name:      "sign",
+				Usage:     "sign a transaction file with keys of the config directory, without contacting ByzCoin",
+				ArgsUsage: "file",
+				Flags: []cli.Flag{
+					cli.StringSliceFlag{
+						Name:  "sign",
+						Usage: "the identity of the key to sign with, can be repeated",
+					},
+					cli.StringFlag{
+						Name:  "out",
+						Usage: "write the signed transaction to this file instead of the given one",
+					},
+				},
+				Action: txSign,
+			},
+			{
+				Name:      "merge",
+				Usage:     "merge the signatures of copies of a transaction signed by different signers",
+				ArgsUsage: "file1 file2 ...",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "out",
+						Usage: "the merged transaction file",
+					},
+				},
+				Action: txMerge,
+			},
+			{
+				Name:      "submit",
+				Usage:     "send a signed transaction file to ByzCoin",
+				ArgsUsage: "file",
+				Flags:     []cli.Flag{bcFlag},
+				Action:    txSubmit,
+			},
+		},
+	},
+	{
+		Name:  "key",
+		Usage: "manage the keys stored in the configuration directory",
+		Subcommands: cli.Commands{
+			{
+				Name:   "list",
+				Usage:  "list the identities of the stored keys",
+				Action: keyList,
+			},
+			{
+				Name:      "export",
+				Usage:     "print the private key of the identity in hex, to be imported elsewhere",
+				ArgsUsage: "identity",
+				Action:    keyExport,
+			},
+			{
+				Name:      "import",
+				Usage:     "store a key printed by export, read from the standard input if not given",
+				ArgsUsage: "[key]",
+				Action:    keyImport,
 			},
 		},
-		Action: add,
 	},
 }
 
 var cliApp = cli.NewApp()
 
+// outputJSON is set by the --json flag, so that the commands print their
+// results as JSON, to be read by scripts.
+var outputJSON bool
+
 // getDataPath is a function pointer so that tests can hook and modify this.
 var getDataPath = cfgpath.GetDataPath
 
@@ -95,9 +353,14 @@ func init() {
 			Value: "",
 			Usage: "path to configuration-directory",
 		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the results as JSON",
+		},
 	}
 	cliApp.Before = func(c *cli.Context) error {
 		log.SetDebugVisible(c.Int("debug"))
+		outputJSON = c.Bool("json")
 		lib.ConfigPath = c.String("config")
 		if lib.ConfigPath == "" {
 			lib.ConfigPath = getDataPath(cliApp.Name)
@@ -129,7 +392,8 @@ func create(c *cli.Context) error {
 
 	owner := darc.NewSignerEd25519(nil, nil)
 
-	req, err := byzcoin.DefaultGenesisMsg(byzcoin.CurrentVersion, r, []string{"spawn:darc"}, owner.Identity())
+	req, err := byzcoin.DefaultGenesisMsg(byzcoin.CurrentVersion, r,
+		[]string{"spawn:darc", "invoke:update_config"}, owner.Identity())
 	if err != nil {
 		return err
 	}
@@ -159,35 +423,43 @@ func create(c *cli.Context) error {
 		return err
 	}
 
-	fmt.Fprintf(c.App.Writer, "Created ByzCoin with ID %x.\n", cfg.ByzCoinID)
-	fmt.Fprintf(c.App.Writer, "export BC=\"%v\"\n", fn)
-
 	// For the tests to use.
 	c.App.Metadata["BC"] = fn
 
+	if outputJSON {
+		return printJSON(c, struct {
+			ByzCoinID string
+			Config    string
+		}{fmt.Sprintf("%x", cfg.ByzCoinID), fn})
+	}
+	fmt.Fprintf(c.App.Writer, "Created ByzCoin with ID %x.\n", cfg.ByzCoinID)
+	fmt.Fprintf(c.App.Writer, "export BC=\"%v\"\n", fn)
+
 	return nil
 }
 
 func show(c *cli.Context) error {
-	bcArg := c.String("bc")
-	if bcArg == "" {
-		return errors.New("--bc flag is required")
-	}
-
-	cfg, cl, err := lib.LoadConfig(bcArg)
+	cfg, cl, err := loadConfig(c)
 	if err != nil {
 		return err
 	}
 
+	gd, err := cl.GetGenDarc()
+	if outputJSON {
+		if err != nil {
+			return err
+		}
+		return printJSON(c, struct {
+			ByzCoinID   string
+			Roster      []string
+			GenesisDarc darcOutput
+		}{fmt.Sprintf("%x", cfg.ByzCoinID), rosterToStrings(&cfg.Roster), newDarcOutput(gd)})
+	}
+
 	fmt.Fprintln(c.App.Writer, "ByzCoinID:", fmt.Sprintf("%x", cfg.ByzCoinID))
 	fmt.Fprintln(c.App.Writer, "Genesis Darc:")
-	var roster []string
-	for _, s := range cfg.Roster.List {
-		roster = append(roster, string(s.Address))
-	}
-	fmt.Fprintln(c.App.Writer, "Roster:", strings.Join(roster, ", "))
+	fmt.Fprintln(c.App.Writer, "Roster:", strings.Join(rosterToStrings(&cfg.Roster), ", "))
 
-	gd, err := cl.GetGenDarc()
 	if err == nil {
 		fmt.Fprintln(c.App.Writer, gd)
 	} else {
@@ -198,12 +470,7 @@ func show(c *cli.Context) error {
 }
 
 func add(c *cli.Context) error {
-	bcArg := c.String("bc")
-	if bcArg == "" {
-		return errors.New("--bc flag is required")
-	}
-
-	cfg, cl, err := lib.LoadConfig(bcArg)
+	cfg, cl, err := loadConfig(c)
 	if err != nil {
 		return err
 	}
@@ -219,9 +486,9 @@ func add(c *cli.Context) error {
 	}
 	action := arg[0]
 
-	identity := c.String("identity")
-	if identity == "" {
-		return errors.New("--identity flag is required")
+	expr, err := exprFromFlags(c)
+	if err != nil {
+		return err
 	}
 
 	d, err := cl.GetGenDarc()
@@ -229,35 +496,71 @@ func add(c *cli.Context) error {
 		return err
 	}
 
-	d2 := d.Copy()
-	d2.EvolveFrom(d)
+	_, err = evolveDarc(cl, d, *signer, func(r *darc.Rules) error {
+		return r.AddRule(darc.Action(action), expr)
+	})
+	return err
+}
 
-	d2.Rules.AddRule(darc.Action(action), []byte(identity))
+// loadConfig returns the ByzCoin config given by the --bc flag and a client
+// to talk to it.
+func loadConfig(c *cli.Context) (lib.Config, *byzcoin.Client, error) {
+	bcArg := c.String("bc")
+	if bcArg == "" {
+		return lib.Config{}, nil, errors.New("--bc flag is required")
+	}
+	return lib.LoadConfig(bcArg)
+}
 
-	d2Buf, err := d2.ToProto()
-	if err != nil {
-		return err
+// loadSigner returns the signer of the identity given by the --sign flag,
+// or the signer of the admin identity of the config.
+func loadSigner(c *cli.Context, cfg lib.Config) (*darc.Signer, error) {
+	if s := c.String("sign"); s != "" {
+		id, err := darc.ParseIdentity(s)
+		if err != nil {
+			return nil, err
+		}
+		return lib.LoadKey(id)
 	}
+	return lib.LoadKey(cfg.AdminIdentity)
+}
 
-	invoke := byzcoin.Invoke{
-		Command: "evolve",
-		Args: []byzcoin.Argument{
-			byzcoin.Argument{
-				Name:  "darc",
-				Value: d2Buf,
-			},
-		},
+// exprFromFlags returns the expression given by the --identity and the
+// --threshold flags.
+func exprFromFlags(c *cli.Context) (expression.Expr, error) {
+	identity := c.String("identity")
+	if identity == "" {
+		return nil, errors.New("--identity flag is required")
 	}
+	if t := c.Int("threshold"); t > 0 {
+		ids := strings.Split(identity, ",")
+		for i := range ids {
+			ids[i] = strings.TrimSpace(ids[i])
+		}
+		if t > len(ids) {
+			return nil, errors.New("the threshold is bigger than the number of identities")
+		}
+		return expression.InitThresholdExpr(t, ids...), nil
+	}
+	return expression.Expr(identity), nil
+}
+
+// sendInvoke sends an instruction invoking the command on the instance,
+// signed by the signer with the rule of the darc, and waits for it to be
+// included in a block.
+func sendInvoke(cl *byzcoin.Client, id byzcoin.InstanceID, darcID darc.ID, signer darc.Signer,
+	command string, args byzcoin.Arguments) error {
 	instr := byzcoin.Instruction{
-		InstanceID: byzcoin.NewInstanceID(d2.GetBaseID()),
+		InstanceID: id,
+		Nonce:      byzcoin.GenNonce(),
 		Index:      0,
 		Length:     1,
-		Invoke:     &invoke,
-		Signatures: []darc.Signature{
-			darc.Signature{Signer: signer.Identity()},
+		Invoke: &byzcoin.Invoke{
+			Command: command,
+			Args:    args,
 		},
 	}
-	err = instr.SignBy(d2.GetBaseID(), *signer)
+	err := instr.SignBy(darcID, signer)
 	if err != nil {
 		return err
 	}
@@ -265,10 +568,16 @@ func add(c *cli.Context) error {
 	_, err = cl.AddTransactionAndWait(byzcoin.ClientTransaction{
 		Instructions: []byzcoin.Instruction{instr},
 	}, 10)
+	return err
+}
+
+// printJSON prints v as indented JSON.
+func printJSON(c *cli.Context, v interface{}) error {
+	buf, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
 		return err
 	}
-
+	fmt.Fprintln(c.App.Writer, string(buf))
 	return nil
 }
 
@@ -290,6 +599,14 @@ func readRoster(r io.Reader) (*onet.Roster, error) {
 	return group.Roster, nil
 }
 
+func rosterToStrings(r *onet.Roster) []string {
+	out := make([]string, len(r.List))
+	for i := range r.List {
+		out[i] = string(r.List[i].Address)
+	}
+	return out
+}
+
 func rosterToServers(r *onet.Roster) []network.Address {
 	out := make([]network.Address, len(r.List))
 	for i := range r.List {
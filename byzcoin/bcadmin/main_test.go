@@ -2,13 +2,19 @@ package main
 
 import (
 	"bytes"
+	"encoding/hex"
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin/bcadmin/lib"
+	"github.com/dedis/cothority/byzcoin/darc"
+	"github.com/dedis/cothority/byzcoin/darc/expression"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/app"
 	"github.com/dedis/onet/log"
@@ -86,6 +92,11 @@ func TestCli(t *testing.T) {
 	err = cliApp.Run(args)
 	require.NoError(t, err)
 
+	args = []string{"bcadmin", "add", "--identity", "ed25519:aa,ed25519:bb, ed25519:cc",
+		"--threshold", "2", "spawn:yyy"}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+
 	time.Sleep(2 * interval)
 
 	log.Lvl1("show after add: ")
@@ -97,4 +108,123 @@ func TestCli(t *testing.T) {
 	require.NoError(t, err)
 	require.Contains(t, string(b.Bytes()), "Roster: tcp://127.0.0.1")
 	require.Contains(t, string(b.Bytes()), "spawn:xxx - \"ed25519:XXX\"")
+	require.Contains(t, string(b.Bytes()), "spawn:yyy - \"[ed25519:aa, ed25519:bb, ed25519:cc]/2\"")
+
+	log.Lvl1("darc history: ")
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	cliApp.ErrWriter = b
+	args = []string{"bcadmin", "darc", "history"}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	require.Contains(t, string(b.Bytes()), "Version 0 - block 0")
+	require.Contains(t, string(b.Bytes()), "+ spawn:darc")
+	require.Contains(t, string(b.Bytes()), "Version 2")
+	require.Contains(t, string(b.Bytes()), "+ spawn:yyy - \"[ed25519:aa, ed25519:bb, ed25519:cc]/2\"")
+
+	run := func(args ...string) string {
+		b := &bytes.Buffer{}
+		cliApp.Writer = b
+		cliApp.ErrWriter = b
+		require.NoError(t, cliApp.Run(append([]string{"bcadmin"}, args...)))
+		return b.String()
+	}
+
+	log.Lvl1("darc show: ")
+	var gd darcOutput
+	require.NoError(t, json.Unmarshal([]byte(run("--json", "darc", "show")), &gd))
+	require.Equal(t, uint64(2), gd.Version)
+	require.Contains(t, gd.Rules, ruleOutput{"spawn:xxx", "ed25519:XXX"})
+
+	log.Lvl1("darc rule and identity: ")
+	run("darc", "rule", "add", "--identity", "ed25519:aa", "spawn:zzz")
+	out := run("darc", "identity", "add", "--identity", "ed25519:bb", "spawn:zzz")
+	require.Contains(t, out, "spawn:zzz - \"ed25519:aa | ed25519:bb\"")
+	out = run("darc", "identity", "remove", "--identity", "ed25519:aa", "spawn:zzz")
+	require.Contains(t, out, "spawn:zzz - \"ed25519:bb\"")
+	out = run("darc", "rule", "update", "--identity", "ed25519:cc,ed25519:dd", "--threshold", "1", "spawn:zzz")
+	require.Contains(t, out, "spawn:zzz - \"[ed25519:cc, ed25519:dd]/1\"")
+	out = run("darc", "rule", "remove", "spawn:zzz")
+	require.NotContains(t, out, "spawn:zzz")
+	require.Error(t, cliApp.Run([]string{"bcadmin", "darc", "rule", "remove", "spawn:zzz"}))
+
+	log.Lvl1("config: ")
+	out = run("config", "update", "--blocksize", "100000")
+	require.Contains(t, out, "Max block size: 100000")
+	var config struct {
+		BlockInterval string
+		MaxBlockSize  int
+		Roster        []string
+	}
+	require.NoError(t, json.Unmarshal([]byte(run("--json", "config", "show")), &config))
+	require.Equal(t, interval.String(), config.BlockInterval)
+	require.Equal(t, 100000, config.MaxBlockSize)
+	require.Equal(t, 2, len(config.Roster))
+
+	log.Lvl1("instance: ")
+	var instances []instanceOutput
+	require.NoError(t, json.Unmarshal([]byte(run("--json", "instance", "list", "--contract", "darc")), &instances))
+	require.Equal(t, 1, len(instances))
+	require.Equal(t, gd.BaseID, instances[0].InstanceID)
+	out = run("instance", "show", gd.BaseID)
+	require.Contains(t, out, "Contract: darc")
+	require.Error(t, cliApp.Run([]string{"bcadmin", "instance", "show", "00"}))
+
+	log.Lvl1("key: ")
+	ids := strings.Split(strings.TrimSpace(run("key", "list")), "\n")
+	require.Equal(t, 1, len(ids))
+	key := strings.TrimSpace(run("key", "export", ids[0]))
+	require.Error(t, cliApp.Run([]string{"bcadmin", "key", "import", key}))
+	dir2, err := ioutil.TempDir("", "ol-test-import")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir2)
+	require.Contains(t, run("--config", dir2, "key", "import", key), ids[0])
+	require.Equal(t, ids[0], strings.TrimSpace(run("--config", dir2, "key", "list")))
+
+	log.Lvl1("offline transaction: ")
+	second := darc.NewSignerEd25519(nil, nil)
+	lib.ConfigPath = dir
+	require.NoError(t, lib.SaveKey(second))
+	run("darc", "rule", "update", "--identity", ids[0]+" & "+second.Identity().String(), "spawn:darc")
+
+	owner := []darc.Identity{second.Identity()}
+	d := darc.NewDarc(darc.InitRules(owner, owner), []byte("offline darc"))
+	dBuf, err := d.ToProto()
+	require.NoError(t, err)
+	txFile := path.Join(dir, "tx")
+	out = run("tx", "create", "--out", txFile, "--spawn", "darc", "--arghex", "darc="+hex.EncodeToString(dBuf),
+		"--signer", ids[0], "--signer", second.Identity().String(), "--counters")
+	require.Contains(t, out, "Instruction 0: spawn:darc on "+gd.BaseID)
+	require.Contains(t, out, "Missing: "+ids[0]+", "+second.Identity().String())
+
+	// Every signer signs its own copy, which are merged afterwards.
+	out = run("tx", "sign", "--sign", ids[0], "--out", txFile+"-0", txFile)
+	require.Contains(t, out, "Signed: "+ids[0])
+	run("tx", "sign", "--sign", second.Identity().String(), "--out", txFile+"-1", txFile)
+	require.Error(t, cliApp.Run([]string{"bcadmin", "tx", "submit", txFile + "-0"}))
+	out = run("tx", "merge", "--out", txFile+"-all", txFile+"-0", txFile+"-1")
+	require.Contains(t, out, "can be submitted")
+	require.Contains(t, run("tx", "submit", txFile+"-all"), "is included")
+	require.Contains(t, run("instance", "show", hex.EncodeToString(d.GetBaseID())), "Contract: darc")
+}
+
+func TestIdentityList(t *testing.T) {
+	expr, err := addIdentity(expression.Expr("ed25519:aa"), "ed25519:bb")
+	require.NoError(t, err)
+	require.Equal(t, expression.Expr("ed25519:aa | ed25519:bb"), expr)
+	expr, err = addIdentity(expression.Expr("ed25519:aa & ed25519:bb"), "ed25519:cc")
+	require.NoError(t, err)
+	require.Equal(t, expression.Expr("(ed25519:aa & ed25519:bb) | ed25519:cc"), expr)
+	_, err = addIdentity(expression.Expr("ed25519:aa"), "ed25519:aa")
+	require.Error(t, err)
+
+	expr, err = removeIdentity(expression.Expr("ed25519:aa | ed25519:bb"), "ed25519:aa")
+	require.NoError(t, err)
+	require.Equal(t, expression.Expr("ed25519:bb"), expr)
+	_, err = removeIdentity(expression.Expr("ed25519:aa"), "ed25519:aa")
+	require.Error(t, err)
+	_, err = removeIdentity(expression.Expr("ed25519:aa | ed25519:bb"), "ed25519:cc")
+	require.Error(t, err)
+	_, err = removeIdentity(expression.Expr("[ed25519:aa, ed25519:bb]/1"), "ed25519:aa")
+	require.Error(t, err)
 }
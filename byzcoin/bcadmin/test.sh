@@ -19,6 +19,8 @@ testCreateStoreRead(){
 	[ -z "$BC" ] && exit 1
     testOK ./"$APP" add spawn:xxx -identity ed25519:foo
 	testGrep "ed25519:foo" ./"$APP" show
+	testOK ./"$APP" config update --blocksize 100000
+	testGrep "Max block size: 100000" ./"$APP" config show
 }
 
 main
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/bcadmin/lib"
+	"github.com/dedis/cothority/byzcoin/darc"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+// txCreate adds an instruction to a new or an existing unsigned transaction
+// file. It needs to contact ByzCoin to get the darc of the instance and the
+// counters of the signers.
+func txCreate(c *cli.Context) error {
+	out := c.String("out")
+	if out == "" {
+		return errors.New("--out flag is required")
+	}
+	cfg, cl, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+
+	instr := byzcoin.Instruction{Nonce: byzcoin.GenNonce()}
+	var d *darc.Darc
+	if inst := c.String("instance"); inst != "" {
+		id, err := hex.DecodeString(inst)
+		if err != nil || len(id) != len(byzcoin.InstanceID{}) {
+			return errors.New("invalid instance ID")
+		}
+		instr.InstanceID = byzcoin.NewInstanceID(id)
+		d, err = instanceDarc(cl, instr.InstanceID)
+		if err != nil {
+			return err
+		}
+	} else {
+		d, err = cl.GetGenDarc()
+		if err != nil {
+			return err
+		}
+		instr.InstanceID = byzcoin.NewInstanceID(d.GetBaseID())
+	}
+
+	args, err := argsFromFlags(c)
+	if err != nil {
+		return err
+	}
+	switch {
+	case c.String("spawn") != "" && c.String("invoke") == "" && !c.Bool("delete"):
+		instr.Spawn = &byzcoin.Spawn{ContractID: c.String("spawn"), Args: args}
+	case c.String("spawn") == "" && c.String("invoke") != "" && !c.Bool("delete"):
+		instr.Invoke = &byzcoin.Invoke{Command: c.String("invoke"), Args: args}
+	case c.String("spawn") == "" && c.String("invoke") == "" && c.Bool("delete"):
+		instr.Delete = &byzcoin.Delete{}
+	default:
+		return errors.New("need exactly one of --spawn, --invoke or --delete")
+	}
+
+	signers := c.StringSlice("signer")
+	if len(signers) == 0 {
+		signers = []string{cfg.AdminIdentity.String()}
+	}
+	for _, s := range signers {
+		id, err := darc.ParseIdentity(s)
+		if err != nil {
+			return err
+		}
+		instr.Signatures = append(instr.Signatures, darc.Signature{Signer: id})
+	}
+
+	tx := &lib.UnsignedTx{ByzCoinID: cfg.ByzCoinID}
+	if c.Bool("append") {
+		tx, err = lib.LoadTx(out)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(tx.ByzCoinID, cfg.ByzCoinID) {
+			return errors.New("the transaction is for another ledger")
+		}
+		for _, sigs := range tx.Transaction.Instructions {
+			for _, sig := range sigs.Signatures {
+				if len(sig.Signature) > 0 {
+					return errors.New("cannot add an instruction to a transaction that is already signed")
+				}
+			}
+		}
+	}
+
+	if c.Bool("counters") {
+		resp, err := cl.GetSignerCounters(signers...)
+		if err != nil {
+			return err
+		}
+		if len(resp.Counters) != len(signers) {
+			return errors.New("didn't get the counters of all the signers")
+		}
+		// The earlier instructions of the transaction already use the
+		// next counters of their signers.
+		for i, s := range signers {
+			ctr := resp.Counters[i] + 1
+			for _, prev := range tx.Transaction.Instructions {
+				for _, sig := range prev.Signatures {
+					if sig.Signer.String() == s && len(prev.SignerCounter) > 0 {
+						ctr++
+					}
+				}
+			}
+			instr.SignerCounter = append(instr.SignerCounter, ctr)
+		}
+	}
+
+	tx.Transaction.Instructions = append(tx.Transaction.Instructions, instr)
+	tx.Darcs = append(tx.Darcs, *d)
+	for i := range tx.Transaction.Instructions {
+		tx.Transaction.Instructions[i].Index = i
+		tx.Transaction.Instructions[i].Length = len(tx.Transaction.Instructions)
+	}
+	err = lib.SaveTx(out, tx)
+	if err != nil {
+		return err
+	}
+	return printTx(c, tx)
+}
+
+func txShow(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return errors.New("need the transaction file")
+	}
+	tx, err := lib.LoadTx(c.Args().First())
+	if err != nil {
+		return err
+	}
+	return printTx(c, tx)
+}
+
+// txSign signs the transaction with keys from the config directory. It
+// doesn't contact ByzCoin, so that it can run on an offline machine.
+func txSign(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return errors.New("need the transaction file")
+	}
+	fn := c.Args().First()
+	tx, err := lib.LoadTx(fn)
+	if err != nil {
+		return err
+	}
+	if len(c.StringSlice("sign")) == 0 {
+		return errors.New("--sign flag is required")
+	}
+	var signers []darc.Signer
+	for _, s := range c.StringSlice("sign") {
+		id, err := darc.ParseIdentity(s)
+		if err != nil {
+			return err
+		}
+		signer, err := lib.LoadKey(id)
+		if err != nil {
+			return err
+		}
+		signers = append(signers, *signer)
+	}
+	err = tx.Sign(signers...)
+	if err != nil {
+		return err
+	}
+
+	if out := c.String("out"); out != "" {
+		fn = out
+	}
+	err = lib.SaveTx(fn, tx)
+	if err != nil {
+		return err
+	}
+	return printTx(c, tx)
+}
+
+func txMerge(c *cli.Context) error {
+	out := c.String("out")
+	if out == "" {
+		return errors.New("--out flag is required")
+	}
+	if c.NArg() < 2 {
+		return errors.New("need at least two transaction files")
+	}
+	tx, err := lib.LoadTx(c.Args().First())
+	if err != nil {
+		return err
+	}
+	for _, fn := range c.Args().Tail() {
+		other, err := lib.LoadTx(fn)
+		if err != nil {
+			return err
+		}
+		err = tx.Merge(other)
+		if err != nil {
+			return fmt.Errorf("cannot merge %s: %v", fn, err)
+		}
+	}
+	err = lib.SaveTx(out, tx)
+	if err != nil {
+		return err
+	}
+	return printTx(c, tx)
+}
+
+func txSubmit(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return errors.New("need the transaction file")
+	}
+	tx, err := lib.LoadTx(c.Args().First())
+	if err != nil {
+		return err
+	}
+	cfg, cl, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(tx.ByzCoinID, cfg.ByzCoinID) {
+		return errors.New("the transaction is for another ledger")
+	}
+	if !tx.IsSigned() {
+		return errors.New("the transaction is missing signatures")
+	}
+
+	_, err = cl.AddTransactionAndWait(tx.Transaction, 10)
+	if err != nil {
+		return err
+	}
+	if outputJSON {
+		return printJSON(c, struct{ Hash string }{fmt.Sprintf("%x", tx.Transaction.Instructions.Hash())})
+	}
+	fmt.Fprintf(c.App.Writer, "Transaction %x is included.\n", tx.Transaction.Instructions.Hash())
+	return nil
+}
+
+// instanceDarc returns the latest version of the darc controlling the
+// instance.
+func instanceDarc(cl *byzcoin.Client, id byzcoin.InstanceID) (*darc.Darc, error) {
+	p, err := cl.GetProof(id.Slice())
+	if err != nil {
+		return nil, err
+	}
+	if !p.Proof.InclusionProof.Match() {
+		return nil, errors.New("cannot find instance " + id.String())
+	}
+	_, vs, err := p.Proof.KeyValue()
+	if err != nil {
+		return nil, err
+	}
+	if len(vs) < 3 {
+		return nil, errors.New("not enough records")
+	}
+	return getDarc(cl, fmt.Sprintf("%x", vs[2]))
+}
+
+// argsFromFlags returns the arguments given as name=value by the --arg flag,
+// and as name=hex by the --arghex flag.
+func argsFromFlags(c *cli.Context) (byzcoin.Arguments, error) {
+	var args byzcoin.Arguments
+	for _, a := range c.StringSlice("arg") {
+		kv := strings.SplitN(a, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("the arguments must be given as name=value: " + a)
+		}
+		args = append(args, byzcoin.Argument{Name: kv[0], Value: []byte(kv[1])})
+	}
+	for _, a := range c.StringSlice("arghex") {
+		kv := strings.SplitN(a, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("the arguments must be given as name=hex: " + a)
+		}
+		value, err := hex.DecodeString(kv[1])
+		if err != nil {
+			return nil, errors.New("invalid hex value of argument " + kv[0])
+		}
+		args = append(args, byzcoin.Argument{Name: kv[0], Value: value})
+	}
+	return args, nil
+}
+
+// txOutput is the JSON representation of an unsigned transaction.
+type txOutput struct {
+	ByzCoinID    string
+	Instructions []instructionOutput
+	Signed       bool
+}
+
+type instructionOutput struct {
+	InstanceID string
+	Action     string
+	DarcID     string
+	Rule       string
+	Signed     []string
+	Missing    []string
+}
+
+func printTx(c *cli.Context, tx *lib.UnsignedTx) error {
+	out := txOutput{
+		ByzCoinID:    fmt.Sprintf("%x", tx.ByzCoinID),
+		Instructions: []instructionOutput{},
+		Signed:       tx.IsSigned(),
+	}
+	for i, instr := range tx.Transaction.Instructions {
+		iout := instructionOutput{
+			InstanceID: instr.InstanceID.String(),
+			Action:     instr.Action(),
+			DarcID:     fmt.Sprintf("%x", tx.Darcs[i].GetBaseID()),
+			Rule:       string(tx.Darcs[i].Rules.Get(darc.Action(instr.Action()))),
+			Signed:     []string{},
+			Missing:    []string{},
+		}
+		for _, sig := range instr.Signatures {
+			if len(sig.Signature) > 0 {
+				iout.Signed = append(iout.Signed, sig.Signer.String())
+			} else {
+				iout.Missing = append(iout.Missing, sig.Signer.String())
+			}
+		}
+		out.Instructions = append(out.Instructions, iout)
+	}
+	if outputJSON {
+		return printJSON(c, out)
+	}
+
+	fmt.Fprintln(c.App.Writer, "ByzCoinID:", out.ByzCoinID)
+	for i, iout := range out.Instructions {
+		fmt.Fprintf(c.App.Writer, "Instruction %d: %s on %s\n", i, iout.Action, iout.InstanceID)
+		fmt.Fprintf(c.App.Writer, "\tDarc: %s - \"%s\"\n", iout.DarcID, iout.Rule)
+		if len(iout.Signed) > 0 {
+			fmt.Fprintln(c.App.Writer, "\tSigned:", strings.Join(iout.Signed, ", "))
+		}
+		if len(iout.Missing) > 0 {
+			fmt.Fprintln(c.App.Writer, "\tMissing:", strings.Join(iout.Missing, ", "))
+		}
+	}
+	if out.Signed {
+		fmt.Fprintln(c.App.Writer, "The transaction is signed and can be submitted.")
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package byzcoin
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin/darc"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// maxCallDepth is the maximum number of nested calls of contracts by
+// CallContract.
+const maxCallDepth = 8
+
+// blockInfo describes the block the instructions are executed for.
+type blockInfo struct {
+	// index of the block.
+	index int
+	// timestamp of the previous block, as the one of the block is only
+	// known once it is created.
+	timestamp int64
+}
+
+// blockTimestamp returns the timestamp stored in the header of the block,
+// or 0 if the header cannot be read.
+func blockTimestamp(sb *skipchain.SkipBlock) int64 {
+	var header DataHeader
+	err := protobuf.DecodeWithConstructors(sb.Data, &header, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return 0
+	}
+	return header.Timestamp
+}
+
+// callContext is the CollectionView given to a contract by ByzCoin. Besides
+// reading the global state, the contract can use it to return values with
+// ReturnValues and to call other contracts with CallContract.
+type callContext struct {
+	*meteredCollection
+	s *Service
+	// coll holds the state of the ClientTransaction, where the state
+	// changes of the executed instructions are stored.
+	coll   *roCollection
+	config *ChainConfig
+	block  blockInfo
+	depth  int
+	// caller is the view of the contract calling this one, if any.
+	caller *meteredCollection
+	// ret holds the values returned by the contract.
+	ret Arguments
+	// called holds the state changes of the contracts called by this one,
+	// which are already stored in coll.
+	called StateChanges
+	// calls holds the resources used by the contracts called by this one.
+	calls Metering
+}
+
+// execute calls the contract of the instruction and stores the resulting
+// state changes in the collection.
+func (ctx *callContext) execute(cin []Coin, instr Instruction, enforceTime bool) (scs StateChanges, cout []Coin, ret Arguments, m Metering, err error) {
+	defer func() {
+		if re := recover(); re != nil {
+			err = fmt.Errorf("%v", re)
+		}
+	}()
+
+	contractID, _, err := instr.GetContractState(ctx.coll)
+	if err != nil {
+		err = errors.New("Couldn't get contract type of instruction: " + err.Error())
+		return
+	}
+
+	contract, exists := ctx.s.getContract(ctx.config, contractID, ctx.block.index)
+	// If the leader does not have a verifier for this contract, it drops the
+	// transaction.
+	if !exists {
+		err = errors.New("Leader is dropping instruction of unknown contract: " + contractID)
+		return
+	}
+	// The signer counters are verified before the contract is called, so
+	// that a replayed instruction never reaches the contract.
+	var ctrScs StateChanges
+	if len(instr.SignerCounter) == 0 && len(instr.Signatures) > 0 &&
+		ctx.config != nil && ctx.config.RequireSignerCounters {
+		err = errors.New("instruction needs signer counters")
+		return
+	}
+	if len(instr.SignerCounter) > 0 {
+		var darcID darc.ID
+		_, _, darcID, err = ctx.coll.GetValues(instr.InstanceID.Slice())
+		if err != nil {
+			err = errors.New("Couldn't get darc of instruction: " + err.Error())
+			return
+		}
+		ctrScs, err = instr.verifySignerCounters(ctx.coll, darcID)
+		if err != nil {
+			return
+		}
+	}
+
+	// Now we call the contract function with the data of the key.
+	log.Lvlf3("%s Calling contract %s", ctx.s.ServerIdentity(), contractID)
+	var timeout time.Duration
+	if enforceTime && ctx.config != nil {
+		timeout = ctx.config.MaxExecutionTime
+	}
+	ctx.meteredCollection = newMeteredCollection(ctx.coll, ctx.config)
+	if ctx.caller != nil {
+		// The called contract stops when the contract calling it times
+		// out, as it runs in the same go-routine.
+		ctx.meteredCollection.stopped = ctx.caller.stopped
+	}
+	start := time.Now()
+	scs, cout, err = runContract(contract, ctx, instr, cin, timeout)
+	m = ctx.metering(scs, time.Now().Sub(start))
+	m.Reads += ctx.calls.Reads
+	m.Writes += ctx.calls.Writes
+	m.StateChangeBytes += ctx.calls.StateChangeBytes
+	if err != nil {
+		return
+	}
+	if err = m.check(ctx.config); err != nil {
+		return
+	}
+
+	scs = append(scs, ctrScs...)
+	for _, sc := range scs {
+		if err = storeInColl(ctx.coll.c, &sc); err != nil {
+			err = errors.New("failed to add to collections with error: " + err.Error())
+			return
+		}
+	}
+	scs = append(ctx.called, scs...)
+	ret = ctx.ret
+	return
+}
+
+// spawnContract returns the contract of the given ID, in the version that
+// is active for the instruction being executed with cdb.
+func (s *Service) spawnContract(cdb CollectionView, contractID string) (ContractFn, bool) {
+	if ctx, ok := cdb.(*callContext); ok {
+		return s.getContract(ctx.config, contractID, ctx.block.index)
+	}
+	c, ok := s.contracts[contractID]
+	return c, ok
+}
+
+// BlockInfoGetter is implemented by the CollectionView given to the
+// contracts. BlockInfo returns the index of the block the instruction will
+// be part of, and the timestamp of the previous block as a Unix timestamp
+// in nanoseconds. The timestamp of the block itself is not used, as it is
+// only known once the block is created.
+type BlockInfoGetter interface {
+	BlockInfo() (index int, timestamp int64)
+}
+
+// BlockInfo returns the index of the block and the timestamp of the
+// previous block.
+func (ctx *callContext) BlockInfo() (int, int64) {
+	return ctx.block.index, ctx.block.timestamp
+}
+
+// GetBlockInfo returns the block information of cdb, which must be the
+// CollectionView given to the contract.
+func GetBlockInfo(cdb CollectionView) (index int, timestamp int64, err error) {
+	bi, ok := cdb.(BlockInfoGetter)
+	if !ok {
+		return 0, 0, errors.New("block information is only available to a contract called by ByzCoin")
+	}
+	index, timestamp = bi.BlockInfo()
+	return
+}
+
+// GetContractVersion returns the version of the contract that is active in
+// the block being created. cdb must be the CollectionView given to the
+// contract.
+func GetContractVersion(cdb CollectionView, contractID string) (int, error) {
+	index, _, err := GetBlockInfo(cdb)
+	if err != nil {
+		return 0, err
+	}
+	config, err := loadConfigFromColl(cdb)
+	if err != nil {
+		return 0, err
+	}
+	return config.contractVersion(contractID, index), nil
+}
+
+// ReturnValues sets values returned by the instruction the contract is
+// executing. The following instructions of the ClientTransaction can use
+// them with Instruction.Inputs, and a contract calling this instruction gets
+// them from CallContract. cdb must be the CollectionView given to the
+// contract.
+func ReturnValues(cdb CollectionView, args ...Argument) error {
+	ctx, ok := cdb.(*callContext)
+	if !ok {
+		return errors.New("values can only be returned from a contract called by ByzCoin")
+	}
+	ctx.ret = append(ctx.ret, args...)
+	return nil
+}
+
+// CallContract lets a contract synchronously execute another instruction
+// as part of the instruction it is executing. The instruction must be
+// authorized like an instruction sent by a client, usually with signatures
+// the client gave to the calling contract. Its state changes are applied
+// immediately, so the calling contract sees them, but they are discarded
+// together with all others if the ClientTransaction fails. It returns the
+// output coins and the values returned by the instruction. cdb must be the
+// CollectionView given to the contract.
+func CallContract(cdb CollectionView, inst Instruction, coins []Coin) ([]Coin, Arguments, error) {
+	ctx, ok := cdb.(*callContext)
+	if !ok {
+		return nil, nil, errors.New("contracts can only be called from a contract called by ByzCoin")
+	}
+	if ctx.depth >= maxCallDepth {
+		return nil, nil, errors.New("too many nested contract calls")
+	}
+	if err := ctx.read(); err != nil {
+		return nil, nil, err
+	}
+	callee := &callContext{
+		s:      ctx.s,
+		coll:   ctx.coll,
+		config: ctx.config,
+		block:  ctx.block,
+		depth:  ctx.depth + 1,
+		caller: ctx.meteredCollection,
+	}
+	// The execution time of the callee is part of the one of the caller.
+	scs, cout, ret, m, err := callee.execute(coins, inst, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx.called = append(ctx.called, scs...)
+	ctx.calls.Reads += m.Reads
+	ctx.calls.Writes += m.Writes
+	ctx.calls.StateChangeBytes += m.StateChangeBytes
+	return cout, ret, nil
+}
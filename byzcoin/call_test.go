@@ -0,0 +1,211 @@
+package byzcoin
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority/byzcoin/collection"
+	"github.com/dedis/cothority/byzcoin/darc"
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+// retContractFunc returns its arguments.
+func retContractFunc(cdb CollectionView, inst Instruction, c []Coin) ([]StateChange, []Coin, error) {
+	if err := inst.VerifyDarcSignature(cdb); err != nil {
+		return nil, nil, err
+	}
+	return nil, c, ReturnValues(cdb, inst.Spawn.Args...)
+}
+
+// storeContractFunc stores its "value" argument in a new instance.
+func storeContractFunc(cdb CollectionView, inst Instruction, c []Coin) ([]StateChange, []Coin, error) {
+	if err := inst.VerifyDarcSignature(cdb); err != nil {
+		return nil, nil, err
+	}
+	value := inst.Spawn.Args.Search("value")
+	if value == nil {
+		return nil, nil, errors.New("missing value")
+	}
+	return []StateChange{
+		NewStateChange(Create, inst.DeriveID(""), "store", value, inst.InstanceID.Slice()),
+	}, c, nil
+}
+
+// callContractFunc calls the instruction in its "instruction" argument and
+// stores the value it returned in a new instance.
+func callContractFunc(cdb CollectionView, inst Instruction, c []Coin) ([]StateChange, []Coin, error) {
+	if err := inst.VerifyDarcSignature(cdb); err != nil {
+		return nil, nil, err
+	}
+	var callee Instruction
+	if err := protobuf.Decode(inst.Spawn.Args.Search("instruction"), &callee); err != nil {
+		return nil, nil, err
+	}
+	_, ret, err := CallContract(cdb, callee, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []StateChange{
+		NewStateChange(Create, inst.DeriveID(""), "store", ret.Search("value"), inst.InstanceID.Slice()),
+	}, c, nil
+}
+
+// loopContractFunc reads the collection until it is not allowed to anymore.
+func loopContractFunc(cdb CollectionView, inst Instruction, c []Coin) ([]StateChange, []Coin, error) {
+	for {
+		if _, _, _, err := cdb.GetValues(inst.InstanceID.Slice()); err != nil {
+			return nil, nil, err
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCall_ReturnValues(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	for _, h := range s.hosts {
+		require.Nil(t, RegisterContract(h, "ret", retContractFunc))
+		require.Nil(t, RegisterContract(h, "store", storeContractFunc))
+		require.Nil(t, RegisterContract(h, "call", callContractFunc))
+	}
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	ids := []darc.Identity{signer.Identity()}
+	d := darc.NewDarc(darc.InitRules(ids, ids), []byte("call darc"))
+	for _, r := range []darc.Action{"spawn:ret", "spawn:store", "spawn:call"} {
+		require.Nil(t, d.Rules.AddRule(r, d.Rules.GetSignExpr()))
+	}
+	dBuf, err := d.ToProto()
+	require.Nil(t, err)
+	dID := NewInstanceID(d.GetBaseID())
+	newColl := func() *collection.Collection {
+		coll := collection.New(collection.Data{}, collection.Data{}, collection.Data{})
+		sc := NewStateChange(Create, dID, ContractDarcID, dBuf, d.GetBaseID())
+		require.Nil(t, storeInColl(coll, &sc))
+		return coll
+	}
+	spawn := func(contractID string, args Arguments, inputs []Input, index, length int) Instruction {
+		instr := Instruction{
+			InstanceID: dID,
+			Spawn:      &Spawn{ContractID: contractID, Args: args},
+			Nonce:      GenNonce(),
+			Index:      index,
+			Length:     length,
+			Inputs:     inputs,
+		}
+		require.Nil(t, instr.SignBy(d.GetBaseID(), signer))
+		return instr
+	}
+	run := func(instrs ...Instruction) (TxResult, StateChanges) {
+		ctx := ClientTransaction{Instructions: instrs}
+		_, txOut, scs := s.service().createStateChanges(newColl(), s.sb.SkipChainID(), 1,
+			NewTxResults(ctx), noTimeout)
+		require.Equal(t, 1, len(txOut))
+		return txOut[0], scs
+	}
+
+	// The value returned by the first instruction is stored by the second.
+	store := spawn("store", nil, []Input{{Instruction: 0, Name: "value", Argument: "value"}}, 1, 2)
+	tx, scs := run(spawn("ret", Arguments{{Name: "value", Value: []byte("hello")}}, nil, 0, 2), store)
+	require.True(t, tx.Accepted, tx.Error)
+	require.Equal(t, 1, len(scs))
+	require.Equal(t, store.DeriveID("").Slice(), scs[0].InstanceID)
+	require.Equal(t, []byte("hello"), scs[0].Value)
+
+	// Inputs can only refer to earlier instructions.
+	store = spawn("store", nil, []Input{{Instruction: 1, Name: "value", Argument: "value"}}, 0, 2)
+	tx, _ = run(store, spawn("ret", Arguments{{Name: "value", Value: []byte("hello")}}, nil, 1, 2))
+	require.False(t, tx.Accepted)
+
+	// The argument of an input is not signed, so it cannot be given by the
+	// client.
+	store = spawn("store", Arguments{{Name: "value", Value: []byte("evil")}},
+		[]Input{{Instruction: 0, Name: "value", Argument: "value"}}, 1, 2)
+	tx, _ = run(spawn("ret", Arguments{{Name: "value", Value: []byte("hello")}}, nil, 0, 2), store)
+	require.False(t, tx.Accepted)
+
+	// Changing the inputs invalidates the signature.
+	store = spawn("store", nil, []Input{{Instruction: 0, Name: "value", Argument: "value"}}, 1, 2)
+	store.Inputs[0].Name = "other"
+	tx, _ = run(spawn("ret", Arguments{{Name: "value", Value: []byte("hello")},
+		{Name: "other", Value: []byte("evil")}}, nil, 0, 2), store)
+	require.False(t, tx.Accepted)
+
+	// A contract calls another one and gets its return values.
+	callee := spawn("ret", Arguments{{Name: "value", Value: []byte("nested")}}, nil, 0, 1)
+	calleeBuf, err := protobuf.Encode(&callee)
+	require.Nil(t, err)
+	call := spawn("call", Arguments{{Name: "instruction", Value: calleeBuf}}, nil, 0, 1)
+	tx, scs = run(call)
+	require.True(t, tx.Accepted, tx.Error)
+	require.Equal(t, 1, len(scs))
+	require.Equal(t, call.DeriveID("").Slice(), scs[0].InstanceID)
+	require.Equal(t, []byte("nested"), scs[0].Value)
+
+	// The called instruction must be signed.
+	callee.Signatures = nil
+	calleeBuf, err = protobuf.Encode(&callee)
+	require.Nil(t, err)
+	tx, _ = run(spawn("call", Arguments{{Name: "instruction", Value: calleeBuf}}, nil, 0, 1))
+	require.False(t, tx.Accepted)
+
+	// Values can only be returned and contracts called through ByzCoin.
+	coll := &roCollection{newColl()}
+	require.NotNil(t, ReturnValues(coll, Argument{}))
+	_, _, err = CallContract(coll, callee, nil)
+	require.NotNil(t, err)
+}
+
+func TestCall_Timeout(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	for _, h := range s.hosts {
+		require.Nil(t, RegisterContract(h, "loop", loopContractFunc))
+		require.Nil(t, RegisterContract(h, "call", callContractFunc))
+	}
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	ids := []darc.Identity{signer.Identity()}
+	d := darc.NewDarc(darc.InitRules(ids, ids), []byte("call darc"))
+	for _, r := range []darc.Action{"spawn:loop", "spawn:call"} {
+		require.Nil(t, d.Rules.AddRule(r, d.Rules.GetSignExpr()))
+	}
+	dBuf, err := d.ToProto()
+	require.Nil(t, err)
+	dID := NewInstanceID(d.GetBaseID())
+	coll := collection.New(collection.Data{}, collection.Data{}, collection.Data{})
+	sc := NewStateChange(Create, dID, ContractDarcID, dBuf, d.GetBaseID())
+	require.Nil(t, storeInColl(coll, &sc))
+
+	callee := Instruction{
+		InstanceID: dID,
+		Spawn:      &Spawn{ContractID: "loop"},
+		Nonce:      GenNonce(),
+		Length:     1,
+	}
+	require.Nil(t, callee.SignBy(d.GetBaseID(), signer))
+	calleeBuf, err := protobuf.Encode(&callee)
+	require.Nil(t, err)
+	call := Instruction{
+		InstanceID: dID,
+		Spawn:      &Spawn{ContractID: "call", Args: Arguments{{Name: "instruction", Value: calleeBuf}}},
+		Nonce:      GenNonce(),
+		Length:     1,
+	}
+	require.Nil(t, call.SignBy(d.GetBaseID(), signer))
+
+	// The called contract is stopped together with the calling one, so
+	// it doesn't stay stuck.
+	ctx := &callContext{s: s.service(), coll: &roCollection{coll}}
+	ctx.meteredCollection = newMeteredCollection(ctx.coll, nil)
+	_, _, err = runContract(callContractFunc, ctx, call, nil, 100*time.Millisecond)
+	require.NotNil(t, err)
+	require.Equal(t, errExecutionTime, err.Error())
+	for i := 0; i < 100 && atomic.LoadInt32(&stuckContracts) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, int32(0), atomic.LoadInt32(&stuckContracts))
+}
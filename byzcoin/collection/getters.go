@@ -109,3 +109,47 @@ func (g Getter) Proof() (Proof, error) {
 
 	return proof, nil
 }
+
+// ForEach calls f for every key/value pair stored in the collection, in the
+// order of the tree, which is the order of the hashes of the keys. The keys
+// and values are copied before calling f, so that f can safely access the
+// collection. The iteration stops at the first error returned by f, which is
+// then returned. An error is also returned if the collection has unknown
+// subtrees.
+func (c *Collection) ForEach(f func(key []byte, values [][]byte) error) error {
+	type entry struct {
+		key    []byte
+		values [][]byte
+	}
+	var entries []entry
+
+	c.Lock()
+	var explore func(*node) error
+	explore = func(cursor *node) error {
+		if !(cursor.known) {
+			return errors.New("collection has unknown subtrees")
+		}
+		if cursor.leaf() {
+			if !(cursor.placeholder()) {
+				entries = append(entries, entry{cursor.copyKey(), cursor.copyVal()})
+			}
+			return nil
+		}
+		if err := explore(cursor.children.left); err != nil {
+			return err
+		}
+		return explore(cursor.children.right)
+	}
+	err := explore(c.root)
+	c.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if err := f(e.key, e.values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
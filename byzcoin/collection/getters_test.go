@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"testing"
 )
 
@@ -165,3 +166,61 @@ func TestGettersProof(test *testing.T) {
 		test.Error("[getters.go]", "[proof]", "Proof() does not yield an error when querying a tree with unknown root.")
 	}
 }
+
+func TestGettersForEach(test *testing.T) {
+	collection := New(Data{})
+
+	keys := make(map[string][]byte)
+	for index := 0; index < 128; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+		value := sha256.Sum256(key)
+
+		collection.Add(key, value[:])
+		keys[string(key)] = value[:]
+	}
+
+	seen := 0
+	err := collection.ForEach(func(key []byte, values [][]byte) error {
+		value, ok := keys[string(key)]
+		if !ok {
+			test.Error("[getters.go]", "[foreach]", "ForEach() returns an unknown key.")
+		}
+		if len(values) != 1 || !bytes.Equal(values[0], value) {
+			test.Error("[getters.go]", "[foreach]", "ForEach() returns a wrong value.")
+		}
+		delete(keys, string(key))
+		seen++
+		return nil
+	})
+
+	if err != nil {
+		test.Error("[getters.go]", "[foreach]", "ForEach() yields an error on a known collection.")
+	}
+
+	if seen != 128 || len(keys) != 0 {
+		test.Error("[getters.go]", "[foreach]", "ForEach() doesn't return all the keys.")
+	}
+
+	stop := errors.New("stop")
+	seen = 0
+	err = collection.ForEach(func(key []byte, values [][]byte) error {
+		seen++
+		return stop
+	})
+
+	if err != stop || seen != 1 {
+		test.Error("[getters.go]", "[foreach]", "ForEach() doesn't stop on error.")
+	}
+
+	collection.scope.None()
+	collection.Collect()
+
+	err = collection.ForEach(func(key []byte, values [][]byte) error {
+		return nil
+	})
+
+	if err == nil {
+		test.Error("[getters.go]", "[foreach]", "ForEach() doesn't yield an error on an unknown subtree.")
+	}
+}
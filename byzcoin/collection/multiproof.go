@@ -0,0 +1,259 @@
+package collection
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/dedis/protobuf"
+)
+
+// Constructors
+
+// Proofs returns a MultiProof of the presence or absence of all the given
+// keys. It holds the same nodes as the Proofs of every key, but the nodes
+// that are on the paths of several keys are only included once.
+func (c *Collection) Proofs(keys ...[]byte) (MultiProof, error) {
+	c.Lock()
+	defer c.Unlock()
+	if len(keys) == 0 {
+		return MultiProof{}, errors.New("cannot create a proof with no key")
+	}
+	var proof MultiProof
+
+	proof.collection = c
+	// To avoid race conditions, we need deep copies here.
+	for _, key := range keys {
+		if len(key) == 0 {
+			return MultiProof{}, errors.New("cannot create a proof with no key")
+		}
+		proof.Keys = append(proof.Keys, append([]byte{}, key...))
+	}
+
+	proof.Root = dumpNode(c.root)
+
+	if !(c.root.known) {
+		return proof, errors.New("record lies in unknown subtree")
+	}
+
+	var explore func(cursor *node, depth int, paths [][sha256.Size]byte) error
+	explore = func(cursor *node, depth int, paths [][sha256.Size]byte) error {
+		if cursor.leaf() {
+			return nil
+		}
+		if !(cursor.children.left.known) || !(cursor.children.right.known) {
+			return errors.New("record lies in unknown subtree")
+		}
+
+		proof.Nodes = append(proof.Nodes, dumpNode(cursor.children.left),
+			dumpNode(cursor.children.right))
+
+		left, right := splitPaths(paths, depth)
+		if len(left) > 0 {
+			if err := explore(cursor.children.left, depth+1, left); err != nil {
+				return err
+			}
+		}
+		if len(right) > 0 {
+			return explore(cursor.children.right, depth+1, right)
+		}
+		return nil
+	}
+
+	return proof, explore(c.root, 0, keyPaths(proof.Keys))
+}
+
+// Getters
+
+// TreeRootHash returns the hash of the merkle tree root.
+func (p MultiProof) TreeRootHash() []byte {
+	return p.Root.Label[:]
+}
+
+// Methods
+
+// Consistent returns true if the given proof is correct, that is, if it
+// holds exactly the nodes on the paths of its keys, and all of them are
+// valid.
+func (p MultiProof) Consistent() bool {
+	if len(p.Keys) == 0 {
+		return false
+	}
+	_, err := p.tree()
+	return err == nil
+}
+
+// Proof returns the Proof of one of the keys of the MultiProof, so that its
+// presence or absence and its values can be read with the methods of Proof.
+// It returns an error if the key is not one of the keys of the MultiProof,
+// or if the MultiProof is not consistent.
+func (p MultiProof) Proof(key []byte) (Proof, error) {
+	found := false
+	for _, k := range p.Keys {
+		if bytes.Equal(k, key) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return Proof{}, errors.New("the key is not in the proof")
+	}
+	root, err := p.tree()
+	if err != nil {
+		return Proof{}, err
+	}
+
+	proof := Proof{
+		Key:        append([]byte{}, key...),
+		Root:       p.Root,
+		collection: p.collection,
+	}
+	path := sha256.Sum256(key)
+	cursor := root
+	for depth := 0; !(cursor.dump.leaf()); depth++ {
+		proof.Steps = append(proof.Steps, step{*cursor.left.dump, *cursor.right.dump})
+		if bit(path[:], depth) {
+			cursor = cursor.right
+		} else {
+			cursor = cursor.left
+		}
+	}
+	return proof, nil
+}
+
+// multiNode is a node of the part of the tree held by a MultiProof.
+type multiNode struct {
+	dump  *dump
+	left  *multiNode
+	right *multiNode
+}
+
+// tree rebuilds the part of the tree held by the proof, by following the
+// paths of the keys. It returns an error if a node is not valid, or if the
+// nodes don't match the paths.
+func (p MultiProof) tree() (*multiNode, error) {
+	if !(p.Root.consistent()) {
+		return nil, errors.New("inconsistent root")
+	}
+
+	next := 0
+	var build func(n *multiNode, depth int, paths [][sha256.Size]byte) error
+	build = func(n *multiNode, depth int, paths [][sha256.Size]byte) error {
+		if n.dump.leaf() {
+			return nil
+		}
+		if depth >= sha256.Size*8 {
+			return errors.New("proof is too deep")
+		}
+		if next+2 > len(p.Nodes) {
+			return errors.New("missing nodes")
+		}
+		left, right := &p.Nodes[next], &p.Nodes[next+1]
+		next += 2
+		if (n.dump.Children.Left != left.Label) || (n.dump.Children.Right != right.Label) {
+			return errors.New("nodes don't match their parent")
+		}
+		if !(left.consistent()) || !(right.consistent()) {
+			return errors.New("inconsistent node")
+		}
+		n.left = &multiNode{dump: left}
+		n.right = &multiNode{dump: right}
+
+		leftPaths, rightPaths := splitPaths(paths, depth)
+		if len(leftPaths) > 0 {
+			if err := build(n.left, depth+1, leftPaths); err != nil {
+				return err
+			}
+		}
+		if len(rightPaths) > 0 {
+			return build(n.right, depth+1, rightPaths)
+		}
+		return nil
+	}
+
+	root := &multiNode{dump: &p.Root}
+	if err := build(root, 0, keyPaths(p.Keys)); err != nil {
+		return nil, err
+	}
+	if next != len(p.Nodes) {
+		return nil, errors.New("too many nodes")
+	}
+	return root, nil
+}
+
+func keyPaths(keys [][]byte) [][sha256.Size]byte {
+	paths := make([][sha256.Size]byte, len(keys))
+	for i, key := range keys {
+		paths[i] = sha256.Sum256(key)
+	}
+	return paths
+}
+
+// splitPaths returns the paths going to the left and to the right at the
+// given depth.
+func splitPaths(paths [][sha256.Size]byte, depth int) (left, right [][sha256.Size]byte) {
+	for _, path := range paths {
+		if bit(path[:], depth) {
+			right = append(right, path)
+		} else {
+			left = append(left, path)
+		}
+	}
+	return
+}
+
+// collection
+
+// Methods (collection) (serialization)
+
+// SerializeMultiProof transforms a given MultiProof into an array of byte,
+// to allow easy exchange of proof, for example on a network.
+func (c *Collection) SerializeMultiProof(proof MultiProof) []byte {
+	serializable := struct {
+		Keys  [][]byte
+		Root  dump
+		Nodes []dump
+	}{proof.Keys, proof.Root, proof.Nodes}
+
+	buffer, _ := protobuf.Encode(&serializable)
+	return buffer
+}
+
+// DeserializeMultiProof is the inverse of SerializeMultiProof. It will
+// generate an error if the given byte array doesn't represent a MultiProof.
+func (c *Collection) DeserializeMultiProof(buffer []byte) (MultiProof, error) {
+	deserializable := struct {
+		Keys  [][]byte
+		Root  dump
+		Nodes []dump
+	}{}
+
+	err := protobuf.Decode(buffer, &deserializable)
+
+	if err != nil {
+		return MultiProof{}, err
+	}
+
+	return MultiProof{deserializable.Keys, deserializable.Root, deserializable.Nodes, c}, nil
+}
+
+// Methods (collection) (verifiers)
+
+// VerifyMultiProof verifies that a given MultiProof is correct. Like
+// Verify, it moreover adds the nodes from the MultiProof to the temporary
+// nodes of the collection. The collection is locked, as the nodes are added
+// while it is read.
+func (c *Collection) VerifyMultiProof(proof MultiProof) bool {
+	c.Lock()
+	defer c.Unlock()
+	if (proof.Root.Label != c.root.label) || !(proof.Consistent()) {
+		return false
+	}
+	for _, key := range proof.Keys {
+		p, err := proof.Proof(key)
+		if err != nil || !(c.Verify(p)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,213 @@
+package collection
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestMultiProofProofs(test *testing.T) {
+	stake64 := Stake64{}
+	data := Data{}
+
+	collection := New(stake64, data)
+
+	for index := 0; index < 512; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		collection.Add(key, uint64(index), key)
+	}
+
+	var keys [][]byte
+	for index := 0; index < 64; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index*8))
+		keys = append(keys, key)
+	}
+	keys = append(keys, []byte("absent"))
+
+	proof, err := collection.Proofs(keys...)
+	if err != nil {
+		test.Fatal("[multiproof.go]", "[proofs]", "Proofs() yields an error on a known collection.")
+	}
+
+	if !(proof.Consistent()) {
+		test.Error("[multiproof.go]", "[proofs]", "Proofs() returns an inconsistent proof.")
+	}
+
+	steps := 0
+	for _, key := range keys {
+		single, _ := collection.Get(key).Proof()
+		steps += len(single.Steps)
+
+		fromMulti, err := proof.Proof(key)
+		if err != nil {
+			test.Error("[multiproof.go]", "[proof]", "Proof() yields an error on a key of the proof.")
+		}
+
+		if !reflect.DeepEqual(single, fromMulti) {
+			test.Error("[multiproof.go]", "[proof]", "Proof() doesn't return the same proof as Getter.Proof().")
+		}
+	}
+
+	if len(proof.Nodes) >= 2*steps {
+		test.Error("[multiproof.go]", "[proofs]", "Proofs() doesn't share the common nodes.")
+	}
+
+	match, _ := proof.Proof(keys[1])
+	if !(match.Match()) {
+		test.Error("[multiproof.go]", "[proof]", "Proof() of a present key doesn't match.")
+	}
+
+	absent, _ := proof.Proof([]byte("absent"))
+	if absent.Match() {
+		test.Error("[multiproof.go]", "[proof]", "Proof() of an absent key matches.")
+	}
+
+	if _, err := proof.Proof([]byte("other")); err == nil {
+		test.Error("[multiproof.go]", "[proof]", "Proof() doesn't yield an error on a key that is not in the proof.")
+	}
+
+	if _, err := collection.Proofs(); err == nil {
+		test.Error("[multiproof.go]", "[proofs]", "Proofs() doesn't yield an error without keys.")
+	}
+
+	if _, err := collection.Proofs(keys[0], []byte{}); err == nil {
+		test.Error("[multiproof.go]", "[proofs]", "Proofs() doesn't yield an error on an empty key.")
+	}
+
+	collection.scope.None()
+	collection.Collect()
+
+	if _, err := collection.Proofs(keys...); err == nil {
+		test.Error("[multiproof.go]", "[proofs]", "Proofs() doesn't yield an error on an unknown subtree.")
+	}
+}
+
+func TestMultiProofConsistent(test *testing.T) {
+	stake64 := Stake64{}
+	data := Data{}
+
+	collection := New(stake64, data)
+
+	var keys [][]byte
+	for index := 0; index < 512; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		collection.Add(key, uint64(index), key)
+		if index%16 == 0 {
+			keys = append(keys, key)
+		}
+	}
+
+	fresh := func() MultiProof {
+		proof, _ := collection.Proofs(keys...)
+		return proof
+	}
+
+	proof := fresh()
+	proof.Nodes[3].Label[0]++
+	if proof.Consistent() {
+		test.Error("[multiproof.go]", "[consistent]", "Consistent() accepts a node with a wrong label.")
+	}
+
+	proof = fresh()
+	proof.Nodes[5].Values[0][0]++
+	if proof.Consistent() {
+		test.Error("[multiproof.go]", "[consistent]", "Consistent() accepts a node with wrong values.")
+	}
+
+	proof = fresh()
+	proof.Nodes = proof.Nodes[:len(proof.Nodes)-2]
+	if proof.Consistent() {
+		test.Error("[multiproof.go]", "[consistent]", "Consistent() accepts missing nodes.")
+	}
+
+	proof = fresh()
+	proof.Nodes = append(proof.Nodes, proof.Nodes[0], proof.Nodes[1])
+	if proof.Consistent() {
+		test.Error("[multiproof.go]", "[consistent]", "Consistent() accepts additional nodes.")
+	}
+
+	proof = fresh()
+	proof.Keys = proof.Keys[1:]
+	if proof.Consistent() {
+		test.Error("[multiproof.go]", "[consistent]", "Consistent() accepts nodes that are not on the paths of the keys.")
+	}
+
+	proof = fresh()
+	proof.Keys = nil
+	if proof.Consistent() {
+		test.Error("[multiproof.go]", "[consistent]", "Consistent() accepts a proof without keys.")
+	}
+}
+
+func TestMultiProofSerialization(test *testing.T) {
+	stake64 := Stake64{}
+	data := Data{}
+
+	collection := New(stake64, data)
+	unknown := New(stake64, data)
+	unknown.scope.None()
+
+	collection.Begin()
+	unknown.Begin()
+
+	var keys [][]byte
+	for index := 0; index < 512; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		collection.Add(key, uint64(index), key)
+		unknown.Add(key, uint64(index), key)
+		if index%4 == 0 {
+			keys = append(keys, key)
+		}
+	}
+
+	collection.End()
+	unknown.End()
+
+	proof, _ := collection.Proofs(keys...)
+	buffer := collection.SerializeMultiProof(proof)
+
+	otherProof, err := unknown.DeserializeMultiProof(buffer)
+
+	if err != nil {
+		test.Error("[multiproof.go]", "[serialization]", "SerializeMultiProof() / DeserializeMultiProof() yields an error on a valid proof.")
+	}
+
+	if otherProof.collection != unknown {
+		test.Error("[multiproof.go]", "[serialization]", "DeserializeMultiProof() does not properly set the collection pointer.")
+	}
+
+	if !(unknown.VerifyMultiProof(otherProof)) {
+		test.Error("[multiproof.go]", "[verify]", "VerifyMultiProof() fails on valid proof.")
+	}
+
+	for index, key := range keys {
+		record, err := unknown.Get(key).Record()
+		if err != nil || !(record.Match()) {
+			test.Error("[multiproof.go]", "[verify]", "VerifyMultiProof() doesn't add the nodes of the proof to the collection.")
+		}
+		values, _ := record.Values()
+		if len(values) != 2 || values[0] != uint64(index*4) {
+			test.Error("[multiproof.go]", "[verify]", "VerifyMultiProof() adds wrong values to the collection.")
+		}
+	}
+
+	collection.Add([]byte("mykey"), uint64(1066), []byte("myvalue"))
+	proof, _ = collection.Proofs(keys...)
+
+	if unknown.VerifyMultiProof(proof) {
+		test.Error("[multiproof.go]", "[verify]", "VerifyMultiProof() accepts a consistent proof from a wrong root.")
+	}
+
+	_, err = collection.DeserializeMultiProof([]byte("definitelynotaproof"))
+
+	if err == nil {
+		test.Error("[multiproof.go]", "[serialization]", "DeserializeMultiProof() does not yield an error when provided with an invalid byte slice.")
+	}
+}
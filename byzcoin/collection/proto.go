@@ -44,3 +44,19 @@ type Proof struct {
 	Steps      []step
 	collection *Collection
 }
+
+// MultiProof
+
+// MultiProof is an object representing the proof of presence or absence of
+// several keys in a collection. The nodes that are on the paths of several
+// keys are only stored once.
+type MultiProof struct {
+	// Keys are the keys that this proof is representing
+	Keys [][]byte
+	// Root is the root node
+	Root dump
+	// Nodes are the children of the nodes on the paths from the root to
+	// the keys, in depth-first order, the left child before the right one
+	Nodes      []dump
+	collection *Collection
+}
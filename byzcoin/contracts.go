@@ -3,6 +3,7 @@ package byzcoin
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/dedis/cothority"
@@ -30,7 +31,7 @@ var CmdDarcEvolve = "evolve"
 // loadConfigFromColl loads the configuration data from the collections.
 func loadConfigFromColl(coll CollectionView) (*ChainConfig, error) {
 	// Find the genesis-darc ID.
-	val, contract, _, err := getValueContract(coll, NewInstanceID(nil).Slice())
+	val, contract, _, err := coll.GetValues(NewInstanceID(nil).Slice())
 	if err != nil {
 		return nil, err
 	}
@@ -47,6 +48,33 @@ func loadConfigFromColl(coll CollectionView) (*ChainConfig, error) {
 	return &config, nil
 }
 
+// contractVersion returns the version of the contract that is active at the
+// block with the given index. Without upgrades, it is version 0.
+func (c *ChainConfig) contractVersion(contractID string, index int) int {
+	if c == nil {
+		return 0
+	}
+	var version int
+	for _, cv := range c.ContractVersions {
+		if cv.ContractID == contractID && cv.Height <= index {
+			version = cv.Version
+		}
+	}
+	return version
+}
+
+// lastContractVersion returns the latest upgrade of the contract, or an
+// empty ContractVersion if it has never been upgraded.
+func (c *ChainConfig) lastContractVersion(contractID string) ContractVersion {
+	last := ContractVersion{ContractID: contractID}
+	for _, cv := range c.ContractVersions {
+		if cv.ContractID == contractID {
+			last = cv
+		}
+	}
+	return last
+}
+
 // LoadDarcFromColl loads a darc which should be stored in key.
 func LoadDarcFromColl(coll CollectionView, key []byte) (*darc.Darc, error) {
 	rec, err := coll.Get(key).Record()
@@ -96,6 +124,9 @@ func (s *Service) ContractConfig(cdb CollectionView, inst Instruction, coins []C
 	case SpawnType:
 		return spawnContractConfig(cdb, inst, coins)
 	case InvokeType:
+		if inst.Invoke.Command == "upgrade_contract" {
+			return upgradeContract(cdb, inst, coins)
+		}
 		return invokeContractConfig(cdb, inst, coins)
 	default:
 		return nil, coins, errors.New("unsupported instruction type")
@@ -128,6 +159,18 @@ func invokeContractConfig(cdb CollectionView, inst Instruction, coins []Coin) (s
 		if err = newConfig.sanityCheck(); err != nil {
 			return
 		}
+		// The upgrades of the contracts can only be changed by
+		// upgrade_contract, which checks them.
+		var oldConfig *ChainConfig
+		oldConfig, err = loadConfigFromColl(cdb)
+		if err != nil {
+			return
+		}
+		newConfig.ContractVersions = oldConfig.ContractVersions
+		configBuf, err = protobuf.Encode(&newConfig)
+		if err != nil {
+			return
+		}
 		sc = []StateChange{
 			NewStateChange(Update, NewInstanceID(nil), ContractConfigID, configBuf, darcID),
 		}
@@ -154,6 +197,71 @@ func invokeContractConfig(cdb CollectionView, inst Instruction, coins []Coin) (s
 	return
 }
 
+// upgradeContract switches the contract given in the argument "contract_id"
+// to the version in the argument "version" from the block with the index in
+// the argument "height" on. Version and height must be 64-bit uints in
+// LittleEndian, both must be bigger than the ones of the previous upgrade,
+// and the height must be bigger than the index of the current block. The
+// local registry of versions is not checked here, as this would make nodes
+// disagree on the block, so AddTransaction refuses upgrades to versions it
+// doesn't know.
+func upgradeContract(cdb CollectionView, inst Instruction, coins []Coin) (sc []StateChange, cOut []Coin, err error) {
+	cOut = coins
+
+	var darcID darc.ID
+	_, _, darcID, err = cdb.GetValues(inst.InstanceID.Slice())
+	if err != nil {
+		return
+	}
+
+	contractID := string(inst.Invoke.Args.Search("contract_id"))
+	versionBuf := inst.Invoke.Args.Search("version")
+	heightBuf := inst.Invoke.Args.Search("height")
+	if len(versionBuf) != 8 || len(heightBuf) != 8 {
+		err = errors.New("version and height must be 64-bit uints in LittleEndian")
+		return
+	}
+	version := int(binary.LittleEndian.Uint64(versionBuf))
+	height := int(binary.LittleEndian.Uint64(heightBuf))
+	// The config is read again for every transaction, so an upgrade from
+	// the current block on would change the contract in the middle of it.
+	index, _, err := GetBlockInfo(cdb)
+	if err != nil {
+		return
+	}
+	if height <= index {
+		err = fmt.Errorf("height must be bigger than the current block %d", index)
+		return
+	}
+
+	config, err := loadConfigFromColl(cdb)
+	if err != nil {
+		return
+	}
+	last := config.lastContractVersion(contractID)
+	if version <= last.Version {
+		err = fmt.Errorf("contract %s is already at version %d", contractID, last.Version)
+		return
+	}
+	if height <= last.Height {
+		err = fmt.Errorf("height must be bigger than %d", last.Height)
+		return
+	}
+	config.ContractVersions = append(config.ContractVersions, ContractVersion{
+		ContractID: contractID,
+		Version:    version,
+		Height:     height,
+	})
+	configBuf, err := protobuf.Encode(config)
+	if err != nil {
+		return
+	}
+	sc = []StateChange{
+		NewStateChange(Update, NewInstanceID(nil), ContractConfigID, configBuf, darcID),
+	}
+	return
+}
+
 func updateRosterScs(cdb CollectionView, darcID darc.ID, newRoster onet.Roster) (StateChanges, error) {
 	config, err := loadConfigFromColl(cdb)
 	if err != nil {
@@ -258,7 +366,7 @@ func (s *Service) ContractDarc(cdb CollectionView, inst Instruction, coins []Coi
 			}, coins, nil
 		}
 
-		c, found := s.contracts[inst.Spawn.ContractID]
+		c, found := s.spawnContract(cdb, inst.Spawn.ContractID)
 		if !found {
 			return nil, nil, errors.New("couldn't find this contract type: " + inst.Spawn.ContractID)
 		}
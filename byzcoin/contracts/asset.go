@@ -0,0 +1,202 @@
+package contracts
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/darc"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/protobuf"
+)
+
+// ContractAssetID denotes a contract holding a unique, non-fungible asset.
+var ContractAssetID = "asset"
+
+// Asset is the value of an asset instance.
+type Asset struct {
+	// Metadata is the hash of the description of the asset. It cannot be
+	// changed once the asset is spawned.
+	Metadata []byte
+}
+
+// ContractAsset holds one asset per instance. Every asset is controlled by
+// its own darc, whose "_sign" rule defines the owner of the asset. The
+// ownership is transferred by evolving this darc. The spawn instruction
+// takes the following arguments:
+//  - metadata is the hash of the description of the asset
+//  - darc is the protobuf-encoded darc of the asset, which is spawned
+//    together with the asset
+// The asset cannot be invoked, as its metadata is immutable. It can be
+// deleted with the "delete" rule of its darc.
+func ContractAsset(cdb byzcoin.CollectionView, inst byzcoin.Instruction, c []byzcoin.Coin) (sc []byzcoin.StateChange, cOut []byzcoin.Coin, err error) {
+	cOut = c
+
+	err = inst.VerifyDarcSignature(cdb)
+	if err != nil {
+		return
+	}
+
+	switch inst.GetType() {
+	case byzcoin.SpawnType:
+		metadata := inst.Spawn.Args.Search("metadata")
+		if len(metadata) == 0 {
+			return nil, nil, errors.New("argument \"metadata\" is missing")
+		}
+		darcBuf := inst.Spawn.Args.Search("darc")
+		var d *darc.Darc
+		d, err = darc.NewFromProtobuf(darcBuf)
+		if err != nil {
+			return nil, nil, errors.New("given darc could not be decoded: " + err.Error())
+		}
+		if d.Version != 0 {
+			return nil, nil, errors.New("the darc of the asset must be a new darc")
+		}
+		darcID := d.GetBaseID()
+		if _, cid, _, err := cdb.GetValues(darcID); err == nil && cid != "" {
+			return nil, nil, errors.New("the darc of the asset already exists")
+		}
+		var aBuf []byte
+		aBuf, err = protobuf.Encode(&Asset{Metadata: metadata})
+		if err != nil {
+			return nil, nil, errors.New("couldn't encode asset: " + err.Error())
+		}
+		sc = []byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Create, byzcoin.NewInstanceID(darcID),
+				byzcoin.ContractDarcID, darcBuf, darcID),
+			byzcoin.NewStateChange(byzcoin.Create, inst.DeriveID(""),
+				ContractAssetID, aBuf, darcID),
+		}
+		return
+	case byzcoin.DeleteType:
+		var darcID darc.ID
+		_, _, darcID, err = cdb.GetValues(inst.InstanceID.Slice())
+		if err != nil {
+			return
+		}
+		sc = []byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Remove, inst.InstanceID, ContractAssetID, nil, darcID),
+		}
+		return
+	}
+	err = errors.New("the metadata of an asset cannot be changed")
+	return
+}
+
+// AssetOwnership is the darc of an asset after a block changed it.
+type AssetOwnership struct {
+	// BlockIndex is the index of the block that changed the darc.
+	BlockIndex int
+	// Timestamp of the block, as a Unix timestamp in nanoseconds.
+	Timestamp int64
+	// Darc of the asset, whose "_sign" rule defines the owner.
+	Darc *darc.Darc
+}
+
+// GetAssetHistory returns the successive darcs of the asset, from its
+// creation to its current owner. The history only goes back as far as the
+// node keeps it: firstBlock is the index of the first block whose changes
+// are known, and the owners before it are unknown if it is bigger than 0.
+func GetAssetHistory(cl *byzcoin.Client, assetID byzcoin.InstanceID) (owners []AssetOwnership, firstBlock int, err error) {
+	resp, err := cl.GetProof(assetID.Slice())
+	if err != nil {
+		return nil, 0, err
+	}
+	_, values, err := resp.Proof.KeyValue()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(values) < 3 || string(values[1]) != ContractAssetID {
+		return nil, 0, errors.New("instance is not an asset")
+	}
+	history, err := cl.GetInstanceHistory(byzcoin.NewInstanceID(values[2]))
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, change := range history.Changes {
+		if change.Removed {
+			continue
+		}
+		d, err := darc.NewFromProtobuf(change.Instance.Value)
+		if err != nil {
+			return nil, 0, errors.New("couldn't decode darc: " + err.Error())
+		}
+		owners = append(owners, AssetOwnership{
+			BlockIndex: change.BlockIndex,
+			Timestamp:  change.Timestamp,
+			Darc:       d,
+		})
+	}
+	return owners, history.FirstBlock, nil
+}
+
+// GetAssetProofs returns the proofs of the asset and of its darc, against
+// the same block. The holder of the asset can present them to anybody
+// knowing the ID of the skipchain, who verifies them offline with
+// VerifyAssetProofs.
+func GetAssetProofs(cl *byzcoin.Client, assetID byzcoin.InstanceID) (assetProof, darcProof *byzcoin.Proof, err error) {
+	resp, err := cl.GetProof(assetID.Slice())
+	if err != nil {
+		return
+	}
+	assetProof = &resp.Proof
+	_, values, err := assetProof.KeyValue()
+	if err != nil {
+		return
+	}
+	if len(values) < 3 {
+		return nil, nil, errors.New("asset not found")
+	}
+	dResp, err := cl.GetProofAt(values[2], assetProof.Latest.Index)
+	if err != nil {
+		return
+	}
+	darcProof = &dResp.Proof
+	return
+}
+
+// VerifyAssetProofs verifies the proofs returned by GetAssetProofs against
+// the skipchain and returns the asset with its darc, whose "_sign" rule
+// defines the owner of the asset.
+func VerifyAssetProofs(scID skipchain.SkipBlockID, assetID byzcoin.InstanceID, assetProof, darcProof *byzcoin.Proof) (*Asset, *darc.Darc, error) {
+	for _, p := range []*byzcoin.Proof{assetProof, darcProof} {
+		if err := p.Verify(scID); err != nil {
+			return nil, nil, err
+		}
+		if !p.InclusionProof.Match() {
+			return nil, nil, errors.New("the proof is a proof of absence")
+		}
+	}
+	if !assetProof.Latest.Hash.Equal(darcProof.Latest.Hash) {
+		return nil, nil, errors.New("the proofs are not against the same block")
+	}
+
+	key, values, err := assetProof.KeyValue()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(key, assetID.Slice()) {
+		return nil, nil, errors.New("the proof is not about the asset")
+	}
+	var a Asset
+	if err = assetProof.ContractValue(cothority.Suite, ContractAssetID, &a); err != nil {
+		return nil, nil, err
+	}
+
+	darcKey, darcValues, err := darcProof.KeyValue()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(darcKey, values[2]) {
+		return nil, nil, errors.New("the proof is not about the darc of the asset")
+	}
+	if string(darcValues[1]) != byzcoin.ContractDarcID {
+		return nil, nil, errors.New("the darc of the asset is not a darc")
+	}
+	d, err := darc.NewFromProtobuf(darcValues[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	return &a, d, nil
+}
@@ -0,0 +1,73 @@
+package contracts
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/darc"
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAsset_Spawn(t *testing.T) {
+	ct := newCT("spawn:asset")
+	owner := darc.NewSignerEd25519(nil, nil)
+	ids := []darc.Identity{owner.Identity()}
+	assetDarc := darc.NewDarc(darc.InitRules(ids, ids), []byte("asset"))
+	require.Nil(t, assetDarc.Rules.AddRule("delete", assetDarc.Rules.GetSignExpr()))
+	assetDarcBuf, err := assetDarc.ToProto()
+	require.Nil(t, err)
+	metadata := sha256.Sum256([]byte("painting"))
+
+	inst := byzcoin.Instruction{
+		InstanceID: byzcoin.NewInstanceID(gdarc.GetBaseID()),
+		Spawn: &byzcoin.Spawn{
+			ContractID: ContractAssetID,
+			Args: byzcoin.Arguments{
+				{Name: "metadata", Value: metadata[:]},
+				{Name: "darc", Value: assetDarcBuf},
+			},
+		},
+	}
+	require.Nil(t, inst.SignBy(gdarc.GetBaseID(), gsigner))
+	sc, _, err := ContractAsset(ct, inst, nil)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(sc))
+	require.Equal(t, byzcoin.NewStateChange(byzcoin.Create, byzcoin.NewInstanceID(assetDarc.GetBaseID()),
+		byzcoin.ContractDarcID, assetDarcBuf, assetDarc.GetBaseID()), sc[0])
+	aBuf, err := protobuf.Encode(&Asset{Metadata: metadata[:]})
+	require.Nil(t, err)
+	require.Equal(t, byzcoin.NewStateChange(byzcoin.Create, inst.DeriveID(""),
+		ContractAssetID, aBuf, assetDarc.GetBaseID()), sc[1])
+
+	// The darc of an asset cannot be an existing darc.
+	for _, s := range sc {
+		ct.Store(byzcoin.NewInstanceID(s.InstanceID), s.Value, string(s.ContractID), s.DarcID)
+	}
+	_, _, err = ContractAsset(ct, inst, nil)
+	require.NotNil(t, err)
+
+	// The metadata cannot be changed, but the owner can delete the asset.
+	assetID := inst.DeriveID("")
+	inst = byzcoin.Instruction{
+		InstanceID: assetID,
+		Invoke:     &byzcoin.Invoke{Command: "update"},
+	}
+	require.Nil(t, inst.SignBy(assetDarc.GetBaseID(), owner))
+	_, _, err = ContractAsset(ct, inst, nil)
+	require.NotNil(t, err)
+
+	inst = byzcoin.Instruction{
+		InstanceID: assetID,
+		Delete:     &byzcoin.Delete{},
+	}
+	require.Nil(t, inst.SignBy(assetDarc.GetBaseID(), gsigner))
+	_, _, err = ContractAsset(ct, inst, nil)
+	require.NotNil(t, err)
+	require.Nil(t, inst.SignBy(assetDarc.GetBaseID(), owner))
+	sc, _, err = ContractAsset(ct, inst, nil)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(sc))
+	require.Equal(t, byzcoin.Remove, sc[0].StateAction)
+}
@@ -32,7 +32,26 @@ var CoinName = iid("olCoin")
 //    parameter for the next instruction to interpret.
 //  - store puts the coins given to the instance back into the account.
 // You can only delete a contractCoin instance if the account is empty.
+//
+// ContractCoin is version 0 of the coin contract, ContractCoinV1 knows about
+// the coin types defined by ContractToken.
 func ContractCoin(cdb byzcoin.CollectionView, inst byzcoin.Instruction, c []byzcoin.Coin) (sc []byzcoin.StateChange, cOut []byzcoin.Coin, err error) {
+	return contractCoin(cdb, inst, c, 0)
+}
+
+// ContractCoinV1 is version 1 of ContractCoin. It is used once the coin
+// contract has been upgraded to it with an "upgrade_contract" instruction,
+// and differs from version 0 in the following:
+//  - the optional argument "type" of the spawn instruction must be the
+//    InstanceID of a ContractToken instance defining the coins
+//  - coins of a token can only be minted by the token instance
+//  - transfer refuses a destination holding another type of coins, and
+//    the account itself
+func ContractCoinV1(cdb byzcoin.CollectionView, inst byzcoin.Instruction, c []byzcoin.Coin) (sc []byzcoin.StateChange, cOut []byzcoin.Coin, err error) {
+	return contractCoin(cdb, inst, c, 1)
+}
+
+func contractCoin(cdb byzcoin.CollectionView, inst byzcoin.Instruction, c []byzcoin.Coin, version int) (sc []byzcoin.StateChange, cOut []byzcoin.Coin, err error) {
 	cOut = c
 
 	err = inst.VerifyDarcSignature(cdb)
@@ -66,6 +85,14 @@ func ContractCoin(cdb byzcoin.CollectionView, inst byzcoin.Instruction, c []byzc
 			if len(t) != len(byzcoin.InstanceID{}) {
 				return nil, nil, errors.New("type needs to be an InstanceID")
 			}
+			// Other types than the default one are defined by a token
+			// instance, so that nobody can mint them before the token
+			// exists.
+			if version >= 1 {
+				if err = checkTokenType(cdb, t); err != nil {
+					return
+				}
+			}
 			ci.Name = byzcoin.NewInstanceID(t)
 		} else {
 			ci.Name = CoinName
@@ -93,7 +120,15 @@ func ContractCoin(cdb byzcoin.CollectionView, inst byzcoin.Instruction, c []byzc
 		}
 		switch inst.Invoke.Command {
 		case "mint":
-			// mint simply adds this amount of coins to the account.
+			// mint simply adds this amount of coins to the account, unless
+			// the coins are defined by a token, which mints them itself.
+			if version >= 1 {
+				_, cid, _, tErr := cdb.GetValues(ci.Name.Slice())
+				if tErr == nil && cid == ContractTokenID {
+					err = errors.New("coins of a token can only be minted by the token instance")
+					return
+				}
+			}
 			log.Lvl2("minting", coinsArg)
 			err = ci.SafeAdd(coinsArg)
 			if err != nil {
@@ -102,6 +137,28 @@ func ContractCoin(cdb byzcoin.CollectionView, inst byzcoin.Instruction, c []byzc
 		case "transfer":
 			// transfer sends a given amount of coins to another account.
 			target := inst.Invoke.Args.Search("destination")
+			if version >= 1 {
+				// The credit would be overwritten by the update of
+				// this account, destroying the coins.
+				if inst.InstanceID.Equal(byzcoin.NewInstanceID(target)) {
+					return nil, nil, errors.New("cannot transfer coins to the same account")
+				}
+				// The destination must hold the same type of coins,
+				// else the cap of a token could be bypassed.
+				err = ci.SafeSub(coinsArg)
+				if err != nil {
+					return
+				}
+				var targetSc byzcoin.StateChange
+				targetSc, err = creditCoin(cdb, byzcoin.NewInstanceID(target),
+					byzcoin.Coin{Name: ci.Name, Value: coinsArg})
+				if err != nil {
+					return
+				}
+				log.Lvlf1("transferring %d to %x", coinsArg, target)
+				sc = append(sc, targetSc)
+				break
+			}
 			var (
 				v   []byte
 				cid string
@@ -182,6 +239,71 @@ func ContractCoin(cdb byzcoin.CollectionView, inst byzcoin.Instruction, c []byzc
 	return
 }
 
+// QueryCoin answers the following read-only queries on a coin instance:
+//  - balance returns the number of coins in the account as a 64-bit uint
+//    in LittleEndian
+//  - type returns the InstanceID identifying the type of the coins
+func QueryCoin(cdb byzcoin.CollectionView, iID byzcoin.InstanceID, name string, args byzcoin.Arguments) ([]byte, error) {
+	value, cid, _, err := cdb.GetValues(iID.Slice())
+	if err != nil {
+		return nil, err
+	}
+	if cid != ContractCoinID {
+		return nil, errors.New("instance is not a coin")
+	}
+	var ci byzcoin.Coin
+	if err = protobuf.Decode(value, &ci); err != nil {
+		return nil, errors.New("couldn't unmarshal instance data: " + err.Error())
+	}
+	switch name {
+	case "balance":
+		balance := make([]byte, 8)
+		binary.LittleEndian.PutUint64(balance, ci.Value)
+		return balance, nil
+	case "type":
+		return ci.Name.Slice(), nil
+	default:
+		return nil, errors.New("unknown query: " + name)
+	}
+}
+
+// creditCoin returns the state change adding coin to the coin instance
+// iID.
+func creditCoin(cdb byzcoin.CollectionView, iID byzcoin.InstanceID, coin byzcoin.Coin) (byzcoin.StateChange, error) {
+	ci, did, err := loadCoinAccount(cdb, iID, coin.Name)
+	if err != nil {
+		return byzcoin.StateChange{}, err
+	}
+	if err = ci.SafeAdd(coin.Value); err != nil {
+		return byzcoin.StateChange{}, err
+	}
+	ciBuf, err := protobuf.Encode(&ci)
+	if err != nil {
+		return byzcoin.StateChange{}, errors.New("couldn't marshal target account: " + err.Error())
+	}
+	return byzcoin.NewStateChange(byzcoin.Update, iID, ContractCoinID, ciBuf, did), nil
+}
+
+// loadCoinAccount returns the coin instance iID and its darc, or an error if
+// it is not a coin instance holding coins of the type name.
+func loadCoinAccount(cdb byzcoin.CollectionView, iID byzcoin.InstanceID, name byzcoin.InstanceID) (byzcoin.Coin, darc.ID, error) {
+	v, cid, did, err := cdb.GetValues(iID.Slice())
+	if err == nil && cid != ContractCoinID {
+		err = errors.New("destination is not a coin contract")
+	}
+	if err != nil {
+		return byzcoin.Coin{}, nil, err
+	}
+	var ci byzcoin.Coin
+	if err = protobuf.Decode(v, &ci); err != nil {
+		return byzcoin.Coin{}, nil, errors.New("couldn't unmarshal target account: " + err.Error())
+	}
+	if !ci.Name.Equal(name) {
+		return byzcoin.Coin{}, nil, errors.New("destination holds another type of coins")
+	}
+	return ci, did, nil
+}
+
 // iid uses sha256(in) in order to manufacture an InstanceID from in
 // thereby handling the case where len(in) != 32.
 //
@@ -191,3 +313,13 @@ func iid(in string) byzcoin.InstanceID {
 	h.Write([]byte(in))
 	return byzcoin.NewInstanceID(h.Sum(nil))
 }
+
+// checkTokenType returns an error if the type of coins t is not defined by
+// a token instance.
+func checkTokenType(cdb byzcoin.CollectionView, t []byte) error {
+	_, cid, _, err := cdb.GetValues(t)
+	if err != nil || cid != ContractTokenID {
+		return errors.New("type needs to be a token instance")
+	}
+	return nil
+}
@@ -1,12 +1,17 @@
 package contracts
 
 import (
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/dedis/cothority"
 	"github.com/dedis/cothority/byzcoin"
 	"github.com/dedis/cothority/byzcoin/collection"
 	"github.com/dedis/cothority/byzcoin/darc"
 	"github.com/dedis/cothority/byzcoin/darc/expression"
+	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
 	"github.com/dedis/protobuf"
 	"github.com/stretchr/testify/require"
@@ -205,10 +210,68 @@ func TestCoin_InvokeTransfer(t *testing.T) {
 	require.Equal(t, byzcoin.NewStateChange(byzcoin.Update, coAddr1, ContractCoinID, ciZero, gdarc.GetBaseID()), sc[1])
 }
 
+// TestCoin_InvokeTransferBefore checks that a key can be allowed to spend
+// only until a given time.
+func TestCoin_InvokeTransferBefore(t *testing.T) {
+	ct := newCT()
+	spender := darc.NewSignerEd25519(nil, nil)
+	expr := expression.Expr(spender.Identity().String() +
+		" & before:1546300800 & attr:contract=" + ContractCoinID)
+	require.Nil(t, gdarc.Rules.AddRule("invoke:transfer", expr))
+	dBuf, err := gdarc.ToProto()
+	require.Nil(t, err)
+	ct.Store(byzcoin.NewInstanceID(gdarc.GetBaseID()), dBuf, "darc", gdarc.GetBaseID())
+	coAddr1 := byzcoin.InstanceID{}
+	coAddr2 := byzcoin.NewInstanceID([]byte("destination"))
+	ct.Store(coAddr1, ciOne, ContractCoinID, gdarc.GetBaseID())
+	ct.Store(coAddr2, ciZero, ContractCoinID, gdarc.GetBaseID())
+
+	inst := byzcoin.Instruction{
+		InstanceID: coAddr1,
+		Invoke: &byzcoin.Invoke{
+			Command: "transfer",
+			Args: byzcoin.Arguments{
+				{Name: "coins", Value: coinOne},
+				{Name: "destination", Value: coAddr2.Slice()},
+			},
+		},
+	}
+	require.Nil(t, inst.SignBy(gdarc.GetBaseID(), spender))
+
+	// The block timestamps are in nanoseconds.
+	ct.timestamp = 1546300800*1e9 - 1
+	_, _, err = ContractCoin(ct, inst, []byzcoin.Coin{})
+	require.Nil(t, err)
+	ct.timestamp = 1546300800 * 1e9
+	_, _, err = ContractCoin(ct, inst, []byzcoin.Coin{})
+	require.NotNil(t, err)
+}
+
+func TestCoin_Query(t *testing.T) {
+	ct := newCT()
+	coAddr := byzcoin.InstanceID{}
+	ct.Store(coAddr, ciTwo, ContractCoinID, gdarc.GetBaseID())
+
+	balance, err := QueryCoin(ct, coAddr, "balance", nil)
+	require.Nil(t, err)
+	require.Equal(t, coinTwo, balance)
+	name, err := QueryCoin(ct, coAddr, "type", nil)
+	require.Nil(t, err)
+	require.Equal(t, CoinName.Slice(), name)
+	_, err = QueryCoin(ct, coAddr, "unknown", nil)
+	require.NotNil(t, err)
+
+	// Only coin instances can be queried.
+	_, err = QueryCoin(ct, byzcoin.NewInstanceID(gdarc.GetBaseID()), "balance", nil)
+	require.NotNil(t, err)
+}
+
 type cvTest struct {
 	values      map[string][]byte
 	contractIDs map[string]string
 	darcIDs     map[string]darc.ID
+	index       int
+	timestamp   int64
 }
 
 var gdarc *darc.Darc
@@ -216,9 +279,9 @@ var gsigner darc.Signer
 
 func newCT(rStr ...string) *cvTest {
 	ct := &cvTest{
-		make(map[string][]byte),
-		make(map[string]string),
-		make(map[string]darc.ID),
+		values:      make(map[string][]byte),
+		contractIDs: make(map[string]string),
+		darcIDs:     make(map[string]darc.ID),
 	}
 	gsigner = darc.NewSignerEd25519(nil, nil)
 	rules := darc.InitRules([]darc.Identity{gsigner.Identity()},
@@ -245,9 +308,120 @@ func (ct *cvTest) Store(key byzcoin.InstanceID, value []byte, contractID string,
 func (ct cvTest) GetValues(key []byte) (value []byte, contractID string, darcID darc.ID, err error) {
 	return ct.values[string(key)], ct.contractIDs[string(key)], ct.darcIDs[string(key)], nil
 }
+func (ct cvTest) ForEach(prefix []byte, f byzcoin.ForEachFn) error {
+	var keys []string
+	for k := range ct.values {
+		if strings.HasPrefix(k, string(prefix)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		err := f([]byte(k), ct.values[k], ct.contractIDs[k], ct.darcIDs[k])
+		if err == byzcoin.ErrStopIteration {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 func (ct cvTest) GetValue(key []byte) ([]byte, error) {
 	return ct.values[string(key)], nil
 }
 func (ct cvTest) GetContractID(key []byte) (string, error) {
 	return ct.contractIDs[string(key)], nil
 }
+func (ct cvTest) BlockInfo() (int, int64) {
+	return ct.index, ct.timestamp
+}
+
+// TestCoin_TransferOnce checks on a ledger that a transfer is only applied
+// in the block it is included in, and not proposed again in later blocks.
+func TestCoin_TransferOnce(t *testing.T) {
+	local := onet.NewTCPTest(cothority.Suite)
+	defer local.CloseAll()
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	_, roster, _ := local.GenTree(2, true)
+
+	genesisMsg, err := byzcoin.DefaultGenesisMsg(byzcoin.CurrentVersion, roster,
+		[]string{"spawn:coin", "invoke:mint", "invoke:transfer"}, signer.Identity())
+	require.Nil(t, err)
+	gDarc := &genesisMsg.GenesisDarc
+	genesisMsg.BlockInterval = 500 * time.Millisecond
+
+	cl, _, err := byzcoin.NewLedger(genesisMsg, false)
+	require.Nil(t, err)
+
+	send := func(instrs ...byzcoin.Instruction) {
+		nonce := byzcoin.GenNonce()
+		for i := range instrs {
+			instrs[i].Nonce = nonce
+			instrs[i].Index = i
+			instrs[i].Length = len(instrs)
+		}
+		for i := range instrs {
+			require.Nil(t, instrs[i].SignBy(gDarc.GetBaseID(), signer))
+		}
+		_, err := cl.AddTransactionAndWait(byzcoin.ClientTransaction{Instructions: instrs}, 10)
+		require.Nil(t, err)
+	}
+	spawn := byzcoin.Instruction{
+		InstanceID: byzcoin.NewInstanceID(gDarc.GetBaseID()),
+		Spawn:      &byzcoin.Spawn{ContractID: ContractCoinID},
+	}
+	send(spawn)
+	accountA := spawn.DeriveID("")
+	spawn = byzcoin.Instruction{
+		InstanceID: byzcoin.NewInstanceID(gDarc.GetBaseID()),
+		Spawn:      &byzcoin.Spawn{ContractID: ContractCoinID},
+	}
+	send(spawn)
+	accountB := spawn.DeriveID("")
+
+	ten := make([]byte, 8)
+	ten[0] = 10
+	send(byzcoin.Instruction{
+		InstanceID: accountA,
+		Invoke: &byzcoin.Invoke{
+			Command: "mint",
+			Args:    byzcoin.Arguments{{Name: "coins", Value: ten}},
+		},
+	})
+	send(byzcoin.Instruction{
+		InstanceID: accountA,
+		Invoke: &byzcoin.Invoke{
+			Command: "transfer",
+			Args: byzcoin.Arguments{
+				{Name: "coins", Value: coinTwo},
+				{Name: "destination", Value: accountB.Slice()},
+			},
+		},
+	})
+	// Some more blocks, in which the transfer must not be applied again.
+	for i := 0; i < 3; i++ {
+		send(byzcoin.Instruction{
+			InstanceID: accountB,
+			Invoke: &byzcoin.Invoke{
+				Command: "mint",
+				Args:    byzcoin.Arguments{{Name: "coins", Value: coinZero}},
+			},
+		})
+	}
+
+	balance := func(id byzcoin.InstanceID) uint64 {
+		resp, err := cl.GetProof(id.Slice())
+		require.Nil(t, err)
+		_, vs, err := resp.Proof.KeyValue()
+		require.Nil(t, err)
+		var ci byzcoin.Coin
+		require.Nil(t, protobuf.Decode(vs[0], &ci))
+		return ci.Value
+	}
+	require.Equal(t, uint64(8), balance(accountA))
+	require.Equal(t, uint64(2), balance(accountB))
+
+	local.WaitDone(genesisMsg.BlockInterval)
+}
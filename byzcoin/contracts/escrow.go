@@ -0,0 +1,230 @@
+package contracts
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/darc"
+	"github.com/dedis/protobuf"
+)
+
+// ContractEscrowID denotes a contract that locks coins until they are
+// released or refunded.
+var ContractEscrowID = "escrow"
+
+// Escrow is the value of an escrow instance.
+type Escrow struct {
+	// Coin holds the locked coins.
+	Coin byzcoin.Coin
+	// Recipient is the coin instance receiving the coins on a release or a
+	// reveal.
+	Recipient byzcoin.InstanceID
+	// Refund is the coin instance receiving the coins on a refund.
+	Refund byzcoin.InstanceID
+	// Height is the index of the block from which on the coins can be
+	// refunded, or 0.
+	Height uint64
+	// Timestamp is the Unix timestamp in nanoseconds from which on the coins
+	// can be refunded, or 0. It is compared to the timestamp of the previous
+	// block.
+	Timestamp int64
+	// Hash is the sha256 of the preimage releasing the coins, or nil.
+	Hash []byte
+}
+
+// ContractEscrow locks the coins given to its spawn instruction, usually
+// fetched from a ContractCoin instance by the previous instruction. The
+// spawn instruction takes the following arguments:
+//  - recipient is the coin instance receiving the coins
+//  - refund is the coin instance receiving the coins back
+//  - height (optional) is the block index from which on a refund is
+//    possible, as a 64-bit uint in LittleEndian
+//  - timestamp (optional) is the Unix timestamp in nanoseconds from which on
+//    a refund is possible, as a 64-bit int in LittleEndian
+//  - hash (optional) is the sha256 of a preimage releasing the coins
+// The following methods are available, each of them removing the instance:
+//  - release sends the coins to the recipient
+//  - refund sends the coins back once the height or the timestamp is reached
+//  - reveal sends the coins to the recipient if the argument "preimage"
+//    matches the hash, as long as the coins cannot be refunded
+// As for the other contracts, the darc of the instance decides who can call
+// each method. Two escrows locked by the same hash on two ledgers, with the
+// one of the initiator having the later deadline, give an atomic swap: the
+// initiator reveals the preimage to get the coins of the other ledger, which
+// lets the other party reveal it too.
+func ContractEscrow(cdb byzcoin.CollectionView, inst byzcoin.Instruction, c []byzcoin.Coin) (sc []byzcoin.StateChange, cOut []byzcoin.Coin, err error) {
+	cOut = c
+
+	err = inst.VerifyDarcSignature(cdb)
+	if err != nil {
+		return
+	}
+
+	var value []byte
+	var darcID darc.ID
+	value, _, darcID, err = cdb.GetValues(inst.InstanceID.Slice())
+	if err != nil {
+		return
+	}
+
+	switch inst.GetType() {
+	case byzcoin.SpawnType:
+		var e Escrow
+		e, cOut, err = newEscrow(cdb, inst.Spawn.Args, c)
+		if err != nil {
+			return
+		}
+		var eBuf []byte
+		eBuf, err = protobuf.Encode(&e)
+		if err != nil {
+			return nil, nil, errors.New("couldn't encode escrow: " + err.Error())
+		}
+		sc = []byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Create, inst.DeriveID(""), ContractEscrowID, eBuf, darcID),
+		}
+		return
+	case byzcoin.InvokeType:
+		var e Escrow
+		err = protobuf.Decode(value, &e)
+		if err != nil {
+			return nil, nil, errors.New("couldn't unmarshal escrow: " + err.Error())
+		}
+		target := e.Recipient
+		switch inst.Invoke.Command {
+		case "release":
+		case "refund":
+			if err = e.checkRefund(cdb); err != nil {
+				return
+			}
+			target = e.Refund
+		case "reveal":
+			if e.Hash == nil {
+				return nil, nil, errors.New("escrow is not locked by a hash")
+			}
+			h := sha256.Sum256(inst.Invoke.Args.Search("preimage"))
+			if !bytes.Equal(h[:], e.Hash) {
+				return nil, nil, errors.New("wrong preimage")
+			}
+			// Else the preimage could still be revealed on this ledger
+			// after the other party of a swap got its refund.
+			var refundable bool
+			refundable, err = e.refundable(cdb)
+			if err != nil {
+				return
+			}
+			if refundable {
+				return nil, nil, errors.New("escrow can only be refunded")
+			}
+		default:
+			return nil, nil, errors.New("escrow contract can only release, refund or reveal")
+		}
+		var targetSc byzcoin.StateChange
+		targetSc, err = creditCoin(cdb, target, e.Coin)
+		if err != nil {
+			return
+		}
+		sc = []byzcoin.StateChange{
+			targetSc,
+			byzcoin.NewStateChange(byzcoin.Remove, inst.InstanceID, ContractEscrowID, nil, darcID),
+		}
+		return
+	}
+	err = errors.New("instruction type not allowed")
+	return
+}
+
+// newEscrow creates an escrow from the arguments of a spawn instruction. It
+// locks the coins of c and returns the remaining ones. The recipient and the
+// refund need to be coin instances of the locked coins, else the coins
+// could never leave the escrow.
+func newEscrow(cdb byzcoin.CollectionView, args byzcoin.Arguments, c []byzcoin.Coin) (e Escrow, cOut []byzcoin.Coin, err error) {
+	for _, co := range c {
+		if co.Value == 0 {
+			continue
+		}
+		if e.Coin.Value > 0 && !e.Coin.Name.Equal(co.Name) {
+			cOut = append(cOut, co)
+			continue
+		}
+		e.Coin.Name = co.Name
+		if err = e.Coin.SafeAdd(co.Value); err != nil {
+			return
+		}
+	}
+	if e.Coin.Value == 0 {
+		err = errors.New("no coins to lock")
+		return
+	}
+
+	recipient := args.Search("recipient")
+	refund := args.Search("refund")
+	if len(recipient) != len(byzcoin.InstanceID{}) || len(refund) != len(byzcoin.InstanceID{}) {
+		err = errors.New("recipient and refund need to be InstanceIDs")
+		return
+	}
+	e.Recipient = byzcoin.NewInstanceID(recipient)
+	e.Refund = byzcoin.NewInstanceID(refund)
+	if _, _, err = loadCoinAccount(cdb, e.Recipient, e.Coin.Name); err != nil {
+		err = errors.New("recipient: " + err.Error())
+		return
+	}
+	if _, _, err = loadCoinAccount(cdb, e.Refund, e.Coin.Name); err != nil {
+		err = errors.New("refund: " + err.Error())
+		return
+	}
+	if buf := args.Search("height"); buf != nil {
+		if len(buf) != 8 {
+			err = errors.New("height needs to be a 64-bit uint")
+			return
+		}
+		e.Height = binary.LittleEndian.Uint64(buf)
+	}
+	if buf := args.Search("timestamp"); buf != nil {
+		if len(buf) != 8 {
+			err = errors.New("timestamp needs to be a 64-bit int")
+			return
+		}
+		e.Timestamp = int64(binary.LittleEndian.Uint64(buf))
+	}
+	if buf := args.Search("hash"); buf != nil {
+		if len(buf) != sha256.Size {
+			err = errors.New("hash needs to be a sha256")
+			return
+		}
+		e.Hash = buf
+	}
+	return
+}
+
+// checkRefund returns an error if the coins of the escrow cannot be
+// refunded yet.
+func (e Escrow) checkRefund(cdb byzcoin.CollectionView) error {
+	if e.Height == 0 && e.Timestamp == 0 {
+		return errors.New("escrow cannot be refunded")
+	}
+	refundable, err := e.refundable(cdb)
+	if err != nil {
+		return err
+	}
+	if !refundable {
+		return errors.New("escrow cannot be refunded yet")
+	}
+	return nil
+}
+
+// refundable returns true if the height or the timestamp of the escrow has
+// been reached.
+func (e Escrow) refundable(cdb byzcoin.CollectionView) (bool, error) {
+	if e.Height == 0 && e.Timestamp == 0 {
+		return false, nil
+	}
+	index, timestamp, err := byzcoin.GetBlockInfo(cdb)
+	if err != nil {
+		return false, err
+	}
+	return e.Height > 0 && uint64(index) >= e.Height ||
+		e.Timestamp > 0 && timestamp >= e.Timestamp, nil
+}
@@ -0,0 +1,190 @@
+package contracts
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+var escrowRecipient = byzcoin.NewInstanceID([]byte("recipient"))
+var escrowRefund = byzcoin.NewInstanceID([]byte("refund"))
+
+// spawnEscrow returns the escrow created by spawning it with args and two
+// coins.
+func spawnEscrow(t *testing.T, ct *cvTest, args byzcoin.Arguments) byzcoin.InstanceID {
+	inst := byzcoin.Instruction{
+		InstanceID: byzcoin.NewInstanceID(gdarc.GetBaseID()),
+		Spawn: &byzcoin.Spawn{
+			ContractID: ContractEscrowID,
+			Args: append(byzcoin.Arguments{
+				{Name: "recipient", Value: escrowRecipient.Slice()},
+				{Name: "refund", Value: escrowRefund.Slice()},
+			}, args...),
+		},
+	}
+	require.Nil(t, inst.SignBy(gdarc.GetBaseID(), gsigner))
+	sc, co, err := ContractEscrow(ct, inst, []byzcoin.Coin{{Name: CoinName, Value: 2}})
+	require.Nil(t, err)
+	require.Equal(t, 0, len(co))
+	require.Equal(t, 1, len(sc))
+	iID := byzcoin.NewInstanceID(sc[0].InstanceID)
+	ct.Store(iID, sc[0].Value, ContractEscrowID, gdarc.GetBaseID())
+	return iID
+}
+
+func invokeEscrow(t *testing.T, ct *cvTest, iID byzcoin.InstanceID, command string, args byzcoin.Arguments) ([]byzcoin.StateChange, error) {
+	inst := byzcoin.Instruction{
+		InstanceID: iID,
+		Invoke:     &byzcoin.Invoke{Command: command, Args: args},
+	}
+	require.Nil(t, inst.SignBy(gdarc.GetBaseID(), gsigner))
+	sc, _, err := ContractEscrow(ct, inst, nil)
+	return sc, err
+}
+
+func newEscrowCT() *cvTest {
+	ct := newCT("spawn:escrow", "invoke:release", "invoke:refund", "invoke:reveal")
+	ct.Store(escrowRecipient, ciZero, ContractCoinID, gdarc.GetBaseID())
+	ct.Store(escrowRefund, ciZero, ContractCoinID, gdarc.GetBaseID())
+	return ct
+}
+
+func TestEscrow_Spawn(t *testing.T) {
+	ct := newEscrowCT()
+	iID := spawnEscrow(t, ct, nil)
+	var e Escrow
+	require.Nil(t, protobuf.Decode(ct.values[string(iID.Slice())], &e))
+	require.Equal(t, uint64(2), e.Coin.Value)
+	require.True(t, e.Recipient.Equal(escrowRecipient))
+	require.True(t, e.Refund.Equal(escrowRefund))
+
+	// An escrow needs coins.
+	inst := byzcoin.Instruction{
+		InstanceID: byzcoin.NewInstanceID(gdarc.GetBaseID()),
+		Spawn: &byzcoin.Spawn{
+			ContractID: ContractEscrowID,
+			Args: byzcoin.Arguments{
+				{Name: "recipient", Value: escrowRecipient.Slice()},
+				{Name: "refund", Value: escrowRefund.Slice()},
+			},
+		},
+	}
+	require.Nil(t, inst.SignBy(gdarc.GetBaseID(), gsigner))
+	_, _, err := ContractEscrow(ct, inst, nil)
+	require.NotNil(t, err)
+
+	// The recipient needs to be a coin instance of the locked coins.
+	coins := []byzcoin.Coin{{Name: CoinName, Value: 2}}
+	inst.Spawn.Args[0].Value = byzcoin.NewInstanceID([]byte("missing")).Slice()
+	require.Nil(t, inst.SignBy(gdarc.GetBaseID(), gsigner))
+	_, _, err = ContractEscrow(ct, inst, coins)
+	require.NotNil(t, err)
+	inst.Spawn.Args[0].Value = iID.Slice()
+	require.Nil(t, inst.SignBy(gdarc.GetBaseID(), gsigner))
+	_, _, err = ContractEscrow(ct, inst, coins)
+	require.NotNil(t, err)
+	other := byzcoin.NewInstanceID([]byte("other"))
+	ci := byzcoin.Coin{Name: other}
+	ciBuf, err := protobuf.Encode(&ci)
+	require.Nil(t, err)
+	ct.Store(other, ciBuf, ContractCoinID, gdarc.GetBaseID())
+	inst.Spawn.Args[0].Value = other.Slice()
+	require.Nil(t, inst.SignBy(gdarc.GetBaseID(), gsigner))
+	_, _, err = ContractEscrow(ct, inst, coins)
+	require.NotNil(t, err)
+}
+
+func TestEscrow_Release(t *testing.T) {
+	ct := newEscrowCT()
+	iID := spawnEscrow(t, ct, nil)
+
+	sc, err := invokeEscrow(t, ct, iID, "release", nil)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(sc))
+	require.Equal(t, byzcoin.NewStateChange(byzcoin.Update, escrowRecipient,
+		ContractCoinID, ciTwo, gdarc.GetBaseID()), sc[0])
+	require.Equal(t, byzcoin.Remove, sc[1].StateAction)
+
+	// Without height or timestamp, the coins cannot be refunded.
+	_, err = invokeEscrow(t, ct, iID, "refund", nil)
+	require.NotNil(t, err)
+	// Without hash, the coins cannot be revealed.
+	_, err = invokeEscrow(t, ct, iID, "reveal", byzcoin.Arguments{{Name: "preimage"}})
+	require.NotNil(t, err)
+}
+
+func TestEscrow_Refund(t *testing.T) {
+	ct := newEscrowCT()
+	height := make([]byte, 8)
+	binary.LittleEndian.PutUint64(height, 10)
+	timestamp := make([]byte, 8)
+	binary.LittleEndian.PutUint64(timestamp, 1000)
+	iID := spawnEscrow(t, ct, byzcoin.Arguments{
+		{Name: "height", Value: height},
+		{Name: "timestamp", Value: timestamp},
+	})
+
+	ct.index = 9
+	ct.timestamp = 999
+	_, err := invokeEscrow(t, ct, iID, "refund", nil)
+	require.NotNil(t, err)
+
+	ct.index = 10
+	sc, err := invokeEscrow(t, ct, iID, "refund", nil)
+	require.Nil(t, err)
+	require.Equal(t, byzcoin.NewStateChange(byzcoin.Update, escrowRefund,
+		ContractCoinID, ciTwo, gdarc.GetBaseID()), sc[0])
+
+	ct.index = 0
+	ct.timestamp = 1000
+	_, err = invokeEscrow(t, ct, iID, "refund", nil)
+	require.Nil(t, err)
+}
+
+func TestEscrow_Reveal(t *testing.T) {
+	ct := newEscrowCT()
+	preimage := []byte("secret")
+	h := sha256.Sum256(preimage)
+	iID := spawnEscrow(t, ct, byzcoin.Arguments{{Name: "hash", Value: h[:]}})
+
+	_, err := invokeEscrow(t, ct, iID, "reveal", byzcoin.Arguments{{Name: "preimage", Value: []byte("guess")}})
+	require.NotNil(t, err)
+
+	sc, err := invokeEscrow(t, ct, iID, "reveal", byzcoin.Arguments{{Name: "preimage", Value: preimage}})
+	require.Nil(t, err)
+	require.Equal(t, byzcoin.NewStateChange(byzcoin.Update, escrowRecipient,
+		ContractCoinID, ciTwo, gdarc.GetBaseID()), sc[0])
+
+	// The coins can only go to an account of the same type.
+	ci := byzcoin.Coin{Name: byzcoin.NewInstanceID([]byte("other"))}
+	ciBuf, err := protobuf.Encode(&ci)
+	require.Nil(t, err)
+	ct.Store(escrowRecipient, ciBuf, ContractCoinID, gdarc.GetBaseID())
+	_, err = invokeEscrow(t, ct, iID, "reveal", byzcoin.Arguments{{Name: "preimage", Value: preimage}})
+	require.NotNil(t, err)
+}
+
+func TestEscrow_RevealAfterDeadline(t *testing.T) {
+	ct := newEscrowCT()
+	preimage := []byte("secret")
+	h := sha256.Sum256(preimage)
+	height := make([]byte, 8)
+	binary.LittleEndian.PutUint64(height, 10)
+	iID := spawnEscrow(t, ct, byzcoin.Arguments{
+		{Name: "hash", Value: h[:]},
+		{Name: "height", Value: height},
+	})
+
+	// Once the coins can be refunded, the preimage is refused.
+	ct.index = 10
+	_, err := invokeEscrow(t, ct, iID, "reveal", byzcoin.Arguments{{Name: "preimage", Value: preimage}})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "refunded")
+	ct.index = 9
+	_, err = invokeEscrow(t, ct, iID, "reveal", byzcoin.Arguments{{Name: "preimage", Value: preimage}})
+	require.Nil(t, err)
+}
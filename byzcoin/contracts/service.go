@@ -28,5 +28,16 @@ func newService(c *onet.Context) (onet.Service, error) {
 	}
 	byzcoin.RegisterContract(c, ContractValueID, ContractValue)
 	byzcoin.RegisterContract(c, ContractCoinID, ContractCoin)
+	byzcoin.RegisterContractVersion(c, ContractCoinID, 1, ContractCoinV1)
+	byzcoin.RegisterQuery(c, ContractCoinID, QueryCoin)
+	byzcoin.RegisterFeeContract(c, ContractCoinID)
+	byzcoin.RegisterContract(c, ContractTokenID, ContractToken)
+	byzcoin.RegisterQuery(c, ContractTokenID, QueryToken)
+	byzcoin.RegisterContract(c, ContractEscrowID, ContractEscrow)
+	byzcoin.RegisterContract(c, ContractAssetID, ContractAsset)
+	byzcoin.RegisterContract(c, ContractWalletID, ContractWallet)
+	byzcoin.RegisterQuery(c, ContractWalletID, QueryWallet)
+	byzcoin.RegisterContract(c, ContractWasmID, ContractWasm)
+	byzcoin.RegisterContract(c, ContractWasmDataID, ContractWasmData)
 	return s, nil
 }
@@ -0,0 +1,189 @@
+package contracts
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/darc"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/protobuf"
+)
+
+// ContractTokenID denotes a contract that defines a type of coins.
+var ContractTokenID = "token"
+
+// Token is the value of a token instance. The InstanceID of the token is
+// the Name of its coins.
+type Token struct {
+	// Name is the human readable name of the token.
+	Name string
+	// Decimals is the number of decimals used to display an amount of
+	// coins.
+	Decimals uint32
+	// Cap is the maximum supply of coins, or 0 if there is no maximum.
+	Cap uint64
+	// Supply is the number of coins minted so far.
+	Supply uint64
+}
+
+// ContractToken defines a type of coins for ContractCoin. The coins are
+// minted by the token instance only, and the darc of the instance, called the
+// mint-darc, decides who can mint them. The spawn instruction takes the
+// following arguments:
+//  - name is the name of the token
+//  - decimals (optional) is the number of decimals, as a single byte
+//  - cap (optional) is the maximum supply, as a 64-bit uint in LittleEndian
+//  - darc (optional) is the ID of the mint-darc, which defaults to the darc
+//    of the spawning instance
+// The following method is available:
+//  - mint adds the number of coins in the argument "coins" to the coin
+//    instance given in the argument "destination", if the supply stays
+//    within the cap. The destination must hold coins of this token.
+// A token cannot be deleted, as coins of its type may exist. Tokens can only
+// be spawned once version 1 of ContractCoin is active, as version 0 lets
+// every account of any type mint coins.
+func ContractToken(cdb byzcoin.CollectionView, inst byzcoin.Instruction, c []byzcoin.Coin) (sc []byzcoin.StateChange, cOut []byzcoin.Coin, err error) {
+	cOut = c
+
+	err = inst.VerifyDarcSignature(cdb)
+	if err != nil {
+		return
+	}
+
+	var value []byte
+	var darcID darc.ID
+	value, _, darcID, err = cdb.GetValues(inst.InstanceID.Slice())
+	if err != nil {
+		return
+	}
+
+	var t Token
+	switch inst.GetType() {
+	case byzcoin.SpawnType:
+		var version int
+		version, err = byzcoin.GetContractVersion(cdb, ContractCoinID)
+		if err != nil {
+			return
+		}
+		if version < 1 {
+			return nil, nil, errors.New("tokens need version 1 of the coin contract")
+		}
+		args := inst.Spawn.Args
+		t.Name = string(args.Search("name"))
+		if t.Name == "" {
+			return nil, nil, errors.New("argument \"name\" is missing")
+		}
+		if d := args.Search("decimals"); d != nil {
+			if len(d) != 1 {
+				return nil, nil, errors.New("decimals needs to be a single byte")
+			}
+			t.Decimals = uint32(d[0])
+		}
+		if capBuf := args.Search("cap"); capBuf != nil {
+			if len(capBuf) != 8 {
+				return nil, nil, errors.New("cap needs to be a 64-bit uint")
+			}
+			t.Cap = binary.LittleEndian.Uint64(capBuf)
+		}
+		if mintDarc := args.Search("darc"); mintDarc != nil {
+			var cid string
+			_, cid, _, err = cdb.GetValues(mintDarc)
+			if err == nil && cid != byzcoin.ContractDarcID {
+				err = errors.New("mint-darc is not a darc")
+			}
+			if err != nil {
+				return
+			}
+			darcID = mintDarc
+		}
+		var tBuf []byte
+		tBuf, err = protobuf.Encode(&t)
+		if err != nil {
+			return nil, nil, errors.New("couldn't encode token: " + err.Error())
+		}
+		tID := inst.DeriveID("")
+		log.Lvlf3("Spawning token %s to %x", t.Name, tID.Slice())
+		sc = []byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Create, tID, ContractTokenID, tBuf, darcID),
+		}
+		return
+	case byzcoin.InvokeType:
+		err = protobuf.Decode(value, &t)
+		if err != nil {
+			return nil, nil, errors.New("couldn't unmarshal token: " + err.Error())
+		}
+		if inst.Invoke.Command != "mint" {
+			return nil, nil, errors.New("token contract can only mint")
+		}
+		coinsBuf := inst.Invoke.Args.Search("coins")
+		if len(coinsBuf) != 8 {
+			return nil, nil, errors.New("argument \"coins\" needs to be a 64-bit uint")
+		}
+		coins := binary.LittleEndian.Uint64(coinsBuf)
+		supply := byzcoin.Coin{Value: t.Supply}
+		if err = supply.SafeAdd(coins); err != nil {
+			return
+		}
+		if t.Cap > 0 && supply.Value > t.Cap {
+			return nil, nil, errors.New("minting would exceed the cap of the token")
+		}
+		t.Supply = supply.Value
+
+		var destSc byzcoin.StateChange
+		destSc, err = creditCoin(cdb, byzcoin.NewInstanceID(inst.Invoke.Args.Search("destination")),
+			byzcoin.Coin{Name: inst.InstanceID, Value: coins})
+		if err != nil {
+			return
+		}
+		var tBuf []byte
+		tBuf, err = protobuf.Encode(&t)
+		if err != nil {
+			return nil, nil, errors.New("couldn't encode token: " + err.Error())
+		}
+		log.Lvlf2("minting %d %s", coins, t.Name)
+		sc = []byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID, ContractTokenID, tBuf, darcID),
+			destSc,
+		}
+		return
+	}
+	err = errors.New("instruction type not allowed")
+	return
+}
+
+// QueryToken answers the following read-only queries on a token instance:
+//  - name returns the name of the token
+//  - decimals returns the number of decimals as a single byte
+//  - cap returns the maximum supply as a 64-bit uint in LittleEndian, 0
+//    meaning no maximum
+//  - supply returns the number of minted coins as a 64-bit uint in
+//    LittleEndian
+func QueryToken(cdb byzcoin.CollectionView, iID byzcoin.InstanceID, name string, args byzcoin.Arguments) ([]byte, error) {
+	value, cid, _, err := cdb.GetValues(iID.Slice())
+	if err != nil {
+		return nil, err
+	}
+	if cid != ContractTokenID {
+		return nil, errors.New("instance is not a token")
+	}
+	var t Token
+	if err = protobuf.Decode(value, &t); err != nil {
+		return nil, errors.New("couldn't unmarshal token: " + err.Error())
+	}
+	buf := make([]byte, 8)
+	switch name {
+	case "name":
+		return []byte(t.Name), nil
+	case "decimals":
+		return []byte{byte(t.Decimals)}, nil
+	case "cap":
+		binary.LittleEndian.PutUint64(buf, t.Cap)
+		return buf, nil
+	case "supply":
+		binary.LittleEndian.PutUint64(buf, t.Supply)
+		return buf, nil
+	default:
+		return nil, errors.New("unknown query: " + name)
+	}
+}
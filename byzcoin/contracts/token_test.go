@@ -0,0 +1,195 @@
+package contracts
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToken_Spawn(t *testing.T) {
+	ct := newCT("spawn:token")
+	config := &byzcoin.ChainConfig{}
+	storeConfig := func() {
+		buf, err := protobuf.Encode(config)
+		require.Nil(t, err)
+		ct.Store(byzcoin.ConfigInstanceID, buf, byzcoin.ContractConfigID, gdarc.GetBaseID())
+	}
+	storeConfig()
+	capBuf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(capBuf, 10)
+	inst := byzcoin.Instruction{
+		InstanceID: byzcoin.NewInstanceID(gdarc.GetBaseID()),
+		Spawn: &byzcoin.Spawn{
+			ContractID: ContractTokenID,
+			Args: byzcoin.Arguments{
+				{Name: "name", Value: []byte("dedis")},
+				{Name: "decimals", Value: []byte{2}},
+				{Name: "cap", Value: capBuf},
+			},
+		},
+	}
+	require.Nil(t, inst.SignBy(gdarc.GetBaseID(), gsigner))
+
+	// Tokens are refused until version 1 of the coin contract is active.
+	_, _, err := ContractToken(ct, inst, nil)
+	require.NotNil(t, err)
+	config.ContractVersions = []byzcoin.ContractVersion{
+		{ContractID: ContractCoinID, Version: 1, Height: 2}}
+	storeConfig()
+	ct.index = 1
+	_, _, err = ContractToken(ct, inst, nil)
+	require.NotNil(t, err)
+	ct.index = 2
+
+	sc, _, err := ContractToken(ct, inst, nil)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(sc))
+	tBuf, err := protobuf.Encode(&Token{Name: "dedis", Decimals: 2, Cap: 10})
+	require.Nil(t, err)
+	require.Equal(t, byzcoin.NewStateChange(byzcoin.Create, inst.DeriveID(""),
+		ContractTokenID, tBuf, gdarc.GetBaseID()), sc[0])
+
+	// The mint-darc must be a darc.
+	inst.Spawn.Args = append(inst.Spawn.Args, byzcoin.Argument{Name: "darc", Value: []byte("nodarc")})
+	require.Nil(t, inst.SignBy(gdarc.GetBaseID(), gsigner))
+	_, _, err = ContractToken(ct, inst, nil)
+	require.NotNil(t, err)
+}
+
+func TestToken_Mint(t *testing.T) {
+	ct := newCT("invoke:mint", "spawn:coin")
+	tID := byzcoin.NewInstanceID([]byte("token"))
+	tBuf, err := protobuf.Encode(&Token{Name: "dedis", Cap: 2})
+	require.Nil(t, err)
+	ct.Store(tID, tBuf, ContractTokenID, gdarc.GetBaseID())
+
+	// Accounts of the token are spawned with its InstanceID as type.
+	inst := byzcoin.Instruction{
+		InstanceID: byzcoin.NewInstanceID(gdarc.GetBaseID()),
+		Spawn: &byzcoin.Spawn{
+			ContractID: ContractCoinID,
+			Args:       byzcoin.Arguments{{Name: "type", Value: tID.Slice()}},
+		},
+	}
+	require.Nil(t, inst.SignBy(gdarc.GetBaseID(), gsigner))
+	sc, _, err := ContractCoinV1(ct, inst, nil)
+	require.Nil(t, err)
+	coAddr := byzcoin.NewInstanceID(sc[0].InstanceID)
+	ct.Store(coAddr, sc[0].Value, ContractCoinID, gdarc.GetBaseID())
+
+	// Only tokens can be used as type, but version 0 of the contract
+	// still accepts any type.
+	inst.Spawn.Args = byzcoin.Arguments{{Name: "type", Value: gdarc.GetBaseID()}}
+	require.Nil(t, inst.SignBy(gdarc.GetBaseID(), gsigner))
+	_, _, err = ContractCoinV1(ct, inst, nil)
+	require.NotNil(t, err)
+	_, _, err = ContractCoin(ct, inst, nil)
+	require.Nil(t, err)
+
+	mint := func(coins []byte) ([]byzcoin.StateChange, error) {
+		inst := byzcoin.Instruction{
+			InstanceID: tID,
+			Invoke: &byzcoin.Invoke{
+				Command: "mint",
+				Args: byzcoin.Arguments{
+					{Name: "coins", Value: coins},
+					{Name: "destination", Value: coAddr.Slice()},
+				},
+			},
+		}
+		require.Nil(t, inst.SignBy(gdarc.GetBaseID(), gsigner))
+		sc, _, err := ContractToken(ct, inst, nil)
+		return sc, err
+	}
+	sc, err = mint(coinTwo)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(sc))
+	var tok Token
+	require.Nil(t, protobuf.Decode(sc[0].Value, &tok))
+	require.Equal(t, uint64(2), tok.Supply)
+	var ci byzcoin.Coin
+	require.Nil(t, protobuf.Decode(sc[1].Value, &ci))
+	require.True(t, ci.Name.Equal(tID))
+	require.Equal(t, uint64(2), ci.Value)
+	ct.Store(tID, sc[0].Value, ContractTokenID, gdarc.GetBaseID())
+	ct.Store(coAddr, sc[1].Value, ContractCoinID, gdarc.GetBaseID())
+
+	// The cap is reached.
+	_, err = mint(coinOne)
+	require.NotNil(t, err)
+
+	// The account cannot mint the coins of the token itself.
+	inst = byzcoin.Instruction{
+		InstanceID: coAddr,
+		Invoke: &byzcoin.Invoke{
+			Command: "mint",
+			Args:    byzcoin.Arguments{{Name: "coins", Value: coinOne}},
+		},
+	}
+	require.Nil(t, inst.SignBy(gdarc.GetBaseID(), gsigner))
+	_, _, err = ContractCoinV1(ct, inst, nil)
+	require.NotNil(t, err)
+	_, _, err = ContractCoin(ct, inst, nil)
+	require.Nil(t, err)
+
+	supply, err := QueryToken(ct, tID, "supply", nil)
+	require.Nil(t, err)
+	require.Equal(t, coinTwo, supply)
+}
+
+func TestToken_Transfer(t *testing.T) {
+	ct := newCT("invoke:transfer")
+	tID := byzcoin.NewInstanceID([]byte("token"))
+	tBuf, err := protobuf.Encode(&Token{Name: "dedis", Cap: 2})
+	require.Nil(t, err)
+	ct.Store(tID, tBuf, ContractTokenID, gdarc.GetBaseID())
+
+	tokenBuf := func(value uint64) []byte {
+		buf, err := protobuf.Encode(&byzcoin.Coin{Name: tID, Value: value})
+		require.Nil(t, err)
+		return buf
+	}
+	cheap := byzcoin.NewInstanceID([]byte("cheap"))
+	capped1 := byzcoin.NewInstanceID([]byte("capped1"))
+	capped2 := byzcoin.NewInstanceID([]byte("capped2"))
+	ct.Store(cheap, ciTwo, ContractCoinID, gdarc.GetBaseID())
+	ct.Store(capped1, tokenBuf(2), ContractCoinID, gdarc.GetBaseID())
+	ct.Store(capped2, tokenBuf(0), ContractCoinID, gdarc.GetBaseID())
+
+	transfer := func(from, to byzcoin.InstanceID) byzcoin.Instruction {
+		inst := byzcoin.Instruction{
+			InstanceID: from,
+			Invoke: &byzcoin.Invoke{
+				Command: "transfer",
+				Args: byzcoin.Arguments{
+					{Name: "coins", Value: coinOne},
+					{Name: "destination", Value: to.Slice()},
+				},
+			},
+		}
+		require.Nil(t, inst.SignBy(gdarc.GetBaseID(), gsigner))
+		return inst
+	}
+
+	// Default coins cannot be sent to an account of the token, which
+	// would bypass its cap.
+	_, _, err = ContractCoinV1(ct, transfer(cheap, capped2), nil)
+	require.NotNil(t, err)
+	_, _, err = ContractCoinV1(ct, transfer(capped1, cheap), nil)
+	require.NotNil(t, err)
+
+	// A transfer to the same account would destroy the coins.
+	_, _, err = ContractCoinV1(ct, transfer(capped1, capped1), nil)
+	require.NotNil(t, err)
+
+	sc, _, err := ContractCoinV1(ct, transfer(capped1, capped2), nil)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(sc))
+	require.Equal(t, byzcoin.NewStateChange(byzcoin.Update, capped2, ContractCoinID,
+		tokenBuf(1), gdarc.GetBaseID()), sc[0])
+	require.Equal(t, byzcoin.NewStateChange(byzcoin.Update, capped1, ContractCoinID,
+		tokenBuf(1), gdarc.GetBaseID()), sc[1])
+}
@@ -0,0 +1,366 @@
+package contracts
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/darc"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/protobuf"
+)
+
+// ContractWalletID denotes a contract holding coins that are spent by
+// several owners together.
+var ContractWalletID = "wallet"
+
+// Wallet is the value of a wallet instance.
+type Wallet struct {
+	// Coin holds the coins of the wallet.
+	Coin byzcoin.Coin
+	// Owners are the identities, in their string representation, that
+	// approve the proposals.
+	Owners []string
+	// Threshold is the number of approvals needed to execute a proposal.
+	Threshold uint32
+	// NextID is the ID of the next proposal.
+	NextID uint64
+	// Proposals are the pending proposals.
+	Proposals []Proposal
+}
+
+// Proposal is a pending transfer of coins from a wallet.
+type Proposal struct {
+	// ID of the proposal in the wallet.
+	ID uint64
+	// Destination is the coin instance receiving the coins.
+	Destination byzcoin.InstanceID
+	// Coins is the number of coins to transfer.
+	Coins uint64
+	// Expiry is the index of the block from which on the proposal is
+	// expired, or 0 if it does not expire.
+	Expiry uint64
+	// Approvals are the owners that approved the proposal.
+	Approvals []string
+}
+
+// Proposals is the answer to the "proposals" query of a wallet.
+type Proposals struct {
+	List []Proposal
+}
+
+// ContractWallet is a multi-signature wallet: a transfer of coins is first
+// proposed, then approved by the owners of the wallet over as many
+// transactions as needed, and executed as soon as it has enough approvals.
+// The approvals are given by the identities signing the instructions, so
+// the darc of the wallet should allow every owner to propose and approve.
+// The spawn instruction deposits the given coins and takes the following
+// arguments:
+//  - owners is the comma-separated list of the distinct identities of the
+//    owners, in the format of darc.Identity.String
+//  - threshold is the number of approvals needed, as a 64-bit uint in
+//    LittleEndian
+//  - type (optional) is the type of the coins, which is CoinName, the
+//    default, or the ID of a token instance
+// The following methods are available:
+//  - deposit adds the coins given to the instruction to the wallet
+//  - propose creates a proposal to transfer the number of coins in the
+//    argument "coins" to the coin instance given in "destination", which
+//    expires at the block index given in the optional argument "expiry". The
+//    proposal is approved by its signers, and gets the NextID of the wallet.
+//  - approve adds the signers to the approvals of the proposal given in the
+//    argument "id"
+// The numbers are 64-bit uints in LittleEndian. Expired proposals are
+// removed whenever the wallet is invoked. A wallet can only be deleted once
+// it is empty.
+func ContractWallet(cdb byzcoin.CollectionView, inst byzcoin.Instruction, c []byzcoin.Coin) (sc []byzcoin.StateChange, cOut []byzcoin.Coin, err error) {
+	cOut = c
+
+	err = inst.VerifyDarcSignature(cdb)
+	if err != nil {
+		return
+	}
+
+	var value []byte
+	var darcID darc.ID
+	value, _, darcID, err = cdb.GetValues(inst.InstanceID.Slice())
+	if err != nil {
+		return
+	}
+
+	var w Wallet
+	switch inst.GetType() {
+	case byzcoin.SpawnType:
+		args := inst.Spawn.Args
+		w.Coin.Name = CoinName
+		if t := args.Search("type"); t != nil {
+			if len(t) != len(byzcoin.InstanceID{}) {
+				return nil, nil, errors.New("type needs to be an InstanceID")
+			}
+			// Like coin accounts, a wallet only holds the default coins or
+			// the coins of a token.
+			if !CoinName.Equal(byzcoin.NewInstanceID(t)) {
+				if err = checkTokenType(cdb, t); err != nil {
+					return
+				}
+			}
+			w.Coin.Name = byzcoin.NewInstanceID(t)
+		}
+		if owners := string(args.Search("owners")); owners != "" {
+			for _, o := range strings.Split(owners, ",") {
+				var id darc.Identity
+				id, err = darc.ParseIdentity(o)
+				if err != nil {
+					return nil, nil, errors.New("invalid owner " + o + ": " + err.Error())
+				}
+				// The owners are compared with the signers of the
+				// approvals, so they are stored as Identity.String
+				// returns them.
+				owner := id.String()
+				if containsString(w.Owners, owner) {
+					return nil, nil, errors.New("owner " + owner + " is given twice")
+				}
+				w.Owners = append(w.Owners, owner)
+			}
+		}
+		threshold := args.Search("threshold")
+		if len(threshold) != 8 {
+			return nil, nil, errors.New("threshold needs to be a 64-bit uint")
+		}
+		t := binary.LittleEndian.Uint64(threshold)
+		if t == 0 || t > uint64(len(w.Owners)) {
+			return nil, nil, errors.New("threshold needs to be between 1 and the number of owners")
+		}
+		w.Threshold = uint32(t)
+		if cOut, err = w.deposit(c); err != nil {
+			return
+		}
+		var wBuf []byte
+		wBuf, err = protobuf.Encode(&w)
+		if err != nil {
+			return nil, nil, errors.New("couldn't encode wallet: " + err.Error())
+		}
+		sc = []byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Create, inst.DeriveID(""), ContractWalletID, wBuf, darcID),
+		}
+		return
+	case byzcoin.InvokeType:
+		err = protobuf.Decode(value, &w)
+		if err != nil {
+			return nil, nil, errors.New("couldn't unmarshal wallet: " + err.Error())
+		}
+		var index int
+		index, _, err = byzcoin.GetBlockInfo(cdb)
+		if err != nil {
+			return
+		}
+		w.removeExpired(uint64(index))
+
+		var p *Proposal
+		switch inst.Invoke.Command {
+		case "deposit":
+			if cOut, err = w.deposit(c); err != nil {
+				return
+			}
+		case "propose":
+			p, err = w.propose(inst.Invoke.Args, uint64(index))
+			if err != nil {
+				return
+			}
+		case "approve":
+			idBuf := inst.Invoke.Args.Search("id")
+			if len(idBuf) != 8 {
+				return nil, nil, errors.New("id needs to be a 64-bit uint")
+			}
+			p = w.proposal(binary.LittleEndian.Uint64(idBuf))
+			if p == nil {
+				return nil, nil, errors.New("unknown or expired proposal")
+			}
+		default:
+			return nil, nil, errors.New("wallet contract can only deposit, propose or approve")
+		}
+
+		if p != nil {
+			if err = w.approve(p, inst.Signatures); err != nil {
+				return
+			}
+			if len(p.Approvals) >= int(w.Threshold) {
+				var destSc byzcoin.StateChange
+				destSc, err = w.execute(cdb, *p)
+				if err != nil {
+					return
+				}
+				sc = append(sc, destSc)
+			}
+		}
+
+		var wBuf []byte
+		wBuf, err = protobuf.Encode(&w)
+		if err != nil {
+			return nil, nil, errors.New("couldn't encode wallet: " + err.Error())
+		}
+		sc = append(sc, byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID,
+			ContractWalletID, wBuf, darcID))
+		return
+	case byzcoin.DeleteType:
+		err = protobuf.Decode(value, &w)
+		if err != nil {
+			return nil, nil, errors.New("couldn't unmarshal wallet: " + err.Error())
+		}
+		if w.Coin.Value > 0 {
+			return nil, nil, errors.New("cannot delete a wallet that still has coins in it")
+		}
+		sc = []byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Remove, inst.InstanceID, ContractWalletID, nil, darcID),
+		}
+		return
+	}
+	err = errors.New("instruction type not allowed")
+	return
+}
+
+// deposit adds the coins of the type of the wallet to it and returns the
+// other coins.
+func (w *Wallet) deposit(c []byzcoin.Coin) (cOut []byzcoin.Coin, err error) {
+	cOut = []byzcoin.Coin{}
+	for _, co := range c {
+		if w.Coin.Name.Equal(co.Name) {
+			if err = w.Coin.SafeAdd(co.Value); err != nil {
+				return
+			}
+		} else {
+			cOut = append(cOut, co)
+		}
+	}
+	return
+}
+
+// removeExpired removes the proposals that are expired at the given block
+// index.
+func (w *Wallet) removeExpired(index uint64) {
+	var pending []Proposal
+	for _, p := range w.Proposals {
+		if p.Expiry == 0 || index < p.Expiry {
+			pending = append(pending, p)
+		}
+	}
+	w.Proposals = pending
+}
+
+// propose adds a new proposal from the arguments of the instruction.
+func (w *Wallet) propose(args byzcoin.Arguments, index uint64) (*Proposal, error) {
+	dest := args.Search("destination")
+	if len(dest) != len(byzcoin.InstanceID{}) {
+		return nil, errors.New("destination needs to be an InstanceID")
+	}
+	coins := args.Search("coins")
+	if len(coins) != 8 {
+		return nil, errors.New("coins needs to be a 64-bit uint")
+	}
+	p := Proposal{
+		ID:          w.NextID,
+		Destination: byzcoin.NewInstanceID(dest),
+		Coins:       binary.LittleEndian.Uint64(coins),
+	}
+	if expiry := args.Search("expiry"); expiry != nil {
+		if len(expiry) != 8 {
+			return nil, errors.New("expiry needs to be a 64-bit uint")
+		}
+		p.Expiry = binary.LittleEndian.Uint64(expiry)
+		if p.Expiry <= index {
+			return nil, errors.New("the proposal is already expired")
+		}
+	}
+	w.NextID++
+	w.Proposals = append(w.Proposals, p)
+	return &w.Proposals[len(w.Proposals)-1], nil
+}
+
+// proposal returns the pending proposal with the given ID, or nil.
+func (w *Wallet) proposal(id uint64) *Proposal {
+	for i := range w.Proposals {
+		if w.Proposals[i].ID == id {
+			return &w.Proposals[i]
+		}
+	}
+	return nil
+}
+
+// approve adds the owners among the signers to the approvals of p. The
+// signatures have already been verified by the darc of the wallet.
+func (w *Wallet) approve(p *Proposal, sigs []darc.Signature) error {
+	var approved bool
+	for _, sig := range sigs {
+		signer := sig.Signer.String()
+		if !containsString(w.Owners, signer) {
+			continue
+		}
+		approved = true
+		if !containsString(p.Approvals, signer) {
+			p.Approvals = append(p.Approvals, signer)
+		}
+	}
+	if !approved {
+		return errors.New("none of the signers is an owner of the wallet")
+	}
+	return nil
+}
+
+// execute transfers the coins of the proposal and removes it.
+func (w *Wallet) execute(cdb byzcoin.CollectionView, p Proposal) (byzcoin.StateChange, error) {
+	if err := w.Coin.SafeSub(p.Coins); err != nil {
+		return byzcoin.StateChange{}, err
+	}
+	sc, err := creditCoin(cdb, p.Destination, byzcoin.Coin{Name: w.Coin.Name, Value: p.Coins})
+	if err != nil {
+		return byzcoin.StateChange{}, err
+	}
+	log.Lvlf2("wallet transfers %d to %x", p.Coins, p.Destination.Slice())
+	var pending []Proposal
+	for _, o := range w.Proposals {
+		if o.ID != p.ID {
+			pending = append(pending, o)
+		}
+	}
+	w.Proposals = pending
+	return sc, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// QueryWallet answers the following read-only queries on a wallet instance:
+//  - balance returns the number of coins in the wallet as a 64-bit uint in
+//    LittleEndian
+//  - proposals returns the protobuf-encoded Proposals of the wallet,
+//    including expired proposals that have not been removed yet
+func QueryWallet(cdb byzcoin.CollectionView, iID byzcoin.InstanceID, name string, args byzcoin.Arguments) ([]byte, error) {
+	value, cid, _, err := cdb.GetValues(iID.Slice())
+	if err != nil {
+		return nil, err
+	}
+	if cid != ContractWalletID {
+		return nil, errors.New("instance is not a wallet")
+	}
+	var w Wallet
+	if err = protobuf.Decode(value, &w); err != nil {
+		return nil, errors.New("couldn't unmarshal wallet: " + err.Error())
+	}
+	switch name {
+	case "balance":
+		balance := make([]byte, 8)
+		binary.LittleEndian.PutUint64(balance, w.Coin.Value)
+		return balance, nil
+	case "proposals":
+		return protobuf.Encode(&Proposals{List: w.Proposals})
+	default:
+		return nil, errors.New("unknown query: " + name)
+	}
+}
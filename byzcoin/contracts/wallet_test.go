@@ -0,0 +1,169 @@
+package contracts
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/darc"
+	"github.com/dedis/cothority/byzcoin/darc/expression"
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWallet(t *testing.T) {
+	ct := newCT()
+	owners := []darc.Signer{darc.NewSignerEd25519(nil, nil),
+		darc.NewSignerEd25519(nil, nil), darc.NewSignerEd25519(nil, nil)}
+	var ownerIDs []string
+	for _, o := range owners {
+		ownerIDs = append(ownerIDs, o.Identity().String())
+	}
+	// Every owner can propose and approve, and so can the outsider, which
+	// is not an owner of the wallet.
+	outsider := darc.NewSignerEd25519(nil, nil)
+	anyOwner := expression.InitOrExpr(append(ownerIDs, outsider.Identity().String())...)
+	for _, r := range []string{"spawn:wallet", "invoke:deposit", "invoke:propose", "invoke:approve"} {
+		require.Nil(t, gdarc.Rules.AddRule(darc.Action(r), anyOwner))
+	}
+	dBuf, err := gdarc.ToProto()
+	require.Nil(t, err)
+	ct.Store(byzcoin.NewInstanceID(gdarc.GetBaseID()), dBuf, "darc", gdarc.GetBaseID())
+	dest := byzcoin.NewInstanceID([]byte("destination"))
+	ct.Store(dest, ciZero, ContractCoinID, gdarc.GetBaseID())
+
+	threshold := make([]byte, 8)
+	binary.LittleEndian.PutUint64(threshold, 2)
+	inst := byzcoin.Instruction{
+		InstanceID: byzcoin.NewInstanceID(gdarc.GetBaseID()),
+		Spawn: &byzcoin.Spawn{
+			ContractID: ContractWalletID,
+			Args: byzcoin.Arguments{
+				{Name: "owners", Value: []byte(strings.Join(ownerIDs, ","))},
+				{Name: "threshold", Value: threshold},
+			},
+		},
+	}
+	// The owners must be valid identities and appear only once.
+	for _, invalid := range []string{
+		strings.Join(append(ownerIDs, ownerIDs[1]), ","),
+		strings.Join(append(ownerIDs, "ed25519:invalid"), ","),
+		strings.Join(append(ownerIDs, ""), ","),
+	} {
+		inst.Spawn.Args[0].Value = []byte(invalid)
+		require.Nil(t, inst.SignBy(gdarc.GetBaseID(), owners[0]))
+		_, _, err = ContractWallet(ct, inst, []byzcoin.Coin{{Name: CoinName, Value: 2}})
+		require.NotNil(t, err)
+	}
+
+	inst.Spawn.Args[0].Value = []byte(strings.Join(ownerIDs, ","))
+	require.Nil(t, inst.SignBy(gdarc.GetBaseID(), owners[0]))
+	sc, co, err := ContractWallet(ct, inst, []byzcoin.Coin{{Name: CoinName, Value: 2}})
+	require.Nil(t, err)
+	require.Equal(t, 0, len(co))
+	require.Equal(t, 1, len(sc))
+	wID := inst.DeriveID("")
+	ct.Store(wID, sc[0].Value, ContractWalletID, gdarc.GetBaseID())
+
+	invoke := func(command string, args byzcoin.Arguments, signer darc.Signer) ([]byzcoin.StateChange, error) {
+		inst := byzcoin.Instruction{
+			InstanceID: wID,
+			Invoke:     &byzcoin.Invoke{Command: command, Args: args},
+		}
+		require.Nil(t, inst.SignBy(gdarc.GetBaseID(), signer))
+		sc, _, err := ContractWallet(ct, inst, nil)
+		if err == nil {
+			ct.Store(wID, sc[len(sc)-1].Value, ContractWalletID, gdarc.GetBaseID())
+		}
+		return sc, err
+	}
+	id := func(i uint64) byzcoin.Arguments {
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, i)
+		return byzcoin.Arguments{{Name: "id", Value: buf}}
+	}
+	expiry := make([]byte, 8)
+	binary.LittleEndian.PutUint64(expiry, 5)
+	propose := byzcoin.Arguments{
+		{Name: "destination", Value: dest.Slice()},
+		{Name: "coins", Value: coinOne},
+		{Name: "expiry", Value: expiry},
+	}
+
+	// The proposal is approved by its proposer only, so nothing moves.
+	sc, err = invoke("propose", propose, owners[0])
+	require.Nil(t, err)
+	require.Equal(t, 1, len(sc))
+	buf, err := QueryWallet(ct, wID, "proposals", nil)
+	require.Nil(t, err)
+	var ps Proposals
+	require.Nil(t, protobuf.Decode(buf, &ps))
+	require.Equal(t, 1, len(ps.List))
+	require.Equal(t, []string{ownerIDs[0]}, ps.List[0].Approvals)
+
+	// Approving twice doesn't count.
+	sc, err = invoke("approve", id(0), owners[0])
+	require.Nil(t, err)
+	require.Equal(t, 1, len(sc))
+
+	// The second approval executes the transfer.
+	sc, err = invoke("approve", id(0), owners[1])
+	require.Nil(t, err)
+	require.Equal(t, 2, len(sc))
+	require.Equal(t, byzcoin.NewStateChange(byzcoin.Update, dest,
+		ContractCoinID, ciOne, gdarc.GetBaseID()), sc[0])
+	balance, err := QueryWallet(ct, wID, "balance", nil)
+	require.Nil(t, err)
+	require.Equal(t, coinOne, balance)
+	_, err = invoke("approve", id(0), owners[2])
+	require.NotNil(t, err)
+
+	// An expired proposal cannot be approved anymore.
+	_, err = invoke("propose", propose, owners[0])
+	require.Nil(t, err)
+	ct.index = 5
+	_, err = invoke("approve", id(1), owners[1])
+	require.NotNil(t, err)
+	_, err = invoke("propose", propose, owners[0])
+	require.NotNil(t, err)
+
+	// Only owners approve, even if the darc lets others sign.
+	ct.index = 0
+	_, err = invoke("propose", propose[:2], outsider)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "none of the signers is an owner")
+	_, err = invoke("propose", propose[:2], owners[0])
+	require.Nil(t, err)
+	_, err = invoke("approve", id(2), outsider)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "none of the signers is an owner")
+}
+
+func TestWallet_Type(t *testing.T) {
+	ct := newCT("spawn:wallet")
+	threshold := make([]byte, 8)
+	binary.LittleEndian.PutUint64(threshold, 1)
+	spawn := func(typ []byte) error {
+		inst := byzcoin.Instruction{
+			InstanceID: byzcoin.NewInstanceID(gdarc.GetBaseID()),
+			Spawn: &byzcoin.Spawn{
+				ContractID: ContractWalletID,
+				Args: byzcoin.Arguments{
+					{Name: "owners", Value: []byte(gsigner.Identity().String())},
+					{Name: "threshold", Value: threshold},
+					{Name: "type", Value: typ},
+				},
+			},
+		}
+		require.Nil(t, inst.SignBy(gdarc.GetBaseID(), gsigner))
+		_, _, err := ContractWallet(ct, inst, nil)
+		return err
+	}
+
+	require.Nil(t, spawn(CoinName.Slice()))
+	tID := byzcoin.NewInstanceID([]byte("token"))
+	require.NotNil(t, spawn(tID.Slice()))
+	ct.Store(tID, []byte{}, ContractTokenID, gdarc.GetBaseID())
+	require.Nil(t, spawn(tID.Slice()))
+}
@@ -0,0 +1,435 @@
+package contracts
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/darc"
+	"github.com/dedis/protobuf"
+	"github.com/perlin-network/life/exec"
+)
+
+// The wasm contract lets clients deploy their own contracts without
+// shipping a new conode binary. The bytecode of a WebAssembly module is
+// spawned as an instance, and every invoke runs one of the exported
+// functions of the module in an interpreter. The interpreter is
+// deterministic: floating point instructions are refused, and the memory,
+// call stack and number of executed instructions are bounded.
+//
+// The module can import the following host functions from the "env"
+// module. Pointers and lengths refer to the memory of the module.
+//
+//  - arg(name_ptr, name_len, out_ptr, out_cap i32) i64 copies the argument
+//    with the given name to out and returns its length, or -1 if it is
+//    missing
+//  - get(key_ptr, key_len, out_ptr, out_cap i32) i64 copies the value stored
+//    under key by this instance and returns its length, or -1 if it is
+//    missing
+//  - set(key_ptr, key_len, val_ptr, val_len i32) stores the value under key
+//  - remove(key_ptr, key_len i32) removes the value stored under key
+//  - instance(id_ptr, out_ptr, out_cap i32) i64 copies the value of the
+//    instance with the 32-byte ID to out and returns its length, or -1 if
+//    it is missing
+//
+// Copies are truncated to the capacity of the output. If get or instance
+// cannot read the collection, for example because the instruction exceeded
+// the maximum number of reads, the module is trapped and the instruction is
+// refused. The exported function must take no parameters and return an
+// i64, which is 0 on success.
+//
+// Every key of the module is stored in its own instance, whose ID is the
+// hash of the ID of the wasm instance and the key. These instances belong
+// to the ContractWasmDataID contract and can only be changed through the
+// wasm instance. The keys themselves are listed in one more instance of
+// ContractWasmDataID, so that deleting the wasm instance also removes all
+// its values.
+
+// ContractWasmID denotes a contract holding the bytecode of a WebAssembly
+// module.
+var ContractWasmID = "wasm"
+
+// ContractWasmDataID denotes the instances holding the values stored by
+// wasm instances.
+var ContractWasmDataID = "wasmdata"
+
+// wasmGasLimit is the maximum number of instructions a call to a module may
+// execute.
+const wasmGasLimit = 10 * 1000 * 1000
+
+// wasmVMConfig is the configuration of the interpreter. The default memory
+// is only used if the module doesn't define it.
+var wasmVMConfig = exec.VMConfig{
+	DefaultMemoryPages:   16,
+	DefaultTableSize:     1024,
+	MaxMemoryPages:       256,
+	MaxTableSize:         1024,
+	MaxValueSlots:        4096,
+	MaxCallStackDepth:    256,
+	DisableFloatingPoint: true,
+	GasLimit:             wasmGasLimit,
+}
+
+// wasmGasPolicy charges one unit of gas per executed instruction.
+var wasmGasPolicy = &exec.SimpleGasPolicy{GasPerInstruction: 1}
+
+// WasmDataID returns the instance ID holding the value stored under key by
+// the wasm instance iID.
+func WasmDataID(iID byzcoin.InstanceID, key []byte) byzcoin.InstanceID {
+	h := sha256.New()
+	h.Write(iID.Slice())
+	h.Write(key)
+	return byzcoin.NewInstanceID(h.Sum(nil))
+}
+
+// wasmKeys lists the keys under which a wasm instance stores values, in
+// the order they have been created.
+type wasmKeys struct {
+	Keys [][]byte
+}
+
+// wasmKeysID returns the instance ID holding the keys of the wasm instance
+// iID.
+func wasmKeysID(iID byzcoin.InstanceID) byzcoin.InstanceID {
+	h := sha256.New()
+	h.Write([]byte("wasmkeys"))
+	h.Write(iID.Slice())
+	return byzcoin.NewInstanceID(h.Sum(nil))
+}
+
+// loadWasmKeys returns the keys of the wasm instance iID and whether they
+// are stored.
+func loadWasmKeys(cdb byzcoin.CollectionView, iID byzcoin.InstanceID) (wk wasmKeys, exists bool, err error) {
+	v, cid, _, err := cdb.GetValues(wasmKeysID(iID).Slice())
+	if err == byzcoin.ErrKeyNotSet || err == nil && v == nil {
+		return wk, false, nil
+	}
+	if err != nil {
+		return wk, false, err
+	}
+	if cid != ContractWasmDataID {
+		return wk, false, errors.New("keys of wasm instance collide with another instance")
+	}
+	if err = protobuf.Decode(v, &wk); err != nil {
+		return wk, false, err
+	}
+	return wk, true, nil
+}
+
+// ContractWasm deploys and runs WebAssembly modules.
+//  - spawn stores the module given in the argument "code". The module is
+//    compiled, so that invalid modules are refused.
+//  - invoke runs the exported function with the name of the command. The
+//    arguments of the instruction are available through the arg host
+//    function.
+//  - delete removes the module and all the values it stored.
+func ContractWasm(cdb byzcoin.CollectionView, inst byzcoin.Instruction, c []byzcoin.Coin) (sc []byzcoin.StateChange, cOut []byzcoin.Coin, err error) {
+	cOut = c
+
+	err = inst.VerifyDarcSignature(cdb)
+	if err != nil {
+		return
+	}
+
+	var code []byte
+	var darcID darc.ID
+	code, _, darcID, err = cdb.GetValues(inst.InstanceID.Slice())
+	if err != nil {
+		return
+	}
+
+	switch inst.GetType() {
+	case byzcoin.SpawnType:
+		code = inst.Spawn.Args.Search("code")
+		if code == nil {
+			return nil, nil, errors.New("argument \"code\" is missing")
+		}
+		if _, err = newWasmVM(code, &wasmHost{}); err != nil {
+			return nil, nil, err
+		}
+		sc = []byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Create, inst.DeriveID(""),
+				ContractWasmID, code, darcID),
+		}
+		return
+	case byzcoin.InvokeType:
+		host := &wasmHost{
+			cdb:    cdb,
+			iID:    inst.InstanceID,
+			darcID: darcID,
+			args:   inst.Invoke.Args,
+			values: make(map[string][]byte),
+		}
+		sc, err = host.run(code, inst.Invoke.Command)
+		return
+	case byzcoin.DeleteType:
+		var wk wasmKeys
+		var exists bool
+		wk, exists, err = loadWasmKeys(cdb, inst.InstanceID)
+		if err != nil {
+			return
+		}
+		for _, k := range wk.Keys {
+			sc = append(sc, byzcoin.NewStateChange(byzcoin.Remove,
+				WasmDataID(inst.InstanceID, k), ContractWasmDataID, nil, darcID))
+		}
+		if exists {
+			sc = append(sc, byzcoin.NewStateChange(byzcoin.Remove,
+				wasmKeysID(inst.InstanceID), ContractWasmDataID, nil, darcID))
+		}
+		sc = append(sc, byzcoin.NewStateChange(byzcoin.Remove, inst.InstanceID,
+			ContractWasmID, nil, darcID))
+		return
+	}
+	return nil, nil, errors.New("didn't find any instruction")
+}
+
+// ContractWasmData refuses all instructions, as the values of a wasm
+// instance can only be changed by its module.
+func ContractWasmData(cdb byzcoin.CollectionView, inst byzcoin.Instruction, c []byzcoin.Coin) (sc []byzcoin.StateChange, cOut []byzcoin.Coin, err error) {
+	return nil, nil, errors.New("values of wasm instances can only be changed by their module")
+}
+
+// wasmHost holds the state of one call to a module and resolves the
+// imports of the module to the host functions.
+type wasmHost struct {
+	cdb    byzcoin.CollectionView
+	iID    byzcoin.InstanceID
+	darcID darc.ID
+	args   byzcoin.Arguments
+	// values holds the values set or removed during the call, removed
+	// values being nil, so that the module reads its own writes.
+	values map[string][]byte
+	// keys holds the keys of values in the order they have been first
+	// written, so that the state changes are deterministic.
+	keys []string
+}
+
+// newWasmVM compiles the module and resolves its imports to the host
+// functions of h.
+func newWasmVM(code []byte, h *wasmHost) (vm *exec.VirtualMachine, err error) {
+	// Unknown imports make the resolver panic.
+	defer func() {
+		if re := recover(); re != nil {
+			vm = nil
+			err = fmt.Errorf("invalid module: %v", re)
+		}
+	}()
+	vm, err = exec.NewVirtualMachine(code, wasmVMConfig, h, wasmGasPolicy)
+	if err != nil {
+		return nil, errors.New("invalid module: " + err.Error())
+	}
+	return vm, nil
+}
+
+// run calls the exported function of the module and returns the state
+// changes of the values it stored.
+func (h *wasmHost) run(code []byte, function string) ([]byzcoin.StateChange, error) {
+	vm, err := newWasmVM(code, h)
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := vm.GetFunctionExport(function)
+	if !ok {
+		return nil, fmt.Errorf("module doesn't export function \"%s\"", function)
+	}
+	// Panics in the host functions are returned as errors by Run.
+	ret, err := vm.Run(entry)
+	if err != nil {
+		return nil, errors.New("module failed: " + err.Error())
+	}
+	if ret != 0 {
+		return nil, fmt.Errorf("module returned error code %d", ret)
+	}
+	return h.stateChanges()
+}
+
+// stateChanges returns the state changes of all values set or removed
+// during the call, and of the list of keys if it changed.
+func (h *wasmHost) stateChanges() ([]byzcoin.StateChange, error) {
+	var sc []byzcoin.StateChange
+	created := make(map[string]bool)
+	removed := make(map[string]bool)
+	for _, k := range h.keys {
+		id := WasmDataID(h.iID, []byte(k))
+		exists, err := h.stored(id)
+		if err != nil {
+			return nil, err
+		}
+		v := h.values[k]
+		switch {
+		case v == nil && exists:
+			sc = append(sc, byzcoin.NewStateChange(byzcoin.Remove, id,
+				ContractWasmDataID, nil, h.darcID))
+			removed[k] = true
+		case v != nil && exists:
+			sc = append(sc, byzcoin.NewStateChange(byzcoin.Update, id,
+				ContractWasmDataID, v, h.darcID))
+		case v != nil:
+			sc = append(sc, byzcoin.NewStateChange(byzcoin.Create, id,
+				ContractWasmDataID, v, h.darcID))
+			created[k] = true
+		}
+	}
+	if len(created) == 0 && len(removed) == 0 {
+		return sc, nil
+	}
+
+	wk, exists, err := loadWasmKeys(h.cdb, h.iID)
+	if err != nil {
+		return nil, err
+	}
+	var keys [][]byte
+	for _, k := range wk.Keys {
+		if !removed[string(k)] {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range h.keys {
+		if created[k] {
+			keys = append(keys, []byte(k))
+		}
+	}
+	id := wasmKeysID(h.iID)
+	if len(keys) == 0 {
+		if exists {
+			sc = append(sc, byzcoin.NewStateChange(byzcoin.Remove, id,
+				ContractWasmDataID, nil, h.darcID))
+		}
+		return sc, nil
+	}
+	buf, err := protobuf.Encode(&wasmKeys{Keys: keys})
+	if err != nil {
+		return nil, err
+	}
+	action := byzcoin.Create
+	if exists {
+		action = byzcoin.Update
+	}
+	sc = append(sc, byzcoin.NewStateChange(action, id, ContractWasmDataID,
+		buf, h.darcID))
+	return sc, nil
+}
+
+// stored returns whether a value is stored in the instance with the
+// given ID.
+func (h *wasmHost) stored(id byzcoin.InstanceID) (bool, error) {
+	v, cid, _, err := h.cdb.GetValues(id.Slice())
+	if err == byzcoin.ErrKeyNotSet || err == nil && v == nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if cid != ContractWasmDataID {
+		return false, errors.New("value of wasm instance collides with another instance")
+	}
+	return true, nil
+}
+
+// ResolveFunc returns the host function imported by the module.
+func (h *wasmHost) ResolveFunc(module, field string) exec.FunctionImport {
+	if module != "env" {
+		panic("unknown import module: " + module)
+	}
+	switch field {
+	case "arg":
+		return h.arg
+	case "get":
+		return h.get
+	case "set":
+		return h.set
+	case "remove":
+		return h.remove
+	case "instance":
+		return h.instance
+	}
+	panic("unknown host function: " + field)
+}
+
+// ResolveGlobal refuses all imported globals.
+func (h *wasmHost) ResolveGlobal(module, field string) int64 {
+	panic("modules cannot import globals")
+}
+
+// memory returns the part of the memory of the module at ptr with length
+// l, or panics if it is out of bounds.
+func memory(vm *exec.VirtualMachine, ptr, l int64) []byte {
+	if ptr < 0 || l < 0 || ptr+l > int64(len(vm.Memory)) {
+		panic("memory access out of bounds")
+	}
+	return vm.Memory[ptr : ptr+l]
+}
+
+// output copies value to the memory given by the parameters at index i
+// and i+1 of the current frame and returns the length of the value, or -1
+// if the value is nil.
+func output(vm *exec.VirtualMachine, i int, value []byte) int64 {
+	p := vm.GetCurrentFrame().Locals
+	out := memory(vm, p[i], p[i+1])
+	if value == nil {
+		return -1
+	}
+	copy(out, value)
+	return int64(len(value))
+}
+
+func (h *wasmHost) arg(vm *exec.VirtualMachine) int64 {
+	p := vm.GetCurrentFrame().Locals
+	name := memory(vm, p[0], p[1])
+	return output(vm, 2, h.args.Search(string(name)))
+}
+
+func (h *wasmHost) get(vm *exec.VirtualMachine) int64 {
+	p := vm.GetCurrentFrame().Locals
+	key := string(memory(vm, p[0], p[1]))
+	if v, ok := h.values[key]; ok {
+		return output(vm, 2, v)
+	}
+	v, cid, _, err := h.cdb.GetValues(WasmDataID(h.iID, []byte(key)).Slice())
+	if err != nil && err != byzcoin.ErrKeyNotSet {
+		// The module is trapped, so that it cannot take a failed
+		// read, for example because of too many reads, for a missing
+		// value.
+		panic(err.Error())
+	}
+	if cid != ContractWasmDataID {
+		v = nil
+	}
+	return output(vm, 2, v)
+}
+
+func (h *wasmHost) set(vm *exec.VirtualMachine) int64 {
+	p := vm.GetCurrentFrame().Locals
+	key := string(memory(vm, p[0], p[1]))
+	value := append([]byte{}, memory(vm, p[2], p[3])...)
+	h.store(key, value)
+	return 0
+}
+
+func (h *wasmHost) remove(vm *exec.VirtualMachine) int64 {
+	p := vm.GetCurrentFrame().Locals
+	h.store(string(memory(vm, p[0], p[1])), nil)
+	return 0
+}
+
+func (h *wasmHost) instance(vm *exec.VirtualMachine) int64 {
+	p := vm.GetCurrentFrame().Locals
+	id := memory(vm, p[0], int64(len(byzcoin.InstanceID{})))
+	v, _, _, err := h.cdb.GetValues(id)
+	if err == byzcoin.ErrKeyNotSet {
+		v = nil
+	} else if err != nil {
+		panic(err.Error())
+	}
+	return output(vm, 1, v)
+}
+
+// store records the value of key, nil meaning it is removed.
+func (h *wasmHost) store(key string, value []byte) {
+	if _, ok := h.values[key]; !ok {
+		h.keys = append(h.keys, key)
+	}
+	h.values[key] = value
+}
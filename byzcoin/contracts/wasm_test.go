@@ -0,0 +1,168 @@
+package contracts
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/darc"
+	"github.com/stretchr/testify/require"
+)
+
+// wasmStore is a module importing env.set and exporting two functions:
+//  - store calls set("key", "value") and returns 0
+//  - fail returns 1
+var wasmStore = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	// type section: (i32, i32, i32, i32) -> () and () -> i64
+	0x01, 0x0c, 0x02, 0x60, 0x04, 0x7f, 0x7f, 0x7f, 0x7f, 0x00, 0x60, 0x00, 0x01, 0x7e,
+	// import section: env.set
+	0x02, 0x0b, 0x01, 0x03, 0x65, 0x6e, 0x76, 0x03, 0x73, 0x65, 0x74, 0x00, 0x00,
+	// function section
+	0x03, 0x03, 0x02, 0x01, 0x01,
+	// memory section: one page
+	0x05, 0x03, 0x01, 0x00, 0x01,
+	// export section: store and fail
+	0x07, 0x10, 0x02, 0x05, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x00, 0x01,
+	0x04, 0x66, 0x61, 0x69, 0x6c, 0x00, 0x02,
+	// code section
+	0x0a, 0x15, 0x02,
+	0x0e, 0x00, 0x41, 0x00, 0x41, 0x03, 0x41, 0x03, 0x41, 0x05, 0x10, 0x00, 0x42, 0x00, 0x0b,
+	0x04, 0x00, 0x42, 0x01, 0x0b,
+	// data section: "keyvalue" at 0
+	0x0b, 0x0e, 0x01, 0x00, 0x41, 0x00, 0x0b, 0x08,
+	0x6b, 0x65, 0x79, 0x76, 0x61, 0x6c, 0x75, 0x65,
+}
+
+func TestWasm_Spawn(t *testing.T) {
+	ct := newCT("spawn:wasm")
+	inst := byzcoin.Instruction{
+		InstanceID: byzcoin.NewInstanceID(gdarc.GetBaseID()),
+		Spawn: &byzcoin.Spawn{
+			ContractID: ContractWasmID,
+			Args:       byzcoin.Arguments{{Name: "code", Value: wasmStore}},
+		},
+	}
+	require.Nil(t, inst.SignBy(gdarc.GetBaseID(), gsigner))
+
+	sc, _, err := ContractWasm(ct, inst, nil)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(sc))
+	require.Equal(t, byzcoin.NewStateChange(byzcoin.Create, inst.DeriveID(""),
+		ContractWasmID, wasmStore, gdarc.GetBaseID()), sc[0])
+
+	// Invalid modules are refused.
+	inst.Spawn.Args = byzcoin.Arguments{{Name: "code", Value: []byte{1, 2, 3}}}
+	require.Nil(t, inst.SignBy(gdarc.GetBaseID(), gsigner))
+	_, _, err = ContractWasm(ct, inst, nil)
+	require.NotNil(t, err)
+}
+
+func TestWasm_Invoke(t *testing.T) {
+	ct := newCT("invoke:store", "invoke:fail", "invoke:missing")
+	iID := byzcoin.NewInstanceID([]byte("wasm"))
+	ct.Store(iID, wasmStore, ContractWasmID, gdarc.GetBaseID())
+
+	invoke := func(command string) ([]byzcoin.StateChange, error) {
+		inst := byzcoin.Instruction{
+			InstanceID: iID,
+			Invoke:     &byzcoin.Invoke{Command: command},
+		}
+		require.Nil(t, inst.SignBy(gdarc.GetBaseID(), gsigner))
+		sc, _, err := ContractWasm(ct, inst, nil)
+		return sc, err
+	}
+
+	sc, err := invoke("store")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(sc))
+	dataID := WasmDataID(iID, []byte("key"))
+	require.Equal(t, byzcoin.NewStateChange(byzcoin.Create, dataID,
+		ContractWasmDataID, []byte("value"), gdarc.GetBaseID()), sc[0])
+	// The new key is listed.
+	require.Equal(t, byzcoin.Create, sc[1].StateAction)
+	require.Equal(t, wasmKeysID(iID).Slice(), sc[1].InstanceID)
+
+	// Once the value exists, it is updated.
+	ct.Store(dataID, []byte("old"), ContractWasmDataID, gdarc.GetBaseID())
+	sc, err = invoke("store")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(sc))
+	require.Equal(t, byzcoin.Update, sc[0].StateAction)
+
+	_, err = invoke("fail")
+	require.NotNil(t, err)
+	_, err = invoke("missing")
+	require.NotNil(t, err)
+
+	// The values cannot be changed directly.
+	inst := byzcoin.Instruction{
+		InstanceID: dataID,
+		Invoke:     &byzcoin.Invoke{Command: "update"},
+	}
+	_, _, err = ContractWasmData(ct, inst, nil)
+	require.NotNil(t, err)
+}
+
+// failingCT fails the reads of the keys that are not stored, like a
+// collection refusing further reads.
+type failingCT struct {
+	*cvTest
+}
+
+func (ct failingCT) GetValues(key []byte) (value []byte, contractID string, darcID darc.ID, err error) {
+	if _, ok := ct.values[string(key)]; ok {
+		return ct.cvTest.GetValues(key)
+	}
+	return nil, "", nil, errors.New("too many reads")
+}
+
+func TestWasm_ReadError(t *testing.T) {
+	ct := newCT("invoke:store")
+	iID := byzcoin.NewInstanceID([]byte("wasm"))
+	ct.Store(iID, wasmStore, ContractWasmID, gdarc.GetBaseID())
+
+	// A failed read is not taken for a missing value.
+	inst := byzcoin.Instruction{
+		InstanceID: iID,
+		Invoke:     &byzcoin.Invoke{Command: "store"},
+	}
+	require.Nil(t, inst.SignBy(gdarc.GetBaseID(), gsigner))
+	_, _, err := ContractWasm(failingCT{ct}, inst, nil)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "too many reads")
+}
+
+func TestWasm_Delete(t *testing.T) {
+	ct := newCT("invoke:store", "delete")
+	iID := byzcoin.NewInstanceID([]byte("wasm"))
+	ct.Store(iID, wasmStore, ContractWasmID, gdarc.GetBaseID())
+
+	inst := byzcoin.Instruction{
+		InstanceID: iID,
+		Invoke:     &byzcoin.Invoke{Command: "store"},
+	}
+	require.Nil(t, inst.SignBy(gdarc.GetBaseID(), gsigner))
+	sc, _, err := ContractWasm(ct, inst, nil)
+	require.Nil(t, err)
+	for _, s := range sc {
+		ct.Store(byzcoin.NewInstanceID(s.InstanceID), s.Value,
+			string(s.ContractID), s.DarcID)
+	}
+
+	// Deleting the module removes its values and the list of its keys.
+	inst = byzcoin.Instruction{
+		InstanceID: iID,
+		Delete:     &byzcoin.Delete{},
+	}
+	require.Nil(t, inst.SignBy(gdarc.GetBaseID(), gsigner))
+	sc, _, err = ContractWasm(ct, inst, nil)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(sc))
+	for _, s := range sc {
+		require.Equal(t, byzcoin.Remove, s.StateAction)
+	}
+	require.Equal(t, WasmDataID(iID, []byte("key")).Slice(), sc[0].InstanceID)
+	require.Equal(t, wasmKeysID(iID).Slice(), sc[1].InstanceID)
+	require.Equal(t, iID.Slice(), sc[2].InstanceID)
+}
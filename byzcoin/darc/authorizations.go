@@ -0,0 +1,130 @@
+package darc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dedis/cothority/byzcoin/darc/expression"
+)
+
+// DefaultMaxDepth is the depth of delegations followed by Authorizations if
+// no other depth is given.
+const DefaultMaxDepth = 10
+
+// Authorizations returns the minimal combinations of identities that
+// satisfy the expression. The delegations to other darcs are replaced by
+// the combinations of the sign rule of the latest version of these darcs,
+// which are found with getDarc. Besides identities, the combinations hold
+// the conditions of the expressions, such as before:1546300800.
+//
+// Delegations that cannot be followed, because the darc is unknown, the
+// delegation is part of a cycle or it is deeper than maxDepth, are never
+// satisfied and reported in the warnings. If maxDepth is 0, DefaultMaxDepth
+// is used. Every darc is only fetched once, and its combinations are reused
+// when it is reached again at the same depth.
+func Authorizations(expr expression.Expr, getDarc GetDarc, maxDepth int) ([][]string, []string, error) {
+	return AuthorizationsLimit(expr, getDarc, maxDepth, expression.MaxComparisons)
+}
+
+// AuthorizationsLimit is like Authorizations, but fails once the
+// combinations of all the darcs needed more than maxComparisons comparisons
+// to be minimized.
+func AuthorizationsLimit(expr expression.Expr, getDarc GetDarc, maxDepth, maxComparisons int) ([][]string, []string, error) {
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxDepth
+	}
+	a := authorizations{
+		getDarc:  getDarc,
+		maxDepth: maxDepth,
+		left:     maxComparisons,
+		warned:   make(map[string]bool),
+		darcs:    make(map[string]*Darc),
+		cache:    make(map[string][][]string),
+	}
+	combinations, err := a.combinations(expr, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return combinations, a.warnings, nil
+}
+
+type authorizations struct {
+	getDarc  GetDarc
+	maxDepth int
+	warnings []string
+	warned   map[string]bool
+	// darcs holds the darcs fetched so far, nil if they are unknown.
+	darcs map[string]*Darc
+	// cache holds the combinations of the darcs by darc and remaining
+	// depth. The combinations that depend on a cycle are not cached, as
+	// they depend on the path to the darc.
+	cache map[string][][]string
+	// cycles counts the delegations cut because of a cycle.
+	cycles int
+	// left is the number of comparisons of combinations that can still be
+	// done.
+	left int
+}
+
+// combinations returns the combinations of expr, where path holds the
+// delegations that lead to expr.
+func (a *authorizations) combinations(expr expression.Expr, path []string) ([][]string, error) {
+	return expression.CombinationsLimit(expr, func(s string) ([][]string, error) {
+		if !strings.HasPrefix(s, "darc:") {
+			return [][]string{{s}}, nil
+		}
+		for _, p := range path {
+			if p == s {
+				a.warn(fmt.Sprintf("cycle: %s -> %s", strings.Join(path, " -> "), s))
+				a.cycles++
+				return nil, nil
+			}
+		}
+		if len(path) >= a.maxDepth {
+			a.warn(fmt.Sprintf("delegation deeper than %d: %s -> %s", a.maxDepth, strings.Join(path, " -> "), s))
+			return nil, nil
+		}
+		key := fmt.Sprintf("%s/%d", s, a.maxDepth-len(path))
+		if c, ok := a.cache[key]; ok {
+			return copyCombinations(c), nil
+		}
+		d, ok := a.darcs[s]
+		if !ok {
+			d = a.getDarc(s, true)
+			a.darcs[s] = d
+		}
+		if d == nil {
+			a.warn("darc not found: " + s)
+			return nil, nil
+		}
+		if !d.Rules.Contains(sign) {
+			a.warn("darc has no sign rule: " + s)
+			return nil, nil
+		}
+		cycles := a.cycles
+		next := append(append([]string{}, path...), s)
+		c, err := a.combinations(d.Rules.GetSignExpr(), next)
+		if err == nil && a.cycles == cycles {
+			a.cache[key] = copyCombinations(c)
+		}
+		return c, err
+	}, &a.left)
+}
+
+// copyCombinations returns a copy of c, as the combinations given to
+// expression.Combinations are sorted in place.
+func copyCombinations(c [][]string) [][]string {
+	cp := make([][]string, len(c))
+	for i := range c {
+		cp[i] = append([]string{}, c[i]...)
+	}
+	return cp
+}
+
+// warn adds the warning, unless it has already been given.
+func (a *authorizations) warn(w string) {
+	if !a.warned[w] {
+		a.warned[w] = true
+		a.warnings = append(a.warnings, w)
+	}
+}
@@ -0,0 +1,83 @@
+package darc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dedis/cothority/byzcoin/darc/expression"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorizations(t *testing.T) {
+	a := createDarc(1, "a").darc
+	b := createDarc(1, "b").darc
+	c := createDarc(1, "c").darc
+	require.Nil(t, a.Rules.UpdateSign(expression.Expr(b.GetIdentityString()+" | ed25519:aa")))
+	require.Nil(t, b.Rules.UpdateSign(expression.InitThresholdExpr(2, "ed25519:b1", "ed25519:b2", c.GetIdentityString())))
+	require.Nil(t, c.Rules.UpdateSign(expression.Expr(b.GetIdentityString())))
+	getDarc := DarcsToGetDarcs([]*Darc{a, b, c})
+	expr := expression.Expr(a.GetIdentityString() + " & ed25519:ee")
+
+	combinations, warnings, err := Authorizations(expr, getDarc, 0)
+	require.Nil(t, err)
+	require.Equal(t, [][]string{{"ed25519:aa", "ed25519:ee"},
+		{"ed25519:b1", "ed25519:b2", "ed25519:ee"}}, combinations)
+	require.Equal(t, 1, len(warnings))
+	require.True(t, strings.HasPrefix(warnings[0], "cycle: "))
+
+	// The combinations are the same as the evaluation of the expression.
+	require.Nil(t, EvalExpr(expr, getDarc, combinations[1]...))
+	require.NotNil(t, EvalExpr(expr, getDarc, combinations[1][1:]...))
+
+	combinations, warnings, err = Authorizations(expr, getDarc, 1)
+	require.Nil(t, err)
+	require.Equal(t, [][]string{{"ed25519:aa", "ed25519:ee"}}, combinations)
+	require.Equal(t, 1, len(warnings))
+	require.True(t, strings.HasPrefix(warnings[0], "delegation deeper than 1: "))
+
+	combinations, warnings, err = Authorizations(expression.Expr("darc:00 | before:10"), getDarc, 0)
+	require.Nil(t, err)
+	require.Equal(t, [][]string{{"before:10"}}, combinations)
+	require.Equal(t, []string{"darc not found: darc:00"}, warnings)
+
+	_, _, err = Authorizations(expression.Expr("ed25519:aa &"), getDarc, 0)
+	require.NotNil(t, err)
+}
+
+func TestAuthorizations_Diamond(t *testing.T) {
+	// Both darcs of a level delegate to both darcs of the next level, so
+	// there are 2^depth paths to the last level.
+	const depth = 8
+	var darcs []*Darc
+	levels := make([][]*Darc, depth)
+	for i := range levels {
+		levels[i] = []*Darc{createDarc(1, "l").darc, createDarc(1, "r").darc}
+		darcs = append(darcs, levels[i]...)
+	}
+	for i := 0; i < depth-1; i++ {
+		for _, d := range levels[i] {
+			require.Nil(t, d.Rules.UpdateSign(expression.Expr(
+				levels[i+1][0].GetIdentityString()+" | "+levels[i+1][1].GetIdentityString())))
+		}
+	}
+	for _, d := range levels[depth-1] {
+		require.Nil(t, d.Rules.UpdateSign(expression.Expr("ed25519:aa")))
+	}
+	calls := 0
+	getDarcs := DarcsToGetDarcs(darcs)
+	getDarc := func(s string, latest bool) *Darc {
+		calls++
+		return getDarcs(s, latest)
+	}
+
+	combinations, warnings, err := Authorizations(expression.Expr(levels[0][0].GetIdentityString()), getDarc, 0)
+	require.Nil(t, err)
+	require.Equal(t, [][]string{{"ed25519:aa"}}, combinations)
+	require.Equal(t, 0, len(warnings))
+	// Every darc is only fetched once.
+	require.Equal(t, len(darcs)-1, calls)
+
+	// The comparisons of all the darcs count towards the limit.
+	_, _, err = AuthorizationsLimit(expression.Expr(levels[0][0].GetIdentityString()), getDarcs, 0, depth)
+	require.NotNil(t, err)
+}
@@ -283,6 +283,39 @@ func (r Rules) Get(a Action) expression.Expr {
 	return nil
 }
 
+// Diff returns the changes from the rules r to newRules: first the removed
+// and updated rules in the order of r, then the added rules in the order of
+// newRules.
+func (r Rules) Diff(newRules Rules) []RuleChange {
+	var changes []RuleChange
+	for _, rule := range r.List {
+		newExpr := newRules.Get(rule.Action)
+		if newExpr == nil || !bytes.Equal(newExpr, rule.Expr) {
+			changes = append(changes, RuleChange{Action: rule.Action, Old: rule.Expr, New: newExpr})
+		}
+	}
+	for _, rule := range newRules.List {
+		if !r.Contains(rule.Action) {
+			changes = append(changes, RuleChange{Action: rule.Action, New: rule.Expr})
+		}
+	}
+	return changes
+}
+
+// String returns the change in the format used by diff: "+ action - expr"
+// for an added rule, "- action - expr" for a removed one and
+// "~ action - old -> new" for an updated one.
+func (rc RuleChange) String() string {
+	switch {
+	case len(rc.Old) == 0:
+		return fmt.Sprintf("+ %s - \"%s\"", rc.Action, rc.New)
+	case len(rc.New) == 0:
+		return fmt.Sprintf("- %s - \"%s\"", rc.Action, rc.Old)
+	default:
+		return fmt.Sprintf("~ %s - \"%s\" -> \"%s\"", rc.Action, rc.Old, rc.New)
+	}
+}
+
 // Copy copies the rules.
 func (r Rules) Copy() Rules {
 	rCopy := NewRules()
@@ -418,6 +451,12 @@ func (r *Request) Verify(d *Darc) error {
 // argument. This function will ignore darcs in Darc.VerificationDarcs, please
 // use Darc.Verify if you wish to use it.
 func (r *Request) VerifyWithCB(d *Darc, getDarc GetDarc) error {
+	return r.VerifyWithAttr(d, getDarc, nil)
+}
+
+// VerifyWithAttr is like VerifyWithCB, but additionally evaluates the
+// conditions of the rule, such as before:1546300800, with attrs.
+func (r *Request) VerifyWithAttr(d *Darc, getDarc GetDarc, attrs AttrInterpreters) error {
 	if len(r.Signatures) == 0 {
 		return errors.New("no signatures - nothing to verify")
 	}
@@ -432,14 +471,11 @@ func (r *Request) VerifyWithCB(d *Darc, getDarc GetDarc) error {
 	if !d.Rules.Contains(r.Action) {
 		return fmt.Errorf("VerifyWithCB: action '%v' does not exist", r.Action)
 	}
-	digest := r.Hash()
-	for i, id := range r.Identities {
-		if err := id.Verify(digest, r.Signatures[i]); err != nil {
-			return err
-		}
+	if err := verifySignatures(r.Identities, r.Hash(), r.Signatures); err != nil {
+		return err
 	}
 	validIDs := r.GetIdentityStrings()
-	err := EvalExpr(d.Rules.Get(r.Action), getDarc, validIDs...)
+	err := EvalExprAttr(d.Rules.Get(r.Action), getDarc, attrs, validIDs...)
 	if err != nil {
 		return err
 	}
@@ -554,13 +590,11 @@ func verifyOneEvolution(newDarc, prevDarc *Darc, getDarc func(string, bool) *Dar
 	}
 
 	// perform the verification
-	digest := req.Hash()
-	for _, sig := range newDarc.Signatures {
-		if err := sig.Signer.Verify(digest, sig.Signature); err != nil {
-			return err
-		}
+	sigs := make([][]byte, len(newDarc.Signatures))
+	for i, sig := range newDarc.Signatures {
+		sigs[i] = sig.Signature
 	}
-	return nil
+	return verifySignatures(signerIDs, req.Hash(), sigs)
 }
 
 // verifyEvolutionRecursive verifies that evolutions, from the genesis darc
@@ -586,36 +620,66 @@ func EvalExprWithSigs(expr expression.Expr, getDarc GetDarc, sigs ...Signature)
 	return nil
 }
 
+// AttrInterpreters maps the prefix of a condition in an expression, such as
+// "before" in before:1546300800, to the function evaluating the rest of the
+// condition.
+type AttrInterpreters map[string]func(value string) (bool, error)
+
 // EvalExpr checks whether the expression evaluates to true given a list of
 // identities.
 func EvalExpr(expr expression.Expr, getDarc GetDarc, ids ...string) error {
-	Y := expression.InitParser(func(s string) bool {
+	return EvalExprAttr(expr, getDarc, nil, ids...)
+}
+
+// EvalExprAttr checks whether the expression evaluates to true given a list
+// of identities. The conditions whose prefix is in attrs are evaluated by
+// attrs, all other values are identities.
+func EvalExprAttr(expr expression.Expr, getDarc GetDarc, attrs AttrInterpreters, ids ...string) error {
+	return evalExprAttr(expr, getDarc, attrs, nil, ids...)
+}
+
+// evalExprAttr evaluates the expression, where path holds the delegations
+// that lead to it. A delegation that is already in path is part of a cycle
+// and evaluates to false.
+func evalExprAttr(expr expression.Expr, getDarc GetDarc, attrs AttrInterpreters, path []string, ids ...string) error {
+	Y := expression.InitParser(func(s string) (bool, error) {
+		if i := strings.Index(s, ":"); i > 0 {
+			if attr, ok := attrs[s[:i]]; ok {
+				return attr(s[i+1:])
+			}
+		}
 		if strings.HasPrefix(s, "darc") {
+			for _, p := range path {
+				if p == s {
+					return false, nil
+				}
+			}
 			// getDarc is responsible for returning the latest Darc
 			d := getDarc(s, true)
 			if d == nil {
-				return false
+				return false, nil
 			}
 			// Evaluate the "sign" action only in the latest darc
 			// because it may have revoked some rules in earlier
 			// darcs. We do this recursively because there may be
 			// further delegations.
 			if !d.Rules.Contains(sign) {
-				return false
+				return false, nil
 			}
 			// Recursively evaluate the sign expression until we
 			// find the final signer with a ed25519 key.
-			if err := EvalExpr(d.Rules.GetSignExpr(), getDarc, ids...); err != nil {
-				return false
+			next := append(append([]string{}, path...), s)
+			if err := evalExprAttr(d.Rules.GetSignExpr(), getDarc, attrs, next, ids...); err != nil {
+				return false, nil
 			}
-			return true
+			return true, nil
 		}
 		for _, id := range ids {
 			if id == s {
-				return true
+				return true, nil
 			}
 		}
-		return false
+		return false, nil
 	})
 	res, err := expression.Evaluate(Y, expr)
 	if err != nil {
@@ -635,6 +699,12 @@ func (s Signer) Type() int {
 		return 1
 	case s.X509EC != nil:
 		return 2
+	case s.Secp256k1 != nil:
+		return 3
+	case s.BLS != nil:
+		return 4
+	case s.WebAuthn != nil:
+		return 5
 	default:
 		return -1
 	}
@@ -648,6 +718,12 @@ func (s Signer) Identity() Identity {
 		return NewIdentityEd25519(s.Ed25519.Point)
 	case 2:
 		return NewIdentityX509EC(s.X509EC.Point)
+	case 3:
+		return NewIdentitySecp256k1(s.Secp256k1.Public)
+	case 4:
+		return NewIdentityBLSFromBytes(s.BLS.Public)
+	case 5:
+		return NewIdentityWebAuthn(s.WebAuthn.Public, s.WebAuthn.RPID, s.WebAuthn.Origin)
 	default:
 		return Identity{}
 	}
@@ -665,6 +741,12 @@ func (s Signer) Sign(msg []byte) ([]byte, error) {
 		return s.Ed25519.Sign(msg)
 	case 2:
 		return s.X509EC.Sign(msg)
+	case 3:
+		return s.Secp256k1.Sign(msg)
+	case 4:
+		return s.BLS.Sign(msg)
+	case 5:
+		return s.WebAuthn.Sign(msg)
 	default:
 		return nil, errors.New("unknown signer type")
 	}
@@ -675,7 +757,9 @@ func (s Signer) GetPrivate() (kyber.Scalar, error) {
 	switch s.Type() {
 	case 1:
 		return s.Ed25519.Secret, nil
-	case 0, 2:
+	case 4:
+		return s.BLS.private()
+	case 0, 2, 3, 5:
 		return nil, errors.New("signer lacks a private key")
 	default:
 		return nil, errors.New("signer is of unknown type")
@@ -695,6 +779,12 @@ func (id Identity) Equal(id2 *Identity) bool {
 		return id.Ed25519.Equal(id2.Ed25519)
 	case 2:
 		return id.X509EC.Equal(id2.X509EC)
+	case 3:
+		return id.Secp256k1.Equal(id2.Secp256k1)
+	case 4:
+		return id.BLS.Equal(id2.BLS)
+	case 5:
+		return id.WebAuthn.Equal(id2.WebAuthn)
 	}
 	return false
 }
@@ -709,6 +799,12 @@ func (id Identity) Type() int {
 		return 1
 	case id.X509EC != nil:
 		return 2
+	case id.Secp256k1 != nil:
+		return 3
+	case id.BLS != nil:
+		return 4
+	case id.WebAuthn != nil:
+		return 5
 	}
 	return -1
 }
@@ -722,6 +818,12 @@ func (id Identity) TypeString() string {
 		return "ed25519"
 	case 2:
 		return "x509ec"
+	case 3:
+		return "secp256k1"
+	case 4:
+		return "bls"
+	case 5:
+		return "webauthn"
 	default:
 		return "No identity"
 	}
@@ -736,6 +838,12 @@ func (id Identity) String() string {
 		return fmt.Sprintf("%s:%s", id.TypeString(), id.Ed25519.Point.String())
 	case 2:
 		return fmt.Sprintf("%s:%x", id.TypeString(), id.X509EC.Public)
+	case 3:
+		return fmt.Sprintf("%s:%x", id.TypeString(), id.Secp256k1.Public)
+	case 4:
+		return fmt.Sprintf("%s:%x", id.TypeString(), id.BLS.Public)
+	case 5:
+		return fmt.Sprintf("%s:%x", id.TypeString(), id.WebAuthn.marshal())
 	default:
 		return "No identity"
 	}
@@ -751,6 +859,12 @@ func (id Identity) Verify(msg, sig []byte) error {
 		return id.Ed25519.Verify(msg, sig)
 	case 2:
 		return id.X509EC.Verify(msg, sig)
+	case 3:
+		return id.Secp256k1.Verify(msg, sig)
+	case 4:
+		return id.BLS.Verify(msg, sig)
+	case 5:
+		return id.WebAuthn.Verify(msg, sig)
 	default:
 		return errors.New("unknown identity")
 	}
@@ -1,6 +1,7 @@
 package darc
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/dedis/cothority/byzcoin/darc/expression"
@@ -395,6 +396,50 @@ func TestDarc_DelegationChain(t *testing.T) {
 	require.Nil(t, td.darc.VerifyWithCB(getDarc, true))
 }
 
+// TestDarc_EvalThreshold checks that threshold expressions also count the
+// delegated darcs.
+func TestDarc_EvalThreshold(t *testing.T) {
+	a := createSigner().Identity().String()
+	b := createSigner().Identity().String()
+	td := createDarc(1, "delegated")
+	require.Nil(t, td.darc.Rules.UpdateSign([]byte(td.ids[0].String())))
+	getDarc := DarcsToGetDarcs([]*Darc{td.darc})
+
+	expr := expression.InitThresholdExpr(2, a, b, td.darc.GetIdentityString())
+	require.Nil(t, EvalExpr(expr, getDarc, a, b))
+	require.Nil(t, EvalExpr(expr, getDarc, a, td.ids[0].String()))
+	require.NotNil(t, EvalExpr(expr, getDarc, td.ids[0].String()))
+	require.NotNil(t, EvalExpr(expr, getDarc, b))
+}
+
+// TestDarc_EvalAttr checks that the conditions are evaluated by the
+// interpreters, also in delegated darcs.
+func TestDarc_EvalAttr(t *testing.T) {
+	a := createSigner().Identity().String()
+	attrs := AttrInterpreters{
+		"before": func(v string) (bool, error) { return v == "10", nil },
+		"attr": func(v string) (bool, error) {
+			if v == "broken=true" {
+				return false, errors.New("broken")
+			}
+			return v == "contract=coin", nil
+		},
+	}
+	td := createDarc(1, "delegated")
+	require.Nil(t, td.darc.Rules.UpdateSign(expression.InitAndExpr(a, "before:10")))
+	getDarc := DarcsToGetDarcs([]*Darc{td.darc})
+
+	require.Nil(t, EvalExprAttr(expression.Expr(a+" & before:10"), getDarc, attrs, a))
+	require.NotNil(t, EvalExprAttr(expression.Expr(a+" & before:20"), getDarc, attrs, a))
+	require.Nil(t, EvalExprAttr(expression.Expr(a+" & attr:contract=coin"), getDarc, attrs, a))
+	require.NotNil(t, EvalExprAttr(expression.Expr(a+" | attr:broken=true"), getDarc, attrs, a))
+	require.Nil(t, EvalExprAttr(expression.Expr(td.darc.GetIdentityString()), getDarc, attrs, a))
+
+	// Without interpreters, the conditions are unknown identities.
+	require.NotNil(t, EvalExpr(expression.Expr(a+" & before:10"), getDarc, a))
+	require.NotNil(t, EvalExpr(expression.Expr(td.darc.GetIdentityString()), getDarc, a))
+}
+
 func TestDarc_X509(t *testing.T) {
 	// TODO
 }
@@ -451,3 +496,25 @@ func localEvolution(newDarc *Darc, oldDarc *Darc, signers ...Signer) error {
 	newDarc.VerificationDarcs = append(oldDarc.VerificationDarcs, oldDarc)
 	return nil
 }
+
+func TestRules_Diff(t *testing.T) {
+	old := NewRules()
+	require.Nil(t, old.AddRule("spawn:a", []byte("ed25519:aa")))
+	require.Nil(t, old.AddRule("spawn:b", []byte("ed25519:bb")))
+	require.Nil(t, old.AddRule("spawn:c", []byte("ed25519:cc")))
+	newRules := old.Copy()
+	require.Nil(t, newRules.DeleteRules("spawn:a"))
+	require.Nil(t, newRules.UpdateRule("spawn:b", []byte("ed25519:dd")))
+	require.Nil(t, newRules.AddRule("spawn:d", []byte("ed25519:dd")))
+
+	changes := old.Diff(newRules)
+	require.Equal(t, []RuleChange{
+		{Action: "spawn:a", Old: []byte("ed25519:aa")},
+		{Action: "spawn:b", Old: []byte("ed25519:bb"), New: []byte("ed25519:dd")},
+		{Action: "spawn:d", New: []byte("ed25519:dd")},
+	}, changes)
+	require.Equal(t, "- spawn:a - \"ed25519:aa\"", changes[0].String())
+	require.Equal(t, "~ spawn:b - \"ed25519:bb\" -> \"ed25519:dd\"", changes[1].String())
+	require.Equal(t, "+ spawn:d - \"ed25519:dd\"", changes[2].String())
+	require.Nil(t, newRules.Diff(newRules))
+}
@@ -0,0 +1,188 @@
+package expression
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	parsec "github.com/prataprc/goparsec"
+)
+
+// MaxCombinations is the maximal number of combinations that Combinations
+// computes for an expression, or for any part of it.
+const MaxCombinations = 10000
+
+// MaxComparisons is the maximal number of comparisons of combinations that
+// Combinations does to minimize them, for the whole expression. Minimizing
+// is quadratic in the number of combinations, so MaxCombinations alone
+// doesn't bound the work.
+const MaxComparisons = 10000000
+
+const tooManyCombinations = "evaluation failed - too many combinations"
+const tooManyComparisons = "evaluation failed - too many comparisons"
+const failedToCastCombinations = "evaluation failed - result is not a list of combinations"
+
+// CombinationsFn is called by Combinations with every value of the
+// expression. It returns the minimal combinations of values that make the
+// value true, usually just the value itself. If it returns no combination,
+// the value is never true.
+type CombinationsFn func(string) ([][]string, error)
+
+// Combinations returns the minimal combinations of values that make the
+// expression true. Every combination is sorted, and no combination includes
+// another one. For example, the combinations of (a:a & b:b) | [a:a, c:c]/1
+// are [a:a] and [c:c].
+func Combinations(expr Expr, fn CombinationsFn) ([][]string, error) {
+	left := MaxComparisons
+	return CombinationsLimit(expr, fn, &left)
+}
+
+// CombinationsLimit is like Combinations, but fails once it did more than
+// *left comparisons of combinations. The comparisons are subtracted from
+// *left, so that several calls can share the same limit.
+func CombinationsLimit(expr Expr, fn CombinationsFn, left *int) ([][]string, error) {
+	v, s := initParser(combinationEvaluator{fn, left})(parsec.NewScanner(expr))
+	if err, ok := v.(error); ok {
+		return nil, err
+	}
+	_, s = s.SkipWS()
+	if !s.Endof() {
+		return nil, errors.New(scannerNotEmpty)
+	}
+	c, ok := v.(combinations)
+	if !ok {
+		return nil, errors.New(failedToCastCombinations)
+	}
+	return c, nil
+}
+
+// combinations is a list of sorted combinations, none of which includes
+// another one. An empty list is false, and a list holding an empty
+// combination is true.
+type combinations [][]string
+
+// combinationEvaluator evaluates an expression to its minimal combinations.
+type combinationEvaluator struct {
+	fn CombinationsFn
+	// left is the number of comparisons that can still be done.
+	left *int
+}
+
+func (e combinationEvaluator) value(s string) parsec.ParsecNode {
+	cs, err := e.fn(s)
+	if err != nil {
+		return err
+	}
+	for i := range cs {
+		cs[i] = sortUnique(cs[i])
+	}
+	return e.minimize(cs)
+}
+
+func (e combinationEvaluator) and(a, b parsec.ParsecNode) parsec.ParsecNode {
+	ca, cb := a.(combinations), b.(combinations)
+	if len(ca)*len(cb) > MaxCombinations {
+		return errors.New(tooManyCombinations)
+	}
+	var c combinations
+	for _, x := range ca {
+		for _, y := range cb {
+			c = append(c, sortUnique(append(append([]string{}, x...), y...)))
+		}
+	}
+	return e.minimize(c)
+}
+
+func (e combinationEvaluator) or(a, b parsec.ParsecNode) parsec.ParsecNode {
+	ca, cb := a.(combinations), b.(combinations)
+	if len(ca)+len(cb) > MaxCombinations {
+		return errors.New(tooManyCombinations)
+	}
+	return e.minimize(append(append(combinations{}, ca...), cb...))
+}
+
+// threshold computes the combinations of at least n of the values, by
+// adding one value at a time: atLeast[k] holds the combinations that make
+// at least k of the values added so far true.
+func (e combinationEvaluator) threshold(n int, values []parsec.ParsecNode) parsec.ParsecNode {
+	// The threshold comes from the rule, so it must not decide how much is
+	// allocated.
+	if n > len(values) {
+		return combinations{}
+	}
+	atLeast := make([]parsec.ParsecNode, n+1)
+	atLeast[0] = combinations{{}}
+	for k := 1; k <= n; k++ {
+		atLeast[k] = combinations{}
+	}
+	for _, v := range values {
+		for k := n; k > 0; k-- {
+			with := e.and(atLeast[k-1], v)
+			if _, ok := with.(error); ok {
+				return with
+			}
+			atLeast[k] = e.or(atLeast[k], with)
+			if _, ok := atLeast[k].(error); ok {
+				return atLeast[k]
+			}
+		}
+	}
+	return atLeast[n]
+}
+
+// sortUnique sorts the values and removes the duplicates.
+func sortUnique(values []string) []string {
+	sort.Strings(values)
+	var unique []string
+	for i, v := range values {
+		if i == 0 || v != values[i-1] {
+			unique = append(unique, v)
+		}
+	}
+	if unique == nil {
+		return []string{}
+	}
+	return unique
+}
+
+// minimize removes the combinations that include another one, and sorts
+// them by size first. It returns an error once the comparisons exceed the
+// limit.
+func (e combinationEvaluator) minimize(cs combinations) parsec.ParsecNode {
+	sort.SliceStable(cs, func(i, j int) bool {
+		if len(cs[i]) != len(cs[j]) {
+			return len(cs[i]) < len(cs[j])
+		}
+		return strings.Join(cs[i], ",") < strings.Join(cs[j], ",")
+	})
+	min := combinations{}
+	for _, c := range cs {
+		included := false
+		for _, m := range min {
+			*e.left--
+			if *e.left < 0 {
+				return errors.New(tooManyComparisons)
+			}
+			if isSubset(m, c) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			min = append(min, c)
+		}
+	}
+	return min
+}
+
+// isSubset returns true if all the values of the sorted a are in the sorted
+// b.
+func isSubset(a, b []string) bool {
+	i := 0
+	for _, v := range b {
+		if i < len(a) && a[i] == v {
+			i++
+		}
+	}
+	return i == len(a)
+}
@@ -0,0 +1,103 @@
+package expression
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func identityFn(s string) ([][]string, error) {
+	return [][]string{{s}}, nil
+}
+
+func TestCombinations(t *testing.T) {
+	for expr, exp := range map[string][][]string{
+		"a:a":                        {{"a:a"}},
+		"a:a & b:b":                  {{"a:a", "b:b"}},
+		"a:a | b:b":                  {{"a:a"}, {"b:b"}},
+		"(a:a & b:b) | [a:a, c:c]/1": {{"a:a"}, {"c:c"}},
+		"a:a & (a:a | b:b)":          {{"a:a"}},
+		"[a:a, b:b, c:c]/2":          {{"a:a", "b:b"}, {"a:a", "c:c"}, {"b:b", "c:c"}},
+		"(a:a | b:b) & (c:c | d:d)":  {{"a:a", "c:c"}, {"a:a", "d:d"}, {"b:b", "c:c"}, {"b:b", "d:d"}},
+	} {
+		c, err := Combinations(Expr(expr), identityFn)
+		if err != nil {
+			t.Fatal(expr, err)
+		}
+		if !reflect.DeepEqual(c, exp) {
+			t.Fatalf("%s gave %v instead of %v", expr, c, exp)
+		}
+	}
+}
+
+func TestCombinations_Fn(t *testing.T) {
+	// The values can be replaced by their own combinations, like a
+	// delegation, or be never true.
+	fn := func(s string) ([][]string, error) {
+		switch s {
+		case "d:d":
+			return [][]string{{"a:a", "b:b"}, {"c:c"}}, nil
+		case "e:e":
+			return nil, nil
+		case "f:f":
+			return nil, errors.New("broken")
+		}
+		return [][]string{{s}}, nil
+	}
+	c, err := Combinations(Expr("d:d & a:a | e:e"), fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := [][]string{{"a:a", "b:b"}, {"a:a", "c:c"}}
+	if !reflect.DeepEqual(c, exp) {
+		t.Fatalf("got %v instead of %v", c, exp)
+	}
+	if _, err = Combinations(Expr("a:a | f:f"), fn); err == nil || err.Error() != "broken" {
+		t.Fatal("expect the error of fn", err)
+	}
+	if _, err = Combinations(Expr("a:a |"), fn); err == nil {
+		t.Fatal("expect a parsing error")
+	}
+	// A threshold that cannot be reached is refused before it is used.
+	for _, expr := range []string{"[a:a, b:b]/3", "[a:a]/99999999999999999999"} {
+		if _, err = Combinations(Expr(expr), fn); err == nil {
+			t.Fatal("expect an error for", expr)
+		}
+	}
+}
+
+func TestCombinations_TooMany(t *testing.T) {
+	var ors []string
+	for i := 0; i < 4; i++ {
+		var ids []string
+		for j := 0; j < 20; j++ {
+			ids = append(ids, string('a'+rune(j))+":"+string('a'+rune(i)))
+		}
+		ors = append(ors, "("+strings.Join(ids, " | ")+")")
+	}
+	_, err := Combinations(Expr(strings.Join(ors, " & ")), identityFn)
+	if err == nil || err.Error() != tooManyCombinations {
+		t.Fatal("expect too many combinations", err)
+	}
+}
+
+func TestCombinations_TooManyComparisons(t *testing.T) {
+	expr := Expr("[a:a, b:b, c:c, d:d]/2")
+	left := 1000
+	if _, err := CombinationsLimit(expr, identityFn, &left); err != nil {
+		t.Fatal(err)
+	}
+	if left <= 0 || left >= 1000 {
+		t.Fatal("expect the comparisons to be counted", left)
+	}
+	// The limit is shared by the calls.
+	left = 1000 - left
+	if _, err := CombinationsLimit(expr, identityFn, &left); err != nil {
+		t.Fatal(err)
+	}
+	_, err := CombinationsLimit(expr, identityFn, &left)
+	if err == nil || err.Error() != tooManyComparisons {
+		t.Fatal("expect too many comparisons", err)
+	}
+}
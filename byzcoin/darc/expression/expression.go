@@ -5,13 +5,17 @@ the syntax we use is from: https://en.wikipedia.org/wiki/Extended_Backus%E2%80%9
 
 	expr = term, [ '&', term ]*
 	term = factor, [ '|', factor ]*
-	factor = '(', expr, ')' | id
+	factor = '(', expr, ')' | id | attr | thexpr
+	thexpr = '[', id, [ ',', id ]*, ']', '/', digit+
 	id = [0-9a-z]+, ':', [0-9a-f]+
+	attr = 'attr:', [0-9a-z_]+, '=', [0-9a-zA-Z_.-]+
 
 Examples:
 
         ed25519:deadbeef // every id evaluates to a boolean
 	(a:a & b:b) | (c:c & d:d)
+	[a:a, b:b, c:c]/2 // at least 2 of the ids evaluate to true
+	ed25519:deadbeef & before:1546300800 & attr:contract=coin
 
 In the simplest case, the evaluation of an expression is performed against a
 set of valid ids.  Suppose we have the expression (a:a & b:b) | (c:c & d:d),
@@ -20,14 +24,21 @@ true.  If the set of valid ids is [a:a, c:c], then the expression will evaluate
 to false. However, the user is able to provide a ValueCheckFn to customise how
 the expressions are evaluated.
 
-EXTENSION - NOT YET IMPLEMENTED:
-To support threshold signatures, we extend the syntax to include the following.
-	thexpr = '[', id, [ ',', id ]*, ']', '/', digit
+A threshold expression evaluates to true if at least the given number of
+distinct ids in the list evaluate to true. The number must be at least 1,
+and at most the number of distinct ids.
+
+The ValueCheckFn is called with every id and attr of the expression, so it
+is also the place to interpret conditions that are not identities, such as
+before:1546300800 or attr:contract=coin. If it returns an error, the
+evaluation of the whole expression fails with this error.
 */
 package expression
 
 import (
 	"errors"
+	"fmt"
+	"strconv"
 	"strings"
 
 	parsec "github.com/prataprc/goparsec"
@@ -37,15 +48,60 @@ const scannerNotEmpty = "parsing failed - scanner is not empty"
 const failedToCast = "evauluation failed - result is not bool"
 
 // ValueCheckFn is a function that will be called when the parser is
-// parsing/evaluating an expression.
-// TODO it is useful if we can return (bool, error).
-type ValueCheckFn func(string) bool
+// parsing/evaluating an expression. It returns an error if the value cannot
+// be evaluated.
+type ValueCheckFn func(string) (bool, error)
 
 // Expr represents the unprocess expression of our DSL.
 type Expr []byte
 
+// evaluator defines the result of the evaluation of an expression, by
+// giving the result of every value and how they are combined. The results
+// are returned as parsec nodes, which are errors if the evaluation failed.
+type evaluator interface {
+	value(string) parsec.ParsecNode
+	and(a, b parsec.ParsecNode) parsec.ParsecNode
+	or(a, b parsec.ParsecNode) parsec.ParsecNode
+	threshold(n int, values []parsec.ParsecNode) parsec.ParsecNode
+}
+
+// boolEvaluator evaluates an expression to a boolean.
+type boolEvaluator struct {
+	fn ValueCheckFn
+}
+
+func (e boolEvaluator) value(s string) parsec.ParsecNode {
+	ok, err := e.fn(s)
+	if err != nil {
+		return err
+	}
+	return ok
+}
+
+func (e boolEvaluator) and(a, b parsec.ParsecNode) parsec.ParsecNode {
+	return a.(bool) && b.(bool)
+}
+
+func (e boolEvaluator) or(a, b parsec.ParsecNode) parsec.ParsecNode {
+	return a.(bool) || b.(bool)
+}
+
+func (e boolEvaluator) threshold(n int, values []parsec.ParsecNode) parsec.ParsecNode {
+	var count int
+	for _, v := range values {
+		if v.(bool) {
+			count++
+		}
+	}
+	return count >= n
+}
+
 // InitParser creates the root parser
 func InitParser(fn ValueCheckFn) parsec.Parser {
+	return initParser(boolEvaluator{fn})
+}
+
+func initParser(e evaluator) parsec.Parser {
 	// Y is root Parser, usually called as `s` in CFG theory.
 	var Y parsec.Parser
 	var sum, value parsec.Parser // circular rats
@@ -55,6 +111,11 @@ func InitParser(fn ValueCheckFn) parsec.Parser {
 	var closeparan = parsec.Token(`\)`, "CLOSEPARAN")
 	var andop = parsec.Token(`&`, "AND")
 	var orop = parsec.Token(`\|`, "OR")
+	var openbracket = parsec.Token(`\[`, "OPENBRACKET")
+	var closebracket = parsec.Token(`\]`, "CLOSEBRACKET")
+	var comma = parsec.Token(`,`, "COMMA")
+	var slash = parsec.Token(`/`, "SLASH")
+	var threshold = parsec.Token(`[1-9][0-9]*`, "THRESHOLD")
 
 	// NonTerminal rats
 	// andop -> "&" |  "|"
@@ -63,14 +124,18 @@ func InitParser(fn ValueCheckFn) parsec.Parser {
 	// value -> "(" expr ")"
 	var groupExpr = parsec.And(exprNode, openparan, &sum, closeparan)
 
+	// thexpr -> "[" id ("," id)* "]" "/" threshold
+	var idList = parsec.Many(nil, id(), comma)
+	var thExpr = parsec.And(thresholdNode(e), openbracket, idList, closebracket, slash, threshold)
+
 	// (andop prod)*
 	var prodK = parsec.Kleene(nil, parsec.And(many2many, sumOp, &value), nil)
 
 	// Circular rats come to life
 	// sum -> prod (andop prod)*
-	sum = parsec.And(sumNode(fn), &value, prodK)
-	// value -> id | "(" expr ")"
-	value = parsec.OrdChoice(exprValueNode(fn), id(), groupExpr)
+	sum = parsec.And(sumNode(e), &value, prodK)
+	// value -> attr | id | "(" expr ")" | thexpr
+	value = parsec.OrdChoice(exprValueNode(e), attr(), id(), groupExpr, thExpr)
 	// expr  -> sum
 	Y = parsec.OrdChoice(one2one, sum)
 	return Y
@@ -81,6 +146,9 @@ func InitParser(fn ValueCheckFn) parsec.Parser {
 // there are no errors.
 func Evaluate(parser parsec.Parser, expr Expr) (bool, error) {
 	v, s := parser(parsec.NewScanner(expr))
+	if err, ok := v.(error); ok {
+		return false, err
+	}
 	_, s = s.SkipWS()
 	if !s.Endof() {
 		return false, errors.New(scannerNotEmpty)
@@ -95,13 +163,13 @@ func Evaluate(parser parsec.Parser, expr Expr) (bool, error) {
 // DefaultParser creates a parser and evaluates the expression expr, every id
 // in pks will evaluate to true.
 func DefaultParser(expr Expr, ids ...string) (bool, error) {
-	return Evaluate(InitParser(func(s string) bool {
+	return Evaluate(InitParser(func(s string) (bool, error) {
 		for _, k := range ids {
 			if k == s {
-				return true
+				return true, nil
 			}
 		}
-		return false
+		return false, nil
 	}), expr)
 }
 
@@ -117,6 +185,12 @@ func InitOrExpr(ids ...string) Expr {
 	return Expr(strings.Join(ids, " | "))
 }
 
+// InitThresholdExpr creates an expression that is true if at least
+// threshold of the IDs are valid.
+func InitThresholdExpr(threshold int, ids ...string) Expr {
+	return Expr("[" + strings.Join(ids, ", ") + "]/" + strconv.Itoa(threshold))
+}
+
 func id() parsec.Parser {
 	return func(s parsec.Scanner) (parsec.ParsecNode, parsec.Scanner) {
 		_, s = s.SkipAny(`^[  \n\t]+`)
@@ -125,18 +199,35 @@ func id() parsec.Parser {
 	}
 }
 
-func sumNode(fn ValueCheckFn) func(ns []parsec.ParsecNode) parsec.ParsecNode {
+// attr parses the attributes, which are given as attr:name=value.
+func attr() parsec.Parser {
+	return func(s parsec.Scanner) (parsec.ParsecNode, parsec.Scanner) {
+		_, s = s.SkipAny(`^[  \n\t]+`)
+		p := parsec.Token(`attr:[0-9a-z_]+=[0-9a-zA-Z_.-]+`, "ATTR")
+		return p(s)
+	}
+}
+
+func sumNode(e evaluator) func(ns []parsec.ParsecNode) parsec.ParsecNode {
 	return func(ns []parsec.ParsecNode) parsec.ParsecNode {
 		if len(ns) > 0 {
-			val := ns[0].(bool)
+			val := ns[0]
+			if err, ok := val.(error); ok {
+				return err
+			}
 			for _, x := range ns[1].([]parsec.ParsecNode) {
 				y := x.([]parsec.ParsecNode)
-				n := y[1].(bool)
+				if err, ok := y[1].(error); ok {
+					return err
+				}
 				switch y[0].(*parsec.Terminal).Name {
 				case "AND":
-					val = val && n
+					val = e.and(val, y[1])
 				case "OR":
-					val = val || n
+					val = e.or(val, y[1])
+				}
+				if err, ok := val.(error); ok {
+					return err
 				}
 			}
 			return val
@@ -145,17 +236,54 @@ func sumNode(fn ValueCheckFn) func(ns []parsec.ParsecNode) parsec.ParsecNode {
 	}
 }
 
-func exprValueNode(fn ValueCheckFn) func(ns []parsec.ParsecNode) parsec.ParsecNode {
+func exprValueNode(e evaluator) func(ns []parsec.ParsecNode) parsec.ParsecNode {
 	return func(ns []parsec.ParsecNode) parsec.ParsecNode {
 		if len(ns) == 0 {
 			return nil
 		} else if term, ok := ns[0].(*parsec.Terminal); ok {
-			return fn(term.Value)
+			return e.value(term.Value)
 		}
 		return ns[0]
 	}
 }
 
+// thresholdNode evaluates the distinct ids of the list and combines them
+// with the threshold. A threshold that cannot be reached by the distinct ids
+// is an error, like a threshold that is not a valid int.
+func thresholdNode(e evaluator) func(ns []parsec.ParsecNode) parsec.ParsecNode {
+	return func(ns []parsec.ParsecNode) parsec.ParsecNode {
+		if len(ns) == 0 {
+			return nil
+		}
+		threshold, err := strconv.Atoi(ns[4].(*parsec.Terminal).Value)
+		if err != nil {
+			return errors.New("invalid threshold: " + err.Error())
+		}
+		seen := make(map[string]bool)
+		var ids []string
+		for _, x := range ns[1].([]parsec.ParsecNode) {
+			id := x.(*parsec.Terminal).Value
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			ids = append(ids, id)
+		}
+		if threshold > len(ids) {
+			return fmt.Errorf("threshold %d is larger than the %d distinct ids",
+				threshold, len(ids))
+		}
+		values := make([]parsec.ParsecNode, len(ids))
+		for i, id := range ids {
+			values[i] = e.value(id)
+			if err, ok := values[i].(error); ok {
+				return err
+			}
+		}
+		return e.threshold(threshold, values)
+	}
+}
+
 func exprNode(ns []parsec.ParsecNode) parsec.ParsecNode {
 	if len(ns) == 0 {
 		return nil
@@ -1,17 +1,18 @@
 package expression
 
 import (
+	"errors"
 	"testing"
 
 	parsec "github.com/prataprc/goparsec"
 )
 
-func trueFn(s string) bool {
-	return true
+func trueFn(s string) (bool, error) {
+	return true, nil
 }
 
-func falseFn(s string) bool {
-	return false
+func falseFn(s string) (bool, error) {
+	return false, nil
 }
 
 func TestExprAllTrue(t *testing.T) {
@@ -48,11 +49,11 @@ func TestInitAnd(t *testing.T) {
 
 func TestParsing_One(t *testing.T) {
 	expr := []byte("a:abc")
-	fn := func(s string) bool {
+	fn := func(s string) (bool, error) {
 		if s == "a:abc" {
-			return true
+			return true, nil
 		}
-		return false
+		return false, nil
 	}
 	v, s := InitParser(fn)(parsec.NewScanner(expr))
 	if v.(bool) != true {
@@ -65,11 +66,11 @@ func TestParsing_One(t *testing.T) {
 
 func TestParsing_Or(t *testing.T) {
 	expr := []byte("a:abc | b:abc | c:abc")
-	fn := func(s string) bool {
+	fn := func(s string) (bool, error) {
 		if s == "b:abc" {
-			return true
+			return true, nil
 		}
-		return false
+		return false, nil
 	}
 	v, s := InitParser(fn)(parsec.NewScanner(expr))
 	if v.(bool) != true {
@@ -123,11 +124,11 @@ func TestParsing_Paran(t *testing.T) {
 
 func TestParsing_Nesting(t *testing.T) {
 	expr := []byte("(a:b | (b:c & c:d))")
-	x, err := Evaluate(InitParser(func(s string) bool {
+	x, err := Evaluate(InitParser(func(s string) (bool, error) {
 		if s == "b:c" || s == "c:d" {
-			return true
+			return true, nil
 		}
-		return false
+		return false, nil
 	}), expr)
 	if err != nil {
 		t.Fatal(err)
@@ -207,3 +208,86 @@ func TestEval_DefaultParser(t *testing.T) {
 		t.Fatal("evaluation should return false")
 	}
 }
+
+func TestParsing_Threshold(t *testing.T) {
+	valid := []string{"a:a", "c:c"}
+	for expr, exp := range map[string]bool{
+		"[a:a, b:b, c:c]/2":          true,
+		"[a:a,b:b,c:c]/3":            false,
+		"[a:a, a:a, b:b]/2":          false,
+		"[a:a]/1 & [b:b, c:c]/1":     true,
+		"([a:a, b:b]/2 | d:d) | c:c": true,
+		"[a:a, b:b]/2 | d:d":         false,
+	} {
+		ok, err := DefaultParser(Expr(expr), valid...)
+		if err != nil {
+			t.Fatal(expr, err)
+		}
+		if ok != exp {
+			t.Fatalf("%s evaluated to %v", expr, ok)
+		}
+	}
+
+	for _, expr := range []string{"[a:a, b:b]/0", "[a:a, b:b]", "[a:a, b:b/1", "[a:a & b:b]/1",
+		"[a:a, b:b]/3", "[a:a, a:a]/2", "[a:a]/99999999999999999999", "c:c | [a:a]/5"} {
+		if _, err := DefaultParser(Expr(expr), valid...); err == nil {
+			t.Fatal("expect an error for", expr)
+		}
+	}
+}
+
+func TestInitThreshold(t *testing.T) {
+	expr := InitThresholdExpr(2, "a:a", "b:b", "c:c")
+	if string(expr) != "[a:a, b:b, c:c]/2" {
+		t.Fatalf("wrong expression %s", expr)
+	}
+	ok, err := DefaultParser(expr, "b:b", "c:c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok != true {
+		t.Fatal("evaluation should return true")
+	}
+}
+
+func TestParsing_Attr(t *testing.T) {
+	fn := func(s string) (bool, error) {
+		switch s {
+		case "a:a", "before:10", "attr:contract=coin":
+			return true, nil
+		case "after:20":
+			return false, errors.New("no time")
+		}
+		return false, nil
+	}
+	for expr, exp := range map[string]bool{
+		"a:a & before:10":                  true,
+		"a:a & attr:contract=coin":         true,
+		"(attr:contract=coin | b:b) & a:a": true,
+		"attr:contract=value & a:a":        false,
+		"a:a & attr:name_1=Some-value.txt": false,
+		"attr:contract=coin&before:10|b:b": true,
+	} {
+		ok, err := Evaluate(InitParser(fn), Expr(expr))
+		if err != nil {
+			t.Fatal(expr, err)
+		}
+		if ok != exp {
+			t.Fatalf("%s evaluated to %v", expr, ok)
+		}
+	}
+
+	for _, expr := range []string{"attr:contract", "attr:contract=", "attr:=coin", "attr:contract=co in"} {
+		if _, err := Evaluate(InitParser(fn), Expr(expr)); err == nil {
+			t.Fatal("expect an error for", expr)
+		}
+	}
+
+	// Errors of the ValueCheckFn are returned, wherever they happen.
+	for _, expr := range []string{"after:20", "a:a & after:20", "(b:b | after:20)", "[a:a, after:20]/1"} {
+		_, err := Evaluate(InitParser(fn), Expr(expr))
+		if err == nil || err.Error() != "no time" {
+			t.Fatal("expect the error of fn for", expr, err)
+		}
+	}
+}
@@ -0,0 +1,451 @@
+package darc
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/pairing/bn256"
+	"github.com/dedis/kyber/sign/bls"
+	"github.com/dedis/protobuf"
+)
+
+// blsSuite is the pairing used by the BLS identities.
+var blsSuite = bn256.NewSuite()
+
+// ParseIdentity returns the identity given in the format of Identity.String.
+func ParseIdentity(s string) (Identity, error) {
+	fields := strings.SplitN(s, ":", 2)
+	if len(fields) != 2 {
+		return Identity{}, errors.New("identity must be of the form type:hex")
+	}
+	buf, err := hex.DecodeString(fields[1])
+	if err != nil {
+		return Identity{}, errors.New("invalid hex in identity: " + err.Error())
+	}
+	switch fields[0] {
+	case "darc":
+		return NewIdentityDarc(buf), nil
+	case "ed25519":
+		point := cothority.Suite.Point()
+		if err = point.UnmarshalBinary(buf); err != nil {
+			return Identity{}, errors.New("invalid ed25519 point: " + err.Error())
+		}
+		return NewIdentityEd25519(point), nil
+	case "x509ec":
+		_, err = x509.ParsePKIXPublicKey(buf)
+		if err != nil {
+			return Identity{}, errors.New("invalid x509ec public key: " + err.Error())
+		}
+		return NewIdentityX509EC(buf), nil
+	case "secp256k1":
+		if _, err = btcec.ParsePubKey(buf, btcec.S256()); err != nil {
+			return Identity{}, errors.New("invalid secp256k1 public key: " + err.Error())
+		}
+		return NewIdentitySecp256k1(buf), nil
+	case "bls":
+		id := NewIdentityBLSFromBytes(buf)
+		if _, err = id.BLS.point(); err != nil {
+			return Identity{}, err
+		}
+		return id, nil
+	case "webauthn":
+		var id IdentityWebAuthn
+		if err = protobuf.Decode(buf, &id); err != nil {
+			return Identity{}, errors.New("invalid webauthn identity: " + err.Error())
+		}
+		if _, err = id.publicKey(); err != nil {
+			return Identity{}, err
+		}
+		if id.RPID == "" || id.Origin == "" {
+			return Identity{}, errors.New("webauthn identity needs a relying party and an origin")
+		}
+		return Identity{WebAuthn: &id}, nil
+	default:
+		return Identity{}, errors.New("unknown identity type: " + fields[0])
+	}
+}
+
+// verifySignatures returns nil if every identity signed msg with the
+// corresponding signature. The signatures of the BLS identities are
+// verified together with verifyBLSBatch.
+func verifySignatures(ids []Identity, msg []byte, sigs [][]byte) error {
+	if len(ids) != len(sigs) {
+		return errors.New("signatures and identities have unequal length")
+	}
+	var blsIDs []IdentityBLS
+	var blsSigs [][]byte
+	for i, id := range ids {
+		if id.BLS != nil {
+			blsIDs = append(blsIDs, *id.BLS)
+			blsSigs = append(blsSigs, sigs[i])
+			continue
+		}
+		if err := id.Verify(msg, sigs[i]); err != nil {
+			return err
+		}
+	}
+	if len(blsIDs) == 0 {
+		return nil
+	}
+	return verifyBLSBatch(blsIDs, msg, blsSigs)
+}
+
+// NewIdentitySecp256k1 creates a new Secp256k1 identity struct given a
+// compressed public key.
+func NewIdentitySecp256k1(public []byte) Identity {
+	return Identity{
+		Secp256k1: &IdentitySecp256k1{
+			Public: public,
+		},
+	}
+}
+
+// Equal returns true if both IdentitySecp256k1 point to the same data.
+func (ids IdentitySecp256k1) Equal(ids2 *IdentitySecp256k1) bool {
+	return bytes.Equal(ids.Public, ids2.Public)
+}
+
+// secp256k1HalfOrder is the largest S accepted in a secp256k1 signature.
+var secp256k1HalfOrder = new(big.Int).Rsh(btcec.S256().N, 1)
+
+// Verify returns nil if sig is a DER-encoded ECDSA signature on the SHA-256
+// hash of msg, or an error if something fails. As for every signature
+// (r, s) the signature (r, N-s) is valid too, only the one with the lower S
+// is accepted, so that signatures cannot be changed.
+func (ids IdentitySecp256k1) Verify(msg, sig []byte) error {
+	public, err := btcec.ParsePubKey(ids.Public, btcec.S256())
+	if err != nil {
+		return err
+	}
+	s, err := btcec.ParseDERSignature(sig, btcec.S256())
+	if err != nil {
+		return err
+	}
+	if s.S.Cmp(secp256k1HalfOrder) > 0 {
+		return errors.New("signature has a high S")
+	}
+	digest := sha256.Sum256(msg)
+	if !s.Verify(digest[:], public) {
+		return errors.New("Wrong signature")
+	}
+	return nil
+}
+
+// NewSignerSecp256k1 initializes a new SignerSecp256k1 given the private key.
+// If the private key is nil, then a new key pair is generated.
+func NewSignerSecp256k1(secret []byte) (Signer, error) {
+	var private *btcec.PrivateKey
+	if secret == nil {
+		var err error
+		private, err = btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			return Signer{}, err
+		}
+	} else {
+		private, _ = btcec.PrivKeyFromBytes(btcec.S256(), secret)
+	}
+	return Signer{Secp256k1: &SignerSecp256k1{
+		Public: private.PubKey().SerializeCompressed(),
+		Secret: private.Serialize(),
+	}}, nil
+}
+
+// Sign creates a DER-encoded ECDSA signature on the SHA-256 hash of the
+// message.
+func (ss SignerSecp256k1) Sign(msg []byte) ([]byte, error) {
+	private, _ := btcec.PrivKeyFromBytes(btcec.S256(), ss.Secret)
+	digest := sha256.Sum256(msg)
+	sig, err := private.Sign(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	return sig.Serialize(), nil
+}
+
+// NewIdentityBLS creates a new BLS identity struct given a point of the G2
+// group of the bn256 pairing.
+func NewIdentityBLS(public kyber.Point) (Identity, error) {
+	buf, err := public.MarshalBinary()
+	if err != nil {
+		return Identity{}, err
+	}
+	return NewIdentityBLSFromBytes(buf), nil
+}
+
+// NewIdentityBLSFromBytes creates a new BLS identity struct given the
+// marshalled point of the G2 group of the bn256 pairing.
+func NewIdentityBLSFromBytes(public []byte) Identity {
+	return Identity{
+		BLS: &IdentityBLS{
+			Public: public,
+		},
+	}
+}
+
+// Equal returns true if both IdentityBLS point to the same data.
+func (idb IdentityBLS) Equal(idb2 *IdentityBLS) bool {
+	return bytes.Equal(idb.Public, idb2.Public)
+}
+
+// Verify returns nil if the signature is correct, or an error if something
+// fails.
+func (idb IdentityBLS) Verify(msg, sig []byte) error {
+	public, err := idb.point()
+	if err != nil {
+		return err
+	}
+	return bls.Verify(blsSuite, public, msg, sig)
+}
+
+func (idb IdentityBLS) point() (kyber.Point, error) {
+	public := blsSuite.G2().Point()
+	if err := public.UnmarshalBinary(idb.Public); err != nil {
+		return nil, errors.New("invalid bls public key: " + err.Error())
+	}
+	return public, nil
+}
+
+// verifyBLSBatch verifies the signatures of many BLS identities on the same
+// message with a single pairing check. Every signature is weighted with a
+// random scalar, so that a signer cannot choose a key that cancels out the
+// missing signature of another identity.
+func verifyBLSBatch(ids []IdentityBLS, msg []byte, sigs [][]byte) error {
+	aggPublic := blsSuite.G2().Point().Null()
+	aggSig := blsSuite.G1().Point().Null()
+	for i, id := range ids {
+		public, err := id.point()
+		if err != nil {
+			return err
+		}
+		sig := blsSuite.G1().Point()
+		if err = sig.UnmarshalBinary(sigs[i]); err != nil {
+			return errors.New("invalid bls signature: " + err.Error())
+		}
+		r := blsSuite.G1().Scalar().Pick(blsSuite.RandomStream())
+		aggPublic.Add(aggPublic, blsSuite.G2().Point().Mul(r, public))
+		aggSig.Add(aggSig, sig.Mul(r, sig))
+	}
+	aggSigBuf, err := aggSig.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return bls.Verify(blsSuite, aggPublic, msg, aggSigBuf)
+}
+
+// NewSignerBLS initializes a new SignerBLS signer given public and private
+// keys. If either of the given keys is nil, then a new key pair is
+// generated.
+func NewSignerBLS(public kyber.Point, private kyber.Scalar) (Signer, error) {
+	if public == nil || private == nil {
+		private, public = bls.NewKeyPair(blsSuite, blsSuite.RandomStream())
+	}
+	publicBuf, err := public.MarshalBinary()
+	if err != nil {
+		return Signer{}, err
+	}
+	privateBuf, err := private.MarshalBinary()
+	if err != nil {
+		return Signer{}, err
+	}
+	return Signer{BLS: &SignerBLS{
+		Public: publicBuf,
+		Secret: privateBuf,
+	}}, nil
+}
+
+// Sign creates a BLS signature on the message.
+func (bs SignerBLS) Sign(msg []byte) ([]byte, error) {
+	private, err := bs.private()
+	if err != nil {
+		return nil, err
+	}
+	return bls.Sign(blsSuite, private, msg)
+}
+
+func (bs SignerBLS) private() (kyber.Scalar, error) {
+	private := blsSuite.G2().Scalar()
+	if err := private.UnmarshalBinary(bs.Secret); err != nil {
+		return nil, err
+	}
+	return private, nil
+}
+
+// NewIdentityWebAuthn creates a new WebAuthn identity struct given the
+// PKIX-encoded public key of the credential, the id of the relying party
+// and the origin the assertions are made for.
+func NewIdentityWebAuthn(public []byte, rpID, origin string) Identity {
+	return Identity{
+		WebAuthn: &IdentityWebAuthn{
+			Public: public,
+			RPID:   rpID,
+			Origin: origin,
+		},
+	}
+}
+
+// Equal returns true if both IdentityWebAuthn point to the same data.
+func (idw IdentityWebAuthn) Equal(idw2 *IdentityWebAuthn) bool {
+	return bytes.Equal(idw.Public, idw2.Public) && idw.RPID == idw2.RPID &&
+		idw.Origin == idw2.Origin
+}
+
+// marshal returns the protobuf encoding of the identity, which is used in
+// its string, as the identity is more than its public key.
+func (idw IdentityWebAuthn) marshal() []byte {
+	// The encoding of a struct of bytes and strings cannot fail.
+	buf, _ := protobuf.Encode(&idw)
+	return buf
+}
+
+// clientData holds the fields of the ClientDataJSON that are verified.
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// Verify returns nil if sig is a protobuf-encoded WebAuthnSignature of an
+// assertion on msg, or an error if something fails. The challenge of the
+// client data must be msg encoded in base64url, its origin must be the one
+// of the identity, and the authenticator must have made the assertion for
+// the relying party of the identity and checked the presence of the user.
+func (idw IdentityWebAuthn) Verify(msg, sig []byte) error {
+	public, err := idw.publicKey()
+	if err != nil {
+		return err
+	}
+	var ws WebAuthnSignature
+	if err = protobuf.Decode(sig, &ws); err != nil {
+		return errors.New("invalid webauthn signature: " + err.Error())
+	}
+	var cd clientData
+	if err = json.Unmarshal(ws.ClientDataJSON, &cd); err != nil {
+		return errors.New("invalid client data: " + err.Error())
+	}
+	if cd.Type != "webauthn.get" {
+		return errors.New("client data is not an assertion")
+	}
+	if cd.Challenge != base64.RawURLEncoding.EncodeToString(msg) {
+		return errors.New("challenge is not the message")
+	}
+	if cd.Origin != idw.Origin {
+		return errors.New("client data is for another origin")
+	}
+	// The authenticator data starts with the 32-byte hash of the relying
+	// party, followed by the flags.
+	if len(ws.AuthenticatorData) < 37 {
+		return errors.New("authenticator data is too short")
+	}
+	rpHash := sha256.Sum256([]byte(idw.RPID))
+	if !bytes.Equal(ws.AuthenticatorData[:32], rpHash[:]) {
+		return errors.New("assertion is for another relying party")
+	}
+	if ws.AuthenticatorData[32]&0x01 == 0 {
+		return errors.New("user is not present")
+	}
+	rs := &sigRS{}
+	if _, err = asn1.Unmarshal(ws.Signature, rs); err != nil {
+		return err
+	}
+	if ecdsa.Verify(public, webAuthnDigest(ws.AuthenticatorData, ws.ClientDataJSON), rs.R, rs.S) {
+		return nil
+	}
+	return errors.New("Wrong signature")
+}
+
+func (idw IdentityWebAuthn) publicKey() (*ecdsa.PublicKey, error) {
+	public, err := x509.ParsePKIXPublicKey(idw.Public)
+	if err != nil {
+		return nil, errors.New("invalid webauthn public key: " + err.Error())
+	}
+	ecPublic, ok := public.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("webauthn public key is not an ECDSA key")
+	}
+	// Authenticators sign with ES256, which is ECDSA on P-256.
+	if ecPublic.Curve != elliptic.P256() {
+		return nil, errors.New("webauthn public key is not on the P-256 curve")
+	}
+	return ecPublic, nil
+}
+
+// webAuthnDigest returns the digest signed by an authenticator.
+func webAuthnDigest(authData, clientDataJSON []byte) []byte {
+	clientHash := sha256.Sum256(clientDataJSON)
+	h := sha256.New()
+	h.Write(authData)
+	h.Write(clientHash[:])
+	return h.Sum(nil)
+}
+
+// NewSignerWebAuthn creates a new SignerWebAuthn with a new P-256 key pair
+// for the relying party rpID and the origin - mostly for tests, as the keys
+// of real credentials never leave their authenticator.
+func NewSignerWebAuthn(rpID, origin string) (Signer, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return Signer{}, err
+	}
+	public, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	if err != nil {
+		return Signer{}, err
+	}
+	secret, err := x509.MarshalECPrivateKey(private)
+	if err != nil {
+		return Signer{}, err
+	}
+	return Signer{WebAuthn: &SignerWebAuthn{
+		Public: public,
+		Secret: secret,
+		RPID:   rpID,
+		Origin: origin,
+	}}, nil
+}
+
+// Sign creates a protobuf-encoded WebAuthnSignature on the message, like an
+// authenticator would for the relying party and the origin of the signer.
+func (ws SignerWebAuthn) Sign(msg []byte) ([]byte, error) {
+	private, err := x509.ParseECPrivateKey(ws.Secret)
+	if err != nil {
+		return nil, errors.New("signer lacks a private key")
+	}
+	cdJSON, err := json.Marshal(clientData{
+		Type:      "webauthn.get",
+		Challenge: base64.RawURLEncoding.EncodeToString(msg),
+		Origin:    ws.Origin,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The hash of the relying party, the user-present flag and a zero
+	// signature counter.
+	rpHash := sha256.Sum256([]byte(ws.RPID))
+	authData := append(rpHash[:], 0x01, 0, 0, 0, 0)
+	r, s, err := ecdsa.Sign(rand.Reader, private, webAuthnDigest(authData, cdJSON))
+	if err != nil {
+		return nil, err
+	}
+	sig, err := asn1.Marshal(sigRS{R: r, S: s})
+	if err != nil {
+		return nil, err
+	}
+	return protobuf.Encode(&WebAuthnSignature{
+		AuthenticatorData: authData,
+		ClientDataJSON:    cdJSON,
+		Signature:         sig,
+	})
+}
@@ -0,0 +1,156 @@
+package darc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/dedis/cothority/byzcoin/darc/expression"
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentity_Signers(t *testing.T) {
+	secp, err := NewSignerSecp256k1(nil)
+	require.Nil(t, err)
+	blsSigner, err := NewSignerBLS(nil, nil)
+	require.Nil(t, err)
+	webauthn, err := NewSignerWebAuthn("example.com", "https://example.com")
+	require.Nil(t, err)
+	msg := []byte("message")
+	for _, s := range []Signer{NewSignerEd25519(nil, nil), secp, blsSigner, webauthn} {
+		id := s.Identity()
+		require.Equal(t, s.Type(), id.Type())
+		require.True(t, strings.HasPrefix(id.String(), id.TypeString()+":"))
+
+		sig, err := s.Sign(msg)
+		require.Nil(t, err)
+		require.Nil(t, id.Verify(msg, sig))
+		require.NotNil(t, id.Verify([]byte("other message"), sig))
+
+		parsed, err := ParseIdentity(id.String())
+		require.Nil(t, err)
+		require.True(t, id.Equal(&parsed))
+		require.Nil(t, parsed.Verify(msg, sig))
+	}
+
+	// The secp256k1 signer can be restored from its private key.
+	secp2, err := NewSignerSecp256k1(secp.Secp256k1.Secret)
+	require.Nil(t, err)
+	require.Equal(t, secp.Identity().String(), secp2.Identity().String())
+
+	// The WebAuthn signer keeps its private key when it is stored.
+	buf, err := protobuf.Encode(&webauthn)
+	require.Nil(t, err)
+	var webauthn2 Signer
+	require.Nil(t, protobuf.Decode(buf, &webauthn2))
+	sig, err := webauthn2.Sign(msg)
+	require.Nil(t, err)
+	require.Nil(t, webauthn.Identity().Verify(msg, sig))
+
+	// A WebAuthn identity needs a relying party, an origin and a P-256 key.
+	noOrigin := NewIdentityWebAuthn(webauthn.WebAuthn.Public, "example.com", "")
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.Nil(t, err)
+	p384Public, err := x509.MarshalPKIXPublicKey(&p384.PublicKey)
+	require.Nil(t, err)
+	otherCurve := NewIdentityWebAuthn(p384Public, "example.com", "https://example.com")
+	for _, s := range []string{"ed25519", "bls:00", "secp256k1:zz", "webauthn:00",
+		noOrigin.String(), otherCurve.String(), "unknown:00"} {
+		_, err := ParseIdentity(s)
+		require.NotNil(t, err, s)
+	}
+}
+
+func TestIdentity_Secp256k1HighS(t *testing.T) {
+	s, err := NewSignerSecp256k1(nil)
+	require.Nil(t, err)
+	msg := []byte("message")
+	sig, err := s.Sign(msg)
+	require.Nil(t, err)
+	id := s.Identity()
+	require.Nil(t, id.Verify(msg, sig))
+
+	// The same signature with N-S is refused.
+	rs := &sigRS{}
+	_, err = asn1.Unmarshal(sig, rs)
+	require.Nil(t, err)
+	rs.S.Sub(btcec.S256().N, rs.S)
+	highS, err := asn1.Marshal(*rs)
+	require.Nil(t, err)
+	require.NotNil(t, id.Verify(msg, highS))
+}
+
+func TestIdentity_WebAuthn(t *testing.T) {
+	s, err := NewSignerWebAuthn("example.com", "https://example.com")
+	require.Nil(t, err)
+	msg := []byte("message")
+	sigBuf, err := s.Sign(msg)
+	require.Nil(t, err)
+	sig := func(f func(*WebAuthnSignature)) []byte {
+		ws := WebAuthnSignature{}
+		require.Nil(t, protobuf.Decode(sigBuf, &ws))
+		f(&ws)
+		buf, err := protobuf.Encode(&ws)
+		require.Nil(t, err)
+		return buf
+	}
+	id := s.Identity()
+	require.Nil(t, id.Verify(msg, sig(func(*WebAuthnSignature) {})))
+	// The user must be present.
+	require.NotNil(t, id.Verify(msg, sig(func(ws *WebAuthnSignature) {
+		ws.AuthenticatorData[32] = 0
+	})))
+	// Only assertions are accepted.
+	require.NotNil(t, id.Verify(msg, sig(func(ws *WebAuthnSignature) {
+		ws.ClientDataJSON = []byte(strings.Replace(string(ws.ClientDataJSON),
+			"webauthn.get", "webauthn.create", 1))
+	})))
+
+	// Assertions of the same credential for another site are refused.
+	other := s
+	other.WebAuthn = &SignerWebAuthn{}
+	*other.WebAuthn = *s.WebAuthn
+	other.WebAuthn.Origin = "https://evil.com"
+	otherSig, err := other.Sign(msg)
+	require.Nil(t, err)
+	require.NotNil(t, id.Verify(msg, otherSig))
+	other.WebAuthn.Origin = s.WebAuthn.Origin
+	other.WebAuthn.RPID = "evil.com"
+	otherSig, err = other.Sign(msg)
+	require.Nil(t, err)
+	require.NotNil(t, id.Verify(msg, otherSig))
+}
+
+func TestIdentity_BLSRequest(t *testing.T) {
+	var signers []Signer
+	var ids []string
+	for i := 0; i < 3; i++ {
+		s, err := NewSignerBLS(nil, nil)
+		require.Nil(t, err)
+		signers = append(signers, s)
+		ids = append(ids, s.Identity().String())
+	}
+	signers = append(signers, NewSignerEd25519(nil, nil))
+	ids = append(ids, signers[3].Identity().String())
+	owner := []Identity{signers[3].Identity()}
+	d := NewDarc(InitRules(owner, owner), []byte("bls"))
+	require.Nil(t, d.Rules.AddRule("spawn:bls", expression.InitAndExpr(ids...)))
+
+	r, err := InitAndSignRequest(d.GetBaseID(), "spawn:bls", []byte("msg"), signers...)
+	require.Nil(t, err)
+	require.Nil(t, r.VerifyWithCB(d, nil))
+
+	// The batch verification fails if any BLS signature is wrong, even
+	// if the sum of the signatures is still the same.
+	r.Signatures[0], r.Signatures[1] = r.Signatures[1], r.Signatures[0]
+	require.NotNil(t, r.VerifyWithCB(d, nil))
+	r.Signatures[0], r.Signatures[1] = r.Signatures[1], r.Signatures[0]
+	r.Signatures[2] = r.Signatures[0]
+	require.NotNil(t, r.VerifyWithCB(d, nil))
+}
@@ -53,8 +53,9 @@ type Darc struct {
 	VerificationDarcs []*Darc
 }
 
-// Identity is a generic structure can be either an Ed25519 public key, a Darc
-// or a X509 Identity.
+// Identity is a generic structure can be either an Ed25519 public key, a Darc,
+// a X509 Identity, a Secp256k1 public key, a BLS public key or a WebAuthn
+// credential.
 type Identity struct {
 	// Darc identity
 	Darc *IdentityDarc
@@ -62,6 +63,12 @@ type Identity struct {
 	Ed25519 *IdentityEd25519
 	// Public-key identity
 	X509EC *IdentityX509EC
+	// Public-key identity
+	Secp256k1 *IdentitySecp256k1
+	// Public-key identity
+	BLS *IdentityBLS
+	// Public-key identity of a hardware authenticator
+	WebAuthn *IdentityWebAuthn
 }
 
 // IdentityEd25519 holds a Ed25519 public key (Point)
@@ -74,6 +81,31 @@ type IdentityX509EC struct {
 	Public []byte
 }
 
+// IdentitySecp256k1 holds a compressed public key of the secp256k1 curve,
+// as used by Bitcoin and Ethereum wallets.
+type IdentitySecp256k1 struct {
+	Public []byte
+}
+
+// IdentityBLS holds a BLS public key, which is a marshalled point of the G2
+// group of the bn256 pairing.
+type IdentityBLS struct {
+	Public []byte
+}
+
+// IdentityWebAuthn holds the PKIX-encoded P-256 public key of a WebAuthn
+// credential, together with the relying party and the origin its
+// assertions must be made for.
+type IdentityWebAuthn struct {
+	Public []byte
+	// RPID is the id of the relying party, whose hash starts the
+	// authenticator data.
+	RPID string
+	// Origin is the origin in the client data, such as
+	// https://example.com.
+	Origin string
+}
+
 // IdentityDarc is a structure that points to a Darc with a given ID on a
 // skipchain. The signer should belong to the Darc.
 type IdentityDarc struct {
@@ -92,8 +124,11 @@ type Signature struct {
 
 // Signer is a generic structure that can hold different types of signers
 type Signer struct {
-	Ed25519 *SignerEd25519
-	X509EC  *SignerX509EC
+	Ed25519   *SignerEd25519
+	X509EC    *SignerX509EC
+	Secp256k1 *SignerSecp256k1
+	BLS       *SignerBLS
+	WebAuthn  *SignerWebAuthn
 }
 
 // SignerEd25519 holds a public and private keys necessary to sign Darcs
@@ -109,6 +144,43 @@ type SignerX509EC struct {
 	secret []byte
 }
 
+// SignerSecp256k1 holds a public and private keys of the secp256k1 curve
+// necessary to sign Darcs
+type SignerSecp256k1 struct {
+	Public []byte
+	Secret []byte
+}
+
+// SignerBLS holds a marshalled public and private BLS keys necessary to sign
+// Darcs
+type SignerBLS struct {
+	Public []byte
+	Secret []byte
+}
+
+// SignerWebAuthn holds the keys of a WebAuthn credential. It signs in
+// software like an authenticator would, mostly for tests. Secret is the
+// SEC1-encoded P-256 private key, so that the signer can be stored.
+type SignerWebAuthn struct {
+	Public []byte
+	Secret []byte
+	RPID   string
+	Origin string
+}
+
+// WebAuthnSignature is the assertion of a WebAuthn authenticator, which is
+// used as the signature of an IdentityWebAuthn.
+type WebAuthnSignature struct {
+	// AuthenticatorData as returned by the authenticator.
+	AuthenticatorData []byte
+	// ClientDataJSON as returned by the browser, whose challenge is the
+	// signed message.
+	ClientDataJSON []byte
+	// Signature is the ASN.1-encoded ECDSA signature on the
+	// AuthenticatorData and the hash of the ClientDataJSON.
+	Signature []byte
+}
+
 // Request is the structure that the client must provide to be verified
 type Request struct {
 	BaseID     ID
@@ -128,3 +200,17 @@ type Rule struct {
 	Action Action
 	Expr   expression.Expr
 }
+
+// RuleChange is the difference of the expression of an action between two
+// versions of the rules.
+type RuleChange struct {
+	Action Action
+	// Old is the expression before the change, it is not set for an added
+	// rule.
+	// optional
+	Old expression.Expr
+	// New is the expression after the change, it is not set for a removed
+	// rule.
+	// optional
+	New expression.Expr
+}
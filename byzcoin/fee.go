@@ -0,0 +1,219 @@
+package byzcoin
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin/collection"
+	"github.com/dedis/cothority/byzcoin/darc"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// feeAction is the rule of the darc of the paying coin instance that must be
+// satisfied by the signatures of the fee.
+const feeAction = darc.Action("invoke:transfer")
+
+// hash returns the hash of the fee, which includes the hash of the
+// instructions, so that the fee cannot be used for another transaction.
+func (f Fee) hash(instructionsHash []byte) []byte {
+	h := sha256.New()
+	h.Write(instructionsHash)
+	h.Write(f.Coin.Slice())
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, f.Amount)
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// feeRequest converts the fee into a darc.Request for the darc with the given
+// base ID.
+func (ctx ClientTransaction) feeRequest(baseID darc.ID) darc.Request {
+	ids := make([]darc.Identity, len(ctx.Fee.Signatures))
+	sigs := make([][]byte, len(ctx.Fee.Signatures))
+	for i, sig := range ctx.Fee.Signatures {
+		ids[i] = sig.Signer
+		sigs[i] = sig.Signature
+	}
+	return darc.NewRequest(baseID, feeAction, ctx.Fee.hash(ctx.Instructions.Hash()),
+		ids, sigs)
+}
+
+// SignFee sets the fee of the transaction, which is paid by the coin
+// instance coin, controlled by the darc darcID. The signers must satisfy the
+// "invoke:transfer" rule of the darc. As the signatures cover the
+// instructions, they must not be changed afterwards.
+func (ctx *ClientTransaction) SignFee(coin InstanceID, amount uint64, darcID darc.ID, signers ...darc.Signer) error {
+	ctx.Fee = &Fee{
+		Coin:       coin,
+		Amount:     amount,
+		Signatures: make([]darc.Signature, len(signers)),
+	}
+	for i, signer := range signers {
+		ctx.Fee.Signatures[i].Signer = signer.Identity()
+	}
+	req := ctx.feeRequest(darcID)
+	digest := req.Hash()
+	for i := range signers {
+		sig, err := signers[i].Sign(digest)
+		if err != nil {
+			return err
+		}
+		ctx.Fee.Signatures[i].Signature = sig
+	}
+	return nil
+}
+
+// feeAmount returns the fee paid by the transaction, or 0 if it has no fee.
+func (ctx ClientTransaction) feeAmount() uint64 {
+	if ctx.Fee == nil {
+		return 0
+	}
+	return ctx.Fee.Amount
+}
+
+// sortByFee orders the transactions by decreasing fee. The fees are
+// verified against the state in coll first: a fee that is wrongly signed, or
+// that the paying coin instance cannot cover, counts as no fee, so that a
+// transaction cannot get ahead by claiming a fee it doesn't pay. Transactions
+// paying the same fee keep their order.
+func sortByFee(config *ChainConfig, coll CollectionView, coinContract string, txs []ClientTransaction) {
+	fees := make([]uint64, len(txs))
+	for i, tx := range txs {
+		if _, err := feeStateChanges(config, coll, tx, coinContract); err == nil {
+			fees[i] = tx.feeAmount()
+		}
+	}
+	order := make([]int, len(txs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return fees[order[i]] > fees[order[j]]
+	})
+	sorted := make([]ClientTransaction, len(txs))
+	for i, o := range order {
+		sorted[i] = txs[o]
+	}
+	copy(txs, sorted)
+}
+
+// loadFeeCoin returns the coin stored in the coin instance with the given
+// ID, together with its darc. The instance must belong to the contract
+// coinContract.
+func loadFeeCoin(coll CollectionView, id InstanceID, coinContract string) (*Coin, darc.ID, error) {
+	value, contractID, darcID, err := coll.GetValues(id.Slice())
+	if err != nil {
+		return nil, nil, err
+	}
+	if contractID != coinContract {
+		return nil, nil, fmt.Errorf("instance %v is not a coin instance", id)
+	}
+	var coin Coin
+	err = protobuf.DecodeWithConstructors(value, &coin, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &coin, darcID, nil
+}
+
+// feeStateChanges verifies the fee of the transaction and returns the state
+// changes moving the fee from the paying coin instance to the reward
+// account. The coin instances belong to the contract coinContract. If the
+// config doesn't define fees, no state changes are returned.
+func feeStateChanges(config *ChainConfig, coll CollectionView, ctx ClientTransaction, coinContract string) (StateChanges, error) {
+	if config == nil || config.FeeCoinType.Equal(InstanceID{}) {
+		return nil, nil
+	}
+	if coinContract == "" {
+		return nil, errors.New("no contract is registered for the fees")
+	}
+	if ctx.Fee == nil {
+		if config.MinFee > 0 {
+			return nil, errors.New("transaction doesn't pay a fee")
+		}
+		return nil, nil
+	}
+	fee := ctx.Fee
+	if fee.Amount < config.MinFee {
+		return nil, fmt.Errorf("fee is less than the minimal fee of %d", config.MinFee)
+	}
+
+	d, err := getInstanceDarc(coll, fee.Coin)
+	if err != nil {
+		return nil, errors.New("darc of fee coin not found: " + err.Error())
+	}
+	req := ctx.feeRequest(d.GetBaseID())
+	if err = req.VerifyWithCB(d, darcGetter(coll)); err != nil {
+		return nil, errors.New("fee verification failed: " + err.Error())
+	}
+
+	payer, payerDarc, err := loadFeeCoin(coll, fee.Coin, coinContract)
+	if err != nil {
+		return nil, err
+	}
+	if !payer.Name.Equal(config.FeeCoinType) {
+		return nil, errors.New("fee is not paid in the coins of the fees")
+	}
+	if err = payer.SafeSub(fee.Amount); err != nil {
+		return nil, err
+	}
+	// The reward account can pay fees too. It needs to hold the fee, which
+	// it then receives back, so it gets one state change only.
+	if fee.Coin.Equal(config.FeeReward) {
+		if err = payer.SafeAdd(fee.Amount); err != nil {
+			return nil, err
+		}
+		payerBuf, err := protobuf.Encode(payer)
+		if err != nil {
+			return nil, err
+		}
+		return StateChanges{
+			NewStateChange(Update, fee.Coin, coinContract, payerBuf, payerDarc),
+		}, nil
+	}
+	reward, rewardDarc, err := loadFeeCoin(coll, config.FeeReward, coinContract)
+	if err != nil {
+		return nil, errors.New("couldn't load reward account: " + err.Error())
+	}
+	if !reward.Name.Equal(config.FeeCoinType) {
+		return nil, errors.New("reward account doesn't hold the coins of the fees")
+	}
+	if err = reward.SafeAdd(fee.Amount); err != nil {
+		return nil, err
+	}
+
+	payerBuf, err := protobuf.Encode(payer)
+	if err != nil {
+		return nil, err
+	}
+	rewardBuf, err := protobuf.Encode(reward)
+	if err != nil {
+		return nil, err
+	}
+	return StateChanges{
+		NewStateChange(Update, fee.Coin, coinContract, payerBuf, payerDarc),
+		NewStateChange(Update, config.FeeReward, coinContract, rewardBuf, rewardDarc),
+	}, nil
+}
+
+// chargeFee stores in coll the state changes paying the fee of the
+// transaction, and returns them. It is used for the refused transactions,
+// which are included in the block and used the resources of the nodes, so
+// they pay their fee too.
+func chargeFee(config *ChainConfig, coll *collection.Collection, ctx ClientTransaction, coinContract string) (StateChanges, error) {
+	scs, err := feeStateChanges(config, &roCollection{coll}, ctx, coinContract)
+	if err != nil {
+		return nil, err
+	}
+	for _, sc := range scs {
+		if err = storeInColl(coll, &sc); err != nil {
+			return nil, err
+		}
+	}
+	return scs, nil
+}
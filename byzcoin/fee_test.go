@@ -0,0 +1,179 @@
+package byzcoin
+
+import (
+	"testing"
+
+	"github.com/dedis/cothority/byzcoin/collection"
+	"github.com/dedis/cothority/byzcoin/darc"
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFee_StateChanges(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	ids := []darc.Identity{signer.Identity()}
+	d := darc.NewDarc(darc.InitRules(ids, ids), []byte("fee darc"))
+	require.Nil(t, d.Rules.AddRule(feeAction, d.Rules.GetSignExpr()))
+	dBuf, err := d.ToProto()
+	require.Nil(t, err)
+
+	coinContract := "coin"
+	coinType := NewInstanceID([]byte("fee coins"))
+	payerID := NewInstanceID([]byte("payer"))
+	rewardID := NewInstanceID([]byte("reward"))
+	otherID := NewInstanceID([]byte("other"))
+	coll := collection.New(collection.Data{}, collection.Data{}, collection.Data{})
+	store := func(id InstanceID, contractID string, value interface{}) {
+		buf, ok := value.([]byte)
+		if !ok {
+			buf, err = protobuf.Encode(value)
+			require.Nil(t, err)
+		}
+		sc := NewStateChange(Create, id, contractID, buf, d.GetBaseID())
+		require.Nil(t, storeInColl(coll, &sc))
+	}
+	store(NewInstanceID(d.GetBaseID()), ContractDarcID, dBuf)
+	store(payerID, coinContract, &Coin{Name: coinType, Value: 100})
+	store(rewardID, coinContract, &Coin{Name: coinType})
+	store(otherID, coinContract, &Coin{Name: NewInstanceID([]byte("other coins")), Value: 100})
+	cv := &roCollection{coll}
+
+	config := &ChainConfig{FeeCoinType: coinType, FeeReward: rewardID, MinFee: 5}
+	ctx, err := createOneClientTx(d.GetBaseID(), "dummy", []byte("value"), signer)
+	require.Nil(t, err)
+
+	// No fee, but a minimal fee is needed.
+	_, err = feeStateChanges(config, cv, ctx, coinContract)
+	require.NotNil(t, err)
+	// No fees without a configuration or a coin type.
+	scs, err := feeStateChanges(nil, cv, ctx, coinContract)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(scs))
+	scs, err = feeStateChanges(&ChainConfig{}, cv, ctx, coinContract)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(scs))
+	// No minimal fee.
+	scs, err = feeStateChanges(&ChainConfig{FeeCoinType: coinType, FeeReward: rewardID}, cv, ctx, coinContract)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(scs))
+
+	// Correct fee.
+	require.Nil(t, ctx.SignFee(payerID, 10, d.GetBaseID(), signer))
+	scs, err = feeStateChanges(config, cv, ctx, coinContract)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(scs))
+	var payer, reward Coin
+	require.Nil(t, protobuf.Decode(scs[0].Value, &payer))
+	require.Nil(t, protobuf.Decode(scs[1].Value, &reward))
+	require.True(t, payerID.Equal(NewInstanceID(scs[0].InstanceID)))
+	require.True(t, rewardID.Equal(NewInstanceID(scs[1].InstanceID)))
+	require.Equal(t, uint64(90), payer.Value)
+	require.Equal(t, uint64(10), reward.Value)
+
+	// Fee below the minimal fee.
+	require.Nil(t, ctx.SignFee(payerID, 4, d.GetBaseID(), signer))
+	_, err = feeStateChanges(config, cv, ctx, coinContract)
+	require.NotNil(t, err)
+
+	// More than the balance of the coin instance.
+	require.Nil(t, ctx.SignFee(payerID, 101, d.GetBaseID(), signer))
+	_, err = feeStateChanges(config, cv, ctx, coinContract)
+	require.NotNil(t, err)
+
+	// Wrong signer.
+	require.Nil(t, ctx.SignFee(payerID, 10, d.GetBaseID(), darc.NewSignerEd25519(nil, nil)))
+	_, err = feeStateChanges(config, cv, ctx, coinContract)
+	require.NotNil(t, err)
+
+	// The fee cannot be reused with other instructions.
+	require.Nil(t, ctx.SignFee(payerID, 10, d.GetBaseID(), signer))
+	ctx2, err := createOneClientTx(d.GetBaseID(), "dummy", []byte("other value"), signer)
+	require.Nil(t, err)
+	ctx2.Fee = ctx.Fee
+	_, err = feeStateChanges(config, cv, ctx2, coinContract)
+	require.NotNil(t, err)
+
+	// Wrong type of coins.
+	require.Nil(t, ctx.SignFee(otherID, 10, d.GetBaseID(), signer))
+	_, err = feeStateChanges(config, cv, ctx, coinContract)
+	require.NotNil(t, err)
+
+	// Instances of another contract.
+	require.Nil(t, ctx.SignFee(payerID, 10, d.GetBaseID(), signer))
+	_, err = feeStateChanges(config, cv, ctx, "other")
+	require.NotNil(t, err)
+	_, err = feeStateChanges(config, cv, ctx, "")
+	require.NotNil(t, err)
+
+	// The reward account needs to hold the fee it pays.
+	require.Nil(t, ctx.SignFee(rewardID, 10, d.GetBaseID(), signer))
+	_, err = feeStateChanges(config, cv, ctx, coinContract)
+	require.NotNil(t, err)
+	sc := NewStateChange(Update, rewardID, coinContract, nil, d.GetBaseID())
+	sc.Value, err = protobuf.Encode(&Coin{Name: coinType, Value: 10})
+	require.Nil(t, err)
+	require.Nil(t, storeInColl(coll, &sc))
+	scs, err = feeStateChanges(config, cv, ctx, coinContract)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(scs))
+	require.Nil(t, protobuf.Decode(scs[0].Value, &reward))
+	require.Equal(t, uint64(10), reward.Value)
+
+	// The fee of a refused transaction is stored directly.
+	require.Nil(t, ctx.SignFee(payerID, 10, d.GetBaseID(), signer))
+	scs, err = chargeFee(config, coll, ctx, coinContract)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(scs))
+	payerBuf, _, _, err := cv.GetValues(payerID.Slice())
+	require.Nil(t, err)
+	require.Nil(t, protobuf.Decode(payerBuf, &payer))
+	require.Equal(t, uint64(90), payer.Value)
+}
+
+func TestFee_SortByFee(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	ids := []darc.Identity{signer.Identity()}
+	d := darc.NewDarc(darc.InitRules(ids, ids), []byte("fee darc"))
+	require.Nil(t, d.Rules.AddRule(feeAction, d.Rules.GetSignExpr()))
+	dBuf, err := d.ToProto()
+	require.Nil(t, err)
+
+	coinContract := "coin"
+	coinType := NewInstanceID([]byte("fee coins"))
+	payerID := NewInstanceID([]byte("payer"))
+	rewardID := NewInstanceID([]byte("reward"))
+	coll := collection.New(collection.Data{}, collection.Data{}, collection.Data{})
+	store := func(id InstanceID, contractID string, value interface{}) {
+		buf, ok := value.([]byte)
+		if !ok {
+			buf, err = protobuf.Encode(value)
+			require.Nil(t, err)
+		}
+		sc := NewStateChange(Create, id, contractID, buf, d.GetBaseID())
+		require.Nil(t, storeInColl(coll, &sc))
+	}
+	store(NewInstanceID(d.GetBaseID()), ContractDarcID, dBuf)
+	store(payerID, coinContract, &Coin{Name: coinType, Value: 25})
+	store(rewardID, coinContract, &Coin{Name: coinType})
+	config := &ChainConfig{FeeCoinType: coinType, FeeReward: rewardID}
+
+	// The last two transactions claim fees they cannot pay: one is signed
+	// by the wrong signer, the other one is more than the balance.
+	txs := make([]ClientTransaction, 6)
+	for i, amount := range []uint64{0, 10, 20, 10, 30, 50} {
+		txs[i], err = createOneClientTx(d.GetBaseID(), "dummy", []byte{byte(i)}, signer)
+		require.Nil(t, err)
+		if amount == 0 {
+			continue
+		}
+		feeSigner := signer
+		if i == 4 {
+			feeSigner = darc.NewSignerEd25519(nil, nil)
+		}
+		require.Nil(t, txs[i].SignFee(payerID, amount, d.GetBaseID(), feeSigner))
+	}
+	sortByFee(config, &roCollection{coll}, coinContract, txs)
+	for i, value := range []byte{2, 1, 3, 0, 4, 5} {
+		require.Equal(t, []byte{value}, txs[i].Instructions[0].Spawn.Args.Search("data"))
+	}
+}
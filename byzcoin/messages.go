@@ -13,6 +13,17 @@ func init() {
 	network.RegisterMessages(
 		&CreateGenesisBlock{}, &CreateGenesisBlockResponse{},
 		&AddTxRequest{}, &AddTxResponse{},
+		&SimulateTxRequest{}, &SimulateTxResponse{},
+		&GetTxStatus{}, &GetTxStatusResponse{},
+		&GetProofs{}, &GetProofsResponse{},
+		&GetSignerCounters{}, &GetSignerCountersResponse{},
+		&Query{}, &QueryResponse{},
+		&GetSnapshot{}, &GetSnapshotResponse{},
+		&ListInstances{}, &ListInstancesResponse{},
+		&GetInstanceHistory{}, &GetInstanceHistoryResponse{},
+		&GetDarcHistory{}, &GetDarcHistoryResponse{},
+		&GetAuthorizations{}, &GetAuthorizationsResponse{},
+		&StreamingRequest{}, &StreamingResponse{},
 	)
 }
 
@@ -0,0 +1,217 @@
+package byzcoin
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/dedis/cothority/byzcoin/collection"
+	"github.com/dedis/cothority/byzcoin/darc"
+	"github.com/dedis/onet/log"
+)
+
+// errExecutionTime is the error of an instruction whose contract ran for
+// longer than the MaxExecutionTime of the configuration. As the execution
+// time depends on the node, it never ends up in a block: the leader leaves
+// the transaction out of the block it plans, like a transaction that
+// doesn't fit, and the other nodes run all the transactions of the block.
+// The limits that all nodes check are the deterministic MaxReads, MaxWrites
+// and MaxStateChangeBytes.
+const errExecutionTime = "instruction exceeded the maximum execution time"
+
+// maxStuckContracts is the maximum number of contracts that still run after
+// they timed out. Their go-routines cannot be killed, and only end once the
+// contract reads the collection again, so a contract looping without
+// reading keeps its go-routine forever. Once there are this many, the
+// contracts are not run anymore when a timeout is given, which leaves their
+// transactions out of the blocks.
+const maxStuckContracts = 16
+
+// stuckContracts counts the contracts that still run after they timed out.
+var stuckContracts int32
+
+// errTooManyReads is returned to a contract reading the collection more
+// often than the MaxReads of the configuration.
+var errTooManyReads = errors.New("instruction exceeded the maximum number of reads")
+
+// stoppableView is a CollectionView that can refuse all further reads.
+type stoppableView interface {
+	CollectionView
+	stop()
+}
+
+// meteredCollection counts the reads of a contract. Once the contract read
+// more than maxReads keys, or once it has been stopped, GetValues and
+// ForEach return an error, and Get panics.
+type meteredCollection struct {
+	CollectionView
+	maxReads int64
+	reads    int64
+	// stopped is shared with the collections of the contracts called by
+	// this one, so that they are stopped together.
+	stopped *int32
+}
+
+func newMeteredCollection(coll CollectionView, config *ChainConfig) *meteredCollection {
+	mc := &meteredCollection{CollectionView: coll, stopped: new(int32)}
+	if config != nil {
+		mc.maxReads = int64(config.MaxReads)
+	}
+	return mc
+}
+
+// read counts one read and returns an error if the contract is not allowed
+// to read anymore.
+func (mc *meteredCollection) read() error {
+	reads := atomic.AddInt64(&mc.reads, 1)
+	if atomic.LoadInt32(mc.stopped) != 0 {
+		return errors.New(errExecutionTime)
+	}
+	if mc.maxReads > 0 && reads > mc.maxReads {
+		return errTooManyReads
+	}
+	return nil
+}
+
+// stop refuses all further reads, also of the contracts called by the
+// contract using mc.
+func (mc *meteredCollection) stop() {
+	atomic.StoreInt32(mc.stopped, 1)
+}
+
+// Get counts the read and returns the collection.Getter for the key. As
+// a Getter cannot fail, Get panics once the contract is not allowed to read
+// anymore. The panic is recovered by ByzCoin and refuses the instruction.
+func (mc *meteredCollection) Get(key []byte) collection.Getter {
+	if err := mc.read(); err != nil {
+		panic(err.Error())
+	}
+	return mc.CollectionView.Get(key)
+}
+
+// GetValues counts the read and returns the value of the key.
+func (mc *meteredCollection) GetValues(key []byte) (value []byte, contractID string, darcID darc.ID, err error) {
+	if err = mc.read(); err != nil {
+		return
+	}
+	return mc.CollectionView.GetValues(key)
+}
+
+// ForEach counts a read for every entry the collection visits, which are
+// all the entries of the collection if it is not sorted by key, even if
+// only a few of them start with prefix. Else it counts a read for every key
+// given to f.
+func (mc *meteredCollection) ForEach(prefix []byte, f ForEachFn) error {
+	// Don't walk the collection if the next read fails anyway.
+	if mc.maxReads > 0 && atomic.LoadInt64(&mc.reads) >= mc.maxReads {
+		return errTooManyReads
+	}
+	if v, ok := mc.CollectionView.(forEachVisitor); ok {
+		return v.forEachVisit(prefix, mc.read, f)
+	}
+	return mc.CollectionView.ForEach(prefix, func(key, value []byte, contractID string, darcID darc.ID) error {
+		if err := mc.read(); err != nil {
+			return err
+		}
+		return f(key, value, contractID, darcID)
+	})
+}
+
+// metering returns the resources used by the contract that returned scs.
+func (mc *meteredCollection) metering(scs StateChanges, d time.Duration) Metering {
+	m := Metering{
+		Reads:         int(atomic.LoadInt64(&mc.reads)),
+		Writes:        len(scs),
+		ExecutionTime: d,
+	}
+	for _, sc := range scs {
+		m.StateChangeBytes += len(sc.InstanceID) + len(sc.ContractID) +
+			len(sc.Value) + len(sc.DarcID)
+	}
+	return m
+}
+
+// check returns an error if the metering exceeds one of the limits of the
+// configuration. The execution time is not checked here, as it is enforced
+// while the contract is running.
+func (m Metering) check(config *ChainConfig) error {
+	if config == nil {
+		return nil
+	}
+	if config.MaxReads > 0 && m.Reads > config.MaxReads {
+		return fmt.Errorf("instruction used %d reads, more than the maximum of %d",
+			m.Reads, config.MaxReads)
+	}
+	if config.MaxWrites > 0 && m.Writes > config.MaxWrites {
+		return fmt.Errorf("instruction used %d writes, more than the maximum of %d",
+			m.Writes, config.MaxWrites)
+	}
+	if config.MaxStateChangeBytes > 0 && m.StateChangeBytes > config.MaxStateChangeBytes {
+		return fmt.Errorf("instruction created %d bytes of state changes, more than the maximum of %d",
+			m.StateChangeBytes, config.MaxStateChangeBytes)
+	}
+	return nil
+}
+
+// runContract calls the contract with cv. If timeout is bigger than 0, the
+// contract runs in its own go-routine and an error is returned once the
+// timeout expires. The go-routine cannot be killed, but all its further
+// reads of cv will fail. It counts as stuck until the contract returns.
+func runContract(contract ContractFn, cv stoppableView, instr Instruction, cin []Coin, timeout time.Duration) ([]StateChange, []Coin, error) {
+	if timeout <= 0 {
+		return callContract(contract, cv, instr, cin)
+	}
+	if atomic.LoadInt32(&stuckContracts) >= maxStuckContracts {
+		log.Warn("too many contracts are still running after their timeout")
+		return nil, nil, errors.New(errExecutionTime)
+	}
+
+	type result struct {
+		scs  []StateChange
+		cout []Coin
+		err  error
+	}
+	done := make(chan result, 1)
+	// state is 0 while the contract runs, 1 once it returned in time and 2
+	// once it timed out.
+	var state int32
+	go func() {
+		var r result
+		defer func() {
+			if !atomic.CompareAndSwapInt32(&state, 0, 1) {
+				atomic.AddInt32(&stuckContracts, -1)
+			}
+			done <- r
+		}()
+		r.scs, r.cout, r.err = callContract(contract, cv, instr, cin)
+	}()
+
+	select {
+	case r := <-done:
+		return r.scs, r.cout, r.err
+	case <-time.After(timeout):
+		atomic.AddInt32(&stuckContracts, 1)
+		if !atomic.CompareAndSwapInt32(&state, 0, 2) {
+			// The contract returned in the meantime.
+			atomic.AddInt32(&stuckContracts, -1)
+			r := <-done
+			return r.scs, r.cout, r.err
+		}
+		cv.stop()
+		return nil, nil, errors.New(errExecutionTime)
+	}
+}
+
+// callContract calls the contract and turns a panic of the contract into an
+// error. The error is part of the hash of the transactions, so it must be
+// the same whether the contract runs with a timeout, on the leader, or
+// without, on the other nodes.
+func callContract(contract ContractFn, cv CollectionView, instr Instruction, cin []Coin) (scs []StateChange, cout []Coin, err error) {
+	defer func() {
+		if re := recover(); re != nil {
+			err = fmt.Errorf("contract panicked: %v", re)
+		}
+	}()
+	return contract(cv, instr, cin)
+}
@@ -0,0 +1,134 @@
+package byzcoin
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority/byzcoin/collection"
+	"github.com/dedis/cothority/byzcoin/darc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeter_Collection(t *testing.T) {
+	coll := collection.New(collection.Data{}, collection.Data{}, collection.Data{})
+	for i := byte(0); i < 5; i++ {
+		sc := NewStateChange(Create, NewInstanceID([]byte{i}), "dummy", []byte{i}, darc.ID{})
+		require.Nil(t, storeInColl(coll, &sc))
+	}
+
+	mc := newMeteredCollection(&roCollection{coll}, &ChainConfig{MaxReads: 4})
+	_, _, _, err := mc.GetValues(NewInstanceID([]byte{0}).Slice())
+	require.Nil(t, err)
+	mc.Get(NewInstanceID([]byte{1}).Slice())
+	require.Equal(t, int64(2), mc.reads)
+
+	// ForEach reads all the entries of the collection, even if only one of
+	// them has the prefix, so it exceeds the limit before calling f.
+	var keys int
+	err = mc.ForEach(NewInstanceID([]byte{2}).Slice(), func(key, value []byte, contractID string, darcID darc.ID) error {
+		keys++
+		return nil
+	})
+	require.Equal(t, errTooManyReads, err)
+	require.Equal(t, 0, keys)
+	reads := mc.reads
+	err = mc.ForEach(nil, func(key, value []byte, contractID string, darcID darc.ID) error {
+		return nil
+	})
+	require.Equal(t, errTooManyReads, err)
+	require.Equal(t, reads, mc.reads)
+	_, _, _, err = mc.GetValues(NewInstanceID([]byte{0}).Slice())
+	require.Equal(t, errTooManyReads, err)
+	require.PanicsWithValue(t, errTooManyReads.Error(), func() {
+		mc.Get(NewInstanceID([]byte{0}).Slice())
+	})
+
+	// Without limit.
+	mc = newMeteredCollection(&roCollection{coll}, nil)
+	err = mc.ForEach(NewInstanceID([]byte{2}).Slice(), func(key, value []byte, contractID string, darcID darc.ID) error {
+		keys++
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, 1, keys)
+	scs := StateChanges{NewStateChange(Create, NewInstanceID([]byte{6}), "dummy", []byte{1, 2, 3}, darc.ID{})}
+	m := mc.metering(scs, time.Second)
+	require.Equal(t, 5, m.Reads)
+	require.Equal(t, 1, m.Writes)
+	require.Equal(t, 32+5+3, m.StateChangeBytes)
+	require.Equal(t, time.Second, m.ExecutionTime)
+
+	mc.stop()
+	_, _, _, err = mc.GetValues(NewInstanceID([]byte{0}).Slice())
+	require.NotNil(t, err)
+	require.PanicsWithValue(t, errExecutionTime, func() {
+		mc.Get(NewInstanceID([]byte{0}).Slice())
+	})
+}
+
+func TestMeter_Check(t *testing.T) {
+	m := Metering{Reads: 10, Writes: 2, StateChangeBytes: 100}
+	require.Nil(t, m.check(nil))
+	require.Nil(t, m.check(&ChainConfig{}))
+	require.Nil(t, m.check(&ChainConfig{MaxReads: 10, MaxWrites: 2, MaxStateChangeBytes: 100}))
+	require.NotNil(t, m.check(&ChainConfig{MaxReads: 9}))
+	require.NotNil(t, m.check(&ChainConfig{MaxWrites: 1}))
+	require.NotNil(t, m.check(&ChainConfig{MaxStateChangeBytes: 99}))
+}
+
+func TestMeter_RunContract(t *testing.T) {
+	coll := collection.New(collection.Data{}, collection.Data{}, collection.Data{})
+	mc := newMeteredCollection(&roCollection{coll}, nil)
+	release := make(chan bool)
+	slow := func(cv CollectionView, inst Instruction, c []Coin) ([]StateChange, []Coin, error) {
+		<-release
+		return nil, c, nil
+	}
+	_, _, err := runContract(slow, mc, Instruction{}, nil, 10*time.Millisecond)
+	require.NotNil(t, err)
+	require.Equal(t, errExecutionTime, err.Error())
+
+	// The slow contract is stuck until it returns.
+	require.Equal(t, int32(1), atomic.LoadInt32(&stuckContracts))
+	close(release)
+	for i := 0; i < 100 && atomic.LoadInt32(&stuckContracts) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, int32(0), atomic.LoadInt32(&stuckContracts))
+
+	mc = newMeteredCollection(&roCollection{coll}, nil)
+	fast := func(cv CollectionView, inst Instruction, c []Coin) ([]StateChange, []Coin, error) {
+		return []StateChange{{}}, c, nil
+	}
+	scs, _, err := runContract(fast, mc, Instruction{}, nil, time.Second)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(scs))
+
+	panics := func(cv CollectionView, inst Instruction, c []Coin) ([]StateChange, []Coin, error) {
+		panic("oops")
+	}
+	_, _, err = runContract(panics, mc, Instruction{}, nil, time.Second)
+	require.NotNil(t, err)
+	// Without timeout, the panic gives the same error.
+	_, _, err2 := runContract(panics, mc, Instruction{}, nil, 0)
+	require.Equal(t, err, err2)
+
+	// Panics with other values than strings are errors, too.
+	panicsErr := func(cv CollectionView, inst Instruction, c []Coin) ([]StateChange, []Coin, error) {
+		panic(errTooManyReads)
+	}
+	_, _, err = runContract(panicsErr, mc, Instruction{}, nil, time.Second)
+	require.NotNil(t, err)
+	_, _, err2 = runContract(panicsErr, mc, Instruction{}, nil, 0)
+	require.Equal(t, err, err2)
+
+	// With too many stuck contracts, no contract is run with a timeout.
+	atomic.StoreInt32(&stuckContracts, maxStuckContracts)
+	defer atomic.StoreInt32(&stuckContracts, 0)
+	_, _, err = runContract(fast, mc, Instruction{}, nil, time.Second)
+	require.NotNil(t, err)
+	require.Equal(t, errExecutionTime, err.Error())
+	_, _, err = runContract(fast, mc, Instruction{}, nil, 0)
+	require.Nil(t, err)
+}
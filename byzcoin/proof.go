@@ -5,6 +5,7 @@ import (
 	"errors"
 
 	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin/collection"
 	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/kyber"
 	"github.com/dedis/onet/network"
@@ -21,28 +22,112 @@ func NewProof(c CollectionView, s *skipchain.SkipBlockDB, id skipchain.SkipBlock
 	if err != nil {
 		return
 	}
+	latest, links, err := latestLinks(s, id)
+	if err != nil {
+		return nil, err
+	}
+	p.Latest, p.Links = *latest, links
+	// p.ProofBytes = p.proof.Consistent()
+	return
+}
+
+// newMultiProof creates a proof for all the keys in the skipchain with the
+// given id, like NewProof does for one key.
+func newMultiProof(c *collection.Collection, s *skipchain.SkipBlockDB, id skipchain.SkipBlockID,
+	keys [][]byte) (p *MultiProof, err error) {
+	p = &MultiProof{}
+	p.InclusionProof, err = c.Proofs(keys...)
+	if err != nil {
+		return
+	}
+	latest, links, err := latestLinks(s, id)
+	if err != nil {
+		return nil, err
+	}
+	p.Latest, p.Links = *latest, links
+	return
+}
+
+// latestLinks returns the latest block of the skipchain and the highest
+// forward links that go to it from the block with the given id.
+func latestLinks(s *skipchain.SkipBlockDB, id skipchain.SkipBlockID) (*skipchain.SkipBlock, []skipchain.ForwardLink, error) {
 	sb := s.GetByID(id)
 	if sb == nil {
-		return nil, errors.New("didn't find skipchain")
+		return nil, nil, errors.New("didn't find skipchain")
 	}
-	p.Links = []skipchain.ForwardLink{{
+	links := []skipchain.ForwardLink{{
 		From:      []byte{},
 		To:        id,
 		NewRoster: sb.Roster,
 	}}
 	for len(sb.ForwardLink) > 0 {
 		link := sb.ForwardLink[len(sb.ForwardLink)-1]
-		p.Links = append(p.Links, *link)
+		links = append(links, *link)
 		sb = s.GetByID(link.To)
 		if sb == nil {
-			return nil, errors.New("missing block in chain")
+			return nil, nil, errors.New("missing block in chain")
 		}
 	}
-	p.Latest = *sb
-	// p.ProofBytes = p.proof.Consistent()
+	return sb, links, nil
+}
+
+// NewProofAt creates a proof for key in the collection c, which must hold
+// the state as it was after applying the block at. The forward links of the
+// proof go from the block with the given id to at, so the proof shows the
+// state at that block instead of the latest state.
+func NewProofAt(c CollectionView, s *skipchain.SkipBlockDB, id skipchain.SkipBlockID,
+	at *skipchain.SkipBlock, key []byte) (p *Proof, err error) {
+	p = &Proof{}
+	p.InclusionProof, err = c.Get(key).Proof()
+	if err != nil {
+		return
+	}
+	sb := s.GetByID(id)
+	if sb == nil {
+		return nil, errors.New("didn't find skipchain")
+	}
+	links, err := linksBetween(s, sb, at)
+	if err != nil {
+		return nil, err
+	}
+	p.Links = append([]skipchain.ForwardLink{{
+		From:      []byte{},
+		To:        id,
+		NewRoster: sb.Roster,
+	}}, links...)
+	p.Latest = *at
 	return
 }
 
+// linksBetween returns the forward links going from the block from to the
+// block to, using the highest links that don't jump over to.
+func linksBetween(s *skipchain.SkipBlockDB, from, to *skipchain.SkipBlock) ([]skipchain.ForwardLink, error) {
+	sb := from
+	var links []skipchain.ForwardLink
+	for sb.Index < to.Index {
+		var next *skipchain.SkipBlock
+		var link *skipchain.ForwardLink
+		for i := len(sb.ForwardLink) - 1; i >= 0 && next == nil; i-- {
+			fl := sb.ForwardLink[i]
+			if fl.IsEmpty() {
+				continue
+			}
+			if b := s.GetByID(fl.To); b != nil && b.Index <= to.Index {
+				next, link = b, fl
+			}
+		}
+		if next == nil {
+			return nil, errors.New("missing forward link in chain")
+		}
+		links = append(links, *link)
+		sb = next
+	}
+	if !sb.Hash.Equal(to.Hash) {
+		return nil, errors.New("block is not reachable with forward links")
+	}
+	return links, nil
+}
+
 // ErrorVerifyCollection is returned if the collection-proof itself
 // is not properly set up.
 var ErrorVerifyCollection = errors.New("collection inclusion proof is wrong")
@@ -63,17 +148,23 @@ func (p Proof) Verify(scID skipchain.SkipBlockID) error {
 	if !p.InclusionProof.Consistent() {
 		return ErrorVerifyCollection
 	}
+	return verifyLinks(scID, p.InclusionProof.TreeRootHash(), p.Latest, p.Links)
+}
+
+// verifyLinks checks that the root of the collection is stored in the
+// latest block and that the links go from the genesis block to it.
+func verifyLinks(scID skipchain.SkipBlockID, root []byte, latest skipchain.SkipBlock, links []skipchain.ForwardLink) error {
 	var header DataHeader
-	err := protobuf.DecodeWithConstructors(p.Latest.Data, &header, network.DefaultConstructors(cothority.Suite))
+	err := protobuf.DecodeWithConstructors(latest.Data, &header, network.DefaultConstructors(cothority.Suite))
 	if err != nil {
 		return err
 	}
-	if !bytes.Equal(p.InclusionProof.TreeRootHash(), header.CollectionRoot) {
+	if !bytes.Equal(root, header.CollectionRoot) {
 		return ErrorVerifyCollectionRoot
 	}
 	var sbID skipchain.SkipBlockID
 	var publics []kyber.Point
-	for i, l := range p.Links {
+	for i, l := range links {
 		if i == 0 {
 			// The first forward link is a pointer from []byte{} to the genesis
 			// block and holds the roster of the genesis block.
@@ -118,3 +209,26 @@ func (p *Proof) ContractValue(suite network.Suite, cid string, value interface{}
 	}
 	return protobuf.DecodeWithConstructors(values[0], value, network.DefaultConstructors(suite))
 }
+
+// Verify takes a skipchain id and verifies that the proof is valid for this
+// skipchain, like Proof.Verify does.
+func (p MultiProof) Verify(scID skipchain.SkipBlockID) error {
+	if !p.InclusionProof.Consistent() {
+		return ErrorVerifyCollection
+	}
+	return verifyLinks(scID, p.InclusionProof.TreeRootHash(), p.Latest, p.Links)
+}
+
+// Proof returns the proof of one of the keys of the MultiProof, with the same
+// block and links.
+func (p MultiProof) Proof(key []byte) (*Proof, error) {
+	inclusion, err := p.InclusionProof.Proof(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Proof{
+		InclusionProof: inclusion,
+		Latest:         p.Latest,
+		Links:          p.Links,
+	}, nil
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/dedis/cothority/byzcoin/darc"
 	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/onet"
+	"github.com/dedis/onet/network"
 )
 
 // PROTOSTART
@@ -20,6 +21,7 @@ import (
 // type :Version:sint32
 // import "skipchain.proto";
 // import "onet.proto";
+// import "network.proto";
 // import "darc.proto";
 // import "collection.proto";
 //
@@ -90,6 +92,73 @@ type AddTxRequest struct {
 type AddTxResponse struct {
 	// Version of the protocol
 	Version Version
+	// BlockIndex is the index of the block holding the transaction. It is
+	// only set if InclusionWait is bigger than 0, as are Accepted and
+	// Error.
+	BlockIndex int `protobuf:"opt"`
+	// Accepted is true if the transaction has been accepted, and false if
+	// it has been refused and is in the block all the same.
+	Accepted bool `protobuf:"opt"`
+	// Error is the reason of the refusal of the transaction.
+	Error string `protobuf:"opt"`
+}
+
+// SimulateTxRequest asks to run a transaction against the latest state of
+// the ledger, without adding it to the ledger.
+type SimulateTxRequest struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// Transaction to be simulated
+	Transaction ClientTransaction
+}
+
+// SimulateTxResponse holds the result of a simulated transaction.
+type SimulateTxResponse struct {
+	// Version of the protocol
+	Version Version
+	// Accepted is true if all the instructions succeeded.
+	Accepted bool
+	// StateChanges holds the state changes of all the instructions, if the
+	// transaction has been accepted.
+	StateChanges []StateChange
+	// CollectionRoot is the merkle root the collection would have after
+	// applying the transaction. If the transaction has been refused, it is
+	// the current merkle root.
+	CollectionRoot []byte
+	// Errors holds the result of every executed instruction, in order: an
+	// empty string for a successful instruction, or the error of the
+	// contract. The execution stops at the first failing instruction. If
+	// the fee of the transaction cannot be paid, its error is appended.
+	Errors []string
+	// Metering holds the resources used by every executed instruction.
+	Metering []Metering `protobuf:"opt"`
+}
+
+// GetTxStatus asks for the status of a transaction that has been included
+// in a block.
+type GetTxStatus struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// TxHash is the hash of the instructions of the ClientTransaction.
+	TxHash []byte
+}
+
+// GetTxStatusResponse holds the status of the transaction.
+type GetTxStatusResponse struct {
+	// Version of the protocol
+	Version Version
+	// Accepted is true if the transaction has been accepted.
+	Accepted bool
+	// BlockIndex is the index of the block holding the transaction.
+	BlockIndex int
+	// BlockID is the hash of the block holding the transaction.
+	BlockID skipchain.SkipBlockID
+	// Error holds the reason why the transaction has been refused.
+	Error string `protobuf:"opt"`
 }
 
 // GetProof returns the proof that the given key is in the collection.
@@ -101,6 +170,11 @@ type GetProof struct {
 	// ID is any block that is known to us in the skipchain, can be the genesis
 	// block or any later block. The proof returned will be starting at this block.
 	ID skipchain.SkipBlockID
+	// BlockID is the block whose state is proven. The proof is against the
+	// collection as it was after applying this block, and ends at it. If it
+	// is missing, the latest state is used. It must be one of the latest 100
+	// blocks.
+	BlockID skipchain.SkipBlockID `protobuf:"opt"`
 }
 
 // GetProofResponse can be used together with the Genesis block to proof that
@@ -113,6 +187,335 @@ type GetProofResponse struct {
 	Proof Proof
 }
 
+// GetProofs returns one proof for several keys of the collection. The
+// nodes of the collection that are common to several keys are only sent
+// once.
+type GetProofs struct {
+	// Version of the protocol
+	Version Version
+	// Keys are the keys we want to look up
+	Keys [][]byte
+	// ID is any block that is known to us in the skipchain, can be the genesis
+	// block or any later block. The proof returned will be starting at this block.
+	ID skipchain.SkipBlockID
+}
+
+// GetProofsResponse can be used together with the Genesis block to proof the
+// presence or absence of all the requested keys.
+type GetProofsResponse struct {
+	// Version of the protocol
+	Version Version
+	// Proof contains everything necessary to prove the presence or absence
+	// of the keys given a genesis skipblock.
+	Proof MultiProof
+}
+
+// StreamingRequest asks the service to stream all the new blocks of the
+// skipchain given by ID to the client.
+type StreamingRequest struct {
+	// ID is the skipchain ID of the ByzCoin ledger.
+	ID skipchain.SkipBlockID
+}
+
+// StreamingResponse is sent to the client for every new block that is
+// added to the ledger. Responses without BlockID are only sent to keep the
+// stream alive.
+type StreamingResponse struct {
+	// BlockID is the hash of the new skipblock.
+	BlockID skipchain.SkipBlockID
+	// Index is the index of the new skipblock.
+	Index int
+	// Header is the DataHeader stored in the new skipblock.
+	Header DataHeader
+	// TxResults are all the transactions of the new skipblock, every one
+	// of them marked as accepted or refused.
+	TxResults TxResults
+}
+
+// GetSignerCounters is a request to get the latest signer counters of the
+// given identities.
+type GetSignerCounters struct {
+	// Version of the protocol
+	Version Version
+	// SignerIDs are the string representations of the darc identities.
+	SignerIDs []string
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+}
+
+// GetSignerCountersResponse holds the latest counters of the signers, in
+// the same order as the request. An identity that never signed with a
+// counter has the counter 0.
+type GetSignerCountersResponse struct {
+	// Version of the protocol
+	Version  Version
+	Counters []uint64
+}
+
+// Query asks the contract of an instance to answer a read-only query about
+// the instance, without creating a transaction.
+type Query struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// InstanceID is the instance the query is about.
+	InstanceID InstanceID
+	// Name is the query, interpreted by the contract of the instance.
+	Name string
+	// Args holds all data necessary to answer the query.
+	Args Arguments
+}
+
+// QueryResponse holds the result of a query.
+type QueryResponse struct {
+	// Version of the protocol
+	Version Version
+	// Result is the answer of the contract.
+	Result []byte
+	// Proof of the instance in the state the query ran against.
+	Proof Proof
+}
+
+// ListInstances asks for the instances of the ledger, sorted by their ID.
+// As there might be many instances, they are returned in pages.
+type ListInstances struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// ContractID, if given, restricts the list to the instances of this
+	// contract.
+	ContractID string `protobuf:"opt"`
+	// DarcID, if given, restricts the list to the instances controlled by
+	// this darc.
+	DarcID darc.ID `protobuf:"opt"`
+	// Cursor is the NextCursor of the previous page. If it is missing, the
+	// first page is returned.
+	Cursor []byte `protobuf:"opt"`
+	// Limit is the maximum number of instances in the page. A missing value
+	// or 0 means the default of 100 instances.
+	Limit int `protobuf:"opt"`
+}
+
+// ListInstancesResponse holds one page of instances.
+type ListInstancesResponse struct {
+	// Version of the protocol
+	Version Version
+	// Instances of the page, sorted by their ID.
+	Instances []Instance
+	// NextCursor has to be given in the next request to get the next page.
+	// It is empty if this is the last page. As the number of instances
+	// visited per request is bounded, a page with a filter can hold fewer
+	// instances than the limit and still have a NextCursor.
+	NextCursor []byte `protobuf:"opt"`
+}
+
+// Instance holds the values of one instance of a contract.
+type Instance struct {
+	// InstanceID of the instance
+	InstanceID InstanceID
+	// ContractID of the instance
+	ContractID string
+	// DarcID is the darc controlling access to the instance.
+	DarcID darc.ID
+	// Value is the data of the instance, interpreted by the contract.
+	Value []byte
+}
+
+// GetInstanceHistory asks for the successive states of an instance, as
+// they have been changed by the blocks of the skipchain.
+type GetInstanceHistory struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// InstanceID of the instance
+	InstanceID InstanceID
+	// Before is the NextBefore of the previous page. If it is missing, the
+	// latest changes are returned.
+	Before int `protobuf:"opt"`
+	// Limit is the maximum number of changes in the page. A missing value
+	// or 0 means the default of 100 changes.
+	Limit int `protobuf:"opt"`
+}
+
+// GetInstanceHistoryResponse holds one page of the changes of the instance,
+// in the order of the blocks. The pages go from the latest changes to the
+// earliest ones. Blocks for which the node doesn't keep the history, for
+// example because it restored the collection from a snapshot or pruned the
+// blocks, are missing.
+type GetInstanceHistoryResponse struct {
+	// Version of the protocol
+	Version Version
+	// Changes of the instance
+	Changes []InstanceChange
+	// FirstBlock is the index of the first block whose changes are known.
+	// The changes of earlier blocks are unknown, so the history is only
+	// complete if it is 0.
+	FirstBlock int `protobuf:"opt"`
+	// NextBefore has to be given as Before in the next request to get the
+	// earlier changes. It is 0 if there are no earlier changes.
+	NextBefore int `protobuf:"opt"`
+}
+
+// InstanceChange is the state of an instance after a block changed it.
+type InstanceChange struct {
+	// BlockIndex is the index of the block that changed the instance.
+	BlockIndex int
+	// Timestamp of the block, as a Unix timestamp in nanoseconds.
+	Timestamp int64
+	// Removed is true if the block removed the instance.
+	Removed bool
+	// Instance holds the values of the instance after the block. Only its
+	// InstanceID is set if the instance has been removed.
+	Instance Instance
+}
+
+// GetDarcHistory asks for the successive versions of a darc, as they have
+// been evolved by the blocks of the skipchain.
+type GetDarcHistory struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// BaseID of the darc
+	BaseID darc.ID
+	// Before is the NextBefore of the previous page. If it is missing, the
+	// latest versions are returned.
+	Before int `protobuf:"opt"`
+	// Limit is the maximum number of versions in the page. A missing value
+	// or 0 means the default of 100 versions.
+	Limit int `protobuf:"opt"`
+}
+
+// GetDarcHistoryResponse holds one page of the versions of the darc, in the
+// order of the blocks. Like for GetInstanceHistoryResponse, the pages go
+// from the latest versions to the earliest ones, and the versions whose
+// history is not kept by the node are missing.
+type GetDarcHistoryResponse struct {
+	// Version of the protocol
+	Version Version
+	// Versions of the darc
+	Versions []DarcVersion
+	// FirstBlock is the index of the first block whose changes are known.
+	// The versions stored by earlier blocks are unknown, so the history is
+	// only complete if it is 0.
+	FirstBlock int `protobuf:"opt"`
+	// NextBefore has to be given as Before in the next request to get the
+	// earlier versions. It is 0 if there are no earlier versions.
+	NextBefore int `protobuf:"opt"`
+}
+
+// DarcVersion is a version of a darc together with the block that stored it.
+type DarcVersion struct {
+	// BlockIndex is the index of the block that stored the version.
+	BlockIndex int
+	// Timestamp of the block, as a Unix timestamp in nanoseconds.
+	Timestamp int64
+	// Darc is the version of the darc.
+	Darc darc.Darc
+	// Signers are the identities that signed the evolve instruction of
+	// this version. It is empty if the version has not been stored by an
+	// evolve instruction, or if the body of the block has been pruned.
+	Signers []darc.Identity
+	// Changes are the changes of the rules from the previous version, or
+	// all the rules for the first known version.
+	Changes []darc.RuleChange
+}
+
+// GetAuthorizations asks which combinations of identities can perform an
+// action on an instance.
+type GetAuthorizations struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// InstanceID of the instance
+	InstanceID InstanceID
+	// Action as found in the rules of the darc, e.g. invoke:transfer
+	Action string
+	// MaxDepth of the delegations that are followed. If it is 0, the
+	// DefaultMaxDepth of the darc package is used, which is also the
+	// maximum.
+	MaxDepth int
+}
+
+// GetAuthorizationsResponse holds the minimal combinations of identities
+// that can perform the action.
+type GetAuthorizationsResponse struct {
+	// Version of the protocol
+	Version Version
+	// Combinations of identities that can perform the action. Besides
+	// identities, they hold the conditions of the rules, such as
+	// before:1546300800.
+	Combinations []Combination
+	// Warnings about delegations that could not be followed, because of a
+	// missing darc, a cycle or the maximal depth.
+	Warnings []string
+}
+
+// Combination is a set of identities that together satisfy a rule.
+type Combination struct {
+	Identities []string
+}
+
+// GetSnapshot asks a node for a snapshot of the latest state of the
+// collection. As a snapshot doesn't fit in one message, its instances are
+// sent in chunks: the first request gets the latest snapshot with its first
+// instances, and the following ones ask for the instances of the same
+// snapshot starting at Offset.
+type GetSnapshot struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// BlockID is the block of the snapshot whose instances are asked for.
+	// It is missing in the first request.
+	BlockID skipchain.SkipBlockID `protobuf:"opt"`
+	// Offset is the index of the first instance to return.
+	Offset int `protobuf:"opt"`
+}
+
+// GetSnapshotResponse holds the snapshot together with the block it has
+// been taken at and the forward links from the genesis block to that block.
+type GetSnapshotResponse struct {
+	// Version of the protocol
+	Version Version
+	// Snapshot of the collection.
+	Snapshot Snapshot
+	// Block is the skipblock whose DataHeader.CollectionRoot corresponds to
+	// the snapshot.
+	Block skipchain.SkipBlock
+	// Links are the forward links from the genesis block to Block. They
+	// are only sent with the first chunk of the snapshot.
+	Links []skipchain.ForwardLink
+	// Total is the number of instances of the snapshot, of which
+	// Snapshot.Instances only holds the ones starting at the Offset of the
+	// request.
+	Total int `protobuf:"opt"`
+}
+
+// Snapshot holds all the key/value pairs of the collection as they were
+// after applying the block at the given index.
+type Snapshot struct {
+	// Index of the block the snapshot has been taken at.
+	Index int
+	// BlockID is the hash of the block the snapshot has been taken at.
+	BlockID skipchain.SkipBlockID
+	// CollectionRoot is the merkle root of the collection at that block.
+	CollectionRoot []byte
+	// Instances holds one Create state change for every key/value pair in
+	// the collection, ordered by key.
+	Instances []StateChange
+	// Signer is the node that created the snapshot. It must be in the
+	// roster of the block of the snapshot.
+	Signer *network.ServerIdentity
+	// Signature is the schnorr signature of the signer on the hash of the
+	// snapshot.
+	Signature []byte
+}
+
 // ChainConfig stores all the configuration information for one skipchain. It will
 // be stored under the key "GenesisDarcID || OneNonce", in the collections. The
 // GenesisDarcID is the value of GenesisReferenceID.
@@ -120,6 +523,41 @@ type ChainConfig struct {
 	BlockInterval time.Duration
 	Roster        onet.Roster
 	MaxBlockSize  int
+	// FeeCoinType is the name of the coins used to pay the fees. If it is
+	// not set, transactions don't pay fees.
+	FeeCoinType InstanceID `protobuf:"opt"`
+	// FeeReward is the coin instance that receives the fees.
+	FeeReward InstanceID `protobuf:"opt"`
+	// MinFee is the minimal fee a transaction has to pay.
+	MinFee uint64 `protobuf:"opt"`
+	// MaxReads is the maximum number of reads of the collection by the
+	// contract of an instruction. 0 means no limit.
+	MaxReads int `protobuf:"opt"`
+	// MaxWrites is the maximum number of state changes returned by the
+	// contract of an instruction. 0 means no limit.
+	MaxWrites int `protobuf:"opt"`
+	// MaxStateChangeBytes is the maximum size of the state changes returned
+	// by the contract of an instruction. 0 means no limit.
+	MaxStateChangeBytes int `protobuf:"opt"`
+	// MaxExecutionTime is the maximum time the leader lets the contract of
+	// an instruction run. A transaction exceeding it is left out of the
+	// block. As it depends on the node, it is not checked by the other
+	// nodes, which rely on the limits above. 0 means no limit.
+	MaxExecutionTime time.Duration `protobuf:"opt"`
+	// RequireSignerCounters refuses signed instructions without signer
+	// counters, so that no instruction can be replayed.
+	RequireSignerCounters bool `protobuf:"opt"`
+	// ContractVersions holds the upgrades of the contracts, in increasing
+	// order of height.
+	ContractVersions []ContractVersion `protobuf:"opt"`
+}
+
+// ContractVersion switches a contract to a new version from the block with
+// index Height on.
+type ContractVersion struct {
+	ContractID string
+	Version    int
+	Height     int
 }
 
 // Proof represents everything necessary to verify a given
@@ -142,6 +580,18 @@ type Proof struct {
 	Links []skipchain.ForwardLink
 }
 
+// MultiProof is like Proof, but for several keys at once.
+type MultiProof struct {
+	// InclusionProof is the deserialized InclusionProof of all the keys
+	InclusionProof collection.MultiProof
+	// Providing the latest skipblock to retrieve the Merkle tree root.
+	Latest skipchain.SkipBlock
+	// Proving the path to the latest skipblock. The first ForwardLink has an
+	// empty-sliced `From` and the genesis-block in `To`, together with the
+	// roster of the genesis-block in the `NewRoster`.
+	Links []skipchain.ForwardLink
+}
+
 // Instruction holds only one of Spawn, Invoke, or Delete
 type Instruction struct {
 	// InstanceID is either the instance that can spawn a new instance, or the instance
@@ -165,6 +615,28 @@ type Instruction struct {
 	Delete *Delete
 	// Signatures that are verified using the Darc controlling access to the instance.
 	Signatures []darc.Signature
+	// SignerCounter holds one counter for every signature, in the same
+	// order. Every counter must be one more than the counter stored in the
+	// ledger for that signer, which is then increased. Instructions without
+	// counters can be replayed, so they are refused once
+	// RequireSignerCounters is set in the configuration.
+	SignerCounter []uint64
+	// Inputs adds values returned by earlier instructions of the same
+	// ClientTransaction to the arguments of this instruction.
+	Inputs []Input `protobuf:"opt"`
+}
+
+// Input takes a value returned by an earlier instruction of the same
+// ClientTransaction and gives it as an argument to the instruction. The
+// argument is not part of the hash of the instruction, but the input is.
+type Input struct {
+	// Instruction is the index of the earlier instruction in the
+	// ClientTransaction.
+	Instruction int
+	// Name of the value returned by the earlier instruction.
+	Name string
+	// Argument is the name of the argument holding the value.
+	Argument string
 }
 
 // Spawn is called upon an existing instance that will spawn a new instance.
@@ -201,12 +673,42 @@ type Argument struct {
 // If any of the instructions fails, none of them will be applied.
 type ClientTransaction struct {
 	Instructions Instructions
+	// Fee is paid to the reward account if the ledger is configured to use
+	// fees. It is not part of the hash of the instructions.
+	Fee *Fee `protobuf:"opt"`
+}
+
+// Fee is paid by a coin instance for a ClientTransaction.
+type Fee struct {
+	// Coin is the coin instance paying the fee.
+	Coin InstanceID
+	// Amount of coins paid.
+	Amount uint64
+	// Signatures of the identities allowed to transfer coins from the coin
+	// instance.
+	Signatures []darc.Signature
 }
 
 // TxResult holds a transaction and the result of running it.
 type TxResult struct {
 	ClientTransaction ClientTransaction
 	Accepted          bool
+	// Error holds the reason why the transaction has been refused. It is
+	// part of the hash of the TxResults, so all nodes must agree on it.
+	Error string `protobuf:"opt"`
+}
+
+// Metering holds the resources used by the contract of an instruction.
+type Metering struct {
+	// Reads is the number of reads of the collection.
+	Reads int
+	// Writes is the number of state changes.
+	Writes int
+	// StateChangeBytes is the size of the state changes.
+	StateChangeBytes int
+	// ExecutionTime is the time the contract has been running on the node
+	// that executed it.
+	ExecutionTime time.Duration
 }
 
 // StateChange is one new state that will be applied to the collection.
@@ -96,6 +96,12 @@ type Service struct {
 
 	// contracts map kinds to kind specific verification functions
 	contracts map[string]ContractFn
+	// contractVersions map kinds to the upgraded versions of the contracts
+	contractVersions map[string]map[int]ContractFn
+	// queries map kinds to kind specific read-only functions
+	queries map[string]QueryFn
+	// feeContract is the contract of the coin instances paying the fees
+	feeContract string
 	// propagate the new transactions
 	propagateTransactions messaging.PropagationFunc
 
@@ -106,8 +112,20 @@ type Service struct {
 	darcToSc    map[string]skipchain.SkipBlockID
 	darcToScMut sync.Mutex
 
+	// restoredTo holds the index of the block of the last snapshot restored
+	// for a skipchain, if it is newer than the block that needed it. The
+	// blocks up to it are handled without replaying their transactions.
+	restoredTo    map[string]int
+	restoredToMut sync.Mutex
+
 	stateChangeCache stateChangeCache
 
+	// snapshotCache holds the last snapshot created for every skipchain.
+	snapshotCache snapshotCache
+
+	// streamingMan holds the clients subscribed to new blocks.
+	streamingMan streamingManager
+
 	closed        bool
 	closedMutex   sync.Mutex
 	working       sync.WaitGroup
@@ -130,6 +148,16 @@ type omniStorage struct {
 	// PropTimeout is used when sending the request to integrate a new block
 	// to all nodes.
 	PropTimeout time.Duration
+	// PruneKeep is the number of latest blocks whose bodies are kept. Zero
+	// means that no block is pruned.
+	PruneKeep int
+	// HistoryKeep is the number of latest blocks whose undo logs are kept.
+	// Zero means the default of defaultHistoryKeep blocks, and a negative
+	// value that all of them are kept, unless blocks are pruned.
+	HistoryKeep int
+	// PruneNext holds, for every skipchain, the ID of the first block whose
+	// body has not been pruned yet.
+	PruneNext map[string]skipchain.SkipBlockID
 
 	sync.Mutex
 }
@@ -236,6 +264,9 @@ func (s *Service) AddTransaction(req *AddTxRequest) (*AddTxResponse, error) {
 	if txsz > maxsz {
 		return nil, errors.New("transaction too large")
 	}
+	if err = s.checkUpgrades(req.Transaction); err != nil {
+		return nil, err
+	}
 
 	// Note to my future self: s.txBuffer.add used to be out here. It used to work
 	// even. But while investigating other race conditions, we realized that
@@ -270,13 +301,15 @@ func (s *Service) AddTransaction(req *AddTxRequest) (*AddTxResponse, error) {
 
 		blocksLeft := req.InclusionWait
 
-		for found := false; !found; {
+		for {
 			select {
-			case success := <-ch:
-				if !success {
-					return nil, errors.New("transaction is in block, but got refused")
-				}
-				found = true
+			case inc := <-ch:
+				return &AddTxResponse{
+					Version:    CurrentVersion,
+					BlockIndex: inc.blockIndex,
+					Accepted:   inc.accepted,
+					Error:      inc.err,
+				}, nil
 			case id := <-blockCh:
 				if id.Equal(req.SkipchainID) {
 					blocksLeft--
@@ -288,17 +321,122 @@ func (s *Service) AddTransaction(req *AddTxRequest) (*AddTxResponse, error) {
 				return nil, fmt.Errorf("did not observe %v blocks after %v", req.InclusionWait, tooLongDur)
 			}
 		}
-	} else {
-		s.txBuffer.add(string(req.SkipchainID), req.Transaction)
 	}
 
+	s.txBuffer.add(string(req.SkipchainID), req.Transaction)
 	return &AddTxResponse{
 		Version: CurrentVersion,
 	}, nil
 }
 
+// SimulateTransaction runs the transaction against a copy of the latest
+// state, the same way as in the next block, and returns the resulting state
+// changes and merkle root, or the error of the first failing instruction or
+// of the fee. Neither the ledger nor the pending transactions are changed.
+func (s *Service) SimulateTransaction(req *SimulateTxRequest) (*SimulateTxResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	if len(req.Transaction.Instructions) == 0 {
+		return nil, errors.New("no instructions to simulate")
+	}
+	if !s.isOurChain(req.SkipchainID) {
+		return nil, errors.New("skipchain ID does not exist")
+	}
+	_, maxsz, err := s.LoadBlockInfo(req.SkipchainID)
+	if err != nil {
+		return nil, err
+	}
+	if txSize(TxResult{ClientTransaction: req.Transaction}) > maxsz {
+		return nil, errors.New("transaction too large")
+	}
+	// The transaction is simulated as if it was in the next block.
+	latest, err := s.db().GetLatestByID(req.SkipchainID)
+	if err != nil {
+		return nil, err
+	}
+	block := blockInfo{
+		index:     latest.Index + 1,
+		timestamp: blockTimestamp(latest),
+	}
+
+	coll := s.getCollection(req.SkipchainID).coll.Clone()
+	resp := &SimulateTxResponse{
+		Version:        CurrentVersion,
+		CollectionRoot: coll.GetRoot(),
+	}
+	cdbI := &roCollection{coll}
+	config, err := loadConfigFromColl(cdbI)
+	if err != nil {
+		return nil, err
+	}
+	states, _, metering, failed, err := s.executeTransaction(cdbI, nil,
+		req.Transaction, config, block, true)
+	resp.Metering = metering
+	for i := 0; i < failed; i++ {
+		resp.Errors = append(resp.Errors, "")
+	}
+	if err != nil {
+		if failed == len(req.Transaction.Instructions) {
+			resp.Errors = append(resp.Errors, "couldn't pay fee: "+err.Error())
+		} else {
+			resp.Errors = append(resp.Errors, err.Error())
+		}
+		return resp, nil
+	}
+
+	resp.Accepted = true
+	resp.StateChanges = states
+	resp.CollectionRoot = coll.GetRoot()
+	return resp, nil
+}
+
+// GetTxStatus returns whether a transaction has been accepted or refused,
+// the block it has been included in and, in case it has been refused, the
+// error returned by the contract.
+func (s *Service) GetTxStatus(req *GetTxStatus) (*GetTxStatusResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	if !s.isOurChain(req.SkipchainID) {
+		return nil, errors.New("skipchain ID does not exist")
+	}
+	blockID := s.getCollection(req.SkipchainID).getTxBlockID(req.TxHash)
+	if blockID == nil {
+		return nil, errors.New("transaction not found")
+	}
+	sb := s.db().GetByID(blockID)
+	if sb == nil {
+		return nil, errors.New("cannot find the block of the transaction")
+	}
+	if len(sb.Payload) == 0 {
+		return nil, errors.New("the body of the block has been pruned")
+	}
+	var body DataBody
+	err := protobuf.DecodeWithConstructors(sb.Payload, &body, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, errors.New("couldn't unmarshal body: " + err.Error())
+	}
+	// Search from the end, as a refused transaction might have been sent
+	// again in the same block.
+	for i := len(body.TxResults) - 1; i >= 0; i-- {
+		tx := body.TxResults[i]
+		if bytes.Equal(tx.ClientTransaction.Instructions.Hash(), req.TxHash) {
+			return &GetTxStatusResponse{
+				Version:    CurrentVersion,
+				Accepted:   tx.Accepted,
+				BlockIndex: sb.Index,
+				BlockID:    sb.Hash,
+				Error:      tx.Error,
+			}, nil
+		}
+	}
+	return nil, errors.New("transaction not found in its block")
+}
+
 // GetProof searches for a key and returns a proof of the
-// presence or the absence of this key.
+// presence or the absence of this key. If a block is given, the proof is
+// against the state of the collection at that block.
 func (s *Service) GetProof(req *GetProof) (resp *GetProofResponse, err error) {
 	if req.Version != CurrentVersion {
 		return nil, errors.New("version mismatch")
@@ -309,7 +447,12 @@ func (s *Service) GetProof(req *GetProof) (resp *GetProofResponse, err error) {
 		err = errors.New("cannot find skipblock while getting proof")
 		return
 	}
-	proof, err := NewProof(s.GetCollectionView(sb.SkipChainID()), s.db(), req.ID, req.Key)
+	var proof *Proof
+	if req.BlockID.IsNull() {
+		proof, err = NewProof(s.GetCollectionView(sb.SkipChainID()), s.db(), req.ID, req.Key)
+	} else {
+		proof, err = s.getProofAt(sb, req.BlockID, req.Key)
+	}
 	if err != nil {
 		return
 	}
@@ -325,6 +468,446 @@ func (s *Service) GetProof(req *GetProof) (resp *GetProofResponse, err error) {
 	return
 }
 
+// GetProofs returns a single proof of the presence or the absence of all
+// the keys in the latest state of the collection.
+func (s *Service) GetProofs(req *GetProofs) (resp *GetProofsResponse, err error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	log.Lvlf2("%s Getting proofs for %d keys on sc %x", s.ServerIdentity(), len(req.Keys), req.ID)
+	sb := s.db().GetByID(req.ID)
+	if sb == nil {
+		err = errors.New("cannot find skipblock while getting proof")
+		return
+	}
+	proof, err := newMultiProof(s.getCollection(sb.SkipChainID()).coll, s.db(), req.ID, req.Keys)
+	if err != nil {
+		return
+	}
+
+	// Sanity check
+	if err = proof.Verify(req.ID); err != nil {
+		return
+	}
+	resp = &GetProofsResponse{
+		Version: CurrentVersion,
+		Proof:   *proof,
+	}
+	return
+}
+
+// getProofAt returns the proof for key against the state of the collection
+// after the block with ID blockID. The proof starts at the block from.
+func (s *Service) getProofAt(from *skipchain.SkipBlock, blockID skipchain.SkipBlockID, key []byte) (*Proof, error) {
+	at := s.db().GetByID(blockID)
+	if at == nil || !at.SkipChainID().Equal(from.SkipChainID()) {
+		return nil, errors.New("cannot find the block of the proof in the skipchain")
+	}
+	if at.Index < from.Index {
+		return nil, errors.New("the block of the proof is before the starting block")
+	}
+	var header DataHeader
+	err := protobuf.DecodeWithConstructors(at.Data, &header, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, errors.New("couldn't unmarshal header: " + err.Error())
+	}
+
+	coll, err := s.getCollection(from.SkipChainID()).collectionAt(at.Index)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(coll.GetRoot(), header.CollectionRoot) {
+		return nil, errors.New("couldn't reconstruct the collection at the given block")
+	}
+	return NewProofAt(&roCollection{coll}, s.db(), from.Hash, at, key)
+}
+
+// StreamTransactions registers the client to receive every new block of
+// the given skipchain, together with the results of its transactions. The
+// stream stops when the client closes the connection, which is noticed at
+// the latest with the next empty response sent to keep the stream alive.
+func (s *Service) StreamTransactions(req *StreamingRequest) (chan *StreamingResponse, chan bool, error) {
+	if !s.isOurChain(req.ID) {
+		return nil, nil, errors.New("skipchain ID does not exist")
+	}
+	key := string(req.ID)
+	outChan := s.streamingMan.newListener(key)
+	stopChan := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(streamingKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopChan:
+				s.streamingMan.stopListener(key, outChan)
+				return
+			case <-ticker.C:
+				if !s.streamingMan.keepAlive(key, outChan) {
+					return
+				}
+			}
+		}
+	}()
+	return outChan, stopChan, nil
+}
+
+// Query runs the read-only function registered for the contract of the
+// given instance and returns its result, together with the proof of the
+// instance in the state the query ran against.
+func (s *Service) Query(req *Query) (*QueryResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	if !s.isOurChain(req.SkipchainID) {
+		return nil, errors.New("skipchain ID does not exist")
+	}
+	// The query and the proof need to see the same state, so no new block
+	// must be applied in the meantime.
+	var resp *QueryResponse
+	err := s.getCollection(req.SkipchainID).view(func(coll CollectionView) error {
+		_, contractID, _, err := coll.GetValues(req.InstanceID.Slice())
+		if err != nil {
+			return errors.New("couldn't get instance: " + err.Error())
+		}
+		query, exists := s.queries[contractID]
+		if !exists {
+			return errors.New("contract doesn't support queries: " + contractID)
+		}
+		result, err := runQuery(query, coll, req)
+		if err != nil {
+			return err
+		}
+
+		proof, err := NewProof(coll, s.db(), req.SkipchainID, req.InstanceID.Slice())
+		if err != nil {
+			return err
+		}
+		if err = proof.Verify(req.SkipchainID); err != nil {
+			return err
+		}
+		resp = &QueryResponse{
+			Version: CurrentVersion,
+			Result:  result,
+			Proof:   *proof,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// runQuery calls the query and turns a panic of the query into an error.
+func runQuery(query QueryFn, coll CollectionView, req *Query) (result []byte, err error) {
+	defer func() {
+		if re := recover(); re != nil {
+			err = fmt.Errorf("query panicked: %v", re)
+		}
+	}()
+	return query(coll, req.InstanceID, req.Name, req.Args)
+}
+
+// defaultListLimit is the number of instances returned by ListInstances if
+// no limit is given.
+const defaultListLimit = 100
+
+// maxListLimit is the maximum number of instances returned by ListInstances.
+const maxListLimit = 1000
+
+// maxListScan is the maximum number of instances visited by one call to
+// ListInstances. It bounds the work of a filtered listing that matches few
+// instances.
+const maxListScan = 10 * maxListLimit
+
+// ListInstances returns one page of the instances of the latest state,
+// restricted to the given contract and darc, if they are given.
+func (s *Service) ListInstances(req *ListInstances) (*ListInstancesResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	if !s.isOurChain(req.SkipchainID) {
+		return nil, errors.New("skipchain ID does not exist")
+	}
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+
+	resp := &ListInstancesResponse{Version: CurrentVersion}
+	scanned := 0
+	var lastKey []byte
+	err := s.getCollection(req.SkipchainID).forEachAfter(req.Cursor,
+		func(key, value []byte, contractID string, darcID darc.ID) error {
+			if scanned == maxListScan {
+				// Stop here, the next page starts after the last visited
+				// instance.
+				resp.NextCursor = lastKey
+				return ErrStopIteration
+			}
+			scanned++
+			lastKey = key
+			if req.ContractID != "" && contractID != req.ContractID {
+				return nil
+			}
+			if len(req.DarcID) > 0 && !darcID.Equal(req.DarcID) {
+				return nil
+			}
+			if len(resp.Instances) == limit {
+				// There is at least one more instance.
+				resp.NextCursor = resp.Instances[limit-1].InstanceID.Slice()
+				return ErrStopIteration
+			}
+			resp.Instances = append(resp.Instances, Instance{
+				InstanceID: NewInstanceID(key),
+				ContractID: contractID,
+				DarcID:     darcID,
+				Value:      value,
+			})
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// defaultHistoryLimit is the number of changes returned by GetInstanceHistory
+// and GetDarcHistory if the request doesn't give a limit.
+const defaultHistoryLimit = 100
+
+// maxHistoryLimit is the maximum number of changes returned by
+// GetInstanceHistory and GetDarcHistory.
+const maxHistoryLimit = 1000
+
+// historyLimit returns the number of changes to return for the limit given
+// in a request.
+func historyLimit(limit int) int {
+	if limit <= 0 {
+		return defaultHistoryLimit
+	}
+	if limit > maxHistoryLimit {
+		return maxHistoryLimit
+	}
+	return limit
+}
+
+// GetInstanceHistory returns one page of the successive states of an
+// instance, as they have been changed by the blocks of the skipchain.
+func (s *Service) GetInstanceHistory(req *GetInstanceHistory) (*GetInstanceHistoryResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	if !s.isOurChain(req.SkipchainID) {
+		return nil, errors.New("skipchain ID does not exist")
+	}
+	changes, first, more, err := s.getCollection(req.SkipchainID).history(
+		req.InstanceID.Slice(), req.Before, historyLimit(req.Limit))
+	if err != nil {
+		return nil, err
+	}
+	for i := range changes {
+		sb, err := s.skService().GetSingleBlockByIndex(&skipchain.GetSingleBlockByIndex{
+			Genesis: req.SkipchainID,
+			Index:   changes[i].BlockIndex,
+		})
+		if err != nil {
+			return nil, errors.New("couldn't get block of change: " + err.Error())
+		}
+		changes[i].Timestamp = blockTimestamp(sb)
+	}
+	resp := &GetInstanceHistoryResponse{
+		Version:    CurrentVersion,
+		Changes:    changes,
+		FirstBlock: first,
+	}
+	if more {
+		resp.NextBefore = changes[0].BlockIndex
+	}
+	return resp, nil
+}
+
+// GetDarcHistory returns one page of the successive versions of a darc,
+// together with the signers of their evolve instructions and the changes of
+// their rules.
+func (s *Service) GetDarcHistory(req *GetDarcHistory) (*GetDarcHistoryResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	if !s.isOurChain(req.SkipchainID) {
+		return nil, errors.New("skipchain ID does not exist")
+	}
+	id := NewInstanceID(req.BaseID)
+	// One more change is read to get the rules the first version of the
+	// page changed.
+	limit := historyLimit(req.Limit)
+	changes, first, more, err := s.getCollection(req.SkipchainID).history(
+		id.Slice(), req.Before, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	var rules darc.Rules
+	if len(changes) > limit {
+		if !changes[0].Removed {
+			d, err := historyDarc(changes[0])
+			if err != nil {
+				return nil, err
+			}
+			rules = d.Rules
+		}
+		changes = changes[1:]
+		more = true
+	}
+	var versions []DarcVersion
+	for _, change := range changes {
+		if change.Removed {
+			rules = darc.Rules{}
+			continue
+		}
+		d, err := historyDarc(change)
+		if err != nil {
+			return nil, err
+		}
+		sb, err := s.skService().GetSingleBlockByIndex(&skipchain.GetSingleBlockByIndex{
+			Genesis: req.SkipchainID,
+			Index:   change.BlockIndex,
+		})
+		if err != nil {
+			return nil, errors.New("couldn't get block of change: " + err.Error())
+		}
+		versions = append(versions, DarcVersion{
+			BlockIndex: change.BlockIndex,
+			Timestamp:  blockTimestamp(sb),
+			Darc:       *d,
+			Signers:    evolveSigners(sb, id),
+			Changes:    rules.Diff(d.Rules),
+		})
+		rules = d.Rules
+	}
+	resp := &GetDarcHistoryResponse{
+		Version:    CurrentVersion,
+		Versions:   versions,
+		FirstBlock: first,
+	}
+	if more {
+		resp.NextBefore = changes[0].BlockIndex
+	}
+	return resp, nil
+}
+
+// historyDarc returns the darc stored by the change.
+func historyDarc(change InstanceChange) (*darc.Darc, error) {
+	if change.Instance.ContractID != ContractDarcID {
+		return nil, errors.New("instance is not a darc")
+	}
+	d, err := darc.NewFromProtobuf(change.Instance.Value)
+	if err != nil {
+		return nil, errors.New("couldn't decode darc: " + err.Error())
+	}
+	return d, nil
+}
+
+// maxAuthorizationComparisons bounds the work of GetAuthorizations, which
+// anybody can call, to a fraction of the default of the darc package.
+const maxAuthorizationComparisons = 1000000
+
+// GetAuthorizations returns the minimal combinations of identities that can
+// perform an action on an instance, following the delegations to other
+// darcs.
+func (s *Service) GetAuthorizations(req *GetAuthorizations) (*GetAuthorizationsResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	if !s.isOurChain(req.SkipchainID) {
+		return nil, errors.New("skipchain ID does not exist")
+	}
+	coll := s.GetCollectionView(req.SkipchainID)
+	d, err := getInstanceDarc(coll, req.InstanceID)
+	if err != nil {
+		return nil, errors.New("darc not found: " + err.Error())
+	}
+	expr := d.Rules.Get(darc.Action(req.Action))
+	if expr == nil {
+		return nil, fmt.Errorf("action '%s' does not exist in the darc", req.Action)
+	}
+	// Anybody can call this, so the client cannot ask for more work than
+	// the default.
+	maxDepth := req.MaxDepth
+	if maxDepth > darc.DefaultMaxDepth {
+		maxDepth = darc.DefaultMaxDepth
+	}
+	combinations, warnings, err := darc.AuthorizationsLimit(expr, darcGetter(coll), maxDepth, maxAuthorizationComparisons)
+	if err != nil {
+		return nil, err
+	}
+	resp := &GetAuthorizationsResponse{
+		Version:  CurrentVersion,
+		Warnings: warnings,
+	}
+	for _, c := range combinations {
+		resp.Combinations = append(resp.Combinations, Combination{Identities: c})
+	}
+	return resp, nil
+}
+
+// evolveSigners returns the signers of the last accepted evolve instruction
+// of the darc instance in the block. It returns nil if there is none, or if
+// the body of the block has been pruned.
+func evolveSigners(sb *skipchain.SkipBlock, id InstanceID) []darc.Identity {
+	if len(sb.Payload) == 0 {
+		return nil
+	}
+	var body DataBody
+	err := protobuf.DecodeWithConstructors(sb.Payload, &body, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		log.Error("couldn't unmarshal body:", err)
+		return nil
+	}
+	var signers []darc.Identity
+	for _, tx := range body.TxResults {
+		if !tx.Accepted {
+			continue
+		}
+		for _, instr := range tx.ClientTransaction.Instructions {
+			if !instr.InstanceID.Equal(id) || instr.Invoke == nil || instr.Invoke.Command != "evolve" {
+				continue
+			}
+			signers = nil
+			for _, sig := range instr.Signatures {
+				signers = append(signers, sig.Signer)
+			}
+		}
+	}
+	return signers
+}
+
+// GetSignerCounters returns the latest counters of the given signers. The
+// next instruction of a signer must use its counter plus one.
+func (s *Service) GetSignerCounters(req *GetSignerCounters) (*GetSignerCountersResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, fmt.Errorf("version mismatch - got %d but need %d", req.Version, CurrentVersion)
+	}
+	if !s.isOurChain(req.SkipchainID) {
+		return nil, errors.New("skipchain ID does not exist")
+	}
+	coll := s.GetCollectionView(req.SkipchainID)
+	counters := make([]uint64, len(req.SignerIDs))
+	for i, id := range req.SignerIDs {
+		ctr, err := getSignerCounter(coll, id)
+		if err != nil {
+			return nil, err
+		}
+		counters[i] = ctr
+	}
+	return &GetSignerCountersResponse{
+		Version:  CurrentVersion,
+		Counters: counters,
+	}, nil
+}
+
 // SetPropagationTimeout overrides the default propagation timeout that is used
 // when a new block is announced to the nodes as well as the skipchain
 // propagation timeout.
@@ -344,6 +927,8 @@ func (s *Service) createNewBlock(scID skipchain.SkipBlockID, r *onet.Roster, tx
 	var sb *skipchain.SkipBlock
 	var mr []byte
 	var coll *collection.Collection
+	// index is the index of the new block.
+	var index int
 
 	if scID.IsNull() {
 		// For a genesis block, we create a throwaway collection.
@@ -372,6 +957,7 @@ func (s *Service) createNewBlock(scID skipchain.SkipBlockID, r *onet.Roster, tx
 		if r != nil {
 			sb.Roster = r
 		}
+		index = sbLatest.Index + 1
 
 		coll = s.getCollection(scID).coll
 	}
@@ -382,7 +968,7 @@ func (s *Service) createNewBlock(scID skipchain.SkipBlockID, r *onet.Roster, tx
 	var txRes TxResults
 
 	log.Lvl3("Creating state changes")
-	mr, txRes, scs = s.createStateChanges(coll, scID, tx, noTimeout)
+	mr, txRes, scs = s.createStateChanges(coll, scID, index, tx, noTimeout)
 	if len(txRes) == 0 {
 		return nil, errors.New("no transactions")
 	}
@@ -448,9 +1034,14 @@ func (s *Service) updateCollectionCallback(sbID skipchain.SkipBlockID) error {
 	cdb := s.getCollection(sb.SkipChainID())
 	collectionIndex := cdb.getIndex()
 
+	// The blocks that are part of a restored snapshot are not replayed.
+	replay := true
 	if sb.Index != collectionIndex+1 {
-		log.Lvlf4("%v updating collection for block %d refused, current collection block is %d", s.ServerIdentity(), sb.Index, collectionIndex)
-		return nil
+		if !s.isRestored(sb) {
+			log.Lvlf4("%v updating collection for block %d refused, current collection block is %d", s.ServerIdentity(), sb.Index, collectionIndex)
+			return nil
+		}
+		replay = false
 	}
 
 	var header DataHeader
@@ -461,29 +1052,65 @@ func (s *Service) updateCollectionCallback(sbID skipchain.SkipBlockID) error {
 	}
 
 	var body DataBody
-	err = protobuf.DecodeWithConstructors(sb.Payload, &body, network.DefaultConstructors(cothority.Suite))
-	if err != nil {
-		log.Error(s.ServerIdentity(), "could not unmarshal body", err)
-		return errors.New("couldn't unmarshal body")
+	if len(sb.Payload) > 0 || sb.Index == 0 {
+		err = protobuf.DecodeWithConstructors(sb.Payload, &body, network.DefaultConstructors(cothority.Suite))
+		if err != nil {
+			log.Error(s.ServerIdentity(), "could not unmarshal body", err)
+			return errors.New("couldn't unmarshal body")
+		}
 	}
+	switch {
+	case !replay:
+		log.Lvlf2("%s block %d is part of the restored snapshot", s.ServerIdentity(), sb.Index)
+	case len(sb.Payload) == 0 && sb.Index > 0:
+		// Blocks always hold transactions, so the body has been pruned by
+		// the node we got the block from, and we cannot replay it. The
+		// rest of the block is handled as usual, without transactions.
+		log.Lvlf2("%s got pruned block %d, catching up from a snapshot", s.ServerIdentity(), sb.Index)
+		index, err := s.syncFromSnapshot(sb)
+		if err != nil {
+			return err
+		}
+		if index > sb.Index {
+			s.restoredToMut.Lock()
+			s.restoredTo[string(sb.SkipChainID())] = index
+			s.restoredToMut.Unlock()
+		}
+	default:
+		log.Lvlf2("%s Updating transactions for %x", s.ServerIdentity(), sb.SkipChainID())
+		_, _, scs := s.createStateChanges(cdb.coll, sb.SkipChainID(), sb.Index, body.TxResults, noTimeout)
 
-	log.Lvlf2("%s Updating transactions for %x", s.ServerIdentity(), sb.SkipChainID())
-	_, _, scs := s.createStateChanges(cdb.coll, sb.SkipChainID(), body.TxResults, noTimeout)
-
-	log.Lvlf3("%s Storing %d state changes %v", s.ServerIdentity(), len(scs), scs.ShortStrings())
-	if err = cdb.StoreAll(scs, sb.Index); err != nil {
-		return err
+		log.Lvlf3("%s Storing %d state changes %v", s.ServerIdentity(), len(scs), scs.ShortStrings())
+		if err = cdb.StoreAll(scs, sb.Index); err != nil {
+			return err
+		}
+		if !bytes.Equal(cdb.RootHash(), header.CollectionRoot) {
+			// TODO: if this happens, we've now got a corrupted cdb. See issue #1447.
+			log.Error("hash of collection doesn't correspond to root hash")
+		}
 	}
-	if !bytes.Equal(cdb.RootHash(), header.CollectionRoot) {
-		// TODO: if this happens, we've now got a corrupted cdb. See issue #1447.
-		log.Error("hash of collection doesn't correspond to root hash")
+
+	if err = cdb.StoreTxResults(body.TxResults, sb.Hash); err != nil {
+		log.Error(s.ServerIdentity(), "couldn't index transactions:", err)
 	}
 
 	// Notify all waiting channels
 	for _, t := range body.TxResults {
-		s.state.informWaitChannel(t.ClientTransaction.Instructions.Hash(), t.Accepted)
+		s.state.informWaitChannel(t.ClientTransaction.Instructions.Hash(), txInclusion{
+			accepted:   t.Accepted,
+			blockIndex: sb.Index,
+			err:        t.Error,
+		})
 	}
 	s.state.informBlock(sb.SkipChainID())
+	s.streamingMan.notify(string(sb.SkipChainID()), &StreamingResponse{
+		BlockID:   sb.Hash,
+		Index:     sb.Index,
+		Header:    header,
+		TxResults: body.TxResults,
+	})
+	s.pruneBlocks(sb)
+	s.pruneHistory(sb)
 
 	// check whether the heartbeat monitor exists, if it doesn't we start a
 	// new one
@@ -651,7 +1278,7 @@ func (s *Service) LoadBlockInfo(scID skipchain.SkipBlockID) (time.Duration, int,
 	}
 	config, err := loadConfigFromColl(cv)
 	if err != nil {
-		if err == errKeyNotSet {
+		if err == ErrKeyNotSet {
 			err = nil
 		}
 		return defaultInterval, defaultMaxBlockSize, err
@@ -743,6 +1370,22 @@ func (s *Service) startPolling(scID skipchain.SkipBlockID, interval time.Duratio
 					continue
 				}
 
+				// If the transactions don't fit in one block, the ones
+				// paying the highest fees go first.
+				var totalsz int
+				for _, ct := range txs {
+					totalsz += txSize(TxResult{ClientTransaction: ct})
+				}
+				if totalsz > maxsz {
+					coll := &roCollection{s.getCollection(scID).coll}
+					config, err := loadConfigFromColl(coll)
+					if err != nil {
+						log.Error(s.ServerIdentity(), "couldn't load the config to sort the transactions:", err)
+					} else {
+						sortByFee(config, coll, s.feeContract, txs)
+					}
+				}
+
 				txIn := make([]TxResult, len(txs))
 				for i := range txIn {
 					txIn[i].ClientTransaction = txs[i]
@@ -753,9 +1396,12 @@ func (s *Service) startPolling(scID skipchain.SkipBlockID, interval time.Duratio
 				log.Lvl3("Counting how many transactions fit in", interval/2)
 				cdb := s.getCollection(scID)
 				then := time.Now()
-				_, txOut, _ := s.createStateChanges(cdb.coll, scID, txIn, interval/2)
+				_, txOut, _ := s.createStateChanges(cdb.coll, scID, sb.Index+1, txIn, interval/2)
 
-				txs = txs[len(txOut):]
+				// The transactions that didn't fit, or that exceeded the
+				// execution time, are not in txOut and are kept for the
+				// next block.
+				txs = removeIncluded(txs, txOut)
 				if len(txs) > 0 {
 					sz := txSize(txOut...)
 					log.Warnf("%d transactions (%v bytes) included in block in %v, %d transactions left for the next block", len(txOut), sz, time.Now().Sub(then), len(txs))
@@ -771,6 +1417,23 @@ func (s *Service) startPolling(scID skipchain.SkipBlockID, interval time.Duratio
 	return closeSignal
 }
 
+// removeIncluded returns the transactions of txs that are not in txOut. As
+// txs may have been sorted by fee, and some of them left out, txOut is not
+// a prefix of txs, so the transactions are matched by their hash.
+func removeIncluded(txs []ClientTransaction, txOut TxResults) []ClientTransaction {
+	included := make(map[string]bool)
+	for _, tx := range txOut {
+		included[string(tx.ClientTransaction.Instructions.Hash())] = true
+	}
+	var left []ClientTransaction
+	for _, tx := range txs {
+		if !included[string(tx.Instructions.Hash())] {
+			left = append(left, tx)
+		}
+	}
+	return left
+}
+
 // We use the ByzCoin as a receiver (as is done in the identity service),
 // so we can access e.g. the collectionDBs of the service.
 func (s *Service) verifySkipBlock(newID []byte, newSB *skipchain.SkipBlock) bool {
@@ -818,8 +1481,20 @@ func (s *Service) verifySkipBlock(newID []byte, newSB *skipchain.SkipBlock) bool
 		return false
 	}
 
+	// Refuse upgrades to versions this node doesn't have, so the roster
+	// cannot agree on a block that some nodes could not execute later.
+	for _, tx := range body.TxResults {
+		if !tx.Accepted {
+			continue
+		}
+		if err := s.checkUpgrades(tx.ClientTransaction); err != nil {
+			log.Error(s.ServerIdentity(), err)
+			return false
+		}
+	}
+
 	cdb := s.getCollection(newSB.SkipChainID())
-	mtr, txOut, scs := s.createStateChanges(cdb.coll, newSB.SkipChainID(), body.TxResults, noTimeout)
+	mtr, txOut, scs := s.createStateChanges(cdb.coll, newSB.SkipChainID(), newSB.Index, body.TxResults, noTimeout)
 
 	// Check that the locally generated list of accepted/rejected txs match the list
 	// the leader proposed.
@@ -914,6 +1589,9 @@ func txSize(txr ...TxResult) (out int) {
 // creating the appropriate StateChanges, by sorting out which transactions can
 // be run, which fail, and which cannot be attempted yet (due to timeout).
 //
+// The index is the one of the block holding the transactions. It defines
+// which versions of the contracts are used.
+//
 // If timeout is not 0, createStateChanges will stop running instructions after
 // that long, in order for the caller to determine how many instructions fit in
 // a block interval.
@@ -921,7 +1599,7 @@ func txSize(txr ...TxResult) (out int) {
 // State caching is implemented here, which is critical to performance, because
 // on the leader it reduces the number of contract executions by 1/3 and on
 // followers by 1/2.
-func (s *Service) createStateChanges(coll *collection.Collection, scID skipchain.SkipBlockID, txIn TxResults, timeout time.Duration) (merkleRoot []byte, txOut TxResults, states StateChanges) {
+func (s *Service) createStateChanges(coll *collection.Collection, scID skipchain.SkipBlockID, index int, txIn TxResults, timeout time.Duration) (merkleRoot []byte, txOut TxResults, states StateChanges) {
 	// If what we want is in the cache, then take it from there. Otherwise
 	// ignore the error and compute the state changes.
 	var err error
@@ -942,6 +1620,17 @@ func (s *Service) createStateChanges(coll *collection.Collection, scID skipchain
 
 	deadline := time.Now().Add(timeout)
 
+	block := blockInfo{index: index}
+	if index > 0 {
+		sb, err := s.skService().GetSingleBlockByIndex(&skipchain.GetSingleBlockByIndex{
+			Genesis: scID,
+			Index:   index - 1,
+		})
+		if err == nil {
+			block.timestamp = blockTimestamp(sb)
+		}
+	}
+
 	// TODO: Because we depend on making at least one clone per transaction
 	// we need to find out if this is as expensive as it looks, and if so if
 	// we could use some kind of copy-on-write technique.
@@ -952,29 +1641,42 @@ clientTransactions:
 	for _, tx := range txIn {
 		txsz := txSize(tx)
 
-		// Make a new collection for each instruction. If the instruction is sucessfully
-		// implemented and changes applied, then keep it (via cdbTemp = cdbI.c),
-		// otherwise dump it.
+		// The fee is paid according to the configuration before the
+		// transaction. The genesis transaction has no configuration yet.
+		config, err := loadConfigFromColl(&roCollection{cdbTemp})
+		if err != nil {
+			config = nil
+		}
+
+		// Make a new collection for each transaction. If the transaction
+		// is sucessfully implemented and changes applied, then keep it
+		// (via cdbTemp = cdbI.c), otherwise dump it.
 		cdbI := &roCollection{cdbTemp.Clone()}
-		for _, instr := range tx.ClientTransaction.Instructions {
-			scs, cout, err := s.executeInstruction(cdbI, cin, instr)
-			if err != nil {
-				log.Errorf("%s Call to contract returned error: %s", s.ServerIdentity(), err)
-				tx.Accepted = false
-				txOut = append(txOut, tx)
-				continue clientTransactions
-			}
-			for _, sc := range scs {
-				if err := storeInColl(cdbI.c, &sc); err != nil {
-					log.Error(s.ServerIdentity(), "failed to add to collections with error: "+err.Error())
-					tx.Accepted = false
-					txOut = append(txOut, tx)
-					continue clientTransactions
-				}
+		scs, cout, _, _, err := s.executeTransaction(cdbI, cin,
+			tx.ClientTransaction, config, block, timeout != noTimeout)
+		if err != nil && err.Error() == errExecutionTime {
+			// The execution time depends on the node, so a transaction
+			// exceeding it is left out of the block by the leader while
+			// planning it, instead of being refused.
+			log.Warnf("%s leaving out transaction exceeding the execution time", s.ServerIdentity())
+			continue clientTransactions
+		}
+		cin = cout
+		if err != nil {
+			log.Errorf("%s Transaction refused: %s", s.ServerIdentity(), err)
+			tx.Accepted = false
+			tx.Error = err.Error()
+			txOut = append(txOut, tx)
+			// The refused transaction is in the block, so it pays its
+			// fee from the state before it, if it can.
+			cdbFee := cdbTemp.Clone()
+			if scs, err := chargeFee(config, cdbFee, tx.ClientTransaction, s.feeContract); err == nil {
+				states = append(states, scs...)
+				cdbTemp = cdbFee
 			}
-			states = append(states, scs...)
-			cin = cout
+			continue clientTransactions
 		}
+		states = append(states, scs...)
 
 		// We would like to be able to check if this txn is so big it could never fit into a block,
 		// and if so, drop it. But we can't with the current API of createStateChanges.
@@ -1006,6 +1708,7 @@ clientTransactions:
 
 		cdbTemp = cdbI.c
 		tx.Accepted = true
+		tx.Error = ""
 		txOut = append(txOut, tx)
 		blocksz += txsz
 	}
@@ -1016,29 +1719,66 @@ clientTransactions:
 	return
 }
 
-func (s *Service) executeInstruction(cdbI CollectionView, cin []Coin, instr Instruction) (scs StateChanges, cout []Coin, err error) {
-	defer func() {
-		if re := recover(); re != nil {
-			err = errors.New(re.(string))
+// executeTransaction runs the instructions of the transaction one after the
+// other and makes it pay its fee, storing the state changes in cdbI. It is
+// used both to create blocks and to simulate transactions, so that a
+// simulation gives the same result as the real execution.
+//
+// It returns the state changes, the coins left by the last successful
+// instruction, the resources used by each executed instruction, and the
+// index of the instruction that failed, which is the number of
+// instructions if the fee couldn't be paid.
+func (s *Service) executeTransaction(cdbI *roCollection, cin []Coin, tx ClientTransaction, config *ChainConfig, block blockInfo, enforceTime bool) (states StateChanges, cout []Coin, metering []Metering, failed int, err error) {
+	cout = cin
+	// results holds the values returned by the instructions, which can be
+	// used by the following ones.
+	var results []Arguments
+	for i, instr := range tx.Instructions {
+		failed = i
+		instr, err = instr.resolveInputs(results)
+		if err != nil {
+			return
 		}
-	}()
+		// The state changes are stored in cdbI by executeInstruction.
+		scs, co, ret, m, err := s.executeInstruction(cdbI, cout, instr, config, block, enforceTime)
+		metering = append(metering, m)
+		if err != nil {
+			return states, cout, metering, failed, err
+		}
+		states = append(states, scs...)
+		results = append(results, ret)
+		cout = co
+	}
 
-	contractID, _, err := instr.GetContractState(cdbI)
+	failed = len(tx.Instructions)
+	scs, err := feeStateChanges(config, cdbI, tx, s.feeContract)
 	if err != nil {
-		err = errors.New("Couldn't get contract type of instruction: " + err.Error())
 		return
 	}
-
-	contract, exists := s.contracts[contractID]
-	// If the leader does not have a verifier for this contract, it drops the
-	// transaction.
-	if !exists {
-		err = errors.New("Leader is dropping instruction of unknown contract: " + contractID)
-		return
+	for _, sc := range scs {
+		if err = storeInColl(cdbI.c, &sc); err != nil {
+			return
+		}
 	}
-	// Now we call the contract function with the data of the key.
-	log.Lvlf3("%s Calling contract %s", s.ServerIdentity(), contractID)
-	return contract(cdbI, instr, cin)
+	states = append(states, scs...)
+	return
+}
+
+// executeInstruction calls the version of the contract of the instruction
+// that is active at the given block, and stores the
+// resulting state changes in cdbI. It returns the state changes, including
+// the ones of the contracts called by the instruction, the values returned
+// by the instruction and the resources it used. The contract is refused if
+// it exceeds the limits of config. The execution time is only enforced if
+// enforceTime is true.
+func (s *Service) executeInstruction(cdbI *roCollection, cin []Coin, instr Instruction, config *ChainConfig, block blockInfo, enforceTime bool) (scs StateChanges, cout []Coin, ret Arguments, m Metering, err error) {
+	ctx := &callContext{
+		s:      s,
+		coll:   cdbI,
+		config: config,
+		block:  block,
+	}
+	return ctx.execute(cin, instr, enforceTime)
 }
 
 func (s *Service) getLeader(scID skipchain.SkipBlockID) (*network.ServerIdentity, error) {
@@ -1120,6 +1860,7 @@ func (s *Service) cleanupGoroutines() {
 	s.heartbeats.closeAll()
 	s.closeLeaderMonitorChan <- true
 	s.viewChangeMan.closeAll()
+	s.streamingMan.closeAll()
 
 	s.pollChanMut.Lock()
 	for k, c := range s.pollChan {
@@ -1257,6 +1998,68 @@ func (s *Service) registerContract(contractID string, c ContractFn) error {
 	return nil
 }
 
+// registerFeeContract sets the contract of the coin instances paying the
+// fees.
+func (s *Service) registerFeeContract(contractID string) error {
+	s.feeContract = contractID
+	return nil
+}
+
+// registerContractVersion stores an upgraded version of a contract.
+func (s *Service) registerContractVersion(contractID string, version int, c ContractFn) error {
+	if version <= 0 {
+		return errors.New("version 0 is registered with RegisterContract")
+	}
+	if s.contractVersions[contractID] == nil {
+		s.contractVersions[contractID] = make(map[int]ContractFn)
+	}
+	s.contractVersions[contractID][version] = c
+	return nil
+}
+
+// checkUpgrades refuses a transaction upgrading a contract to a version that
+// is not registered on this node. The config contract cannot check it, as
+// nodes with different registries would disagree on the state, so it is
+// checked when adding the transaction and when verifying the block.
+func (s *Service) checkUpgrades(tx ClientTransaction) error {
+	for _, instr := range tx.Instructions {
+		if !instr.InstanceID.Equal(ConfigInstanceID) || instr.Invoke == nil ||
+			instr.Invoke.Command != "upgrade_contract" {
+			continue
+		}
+		contractID := string(instr.Invoke.Args.Search("contract_id"))
+		versionBuf := instr.Invoke.Args.Search("version")
+		if len(versionBuf) != 8 {
+			// The config contract refuses it.
+			continue
+		}
+		version := int(binary.LittleEndian.Uint64(versionBuf))
+		if _, ok := s.contractVersions[contractID][version]; !ok {
+			return fmt.Errorf("version %d of contract %s is not registered", version, contractID)
+		}
+	}
+	return nil
+}
+
+// getContract returns the version of the contract that is active at the
+// block with the given index, according to the config.
+func (s *Service) getContract(config *ChainConfig, contractID string, index int) (ContractFn, bool) {
+	version := config.contractVersion(contractID, index)
+	if version == 0 {
+		c, ok := s.contracts[contractID]
+		return c, ok
+	}
+	c, ok := s.contractVersions[contractID][version]
+	return c, ok
+}
+
+// registerQuery stores the read-only function of a contract in a map and
+// will call it whenever a query on an instance of the contract comes in.
+func (s *Service) registerQuery(contractID string, q QueryFn) error {
+	s.queries[contractID] = q
+	return nil
+}
+
 // startAllChains loads the configuration, updates the data in the service if
 // it finds a valid config-file and synchronises skipblocks if it can contact
 // other nodes.
@@ -1275,7 +2078,7 @@ func (s *Service) startAllChains() error {
 	}
 	s.collectionDB = map[string]*collectionDB{}
 	s.state = bcState{
-		waitChannels: make(map[string]chan bool),
+		waitChannels: make(map[string]chan txInclusion),
 	}
 
 	// NOTE: Usually startAllChains is only called when services start up. but for
@@ -1419,19 +2222,29 @@ func newService(c *onet.Context) (onet.Service, error) {
 	s := &Service{
 		ServiceProcessor:       onet.NewServiceProcessor(c),
 		contracts:              make(map[string]ContractFn),
+		contractVersions:       make(map[string]map[int]ContractFn),
+		queries:                make(map[string]QueryFn),
 		txBuffer:               newTxBuffer(),
 		storage:                &omniStorage{},
 		darcToSc:               make(map[string]skipchain.SkipBlockID),
+		restoredTo:             make(map[string]int),
 		stateChangeCache:       newStateChangeCache(),
+		snapshotCache:          newSnapshotCache(),
 		heartbeatsTimeout:      make(chan string, 1),
 		closeLeaderMonitorChan: make(chan bool, 1),
 		heartbeats:             newHeartbeats(),
 		viewChangeMan:          newViewChangeManager(),
+		streamingMan:           newStreamingManager(),
 	}
 	if err := s.RegisterHandlers(s.CreateGenesisBlock, s.AddTransaction,
-		s.GetProof); err != nil {
+		s.GetProof, s.GetProofs, s.GetTxStatus, s.GetSignerCounters, s.Query,
+		s.SimulateTransaction, s.GetSnapshot, s.ListInstances,
+		s.GetInstanceHistory, s.GetDarcHistory, s.GetAuthorizations); err != nil {
 		log.ErrFatal(err, "Couldn't register messages")
 	}
+	if err := s.RegisterStreamingHandler(s.StreamTransactions); err != nil {
+		log.ErrFatal(err, "Couldn't register streaming messages")
+	}
 	s.RegisterProcessorFunc(viewChangeMsgID, s.handleViewChangeReq)
 
 	s.registerContract(ContractConfigID, s.ContractConfig)
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"math"
+	"sort"
 	"testing"
 	"time"
 
@@ -12,6 +13,7 @@ import (
 	"github.com/dedis/cothority/byzcoin/darc"
 	"github.com/dedis/cothority/byzcoin/darc/expression"
 	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/kyber/sign/schnorr"
 	"github.com/dedis/kyber/suites"
 	"github.com/dedis/kyber/util/random"
 	"github.com/dedis/onet"
@@ -278,6 +280,492 @@ func TestService_GetProof(t *testing.T) {
 	require.NotNil(t, err)
 }
 
+func TestService_Query(t *testing.T) {
+	s := newSer(t, 2, testInterval)
+	defer s.local.CloseAll()
+
+	id := NewInstanceID(s.tx.Instructions[0].Hash())
+	s.waitProof(t, id)
+
+	query := func(iID InstanceID, name string) (*QueryResponse, error) {
+		return s.service().Query(&Query{
+			Version:     CurrentVersion,
+			SkipchainID: s.sb.SkipChainID(),
+			InstanceID:  iID,
+			Name:        name,
+		})
+	}
+	resp, err := query(id, "value")
+	require.Nil(t, err)
+	require.Equal(t, s.value, resp.Result)
+	require.Nil(t, resp.Proof.Verify(s.sb.SkipChainID()))
+	require.True(t, resp.Proof.InclusionProof.Match())
+	_, vs, err := resp.Proof.KeyValue()
+	require.Nil(t, err)
+	require.Equal(t, s.value, vs[0])
+
+	_, err = query(id, "unknown")
+	require.NotNil(t, err)
+	_, err = query(id, "panic")
+	require.NotNil(t, err)
+	// The darc contract has no query function.
+	_, err = query(NewInstanceID(s.darc.GetBaseID()), "value")
+	require.NotNil(t, err)
+	_, err = query(genID(), "value")
+	require.NotNil(t, err)
+}
+
+func TestService_SimulateTransaction(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	root := s.service().getCollection(s.sb.SkipChainID()).coll.GetRoot()
+	simulate := func(tx ClientTransaction) *SimulateTxResponse {
+		resp, err := s.service().SimulateTransaction(&SimulateTxRequest{
+			Version:     CurrentVersion,
+			SkipchainID: s.sb.SkipChainID(),
+			Transaction: tx,
+		})
+		require.Nil(t, err)
+		return resp
+	}
+
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyContract, s.value, s.signer)
+	require.Nil(t, err)
+	resp := simulate(tx)
+	require.True(t, resp.Accepted)
+	require.Equal(t, []string{""}, resp.Errors)
+	require.Equal(t, 1, len(resp.Metering))
+	require.Equal(t, 1, resp.Metering[0].Writes)
+	require.Equal(t, 1, len(resp.StateChanges))
+	require.Equal(t, s.value, resp.StateChanges[0].Value)
+	require.NotEqual(t, root, resp.CollectionRoot)
+
+	// The simulation gives the same result as the execution in the next
+	// block.
+	latest, err := s.service().db().GetLatestByID(s.sb.SkipChainID())
+	require.Nil(t, err)
+	mr, txOut, states := s.service().createStateChanges(
+		s.service().getCollection(s.sb.SkipChainID()).coll, s.sb.SkipChainID(),
+		latest.Index+1, NewTxResults(tx), noTimeout)
+	require.True(t, txOut[0].Accepted)
+	require.Equal(t, mr, resp.CollectionRoot)
+	require.Equal(t, len(states), len(resp.StateChanges))
+
+	tx, err = createOneClientTx(s.darc.GetBaseID(), invalidContract, s.value, s.signer)
+	require.Nil(t, err)
+	resp = simulate(tx)
+	require.False(t, resp.Accepted)
+	require.Equal(t, 1, len(resp.Errors))
+	require.NotEqual(t, "", resp.Errors[0])
+	require.Equal(t, 0, len(resp.StateChanges))
+	require.Equal(t, root, resp.CollectionRoot)
+
+	// Nothing must have been changed by the simulations.
+	require.Equal(t, root, s.service().getCollection(s.sb.SkipChainID()).coll.GetRoot())
+	require.Equal(t, 0, len(s.service().txBuffer.take(string(s.sb.SkipChainID()))))
+}
+
+func TestService_ContractUpgrade(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	v1 := func(cdb CollectionView, inst Instruction, c []Coin) ([]StateChange, []Coin, error) {
+		return nil, nil, errors.New("version 1")
+	}
+	for _, h := range s.hosts {
+		require.Nil(t, RegisterContractVersion(h, dummyContract, 1, v1))
+	}
+	require.NotNil(t, RegisterContractVersion(s.hosts[0], dummyContract, 0, v1))
+
+	upgrade := func(contractID string, version, height uint64) ClientTransaction {
+		vBuf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(vBuf, version)
+		hBuf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(hBuf, height)
+		ctx := ClientTransaction{
+			Instructions: []Instruction{{
+				InstanceID: ConfigInstanceID,
+				Nonce:      GenNonce(),
+				Index:      0,
+				Length:     1,
+				Invoke: &Invoke{
+					Command: "upgrade_contract",
+					Args: []Argument{
+						{Name: "contract_id", Value: []byte(contractID)},
+						{Name: "version", Value: vBuf},
+						{Name: "height", Value: hBuf},
+					},
+				},
+			}},
+		}
+		require.Nil(t, ctx.Instructions[0].SignBy(s.darc.GetBaseID(), s.signer))
+		return ctx
+	}
+
+	// Unknown versions are refused by the node, and the height must be in
+	// the future.
+	_, err := s.service().AddTransaction(&AddTxRequest{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		Transaction: upgrade(dummyContract, 2, 10),
+	})
+	require.NotNil(t, err)
+	// Blocks holding such an upgrade are refused.
+	_, err = s.service().createNewBlock(s.sb.SkipChainID(), nil, []TxResult{{
+		ClientTransaction: upgrade(dummyContract, 2, 10),
+		Accepted:          true,
+	}})
+	require.NotNil(t, err)
+	cv := s.service().GetCollectionView(s.sb.SkipChainID())
+	_, _, err = upgradeContract(blockView{cv, 10}, upgrade(dummyContract, 1, 10).Instructions[0], nil)
+	require.NotNil(t, err)
+	_, _, err = upgradeContract(blockView{cv, 9}, upgrade(dummyContract, 1, 10).Instructions[0], nil)
+	require.Nil(t, err)
+
+	s.sendTx(t, upgrade(dummyContract, 1, 10))
+	var config *ChainConfig
+	for i := 0; i < 10; i++ {
+		config, err = loadConfigFromColl(s.service().GetCollectionView(s.sb.SkipChainID()))
+		require.Nil(t, err)
+		if len(config.ContractVersions) > 0 {
+			break
+		}
+		time.Sleep(testInterval)
+	}
+	require.Equal(t, []ContractVersion{{dummyContract, 1, 10}}, config.ContractVersions)
+
+	// The new version is only used from the height of the upgrade on.
+	require.Equal(t, 0, config.contractVersion(dummyContract, 9))
+	require.Equal(t, 1, config.contractVersion(dummyContract, 10))
+	require.Equal(t, 0, config.contractVersion("darc", 10))
+	f, ok := s.service().getContract(config, dummyContract, 10)
+	require.True(t, ok)
+	_, _, err = f(nil, Instruction{}, nil)
+	require.Equal(t, "version 1", err.Error())
+
+	// Versions and heights must increase.
+	cv = s.service().GetCollectionView(s.sb.SkipChainID())
+	_, _, err = upgradeContract(blockView{cv, 2}, upgrade(dummyContract, 1, 20).Instructions[0], nil)
+	require.NotNil(t, err)
+	_, _, err = upgradeContract(blockView{cv, 2}, upgrade(dummyContract, 2, 10).Instructions[0], nil)
+	require.NotNil(t, err)
+
+	// update_config cannot change the upgrades, even when it doesn't know
+	// about them.
+	for _, cvs := range [][]ContractVersion{nil, {{dummyContract, 3, 5}}} {
+		ctx, newConfig := createConfigTx(t, s, false, false)
+		newConfig.ContractVersions = cvs
+		configBuf, err := protobuf.Encode(&newConfig)
+		require.Nil(t, err)
+		ctx.Instructions[0].Invoke.Args = Arguments{{Name: "config", Value: configBuf}}
+		sc, _, err := invokeContractConfig(cv, ctx.Instructions[0], nil)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(sc))
+		var stored ChainConfig
+		require.Nil(t, protobuf.DecodeWithConstructors(sc[0].Value, &stored, network.DefaultConstructors(cothority.Suite)))
+		require.Equal(t, config.ContractVersions, stored.ContractVersions)
+		require.Equal(t, newConfig.MaxBlockSize, stored.MaxBlockSize)
+	}
+}
+
+// blockView adds the block information to a CollectionView, like the
+// CollectionView given to the contracts by ByzCoin.
+type blockView struct {
+	CollectionView
+	index int
+}
+
+func (bv blockView) BlockInfo() (int, int64) {
+	return bv.index, 0
+}
+
+func TestService_ListInstances(t *testing.T) {
+	s := newSer(t, 2, testInterval)
+	defer s.local.CloseAll()
+
+	ids := []InstanceID{NewInstanceID(s.tx.Instructions[0].Hash())}
+	s.waitProof(t, ids[0])
+	for i := 0; i < 3; i++ {
+		tx, err := createOneClientTx(s.darc.GetBaseID(), dummyContract, s.value, s.signer)
+		require.Nil(t, err)
+		s.sendTx(t, tx)
+		ids = append(ids, NewInstanceID(tx.Instructions[0].Hash()))
+	}
+	for _, id := range ids {
+		s.waitProof(t, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i][:], ids[j][:]) < 0
+	})
+
+	list := func(contractID string, darcID darc.ID, cursor []byte) *ListInstancesResponse {
+		resp, err := s.service().ListInstances(&ListInstances{
+			Version:     CurrentVersion,
+			SkipchainID: s.sb.SkipChainID(),
+			ContractID:  contractID,
+			DarcID:      darcID,
+			Cursor:      cursor,
+			Limit:       2,
+		})
+		require.Nil(t, err)
+		return resp
+	}
+	resp := list(dummyContract, s.darc.GetBaseID(), nil)
+	require.Equal(t, 2, len(resp.Instances))
+	require.Equal(t, ids[0], resp.Instances[0].InstanceID)
+	require.Equal(t, ids[1], resp.Instances[1].InstanceID)
+	require.Equal(t, s.value, resp.Instances[0].Value)
+	require.Equal(t, dummyContract, resp.Instances[0].ContractID)
+	require.NotNil(t, resp.NextCursor)
+	resp = list(dummyContract, s.darc.GetBaseID(), resp.NextCursor)
+	require.Equal(t, 2, len(resp.Instances))
+	require.Equal(t, ids[2], resp.Instances[0].InstanceID)
+	require.Equal(t, ids[3], resp.Instances[1].InstanceID)
+	require.Nil(t, resp.NextCursor)
+
+	resp = list(ContractDarcID, nil, nil)
+	require.Equal(t, 1, len(resp.Instances))
+	require.Equal(t, NewInstanceID(s.darc.GetBaseID()), resp.Instances[0].InstanceID)
+	resp = list(dummyContract, darc.ID{1, 2, 3}, nil)
+	require.Equal(t, 0, len(resp.Instances))
+}
+
+func TestService_GetProofs(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	id1 := NewInstanceID(s.tx.Instructions[0].Hash())
+	s.waitProof(t, id1)
+	darcID := NewInstanceID(s.darc.GetBaseID())
+	absent := NewInstanceID([]byte("absent"))
+
+	resp, err := s.service().GetProofs(&GetProofs{
+		Version: CurrentVersion,
+		Keys:    [][]byte{id1.Slice(), darcID.Slice(), absent.Slice()},
+		ID:      s.sb.SkipChainID(),
+	})
+	require.Nil(t, err)
+
+	// The proof is still valid after being sent over the network.
+	buf, err := protobuf.Encode(resp)
+	require.Nil(t, err)
+	var received GetProofsResponse
+	require.Nil(t, protobuf.DecodeWithConstructors(buf, &received, network.DefaultConstructors(cothority.Suite)))
+	mp := received.Proof
+	require.Nil(t, mp.Verify(s.sb.SkipChainID()))
+
+	p, err := mp.Proof(id1.Slice())
+	require.Nil(t, err)
+	require.Nil(t, p.Verify(s.sb.SkipChainID()))
+	require.True(t, p.InclusionProof.Match())
+	_, vs, err := p.KeyValue()
+	require.Nil(t, err)
+	require.Equal(t, s.value, vs[0])
+	p, err = mp.Proof(darcID.Slice())
+	require.Nil(t, err)
+	require.True(t, p.InclusionProof.Match())
+	p, err = mp.Proof(absent.Slice())
+	require.Nil(t, err)
+	require.False(t, p.InclusionProof.Match())
+	_, err = mp.Proof([]byte("not requested"))
+	require.NotNil(t, err)
+
+	// A tampered proof is refused.
+	mp.InclusionProof.Nodes[0].Label[0]++
+	require.Equal(t, ErrorVerifyCollection, mp.Verify(s.sb.SkipChainID()))
+
+	_, err = s.service().GetProofs(&GetProofs{
+		Version: CurrentVersion,
+		ID:      s.sb.SkipChainID(),
+	})
+	require.NotNil(t, err)
+}
+
+func TestService_GetProofAt(t *testing.T) {
+	s := newSer(t, 2, testInterval)
+	defer s.local.CloseAll()
+
+	id1 := NewInstanceID(s.tx.Instructions[0].Hash())
+	s.waitProof(t, id1)
+	block1, err := s.service().db().GetLatestByID(s.sb.SkipChainID())
+	require.Nil(t, err)
+
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyContract, s.value, s.signer)
+	require.Nil(t, err)
+	s.sendTx(t, tx)
+	id2 := NewInstanceID(tx.Instructions[0].Hash())
+	s.waitProof(t, id2)
+
+	getProof := func(key InstanceID, at skipchain.SkipBlockID) (*Proof, error) {
+		resp, err := s.service().GetProof(&GetProof{
+			Version: CurrentVersion,
+			Key:     key.Slice(),
+			ID:      s.sb.SkipChainID(),
+			BlockID: at,
+		})
+		if err != nil {
+			return nil, err
+		}
+		require.Nil(t, resp.Proof.Verify(s.sb.SkipChainID()))
+		require.True(t, resp.Proof.Latest.Hash.Equal(at))
+		return &resp.Proof, nil
+	}
+
+	// In the genesis block, none of the instances exist.
+	p, err := getProof(id1, s.sb.Hash)
+	require.Nil(t, err)
+	require.False(t, p.InclusionProof.Match())
+
+	// In the first block, only the first instance exists.
+	p, err = getProof(id1, block1.Hash)
+	require.Nil(t, err)
+	require.True(t, p.InclusionProof.Match())
+	p, err = getProof(id2, block1.Hash)
+	require.Nil(t, err)
+	require.False(t, p.InclusionProof.Match())
+
+	_, err = getProof(id1, skipchain.SkipBlockID{1, 2, 3})
+	require.NotNil(t, err)
+}
+
+func TestService_Snapshot(t *testing.T) {
+	s := newSer(t, 2, testInterval)
+	defer s.local.CloseAll()
+
+	s.waitProof(t, NewInstanceID(s.tx.Instructions[0].Hash()))
+	resp, err := s.service().GetSnapshot(&GetSnapshot{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+	})
+	require.Nil(t, err)
+	require.Nil(t, resp.Verify(s.sb))
+	latest, err := s.service().db().GetLatestByID(s.sb.SkipChainID())
+	require.Nil(t, err)
+	require.Equal(t, latest.Index, resp.Snapshot.Index)
+	require.Equal(t, latest.Hash, resp.Snapshot.BlockID)
+	require.Equal(t, s.service().getCollection(s.sb.SkipChainID()).RootHash(),
+		resp.Snapshot.CollectionRoot)
+
+	// Restore the snapshot in a new collection and load it again from the
+	// disk.
+	name := []byte("snapshot-test")
+	cdb := newCollectionDB(s.service().db().DB, name)
+	require.Nil(t, cdb.restore(&resp.Snapshot))
+	require.Equal(t, resp.Snapshot.CollectionRoot, cdb.RootHash())
+	require.Equal(t, latest.Index, cdb.getIndex())
+	cdb = newCollectionDB(s.service().db().DB, name)
+	require.Equal(t, resp.Snapshot.CollectionRoot, cdb.RootHash())
+
+	// A snapshot signed by a node outside of the roster is refused.
+	signed := resp.Snapshot
+	priv := cothority.Suite.Scalar().Pick(cothority.Suite.RandomStream())
+	resp.Snapshot.Signer = network.NewServerIdentity(cothority.Suite.Point().Mul(priv, nil),
+		network.NewAddress(network.PlainTCP, "127.0.0.1:2000"))
+	resp.Snapshot.Signature, err = schnorr.Sign(cothority.Suite, priv, resp.Snapshot.Hash())
+	require.Nil(t, err)
+	require.NotNil(t, resp.Verify(s.sb))
+	resp.Snapshot = signed
+	require.Nil(t, resp.Verify(s.sb))
+
+	// Changing the snapshot must be detected.
+	resp.Snapshot.Instances[0].Value = []byte("wrong value")
+	require.NotNil(t, resp.Verify(s.sb))
+
+	// Until minSnapshotInterval passed, the same snapshot is returned, even
+	// after a new block.
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyContract, s.value, s.signer)
+	require.Nil(t, err)
+	s.sendTx(t, tx)
+	s.waitProof(t, NewInstanceID(tx.Instructions[0].Hash()))
+	resp2, err := s.service().GetSnapshot(&GetSnapshot{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+	})
+	require.Nil(t, err)
+	require.Equal(t, latest.Index, resp2.Snapshot.Index)
+	require.Nil(t, resp2.Verify(s.sb))
+
+	// The instances are sent in chunks, which are only available as long
+	// as the snapshot is the last one.
+	oldChunkSize := snapshotChunkSize
+	defer func() {
+		snapshotChunkSize = oldChunkSize
+	}()
+	snapshotChunkSize = 1
+	resp2, err = s.service().GetSnapshot(&GetSnapshot{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+	})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(resp2.Snapshot.Instances))
+	require.True(t, resp2.Total > 1)
+	require.NotNil(t, resp2.Verify(s.sb))
+	resp2, err = fetchSnapshot(s.sb.SkipChainID(), s.service().GetSnapshot)
+	require.Nil(t, err)
+	require.Equal(t, resp2.Total, len(resp2.Snapshot.Instances))
+	require.Nil(t, resp2.Verify(s.sb))
+	_, err = s.service().GetSnapshot(&GetSnapshot{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		BlockID:     s.sb.Hash,
+		Offset:      1,
+	})
+	require.NotNil(t, err)
+
+	oldInterval := minSnapshotInterval
+	defer func() {
+		minSnapshotInterval = oldInterval
+	}()
+	minSnapshotInterval = 0
+	resp2, err = s.service().GetSnapshot(&GetSnapshot{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+	})
+	require.Nil(t, err)
+	require.True(t, resp2.Snapshot.Index > latest.Index)
+}
+
+func TestService_Pruning(t *testing.T) {
+	s := newSer(t, 2, testInterval)
+	defer s.local.CloseAll()
+
+	s.waitProof(t, NewInstanceID(s.tx.Instructions[0].Hash()))
+	for _, ser := range s.services {
+		ser.SetPruning(1)
+	}
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyContract, s.value, s.signer)
+	require.Nil(t, err)
+	s.sendTx(t, tx)
+	s.waitProof(t, NewInstanceID(tx.Instructions[0].Hash()))
+
+	latest, err := s.service().db().GetLatestByID(s.sb.SkipChainID())
+	require.Nil(t, err)
+	require.NotEqual(t, 0, len(latest.Payload))
+	for _, ser := range s.services {
+		require.NotEqual(t, 0, len(ser.db().GetByID(s.sb.Hash).Payload))
+		prev := ser.db().GetByID(latest.BackLinkIDs[0])
+		require.Equal(t, 0, len(prev.Payload))
+
+		// The undo logs of the pruned blocks are removed.
+		cdb := ser.getCollection(s.sb.SkipChainID())
+		_, err = cdb.collectionAt(latest.Index - 1)
+		require.Nil(t, err)
+		_, err = cdb.collectionAt(latest.Index - 2)
+		require.NotNil(t, err)
+	}
+
+	// The transaction of the pruned block cannot be looked up anymore, but
+	// the state is still there.
+	_, err = s.service().GetTxStatus(&GetTxStatus{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		TxHash:      s.tx.Instructions.Hash(),
+	})
+	require.NotNil(t, err)
+	s.waitProof(t, NewInstanceID(s.tx.Instructions[0].Hash()))
+}
+
 // Test that inter-instruction dependencies are correctly handled.
 func TestService_Depending(t *testing.T) {
 	s := newSer(t, 1, testInterval)
@@ -309,18 +797,19 @@ func TestService_Depending(t *testing.T) {
 		Instructions: []Instruction{in1, in2},
 	}
 
-	_, err = s.services[0].AddTransaction(&AddTxRequest{
+	resp, err := s.services[0].AddTransaction(&AddTxRequest{
 		Version:       CurrentVersion,
 		SkipchainID:   s.sb.SkipChainID(),
 		Transaction:   tx,
 		InclusionWait: 2,
 	})
 	require.Nil(t, err)
+	require.True(t, resp.BlockIndex > 0)
 
 	cdb := s.service().getCollection(s.sb.SkipChainID())
 	_, _, _, err = cdb.GetValues(in1.Hash())
 	require.NotNil(t, err)
-	require.Equal(t, errKeyNotSet, err)
+	require.Equal(t, ErrKeyNotSet, err)
 
 	// We need to wait a bit for the propagation to finish because the
 	// skipchain service might decide to update forward links by adding
@@ -329,6 +818,100 @@ func TestService_Depending(t *testing.T) {
 	time.Sleep(time.Second)
 }
 
+func TestService_SignerCounters(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	id := s.signer.Identity().String()
+	resp, err := s.service().GetSignerCounters(&GetSignerCounters{
+		Version:     CurrentVersion,
+		SignerIDs:   []string{id},
+		SkipchainID: s.sb.SkipChainID(),
+	})
+	require.Nil(t, err)
+	require.Equal(t, CurrentVersion, resp.Version)
+	require.Equal(t, []uint64{0}, resp.Counters)
+
+	// createTx leaves out the counter if ctr is 0.
+	createTx := func(ctr uint64) ClientTransaction {
+		instr := Instruction{
+			InstanceID: NewInstanceID(s.darc.GetBaseID()),
+			Spawn: &Spawn{
+				ContractID: dummyContract,
+				Args:       Arguments{{Name: "data", Value: s.value}},
+			},
+			Nonce:         GenNonce(),
+			Index:         0,
+			Length:        1,
+			SignerCounter: []uint64{ctr},
+		}
+		if ctr == 0 {
+			instr.SignerCounter = nil
+		}
+		require.Nil(t, instr.SignBy(s.darc.GetBaseID(), s.signer))
+		return ClientTransaction{Instructions: []Instruction{instr}}
+	}
+	addTx := func(tx ClientTransaction) error {
+		_, err := s.service().AddTransaction(&AddTxRequest{
+			Version:       CurrentVersion,
+			SkipchainID:   s.sb.SkipChainID(),
+			Transaction:   tx,
+			InclusionWait: 5,
+		})
+		return err
+	}
+
+	// The first counter must be 1.
+	require.NotNil(t, addTx(createTx(2)))
+	tx := createTx(1)
+	require.Nil(t, addTx(tx))
+
+	_, err = s.service().GetSignerCounters(&GetSignerCounters{
+		SignerIDs:   []string{id},
+		SkipchainID: s.sb.SkipChainID(),
+	})
+	require.NotNil(t, err)
+	resp, err = s.service().GetSignerCounters(&GetSignerCounters{
+		Version:     CurrentVersion,
+		SignerIDs:   []string{id},
+		SkipchainID: s.sb.SkipChainID(),
+	})
+	require.Nil(t, err)
+	require.Equal(t, []uint64{1}, resp.Counters)
+
+	// Replaying the same instruction must fail.
+	err = addTx(tx)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "signer counter")
+	require.Nil(t, addTx(createTx(2)))
+
+	// Instructions without counters are refused once the configuration
+	// requires them.
+	require.Nil(t, addTx(createTx(0)))
+	config, err := s.service().LoadConfig(s.sb.SkipChainID())
+	require.Nil(t, err)
+	config.RequireSignerCounters = true
+	configBuf, err := protobuf.Encode(config)
+	require.Nil(t, err)
+	instr := Instruction{
+		InstanceID: NewInstanceID(nil),
+		Nonce:      GenNonce(),
+		Index:      0,
+		Length:     1,
+		Invoke: &Invoke{
+			Command: "update_config",
+			Args:    Arguments{{Name: "config", Value: configBuf}},
+		},
+		SignerCounter: []uint64{3},
+	}
+	require.Nil(t, instr.SignBy(s.darc.GetBaseID(), s.signer))
+	require.Nil(t, addTx(ClientTransaction{Instructions: []Instruction{instr}}))
+	err = addTx(createTx(0))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "signer counters")
+	require.Nil(t, addTx(createTx(4)))
+}
+
 func TestService_LateBlock(t *testing.T) {
 	s := newSer(t, 1, testInterval)
 	defer s.local.CloseAll()
@@ -435,7 +1018,7 @@ func waitInclusion(t *testing.T, client int) {
 
 	log.Lvl1("Create wrong transaction and wait")
 	pr, err, err2 = sendTransaction(t, s, client, invalidContract, 10)
-	require.Contains(t, err.Error(), "transaction is in block, but got refused")
+	require.Contains(t, err.Error(), "this invalid contract always returns an error")
 	require.NoError(t, err2)
 
 	// We expect to see only the refused transaction in the block in pr.
@@ -559,12 +1142,15 @@ func sendTransaction(t *testing.T, s *ser, client int, kind string, wait int) (P
 	tx, err := createOneClientTx(s.darc.GetBaseID(), kind, s.value, s.signer)
 	require.Nil(t, err)
 	ser := s.services[client]
-	_, err = ser.AddTransaction(&AddTxRequest{
+	resp, err := ser.AddTransaction(&AddTxRequest{
 		Version:       CurrentVersion,
 		SkipchainID:   s.sb.SkipChainID(),
 		Transaction:   tx,
 		InclusionWait: wait,
 	})
+	if err == nil && wait > 0 && !resp.Accepted {
+		err = errors.New(resp.Error)
+	}
 
 	rep, err2 := ser.GetProof(&GetProof{
 		Version: CurrentVersion,
@@ -619,6 +1205,43 @@ func TestService_InvalidVerification(t *testing.T) {
 	require.Nil(t, err)
 	require.NotNil(t, akvresp)
 	require.Equal(t, CurrentVersion, akvresp.Version)
+	require.True(t, akvresp.BlockIndex > 0)
+
+	// Check that tx0 and tx1 have been refused with the error of the
+	// contract.
+	st, err := s.service().GetTxStatus(&GetTxStatus{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		TxHash:      tx0.Instructions.Hash(),
+	})
+	require.Nil(t, err)
+	require.False(t, st.Accepted)
+	require.Contains(t, st.Error, "this contract panics")
+	st, err = s.service().GetTxStatus(&GetTxStatus{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		TxHash:      tx1.Instructions.Hash(),
+	})
+	require.Nil(t, err)
+	require.False(t, st.Accepted)
+	require.Contains(t, st.Error, "this invalid contract always returns an error")
+	st, err = s.service().GetTxStatus(&GetTxStatus{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		TxHash:      tx2.Instructions.Hash(),
+	})
+	require.Nil(t, err)
+	require.True(t, st.Accepted)
+	require.Equal(t, akvresp.BlockIndex, st.BlockIndex)
+	require.Equal(t, "", st.Error)
+
+	// An unknown transaction returns an error.
+	_, err = s.service().GetTxStatus(&GetTxStatus{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		TxHash:      []byte("unknown"),
+	})
+	require.NotNil(t, err)
 
 	// Check that tx1 is _not_ stored.
 	pr, err := s.service().GetProof(&GetProof{
@@ -645,6 +1268,102 @@ func TestService_InvalidVerification(t *testing.T) {
 	time.Sleep(2 * s.interval)
 }
 
+// TestService_PanicHash checks that a contract panicking, directly or by
+// reading too often, gives the same hash of the transactions on the leader,
+// which runs it with a timeout, and on the followers, which don't.
+func TestService_PanicHash(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	reads := func(cdb CollectionView, inst Instruction, c []Coin) ([]StateChange, []Coin, error) {
+		for i := 0; i < 20; i++ {
+			cdb.Get(inst.InstanceID.Slice())
+		}
+		return nil, c, nil
+	}
+	for i := range s.hosts {
+		RegisterContract(s.hosts[i], "panic", panicContractFunc)
+		RegisterContract(s.hosts[i], "reads", reads)
+	}
+
+	config, err := s.service().LoadConfig(s.sb.SkipChainID())
+	require.Nil(t, err)
+	config.MaxReads = 10
+	config.MaxExecutionTime = s.interval
+	configBuf, err := protobuf.Encode(config)
+	require.Nil(t, err)
+	ctx := ClientTransaction{
+		Instructions: []Instruction{{
+			InstanceID: NewInstanceID(nil),
+			Nonce:      GenNonce(),
+			Index:      0,
+			Length:     1,
+			Invoke: &Invoke{
+				Command: "update_config",
+				Args:    []Argument{{Name: "config", Value: configBuf}},
+			},
+		}},
+	}
+	require.Nil(t, ctx.Instructions[0].SignBy(s.darc.GetBaseID(), s.signer))
+	_, err = s.service().AddTransaction(&AddTxRequest{
+		Version:       CurrentVersion,
+		SkipchainID:   s.sb.SkipChainID(),
+		Transaction:   ctx,
+		InclusionWait: 10,
+	})
+	require.Nil(t, err)
+
+	tx0, err := createOneClientTx(s.darc.GetBaseID(), "panic", s.value, s.signer)
+	require.Nil(t, err)
+	tx1, err := createOneClientTx(s.darc.GetBaseID(), "reads", s.value, s.signer)
+	require.Nil(t, err)
+
+	// The leader plans the block with the execution time, and the
+	// followers verify it without.
+	scID := s.sb.SkipChainID()
+	latest, err := s.service().db().GetLatestByID(scID)
+	require.Nil(t, err)
+	coll := s.service().getCollection(scID).coll
+	_, txOut, _ := s.service().createStateChanges(coll, scID, latest.Index+1,
+		NewTxResults(tx0, tx1), s.interval)
+	require.Equal(t, 2, len(txOut))
+	require.False(t, txOut[0].Accepted)
+	require.Contains(t, txOut[0].Error, "this contract panics")
+	require.False(t, txOut[1].Accepted)
+	require.Contains(t, txOut[1].Error, errTooManyReads.Error())
+	s.service().stateChangeCache = newStateChangeCache()
+	_, txVerify, _ := s.service().createStateChanges(coll, scID, latest.Index+1,
+		txOut, noTimeout)
+	require.Equal(t, txOut.Hash(), txVerify.Hash())
+
+	// The followers accept the block with the refused transactions.
+	for _, tx := range []ClientTransaction{tx0, tx1} {
+		_, err = s.service().AddTransaction(&AddTxRequest{
+			Version:     CurrentVersion,
+			SkipchainID: scID,
+			Transaction: tx,
+		})
+		require.Nil(t, err)
+	}
+	tx2, err := createOneClientTx(s.darc.GetBaseID(), dummyContract, s.value, s.signer)
+	require.Nil(t, err)
+	resp, err := s.service().AddTransaction(&AddTxRequest{
+		Version:       CurrentVersion,
+		SkipchainID:   scID,
+		Transaction:   tx2,
+		InclusionWait: 10,
+	})
+	require.Nil(t, err)
+	st, err := s.service().GetTxStatus(&GetTxStatus{
+		Version:     CurrentVersion,
+		SkipchainID: scID,
+		TxHash:      tx0.Instructions.Hash(),
+	})
+	require.Nil(t, err)
+	require.False(t, st.Accepted)
+	require.Equal(t, resp.BlockIndex, st.BlockIndex)
+}
+
 func findTx(tx ClientTransaction, res TxResults) TxResult {
 	h := tx.Instructions.Hash()
 	for i := range res {
@@ -773,7 +1492,7 @@ func TestService_StateChange(t *testing.T) {
 	ct1 := ClientTransaction{Instructions: instrs}
 	ct2 := ClientTransaction{Instructions: instrs2}
 
-	_, txOut, scs := s.service().createStateChanges(cdb.coll, s.sb.SkipChainID(), NewTxResults(ct1, ct2), noTimeout)
+	_, txOut, scs := s.service().createStateChanges(cdb.coll, s.sb.SkipChainID(), s.sb.Index+1, NewTxResults(ct1, ct2), noTimeout)
 	require.Equal(t, 2, len(txOut))
 	require.True(t, txOut[0].Accepted)
 	require.False(t, txOut[1].Accepted)
@@ -819,6 +1538,183 @@ func TestService_DarcEvolution(t *testing.T) {
 	require.True(t, d22.Equal(d2))
 }
 
+func TestService_GetInstanceHistory(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	d2 := s.darc.Copy()
+	require.Nil(t, d2.EvolveFrom(s.darc))
+	s.testDarcEvolution(t, *d2, false)
+
+	resp, err := s.service().GetInstanceHistory(&GetInstanceHistory{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		InstanceID:  NewInstanceID(s.darc.GetBaseID()),
+	})
+	require.Nil(t, err)
+	require.Equal(t, 0, resp.FirstBlock)
+	require.Equal(t, 2, len(resp.Changes))
+	require.Equal(t, 0, resp.Changes[0].BlockIndex)
+	require.True(t, resp.Changes[0].Timestamp > 0)
+	d, err := darc.NewFromProtobuf(resp.Changes[0].Instance.Value)
+	require.Nil(t, err)
+	require.True(t, d.Equal(s.darc))
+	require.True(t, resp.Changes[1].BlockIndex > 0)
+	d, err = darc.NewFromProtobuf(resp.Changes[1].Instance.Value)
+	require.Nil(t, err)
+	require.True(t, d.Equal(d2))
+	require.Equal(t, 0, resp.NextBefore)
+
+	// The pages go from the latest change to the earliest one.
+	resp, err = s.service().GetInstanceHistory(&GetInstanceHistory{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		InstanceID:  NewInstanceID(s.darc.GetBaseID()),
+		Limit:       1,
+	})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(resp.Changes))
+	require.True(t, resp.Changes[0].BlockIndex > 0)
+	require.Equal(t, resp.Changes[0].BlockIndex, resp.NextBefore)
+	resp, err = s.service().GetInstanceHistory(&GetInstanceHistory{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		InstanceID:  NewInstanceID(s.darc.GetBaseID()),
+		Before:      resp.NextBefore,
+		Limit:       1,
+	})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(resp.Changes))
+	require.Equal(t, 0, resp.Changes[0].BlockIndex)
+	require.Equal(t, 0, resp.NextBefore)
+
+	_, err = s.service().GetInstanceHistory(&GetInstanceHistory{
+		Version:     CurrentVersion,
+		SkipchainID: skipchain.SkipBlockID{1, 2, 3},
+	})
+	require.NotNil(t, err)
+}
+
+func TestService_GetDarcHistory(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	d2 := s.darc.Copy()
+	require.Nil(t, d2.EvolveFrom(s.darc))
+	require.Nil(t, d2.Rules.AddRule("spawn:history", []byte(s.signer.Identity().String())))
+	s.testDarcEvolution(t, *d2, false)
+
+	resp, err := s.service().GetDarcHistory(&GetDarcHistory{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		BaseID:      s.darc.GetBaseID(),
+	})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(resp.Versions))
+	v0, v1 := resp.Versions[0], resp.Versions[1]
+	require.Equal(t, 0, v0.BlockIndex)
+	require.True(t, v0.Darc.Equal(s.darc))
+	require.Equal(t, len(s.darc.Rules.List), len(v0.Changes))
+	require.Equal(t, 0, len(v0.Signers))
+
+	require.True(t, v1.BlockIndex > 0)
+	require.True(t, v1.Timestamp >= v0.Timestamp)
+	require.True(t, v1.Darc.Equal(d2))
+	require.Equal(t, []darc.RuleChange{{Action: "spawn:history",
+		New: []byte(s.signer.Identity().String())}}, v1.Changes)
+	require.Equal(t, 1, len(v1.Signers))
+	signerID := s.signer.Identity()
+	require.True(t, v1.Signers[0].Equal(&signerID))
+	require.Equal(t, 0, resp.FirstBlock)
+
+	// The changes of the first version of a page are relative to the
+	// version before it.
+	resp, err = s.service().GetDarcHistory(&GetDarcHistory{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		BaseID:      s.darc.GetBaseID(),
+		Limit:       1,
+	})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(resp.Versions))
+	require.Equal(t, v1.BlockIndex, resp.NextBefore)
+	require.Equal(t, v1.Changes, resp.Versions[0].Changes)
+
+	// Without the history of the genesis block, the first version is
+	// unknown.
+	require.Nil(t, s.service().getCollection(s.sb.SkipChainID()).pruneUndo(0))
+	resp, err = s.service().GetDarcHistory(&GetDarcHistory{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		BaseID:      s.darc.GetBaseID(),
+	})
+	require.Nil(t, err)
+	require.Equal(t, 1, resp.FirstBlock)
+	require.Equal(t, 1, len(resp.Versions))
+	require.True(t, resp.Versions[0].Darc.Equal(d2))
+
+	_, err = s.service().GetDarcHistory(&GetDarcHistory{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		BaseID:      ConfigInstanceID.Slice(),
+	})
+	require.NotNil(t, err)
+}
+
+func TestService_GetAuthorizations(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	// Delegate spawn:dummy to a second darc signed by two new keys.
+	signers := []darc.Signer{darc.NewSignerEd25519(nil, nil), darc.NewSignerEd25519(nil, nil)}
+	ids := []darc.Identity{signers[0].Identity(), signers[1].Identity()}
+	delegated := darc.NewDarc(darc.InitRules(ids, ids), []byte("delegated"))
+	require.Nil(t, delegated.Rules.UpdateSign(expression.InitAndExpr(ids[0].String(), ids[1].String())))
+	delegatedBuf, err := delegated.ToProto()
+	require.Nil(t, err)
+	ctx := ClientTransaction{
+		Instructions: []Instruction{{
+			InstanceID: NewInstanceID(s.darc.GetBaseID()),
+			Nonce:      GenNonce(),
+			Index:      0,
+			Length:     1,
+			Spawn: &Spawn{
+				ContractID: ContractDarcID,
+				Args:       []Argument{{Name: "darc", Value: delegatedBuf}},
+			},
+		}},
+	}
+	require.Nil(t, ctx.Instructions[0].SignBy(s.darc.GetBaseID(), s.signer))
+	s.sendTx(t, ctx)
+	s.waitProof(t, NewInstanceID(delegated.GetBaseID()))
+
+	d2 := s.darc.Copy()
+	require.Nil(t, d2.EvolveFrom(s.darc))
+	require.Nil(t, d2.Rules.UpdateRule("spawn:dummy",
+		expression.InitOrExpr(s.signer.Identity().String(), delegated.GetIdentityString())))
+	s.testDarcEvolution(t, *d2, false)
+
+	resp, err := s.service().GetAuthorizations(&GetAuthorizations{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		InstanceID:  NewInstanceID(s.darc.GetBaseID()),
+		Action:      "spawn:dummy",
+	})
+	require.Nil(t, err)
+	require.Equal(t, 0, len(resp.Warnings))
+	require.Equal(t, 2, len(resp.Combinations))
+	require.Equal(t, []string{s.signer.Identity().String()}, resp.Combinations[0].Identities)
+	require.Equal(t, 2, len(resp.Combinations[1].Identities))
+
+	_, err = s.service().GetAuthorizations(&GetAuthorizations{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		InstanceID:  NewInstanceID(s.darc.GetBaseID()),
+		Action:      "spawn:unknown",
+	})
+	require.NotNil(t, err)
+}
+
 func TestService_DarcSpawn(t *testing.T) {
 	s := newSer(t, 1, testInterval)
 	defer s.local.CloseAll()
@@ -1150,7 +2046,7 @@ func TestService_StateChangeCache(t *testing.T) {
 
 	txs := NewTxResults(tx1, tx2)
 	require.NoError(t, err)
-	root, txOut, states := s.service().createStateChanges(coll, scID, txs, noTimeout)
+	root, txOut, states := s.service().createStateChanges(coll, scID, 1, txs, noTimeout)
 	require.Equal(t, 2, len(txOut))
 	require.Equal(t, 0, len(states))
 	require.Equal(t, 1, ctr)
@@ -1160,7 +2056,7 @@ func TestService_StateChangeCache(t *testing.T) {
 	// createStateChanges when making the block), then it should load it from the
 	// cache, which means that ctr is still one (we do not call the
 	// contract twice).
-	root1, txOut1, states1 := s.service().createStateChanges(coll, scID, txOut, noTimeout)
+	root1, txOut1, states1 := s.service().createStateChanges(coll, scID, 1, txOut, noTimeout)
 	require.Equal(t, 1, ctr)
 	require.Equal(t, root, root1)
 	require.Equal(t, txOut, txOut1)
@@ -1170,7 +2066,7 @@ func TestService_StateChangeCache(t *testing.T) {
 	// again, i.e., ctr == 2.
 	s.service().stateChangeCache = newStateChangeCache()
 	require.NoError(t, err)
-	root2, txOut2, states2 := s.service().createStateChanges(coll, scID, txs, noTimeout)
+	root2, txOut2, states2 := s.service().createStateChanges(coll, scID, 1, txs, noTimeout)
 	require.Equal(t, root, root2)
 	require.Equal(t, txOut, txOut2)
 	require.Equal(t, states, states2)
@@ -1181,11 +2077,11 @@ func createConfigTx(t *testing.T, s *ser, intervalBad, szBad bool) (ClientTransa
 	var config ChainConfig
 	switch {
 	case intervalBad:
-		config = ChainConfig{-1, *s.roster.RandomSubset(s.services[1].ServerIdentity(), 2), defaultMaxBlockSize}
+		config = ChainConfig{BlockInterval: -1, Roster: *s.roster.RandomSubset(s.services[1].ServerIdentity(), 2), MaxBlockSize: defaultMaxBlockSize}
 	case szBad:
-		config = ChainConfig{420 * time.Millisecond, *s.roster.RandomSubset(s.services[1].ServerIdentity(), 2), 30 * 1e6}
+		config = ChainConfig{BlockInterval: 420 * time.Millisecond, Roster: *s.roster.RandomSubset(s.services[1].ServerIdentity(), 2), MaxBlockSize: 30 * 1e6}
 	default:
-		config = ChainConfig{420 * time.Millisecond, *s.roster, 424242}
+		config = ChainConfig{BlockInterval: 420 * time.Millisecond, Roster: *s.roster, MaxBlockSize: 424242}
 	}
 	configBuf, err := protobuf.Encode(&config)
 	require.NoError(t, err)
@@ -1337,7 +2233,7 @@ func newSerN(t *testing.T, step int, interval time.Duration, n int, viewchange b
 	registerDummy(s.hosts)
 
 	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, s.roster,
-		[]string{"spawn:dummy", "spawn:invalid", "spawn:panic", "spawn:darc", "invoke:update_config", "spawn:slow", "spawn:stateShangeCacheTest", "delete"}, s.signer.Identity())
+		[]string{"spawn:dummy", "spawn:invalid", "spawn:panic", "spawn:darc", "invoke:update_config", "invoke:upgrade_contract", "spawn:slow", "spawn:stateShangeCacheTest", "delete"}, s.signer.Identity())
 	require.Nil(t, err)
 	s.darc = &genesisMsg.GenesisDarc
 
@@ -1415,6 +2311,22 @@ func registerDummy(servers []*onet.Server) {
 		RegisterContract(s, dummyContract, dummyContractFunc)
 		RegisterContract(s, slowContract, slowContractFunc)
 		RegisterContract(s, invalidContract, invalidContractFunc)
+		RegisterQuery(s, dummyContract, dummyQueryFunc)
+	}
+}
+
+func dummyQueryFunc(cdb CollectionView, iID InstanceID, name string, args Arguments) ([]byte, error) {
+	value, _, _, err := cdb.GetValues(iID.Slice())
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "value":
+		return value, nil
+	case "panic":
+		panic("this query panics")
+	default:
+		return nil, errors.New("unknown query")
 	}
 }
 
@@ -0,0 +1,541 @@
+package byzcoin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin/collection"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// minSnapshotInterval is the minimal time between two snapshots of the same
+// skipchain. Anybody can ask for a snapshot, which makes the node dump and
+// sign its whole state, so in the meantime the last snapshot is returned.
+// A node catching up that gets a snapshot older than it needs will ask
+// again with the next block.
+var minSnapshotInterval = 10 * time.Second
+
+// snapshotCache holds the last snapshot created for every skipchain.
+type snapshotCache struct {
+	sync.Mutex
+	snapshots map[string]*cachedSnapshot
+}
+
+type cachedSnapshot struct {
+	created time.Time
+	resp    *GetSnapshotResponse
+}
+
+func newSnapshotCache() snapshotCache {
+	return snapshotCache{
+		snapshots: make(map[string]*cachedSnapshot),
+	}
+}
+
+// get returns the last snapshot of the skipchain if it is more recent than
+// minSnapshotInterval, else it creates a new one with create. The lock is
+// held while creating it, so that concurrent requests don't create more
+// than one. If blockID is given, it returns the last snapshot only if it
+// has been taken at that block, without creating a new one. The caller must
+// not change the instances of the snapshot, which are shared with the cache.
+func (c *snapshotCache) get(scID, blockID skipchain.SkipBlockID, create func() (*GetSnapshotResponse, error)) (*GetSnapshotResponse, error) {
+	c.Lock()
+	defer c.Unlock()
+	key := string(scID)
+	cached, ok := c.snapshots[key]
+	if blockID != nil {
+		if !ok || !cached.resp.Snapshot.BlockID.Equal(blockID) {
+			return nil, errors.New("snapshot has been replaced by a newer one")
+		}
+	} else if !ok || time.Now().Sub(cached.created) >= minSnapshotInterval {
+		resp, err := create()
+		if err != nil {
+			return nil, err
+		}
+		cached = &cachedSnapshot{created: time.Now(), resp: resp}
+		c.snapshots[key] = cached
+	}
+	resp := *cached.resp
+	return &resp, nil
+}
+
+// snapshotChunkSize is the maximum size of the instances sent in one
+// GetSnapshotResponse, so that it stays below the maximum packet size of
+// onet. At least one instance is sent in every response.
+var snapshotChunkSize = 1 << 20
+
+// snapshotChunk returns a copy of the first instances whose size is at most
+// snapshotChunkSize.
+func snapshotChunk(instances []StateChange) []StateChange {
+	var size, n int
+	for ; n < len(instances); n++ {
+		sc := &instances[n]
+		size += len(sc.InstanceID) + len(sc.ContractID) + len(sc.Value) + len(sc.DarcID)
+		if n > 0 && size > snapshotChunkSize {
+			break
+		}
+	}
+	return append([]StateChange{}, instances[:n]...)
+}
+
+// fetchSnapshot gets the latest snapshot of the skipchain with get, which
+// sends the request to a node, asking for its instances chunk by chunk. It
+// doesn't verify the snapshot.
+func fetchSnapshot(scID skipchain.SkipBlockID, get func(*GetSnapshot) (*GetSnapshotResponse, error)) (*GetSnapshotResponse, error) {
+	resp, err := get(&GetSnapshot{
+		Version:     CurrentVersion,
+		SkipchainID: scID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for len(resp.Snapshot.Instances) < resp.Total {
+		chunk, err := get(&GetSnapshot{
+			Version:     CurrentVersion,
+			SkipchainID: scID,
+			BlockID:     resp.Snapshot.BlockID,
+			Offset:      len(resp.Snapshot.Instances),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(chunk.Snapshot.Instances) == 0 {
+			return nil, errors.New("got an empty chunk of the snapshot")
+		}
+		resp.Snapshot.Instances = append(resp.Snapshot.Instances, chunk.Snapshot.Instances...)
+	}
+	return resp, nil
+}
+
+// Hash returns the hash that is signed by the creator of the snapshot.
+func (snap *Snapshot) Hash() []byte {
+	h := sha256.New()
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(snap.Index))
+	h.Write(b)
+	h.Write(snap.BlockID)
+	h.Write(snap.CollectionRoot)
+	h.Write(StateChanges(snap.Instances).Hash())
+	return h.Sum(nil)
+}
+
+// collection creates a new collection holding all the instances of the
+// snapshot.
+func (snap *Snapshot) collection() (*collection.Collection, error) {
+	coll := collection.New(collection.Data{}, collection.Data{}, collection.Data{})
+	for _, sc := range snap.Instances {
+		if sc.StateAction != Create {
+			return nil, errors.New("snapshot can only hold Create state changes")
+		}
+		if err := storeInColl(coll, &sc); err != nil {
+			return nil, err
+		}
+	}
+	return coll, nil
+}
+
+// Verify makes sure that the snapshot, with all its instances, has been
+// signed by a node of the roster of its block, that the block is part of the skipchain starting at
+// the given genesis block, and that the instances of the snapshot result in
+// the collection root stored in the block.
+func (r *GetSnapshotResponse) Verify(genesis *skipchain.SkipBlock) error {
+	snap := &r.Snapshot
+	if !r.Block.CalculateHash().Equal(r.Block.Hash) ||
+		!r.Block.Hash.Equal(snap.BlockID) || r.Block.Index != snap.Index {
+		return errors.New("block doesn't correspond to the snapshot")
+	}
+
+	// The signer is given by the snapshot itself, so its signature only
+	// means something if it is one of the nodes of the block.
+	if snap.Signer == nil {
+		return errors.New("snapshot is not signed")
+	}
+	if r.Block.Roster == nil {
+		return errors.New("block has no roster")
+	}
+	inRoster := false
+	for _, si := range r.Block.Roster.List {
+		if si.Public.Equal(snap.Signer.Public) {
+			inRoster = true
+			break
+		}
+	}
+	if !inRoster {
+		return errors.New("signer of the snapshot is not in the roster of its block")
+	}
+	err := schnorr.Verify(cothority.Suite, snap.Signer.Public, snap.Hash(), snap.Signature)
+	if err != nil {
+		return errors.New("wrong signature on snapshot: " + err.Error())
+	}
+	id := genesis.Hash
+	publics := genesis.Roster.Publics()
+	for _, l := range r.Links {
+		if !l.From.Equal(id) {
+			return errors.New("forward links are not chained")
+		}
+		if err = l.Verify(cothority.Suite, publics); err != nil {
+			return errors.New("wrong forward link: " + err.Error())
+		}
+		id = l.To
+		if l.NewRoster != nil {
+			publics = l.NewRoster.Publics()
+		}
+	}
+	if !id.Equal(snap.BlockID) {
+		return errors.New("forward links don't point to the block of the snapshot")
+	}
+
+	var header DataHeader
+	err = protobuf.DecodeWithConstructors(r.Block.Data, &header, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return errors.New("couldn't unmarshal header: " + err.Error())
+	}
+	if !bytes.Equal(header.CollectionRoot, snap.CollectionRoot) {
+		return ErrorVerifyCollectionRoot
+	}
+	coll, err := snap.collection()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(coll.GetRoot(), snap.CollectionRoot) {
+		return errors.New("instances don't correspond to the collection root")
+	}
+	return nil
+}
+
+// snapshot returns the index of the latest block applied to the collection,
+// together with all its key/value pairs. Both are read in the same
+// transaction, so they are consistent.
+func (c *collectionDB) snapshot() (index int, instances []StateChange, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(c.bucketName))
+		if bucket == nil {
+			return errors.New("bucket does not exist")
+		}
+
+		b := bucket.Get([]byte{dbMeta, dbMetaIndex})
+		if len(b) != 4 {
+			return errors.New("collection index not found")
+		}
+		index = int(binary.LittleEndian.Uint32(b))
+
+		cur := bucket.Cursor()
+		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+			if len(k) > 0 && k[0] != dbValue {
+				continue
+			}
+			k2 := dup(k)
+			k2[0] = dbContract
+			cv := bucket.Get(k2)
+			k2[0] = dbDarcID
+			dv := bucket.Get(k2)
+			instances = append(instances, StateChange{
+				StateAction: Create,
+				InstanceID:  dup(k[1:]),
+				ContractID:  dup(cv),
+				Value:       dup(v),
+				DarcID:      dup(dv),
+			})
+		}
+		return nil
+	})
+	return
+}
+
+// restore replaces all key/value pairs of the collection with the instances
+// of the snapshot, and sets the index to the block of the snapshot.
+func (c *collectionDB) restore(snap *Snapshot) error {
+	coll, err := snap.collection()
+	if err != nil {
+		return err
+	}
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(c.bucketName))
+		if bucket == nil {
+			return errors.New("bucket does not exist")
+		}
+
+		// Remove all key/value pairs and the history of the blocks, which
+		// cannot be used with the state of the snapshot.
+		var keys [][]byte
+		cur := bucket.Cursor()
+		for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
+			if len(k) > 0 && k[0] != dbMeta ||
+				len(k) > 1 && k[0] == dbMeta && (k[1] == dbMetaUndo || k[1] == dbMetaHistory) {
+				keys = append(keys, dup(k))
+			}
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		for _, t := range snap.Instances {
+			if err := storeInBucket(bucket, &t); err != nil {
+				return err
+			}
+		}
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, uint32(snap.Index))
+		return bucket.Put([]byte{dbMeta, dbMetaIndex}, b)
+	})
+	if err != nil {
+		return err
+	}
+	c.collMut.Lock()
+	c.coll = coll
+	c.changes++
+	c.collMut.Unlock()
+	return nil
+}
+
+// GetSnapshot returns a signed snapshot of the latest state of the
+// collection, together with the proof that the block it has been taken at
+// is part of the skipchain. New nodes use it to catch up without replaying
+// all the blocks. At most one snapshot is created every minSnapshotInterval.
+// The response only holds the instances that fit in snapshotChunkSize,
+// starting at the offset of the request. The following ones can be asked
+// for as long as the snapshot has not been replaced by a newer one.
+func (s *Service) GetSnapshot(req *GetSnapshot) (*GetSnapshotResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	if !s.isOurChain(req.SkipchainID) {
+		return nil, errors.New("skipchain ID does not exist")
+	}
+	resp, err := s.snapshotCache.get(req.SkipchainID, req.BlockID, func() (*GetSnapshotResponse, error) {
+		return s.createSnapshot(req.SkipchainID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	instances := resp.Snapshot.Instances
+	if req.Offset < 0 || req.Offset > len(instances) {
+		return nil, errors.New("offset is outside of the snapshot")
+	}
+	if req.Offset > 0 {
+		resp.Links = nil
+	}
+	resp.Total = len(instances)
+	resp.Snapshot.Instances = snapshotChunk(instances[req.Offset:])
+	return resp, nil
+}
+
+// createSnapshot creates and signs a snapshot of the latest state of the
+// collection of the skipchain.
+func (s *Service) createSnapshot(scID skipchain.SkipBlockID) (*GetSnapshotResponse, error) {
+	index, instances, err := s.getCollection(scID).snapshot()
+	if err != nil {
+		return nil, err
+	}
+	sb, err := s.skService().GetSingleBlockByIndex(&skipchain.GetSingleBlockByIndex{
+		Genesis: scID,
+		Index:   index,
+	})
+	if err != nil {
+		return nil, err
+	}
+	genesis := s.db().GetByID(scID)
+	if genesis == nil {
+		return nil, errors.New("didn't find genesis block")
+	}
+	links, err := linksBetween(s.db(), genesis, sb)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := Snapshot{
+		Index:     index,
+		BlockID:   sb.Hash,
+		Instances: instances,
+		Signer:    s.ServerIdentity(),
+	}
+	coll, err := snap.collection()
+	if err != nil {
+		return nil, err
+	}
+	snap.CollectionRoot = coll.GetRoot()
+	var header DataHeader
+	err = protobuf.DecodeWithConstructors(sb.Data, &header, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, errors.New("couldn't unmarshal header: " + err.Error())
+	}
+	if !bytes.Equal(header.CollectionRoot, snap.CollectionRoot) {
+		return nil, errors.New("collection doesn't correspond to its block")
+	}
+	snap.Signature, err = schnorr.Sign(cothority.Suite, s.getPrivateKey(), snap.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	return &GetSnapshotResponse{
+		Version:  CurrentVersion,
+		Snapshot: snap,
+		Block:    *sb,
+		Links:    links,
+	}, nil
+}
+
+// syncFromSnapshot asks the nodes of the roster of sb for a snapshot that
+// is at least as recent as sb. The first valid snapshot replaces our
+// collection, so that the blocks up to the snapshot are not replayed. It
+// returns the index of the block of the snapshot.
+func (s *Service) syncFromSnapshot(sb *skipchain.SkipBlock) (int, error) {
+	genesis := s.db().GetByID(sb.SkipChainID())
+	if genesis == nil {
+		return 0, errors.New("didn't find genesis block")
+	}
+	cl := onet.NewClient(cothority.Suite, ServiceName)
+	defer cl.Close()
+	for _, si := range sb.Roster.List {
+		if si.Equal(s.ServerIdentity()) {
+			continue
+		}
+		reply, err := fetchSnapshot(sb.SkipChainID(), func(req *GetSnapshot) (*GetSnapshotResponse, error) {
+			chunk := &GetSnapshotResponse{}
+			return chunk, cl.SendProtobuf(si, req, chunk)
+		})
+		if err != nil {
+			log.Lvl2(s.ServerIdentity(), "couldn't get snapshot from", si, err)
+			continue
+		}
+		if reply.Snapshot.Index < sb.Index {
+			log.Lvl2(s.ServerIdentity(), "snapshot of", si, "is too old")
+			continue
+		}
+		if err = reply.Verify(genesis); err != nil {
+			log.Warn(s.ServerIdentity(), "got invalid snapshot from", si, err)
+			continue
+		}
+		if err = s.getCollection(sb.SkipChainID()).restore(&reply.Snapshot); err != nil {
+			return 0, err
+		}
+		log.Lvlf2("%s restored collection of %x at block %d", s.ServerIdentity(),
+			sb.SkipChainID(), reply.Snapshot.Index)
+		return reply.Snapshot.Index, nil
+	}
+	return 0, errors.New("couldn't get a valid snapshot from the roster")
+}
+
+// isRestored returns whether the state of sb is already part of the last
+// snapshot restored for its skipchain.
+func (s *Service) isRestored(sb *skipchain.SkipBlock) bool {
+	s.restoredToMut.Lock()
+	defer s.restoredToMut.Unlock()
+	id := string(sb.SkipChainID())
+	to, ok := s.restoredTo[id]
+	if !ok || sb.Index > to {
+		return false
+	}
+	if sb.Index == to {
+		delete(s.restoredTo, id)
+	}
+	return true
+}
+
+// SetPruning makes the node remove the bodies of the blocks that are older
+// than the latest keep blocks. The headers are kept, so the skipchain stays
+// valid, but the transactions of pruned blocks cannot be looked up anymore.
+// Nodes that need a pruned block to catch up will get a snapshot instead.
+// A value of 0 disables pruning.
+func (s *Service) SetPruning(keep int) {
+	s.storage.Lock()
+	s.storage.PruneKeep = keep
+	s.storage.Unlock()
+	s.save()
+}
+
+// defaultHistoryKeep is the number of latest blocks whose undo logs are
+// kept if SetHistory has not been called.
+const defaultHistoryKeep = 10000
+
+// SetHistory makes the node keep the undo logs of the latest keep blocks
+// only. The undo logs are needed to get proofs against the state of earlier
+// blocks and the history of instances, and one is written for every block.
+// A value of 0 keeps the latest defaultHistoryKeep blocks, and a negative
+// value keeps all of them. If pruning is enabled, the undo logs of the
+// pruned blocks are always removed.
+func (s *Service) SetHistory(keep int) {
+	s.storage.Lock()
+	s.storage.HistoryKeep = keep
+	s.storage.Unlock()
+	s.save()
+}
+
+// pruneHistory removes the undo logs of all the blocks before sb that are
+// not within the blocks to keep, or whose bodies are pruned.
+func (s *Service) pruneHistory(sb *skipchain.SkipBlock) {
+	s.storage.Lock()
+	keep := s.storage.HistoryKeep
+	if keep == 0 {
+		keep = defaultHistoryKeep
+	}
+	if pk := s.storage.PruneKeep; pk > 0 && (keep < 0 || pk < keep) {
+		keep = pk
+	}
+	s.storage.Unlock()
+	if keep <= 0 || sb.Index < keep {
+		return
+	}
+
+	err := s.getCollection(sb.SkipChainID()).pruneUndo(sb.Index - keep)
+	if err != nil {
+		log.Error(s.ServerIdentity(), "couldn't prune the history:", err)
+	}
+}
+
+// pruneBlocks removes the bodies of all the blocks before sb that are not
+// within the blocks to keep. The genesis block is never pruned. The pruning
+// continues from the first block that has not been pruned yet, so that
+// every block is only visited once.
+func (s *Service) pruneBlocks(sb *skipchain.SkipBlock) {
+	key := string(sb.SkipChainID())
+	s.storage.Lock()
+	keep := s.storage.PruneKeep
+	nextID := s.storage.PruneNext[key]
+	s.storage.Unlock()
+	if keep <= 0 || sb.Index <= keep {
+		return
+	}
+
+	next := s.db().GetByID(sb.SkipChainID())
+	if nextID != nil {
+		next = s.db().GetByID(nextID)
+	}
+	start := next
+	for next != nil && next.Index <= sb.Index-keep {
+		if next.Index > 0 && len(next.Payload) > 0 {
+			log.Lvlf3("%s pruning block %d", s.ServerIdentity(), next.Index)
+			if err := s.db().PrunePayload(next.Hash); err != nil {
+				log.Error(s.ServerIdentity(), "couldn't prune block:", err)
+				break
+			}
+		}
+		if len(next.ForwardLink) == 0 {
+			break
+		}
+		next = s.db().GetByID(next.ForwardLink[0].To)
+	}
+	if next == nil || next == start {
+		return
+	}
+	s.storage.Lock()
+	if s.storage.PruneNext == nil {
+		s.storage.PruneNext = make(map[string]skipchain.SkipBlockID)
+	}
+	s.storage.PruneNext[key] = next.Hash
+	s.storage.Unlock()
+	s.save()
+}
@@ -0,0 +1,116 @@
+package byzcoin
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dedis/onet/log"
+)
+
+// streamingBufferSize is the number of blocks that can be queued for one
+// listener before it is considered too slow and gets disconnected.
+const streamingBufferSize = 100
+
+// streamingKeepAlive is the interval at which an empty response is sent to
+// every listener. A stream is only cleaned up once sending to the client
+// fails, so without them a client gone on an idle chain would never be
+// noticed.
+var streamingKeepAlive = 10 * time.Second
+
+// streamingManager keeps track of all the clients that are subscribed to new
+// blocks, keyed on the skipchain ID. The manager never blocks the caller of
+// notify: if a listener does not keep up, its channel is closed, which ends
+// the stream on the client side.
+type streamingManager struct {
+	sync.Mutex
+	listeners map[string][]chan *StreamingResponse
+}
+
+func newStreamingManager() streamingManager {
+	return streamingManager{
+		listeners: make(map[string][]chan *StreamingResponse),
+	}
+}
+
+// newListener creates a new channel that will receive all the blocks of the
+// skipchain given by key.
+func (m *streamingManager) newListener(key string) chan *StreamingResponse {
+	m.Lock()
+	defer m.Unlock()
+	ch := make(chan *StreamingResponse, streamingBufferSize)
+	m.listeners[key] = append(m.listeners[key], ch)
+	return ch
+}
+
+// stopListener removes and closes the given channel. It is safe to call it
+// more than once for the same channel.
+func (m *streamingManager) stopListener(key string, ch chan *StreamingResponse) {
+	m.Lock()
+	defer m.Unlock()
+	m.removeLocked(key, ch)
+}
+
+func (m *streamingManager) removeLocked(key string, ch chan *StreamingResponse) {
+	chs := m.listeners[key]
+	for i := range chs {
+		if chs[i] == ch {
+			close(ch)
+			m.listeners[key] = append(chs[:i], chs[i+1:]...)
+			break
+		}
+	}
+	if len(m.listeners[key]) == 0 {
+		delete(m.listeners, key)
+	}
+}
+
+// notify sends the response to all the listeners of the skipchain given by
+// key.
+func (m *streamingManager) notify(key string, resp *StreamingResponse) {
+	m.Lock()
+	defer m.Unlock()
+	// Copy the slice as removeLocked modifies it.
+	chs := append([]chan *StreamingResponse{}, m.listeners[key]...)
+	for _, ch := range chs {
+		select {
+		case ch <- resp:
+		default:
+			log.Warn("streaming listener is too slow, closing it")
+			m.removeLocked(key, ch)
+		}
+	}
+}
+
+// keepAlive sends an empty response to the listener ch of the skipchain
+// given by key. It returns false if the listener is not registered anymore,
+// either because it has been stopped or because it is too slow.
+func (m *streamingManager) keepAlive(key string, ch chan *StreamingResponse) bool {
+	m.Lock()
+	defer m.Unlock()
+	for _, c := range m.listeners[key] {
+		if c != ch {
+			continue
+		}
+		select {
+		case ch <- &StreamingResponse{}:
+			return true
+		default:
+			log.Warn("streaming listener is too slow, closing it")
+			m.removeLocked(key, ch)
+			return false
+		}
+	}
+	return false
+}
+
+// closeAll closes all the listeners, which will end all the streams.
+func (m *streamingManager) closeAll() {
+	m.Lock()
+	defer m.Unlock()
+	for key, chs := range m.listeners {
+		for _, ch := range chs {
+			close(ch)
+		}
+		delete(m.listeners, key)
+	}
+}
@@ -0,0 +1,52 @@
+package byzcoin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamingManager(t *testing.T) {
+	m := newStreamingManager()
+	ch1 := m.newListener("a")
+	ch2 := m.newListener("b")
+
+	m.notify("a", &StreamingResponse{Index: 1})
+	require.Equal(t, 1, (<-ch1).Index)
+	require.Equal(t, 0, len(ch2))
+
+	// Stopping a listener twice must not panic.
+	m.stopListener("a", ch1)
+	m.stopListener("a", ch1)
+	_, more := <-ch1
+	require.False(t, more)
+	m.notify("a", &StreamingResponse{Index: 2})
+
+	// A slow listener gets disconnected.
+	for i := 0; i <= streamingBufferSize; i++ {
+		m.notify("b", &StreamingResponse{Index: i})
+	}
+	for i := 0; i < streamingBufferSize; i++ {
+		require.Equal(t, i, (<-ch2).Index)
+	}
+	_, more = <-ch2
+	require.False(t, more)
+	require.Equal(t, 0, len(m.listeners))
+
+	// Keep-alive responses are queued like blocks, and fail once the
+	// listener is gone.
+	ch4 := m.newListener("d")
+	require.True(t, m.keepAlive("d", ch4))
+	require.Nil(t, (<-ch4).BlockID)
+	for i := 0; i < streamingBufferSize; i++ {
+		require.True(t, m.keepAlive("d", ch4))
+	}
+	require.False(t, m.keepAlive("d", ch4))
+	require.Equal(t, 0, len(m.listeners))
+	require.False(t, m.keepAlive("d", ch4))
+
+	ch3 := m.newListener("c")
+	m.closeAll()
+	_, more = <-ch3
+	require.False(t, more)
+}
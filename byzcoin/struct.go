@@ -1,9 +1,11 @@
 package byzcoin
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 
 	bolt "github.com/coreos/bbolt"
@@ -12,6 +14,7 @@ import (
 	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/onet/log"
 	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
 )
 
 func init() {
@@ -24,6 +27,13 @@ type collectionDB struct {
 	bucketName []byte
 	coll       *collection.Collection
 	scID       skipchain.SkipBlockID
+	// collMut is held for writing while a block is applied to coll, and
+	// for reading by view.
+	collMut sync.RWMutex
+	// changes counts the blocks applied to coll, and its replacements, so
+	// that coll can be copied without holding collMut. It is protected by
+	// collMut.
+	changes uint64
 }
 
 // A CollectionView is an interface that defines the read-only operations
@@ -36,8 +46,24 @@ type CollectionView interface {
 	// an error if something went wrong. A non-existing key returns an
 	// error.
 	GetValues(key []byte) (value []byte, contractID string, darcID darc.ID, err error)
+	// ForEach calls f for every key starting with prefix, in increasing
+	// order of the keys. A nil prefix iterates over all keys. The iteration
+	// stops at the first error returned by f, which is then returned. f can
+	// return ErrStopIteration to stop the iteration without error.
+	// The view given to the contracts is ordered by the hashes of the keys,
+	// so its ForEach visits and sorts the whole collection, even for a
+	// prefix matching a few keys, and counts a read for every key visited.
+	ForEach(prefix []byte, f ForEachFn) error
 }
 
+// ForEachFn is called by CollectionView.ForEach with the values of every
+// key.
+type ForEachFn func(key []byte, value []byte, contractID string, darcID darc.ID) error
+
+// ErrStopIteration can be returned by a ForEachFn to stop the iteration
+// without error.
+var ErrStopIteration = errors.New("stop iteration")
+
 // roCollection is a wrapper for a collection that satisfies interface
 // CollectionView and makes it impossible for callers who receive it to call
 // the methods on the collection which can modify it. This is about type
@@ -58,10 +84,34 @@ func (r *roCollection) GetValues(key []byte) (value []byte, contractID string, d
 	return getValueContract(r, key)
 }
 
+// ForEach calls f for every key starting with prefix, in increasing order
+// of the keys.
+func (r *roCollection) ForEach(prefix []byte, f ForEachFn) error {
+	return forEachInColl(r.c, prefix, nil, f)
+}
+
+// forEachVisitor is implemented by the collections that visit all their
+// entries to find the keys starting with a prefix.
+type forEachVisitor interface {
+	// forEachVisit works like ForEach, but also calls visit for every
+	// entry of the collection before f is called. If visit returns an
+	// error, forEachVisit stops and returns it.
+	forEachVisit(prefix []byte, visit func() error, f ForEachFn) error
+}
+
+func (r *roCollection) forEachVisit(prefix []byte, visit func() error, f ForEachFn) error {
+	return forEachInColl(r.c, prefix, visit, f)
+}
+
 // ContractFn is the type signature of the class functions
 // which can be registered with the ByzCoin service.
 type ContractFn func(coll CollectionView, inst Instruction, inCoins []Coin) (sc []StateChange, outCoins []Coin, err error)
 
+// QueryFn is the type signature of the read-only functions which can be
+// registered with the ByzCoin service for a contract. It answers the query
+// with the given name about the instance iID, without changing the state.
+type QueryFn func(coll CollectionView, iID InstanceID, name string, args Arguments) ([]byte, error)
+
 // newCollectionDB initialises a structure and reads all key/value pairs to store
 // it in the collection.
 func newCollectionDB(db *bolt.DB, name []byte) *collectionDB {
@@ -102,8 +152,40 @@ const (
 
 const (
 	dbMetaIndex byte = iota
+	dbMetaTx
+	dbMetaUndo
+	dbMetaHistory
 )
 
+// undoLog holds the state changes that revert the collection to the state
+// before a block has been applied. They must be applied in order.
+type undoLog struct {
+	StateChanges StateChanges
+}
+
+func undoKey(index int) []byte {
+	key := []byte{dbMeta, dbMetaUndo, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(key[2:], uint32(index))
+	return key
+}
+
+// historyPrefix is the prefix of the history entries of the key. The entry
+// of a block holds the state of the key before the block changed it. The
+// length of the key is part of the prefix, so that the entries of a key are
+// not mixed with the ones of longer keys.
+func historyPrefix(key []byte) []byte {
+	prefix := make([]byte, 6, 6+len(key)+4)
+	prefix[0], prefix[1] = dbMeta, dbMetaHistory
+	binary.BigEndian.PutUint32(prefix[2:], uint32(len(key)))
+	return append(prefix, key...)
+}
+
+func historyKey(key []byte, index int) []byte {
+	hk := append(historyPrefix(key), 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(hk[len(hk)-4:], uint32(index))
+	return hk
+}
+
 func (c *collectionDB) loadAll() error {
 	return c.db.View(func(tx *bolt.Tx) error {
 		// Assume bucket exists and has keys
@@ -160,6 +242,111 @@ func (c *collectionDB) GetValues(key []byte) (value []byte, contractID string, d
 	return getValueContract(c, key)
 }
 
+// ForEach calls f for every key starting with prefix, in increasing order
+// of the keys. It reads the sorted database instead of the collection, so
+// it only visits the keys starting with prefix.
+func (c *collectionDB) ForEach(prefix []byte, f ForEachFn) error {
+	return c.forEachFrom(prefix, func(key, value []byte, contractID string, darcID darc.ID) error {
+		if !bytes.HasPrefix(key, prefix) {
+			return ErrStopIteration
+		}
+		return f(key, value, contractID, darcID)
+	})
+}
+
+// view calls f with a read-only view of the latest state of the
+// collection. No block is applied while f runs, so that all the reads of f
+// see the same state, without copying the collection.
+func (c *collectionDB) view(f func(CollectionView) error) error {
+	c.collMut.RLock()
+	defer c.collMut.RUnlock()
+	return f(&roCollection{c.coll})
+}
+
+// forEachAfter calls f with the instances whose keys are greater than
+// cursor, in the order of the keys. Unlike the ForEach of the collection,
+// it reads the sorted database, so it only visits the keys it returns.
+func (c *collectionDB) forEachAfter(cursor []byte, f ForEachFn) error {
+	return c.forEachFrom(cursor, func(key, value []byte, contractID string, darcID darc.ID) error {
+		if bytes.Equal(key, cursor) {
+			return nil
+		}
+		return f(key, value, contractID, darcID)
+	})
+}
+
+// forEachFrom calls f with the instances of the sorted database whose keys
+// are not smaller than start, in the order of the keys.
+func (c *collectionDB) forEachFrom(start []byte, f ForEachFn) error {
+	return c.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(c.bucketName))
+		if bucket == nil {
+			return errors.New("bucket does not exist")
+		}
+		cur := bucket.Cursor()
+		k, v := cur.Seek(append([]byte{dbValue}, start...))
+		for ; len(k) > 0 && k[0] == dbValue; k, v = cur.Next() {
+			k2 := dup(k)
+			k2[0] = dbContract
+			contractID := bucket.Get(k2)
+			k2[0] = dbDarcID
+			darcID := bucket.Get(k2)
+			err := f(dup(k[1:]), dup(v), string(contractID), darc.ID(dup(darcID)))
+			if err == ErrStopIteration {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// forEachInColl sorts the keys of the collection starting with prefix and
+// calls f with their values. As the collection is ordered by the hashes of
+// the keys, all keys have to be visited, and visit is called for every one
+// of them if it is not nil.
+func forEachInColl(coll *collection.Collection, prefix []byte, visit func() error, f ForEachFn) error {
+	type entry struct {
+		key    []byte
+		values [][]byte
+	}
+	var entries []entry
+	err := coll.ForEach(func(key []byte, values [][]byte) error {
+		if visit != nil {
+			if err := visit(); err != nil {
+				return err
+			}
+		}
+		if !bytes.HasPrefix(key, prefix) {
+			return nil
+		}
+		if len(values) != 3 {
+			return errors.New("wrong number of values")
+		}
+		entries = append(entries, entry{key, values})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+
+	for _, e := range entries {
+		err = f(e.key, e.values[0], string(e.values[1]), darc.ID(e.values[2]))
+		if err == ErrStopIteration {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Look up the index number of the skipblock that held the most recently
 // applied state changes. On error, it returns index -1, which callers
 // might want (new chain case) or might detect as an error (existing
@@ -190,11 +377,32 @@ func (c *collectionDB) getIndex() int {
 // FIXME: if there is an error, the data in collection may not be consistent
 // with boltdb.
 func (c *collectionDB) StoreAll(ts StateChanges, index int) error {
-	for _, t := range ts {
+	c.collMut.Lock()
+	defer c.collMut.Unlock()
+	c.changes++
+	// Keep the inverse of every state change, so that the collection at
+	// an earlier block can be reconstructed.
+	// The state of every key before the block is also indexed by key, for
+	// the history of the instances.
+	undo := make(StateChanges, len(ts))
+	history := make(map[string][]byte)
+	for i, t := range ts {
+		undo[len(ts)-1-i] = c.inverse(&t)
+		if _, ok := history[string(t.InstanceID)]; !ok {
+			buf, err := protobuf.Encode(&undo[len(ts)-1-i])
+			if err != nil {
+				return err
+			}
+			history[string(t.InstanceID)] = buf
+		}
 		if err := storeInColl(c.coll, &t); err != nil {
 			return err
 		}
 	}
+	undoBuf, err := protobuf.Encode(&undoLog{undo})
+	if err != nil {
+		return err
+	}
 	return c.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(c.bucketName))
 		if bucket == nil {
@@ -206,52 +414,328 @@ func (c *collectionDB) StoreAll(ts StateChanges, index int) error {
 		if err := bucket.Put([]byte{dbMeta, dbMetaIndex}, b); err != nil {
 			return err
 		}
+		if err := bucket.Put(undoKey(index), undoBuf); err != nil {
+			return err
+		}
+		for key, buf := range history {
+			if err := bucket.Put(historyKey([]byte(key), index), buf); err != nil {
+				return err
+			}
+		}
 
 		for _, t := range ts {
-			key := make([]byte, 1+len(t.InstanceID))
-			copy(key[1:], t.InstanceID)
-
-			switch t.StateAction {
-			case Create, Update:
-				key[0] = dbValue
-				if err := bucket.Put(key, t.Value); err != nil {
-					return err
-				}
-				key[0] = dbContract
-				if err := bucket.Put(key, t.ContractID); err != nil {
-					return err
-				}
-				key[0] = dbDarcID
-				if err := bucket.Put(key, t.DarcID); err != nil {
-					return err
-				}
-			case Remove:
-				key[0] = dbValue
-				if err := bucket.Delete(key); err != nil {
-					return err
-				}
-				key[0] = dbContract
-				if err := bucket.Delete(key); err != nil {
-					return err
-				}
-				key[0] = dbDarcID
-				if err := bucket.Delete(key); err != nil {
-					return err
+			if err := storeInBucket(bucket, &t); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// inverse returns the state change that reverts t, given the current
+// state of the collection.
+func (c *collectionDB) inverse(t *StateChange) StateChange {
+	value, contractID, darcID, err := c.GetValues(t.InstanceID)
+	if err != nil {
+		return StateChange{StateAction: Remove, InstanceID: t.InstanceID}
+	}
+	action := Update
+	if t.StateAction == Remove {
+		action = Create
+	}
+	return StateChange{
+		StateAction: action,
+		InstanceID:  t.InstanceID,
+		ContractID:  []byte(contractID),
+		Value:       value,
+		DarcID:      darcID,
+	}
+}
+
+// maxRevertBlocks is the maximum number of blocks collectionAt reverts,
+// which bounds the work of a request for a proof at an earlier block.
+const maxRevertBlocks = 100
+
+// maxCopyAttempts is the number of times collectionAt copies the collection
+// before giving up because blocks are applied in the meantime.
+const maxCopyAttempts = 3
+
+// collectionAt returns a copy of the collection as it was after applying
+// the block with the given index, by reverting the state changes of the
+// later blocks, which must not be more than maxRevertBlocks. It fails if
+// the history of one of the blocks has not been kept, for example if the
+// collection has been restored from a snapshot. The collection is copied
+// without holding collMut, so that blocks are applied in the meantime, and
+// the copy is only used if no block has been applied while it was made.
+func (c *collectionDB) collectionAt(index int) (*collection.Collection, error) {
+	latest := c.getIndex()
+	if index > latest {
+		return nil, errors.New("block has not been applied to the collection yet")
+	}
+	if latest-index > maxRevertBlocks {
+		return nil, fmt.Errorf("cannot go back more than %d blocks", maxRevertBlocks)
+	}
+	for attempt := 0; attempt < maxCopyAttempts; attempt++ {
+		c.collMut.RLock()
+		changes, live := c.changes, c.coll
+		c.collMut.RUnlock()
+		coll := live.Clone()
+
+		c.collMut.RLock()
+		if c.changes != changes {
+			c.collMut.RUnlock()
+			continue
+		}
+		undos, err := c.undoLogs(index)
+		c.collMut.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		for _, undo := range undos {
+			for _, sc := range undo.StateChanges {
+				if err = storeInColl(coll, &sc); err != nil {
+					return nil, err
 				}
-			default:
-				return errors.New("invalid state action")
+			}
+		}
+		return coll, nil
+	}
+	return nil, errors.New("the collection changed while it was copied")
+}
+
+// undoLogs returns the undo logs of the blocks after the one with the given
+// index, starting with the latest block. collMut must be held, so that the
+// undo logs match the collection.
+func (c *collectionDB) undoLogs(index int) ([]undoLog, error) {
+	latest := c.getIndex()
+	if index > latest {
+		return nil, errors.New("block has not been applied to the collection yet")
+	}
+	if latest-index > maxRevertBlocks {
+		return nil, fmt.Errorf("cannot go back more than %d blocks", maxRevertBlocks)
+	}
+	var undos []undoLog
+	err := c.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(c.bucketName))
+		if bucket == nil {
+			return errors.New("bucket does not exist")
+		}
+		for i := latest; i > index; i-- {
+			buf := bucket.Get(undoKey(i))
+			if buf == nil {
+				return fmt.Errorf("no history kept for block %d", i)
+			}
+			var undo undoLog
+			if err := protobuf.Decode(buf, &undo); err != nil {
+				return err
+			}
+			undos = append(undos, undo)
+		}
+		return nil
+	})
+	return undos, err
+}
+
+// pruneUndo removes the undo logs of all the blocks up to the given index,
+// together with their history entries, so the collection cannot be
+// reverted to these blocks anymore.
+func (c *collectionDB) pruneUndo(index int) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(c.bucketName))
+		if bucket == nil {
+			return errors.New("bucket does not exist")
+		}
+		// The indexes are stored in BigEndian, so the undo logs are sorted
+		// by block.
+		prefix := []byte{dbMeta, dbMetaUndo}
+		var keys [][]byte
+		cur := bucket.Cursor()
+		for k, v := cur.Seek(prefix); bytes.HasPrefix(k, prefix); k, v = cur.Next() {
+			block := int(binary.BigEndian.Uint32(k[2:]))
+			if block > index {
+				break
+			}
+			keys = append(keys, dup(k))
+			var undo undoLog
+			if err := protobuf.Decode(v, &undo); err != nil {
+				return err
+			}
+			for _, sc := range undo.StateChanges {
+				keys = append(keys, historyKey(sc.InstanceID, block))
+			}
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// history returns the latest changes of the key by the blocks before the
+// block with index before, in the order of the blocks. At most limit
+// changes are returned, or all of them if limit is 0, and more is true if
+// there are earlier ones. If before is 0, the changes of all the blocks are
+// considered. Only the
+// history entries of the key are read, starting with the latest one. It
+// also returns the index of the first block whose changes are known, which
+// is 0 if the history is complete. No block is applied while the history
+// is read, so that the current state of the key matches the entries.
+func (c *collectionDB) history(key []byte, before, limit int) (changes []InstanceChange, first int, more bool, err error) {
+	c.collMut.RLock()
+	defer c.collMut.RUnlock()
+	latest := c.getIndex()
+	if latest < 0 {
+		return nil, 0, false, errors.New("no block has been applied to the collection yet")
+	}
+	if before <= 0 || before > latest+1 {
+		before = latest + 1
+	}
+	first = latest + 1
+	// after holds the state of the key after the change being read.
+	after := c.inverse(&StateChange{StateAction: Update, InstanceID: key})
+	err = c.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(c.bucketName))
+		if bucket == nil {
+			return errors.New("bucket does not exist")
+		}
+		cur := bucket.Cursor()
+		undoPrefix := []byte{dbMeta, dbMetaUndo}
+		if k, _ := cur.Seek(undoPrefix); bytes.HasPrefix(k, undoPrefix) {
+			first = int(binary.BigEndian.Uint32(k[2:]))
+		}
+
+		// The entry of the first change from before on holds the state
+		// after the last change before it.
+		prefix := historyPrefix(key)
+		k, v := cur.Seek(historyKey(key, before))
+		if bytes.HasPrefix(k, prefix) {
+			var state StateChange
+			if err := protobuf.Decode(v, &state); err != nil {
+				return err
+			}
+			after = state
+		}
+		if k == nil {
+			k, v = cur.Last()
+		} else {
+			k, v = cur.Prev()
+		}
+		for ; bytes.HasPrefix(k, prefix); k, v = cur.Prev() {
+			if limit > 0 && len(changes) == limit {
+				more = true
+				break
+			}
+			var state StateChange
+			if err := protobuf.Decode(v, &state); err != nil {
+				return err
+			}
+			change := InstanceChange{
+				BlockIndex: int(binary.BigEndian.Uint32(k[len(prefix):])),
+				Removed:    after.StateAction == Remove,
+				Instance:   Instance{InstanceID: NewInstanceID(key)},
+			}
+			if !change.Removed {
+				change.Instance.ContractID = string(after.ContractID)
+				change.Instance.DarcID = after.DarcID
+				change.Instance.Value = after.Value
+			}
+			changes = append(changes, change)
+			after = state
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, false, err
+	}
+	for i, j := 0, len(changes)-1; i < j; i, j = i+1, j-1 {
+		changes[i], changes[j] = changes[j], changes[i]
+	}
+	return changes, first, more, nil
+}
+
+// storeInBucket applies the state change to the key/value pairs stored in
+// the bucket.
+func storeInBucket(bucket *bolt.Bucket, t *StateChange) error {
+	key := make([]byte, 1+len(t.InstanceID))
+	copy(key[1:], t.InstanceID)
+
+	switch t.StateAction {
+	case Create, Update:
+		key[0] = dbValue
+		if err := bucket.Put(key, t.Value); err != nil {
+			return err
+		}
+		key[0] = dbContract
+		if err := bucket.Put(key, t.ContractID); err != nil {
+			return err
+		}
+		key[0] = dbDarcID
+		if err := bucket.Put(key, t.DarcID); err != nil {
+			return err
+		}
+	case Remove:
+		key[0] = dbValue
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+		key[0] = dbContract
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+		key[0] = dbDarcID
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	default:
+		return errors.New("invalid state action")
+	}
+	return nil
+}
+
+// StoreTxResults indexes the transactions of the block with the given ID,
+// so that their status can be looked up by the hash of their instructions.
+func (c *collectionDB) StoreTxResults(txs TxResults, blockID skipchain.SkipBlockID) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(c.bucketName))
+		if bucket == nil {
+			return errors.New("bucket does not exist")
+		}
+		for _, t := range txs {
+			key := append([]byte{dbMeta, dbMetaTx}, t.ClientTransaction.Instructions.Hash()...)
+			if err := bucket.Put(key, blockID); err != nil {
+				return err
 			}
 		}
 		return nil
 	})
 }
 
+// getTxBlockID returns the ID of the block that holds the transaction with
+// the given hash, or nil if the transaction is unknown.
+func (c *collectionDB) getTxBlockID(txHash []byte) skipchain.SkipBlockID {
+	var out skipchain.SkipBlockID
+	c.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(c.bucketName))
+		if bucket == nil {
+			return errors.New("bucket does not exist")
+		}
+		if v := bucket.Get(append([]byte{dbMeta, dbMetaTx}, txHash...)); v != nil {
+			out = dup(v)
+		}
+		return nil
+	})
+	return out
+}
+
 // RootHash returns the hash of the root node in the merkle tree.
 func (c *collectionDB) RootHash() []byte {
 	return c.coll.GetRoot()
 }
 
-var errKeyNotSet = errors.New("key not set")
+// ErrKeyNotSet is returned by GetValues if nothing is stored under the key.
+var ErrKeyNotSet = errors.New("key not set")
 
 func getValueContract(coll CollectionView, key []byte) (value []byte, contract string, darcID darc.ID, err error) {
 	record, err := coll.Get(key).Record()
@@ -259,7 +743,7 @@ func getValueContract(coll CollectionView, key []byte) (value []byte, contract s
 		return
 	}
 	if !record.Match() {
-		err = errKeyNotSet
+		err = ErrKeyNotSet
 		return
 	}
 	values, err := record.Values()
@@ -351,6 +835,44 @@ func RegisterContract(s skipchain.GetService, kind string, f ContractFn) error {
 	return scs.(*Service).registerContract(kind, f)
 }
 
+// RegisterContractVersion stores an upgraded version of a contract. A
+// version is only used once an "upgrade_contract" instruction on the config
+// instance switched to it, from the given block height on. Older blocks are
+// still verified with the version that was active for them, so all
+// versions must be kept. RegisterContract registers version 0.
+func RegisterContractVersion(s skipchain.GetService, kind string, version int, f ContractFn) error {
+	scs := s.Service(ServiceName)
+	if scs == nil {
+		return errors.New("Didn't find our service: " + ServiceName)
+	}
+	return scs.(*Service).registerContractVersion(kind, version, f)
+}
+
+// RegisterQuery stores the read-only function of a contract, which will be
+// called for every Query on an instance of this contract.
+// GetService makes it possible to give either an `onet.Context` or
+// `onet.Server` to `RegisterQuery`.
+func RegisterQuery(s skipchain.GetService, kind string, f QueryFn) error {
+	scs := s.Service(ServiceName)
+	if scs == nil {
+		return errors.New("Didn't find our service: " + ServiceName)
+	}
+	return scs.(*Service).registerQuery(kind, f)
+}
+
+// RegisterFeeContract sets the contract whose instances hold the Coin
+// paying the fees and the reward account given in the ChainConfig. Without
+// it, transactions cannot pay fees.
+// GetService makes it possible to give either an `onet.Context` or
+// `onet.Server` to `RegisterFeeContract`.
+func RegisterFeeContract(s skipchain.GetService, kind string) error {
+	scs := s.Service(ServiceName)
+	if scs == nil {
+		return errors.New("Didn't find our service: " + ServiceName)
+	}
+	return scs.(*Service).registerFeeContract(kind)
+}
+
 // SafeAdd will add a to the value of the coin if there will be no
 // overflow.
 func (c *Coin) SafeAdd(a uint64) error {
@@ -376,29 +898,37 @@ type bcState struct {
 	sync.Mutex
 	// waitChannels will be informed by Service.updateCollection that a
 	// given ClientTransaction has been included. updateCollection will
-	// send true for a valid ClientTransaction and false for an invalid
-	// ClientTransaction.
-	waitChannels map[string]chan bool
+	// send whether the ClientTransaction has been accepted, the index of
+	// the block and the reason of a refusal.
+	waitChannels map[string]chan txInclusion
 	// blockListeners will be notified every time a block is created.
 	// It is up to them to filter out block creations on chains they are not
 	// interested in.
 	blockListeners []chan skipchain.SkipBlockID
 }
 
-func (bc *bcState) createWaitChannel(ctxHash []byte) chan bool {
+// txInclusion is sent to the wait channel of a ClientTransaction once it is
+// included in a block.
+type txInclusion struct {
+	accepted   bool
+	blockIndex int
+	err        string
+}
+
+func (bc *bcState) createWaitChannel(ctxHash []byte) chan txInclusion {
 	bc.Lock()
 	defer bc.Unlock()
-	ch := make(chan bool, 1)
+	ch := make(chan txInclusion, 1)
 	bc.waitChannels[string(ctxHash)] = ch
 	return ch
 }
 
-func (bc *bcState) informWaitChannel(ctxHash []byte, valid bool) {
+func (bc *bcState) informWaitChannel(ctxHash []byte, inc txInclusion) {
 	bc.Lock()
 	defer bc.Unlock()
 	ch := bc.waitChannels[string(ctxHash)]
 	if ch != nil {
-		ch <- valid
+		ch <- inc
 	}
 }
 
@@ -454,5 +984,11 @@ func (c ChainConfig) sanityCheck() error {
 	if c.MaxBlockSize > 8*1e6 {
 		return errors.New("max block size is greater than 8 megs")
 	}
+	if !c.FeeCoinType.Equal(InstanceID{}) && c.FeeReward.Equal(InstanceID{}) {
+		return errors.New("fees need a reward account")
+	}
+	if c.MaxReads < 0 || c.MaxWrites < 0 || c.MaxStateChangeBytes < 0 || c.MaxExecutionTime < 0 {
+		return errors.New("contract limits cannot be negative")
+	}
 	return nil
 }
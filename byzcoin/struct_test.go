@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/cothority/byzcoin/darc"
 	"github.com/stretchr/testify/require"
 )
 
@@ -120,7 +121,139 @@ func TestCollectionDB(t *testing.T) {
 	}
 }
 
+func TestCollectionDBHistory(t *testing.T) {
+	tmpDB, err := ioutil.TempFile("", "tmpDB")
+	require.Nil(t, err)
+	tmpDB.Close()
+	defer os.Remove(tmpDB.Name())
+
+	db, err := bolt.Open(tmpDB.Name(), 0600, nil)
+	require.Nil(t, err)
+	cdb := newCollectionDB(db, testName)
+
+	key := []byte("key")
+	sc := func(action StateAction, k, value string) StateChange {
+		return StateChange{StateAction: action, InstanceID: []byte(k),
+			Value: []byte(value), ContractID: []byte("myContract")}
+	}
+	require.Nil(t, cdb.StoreAll(StateChanges{sc(Create, "other", "0")}, 0))
+	require.Nil(t, cdb.StoreAll(StateChanges{sc(Create, "key", "1")}, 1))
+	require.Nil(t, cdb.StoreAll(StateChanges{sc(Update, "other", "2")}, 2))
+	require.Nil(t, cdb.StoreAll(StateChanges{sc(Update, "key", "3a"),
+		sc(Update, "key", "3b")}, 3))
+	require.Nil(t, cdb.StoreAll(StateChanges{sc(Remove, "key", "")}, 4))
+
+	changes, first, more, err := cdb.history(key, 0, 0)
+	require.Nil(t, err)
+	require.Equal(t, 0, first)
+	require.False(t, more)
+	require.Equal(t, 3, len(changes))
+	require.Equal(t, 1, changes[0].BlockIndex)
+	require.Equal(t, []byte("1"), changes[0].Instance.Value)
+	require.Equal(t, "myContract", changes[0].Instance.ContractID)
+	require.Equal(t, 3, changes[1].BlockIndex)
+	require.Equal(t, []byte("3b"), changes[1].Instance.Value)
+	require.Equal(t, 4, changes[2].BlockIndex)
+	require.True(t, changes[2].Removed)
+	require.True(t, changes[2].Instance.InstanceID.Equal(NewInstanceID(key)))
+
+	// Only the changes before the given block are returned, starting with
+	// the latest one.
+	changes, _, more, err = cdb.history(key, 4, 1)
+	require.Nil(t, err)
+	require.True(t, more)
+	require.Equal(t, 1, len(changes))
+	require.Equal(t, 3, changes[0].BlockIndex)
+	require.Equal(t, []byte("3b"), changes[0].Instance.Value)
+	changes, _, more, err = cdb.history(key, 3, 1)
+	require.Nil(t, err)
+	require.False(t, more)
+	require.Equal(t, 1, len(changes))
+	require.Equal(t, 1, changes[0].BlockIndex)
+
+	// The history entries of a key are not mixed with the ones of the
+	// keys it prefixes.
+	changes, _, _, err = cdb.history([]byte("ke"), 0, 0)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(changes))
+
+	// Without the undo logs of the first blocks, the history starts later.
+	require.Nil(t, cdb.pruneUndo(2))
+	changes, first, _, err = cdb.history(key, 0, 0)
+	require.Nil(t, err)
+	require.Equal(t, 3, first)
+	require.Equal(t, 2, len(changes))
+	require.Equal(t, 3, changes[0].BlockIndex)
+	_, err = cdb.collectionAt(2)
+	require.Nil(t, err)
+	_, err = cdb.collectionAt(1)
+	require.NotNil(t, err)
+
+	// The collection cannot be reverted by more than maxRevertBlocks.
+	for i := 5; i < 5+maxRevertBlocks; i++ {
+		require.Nil(t, cdb.StoreAll(StateChanges{sc(Update, "other", fmt.Sprint(i))}, i))
+	}
+	coll, err := cdb.collectionAt(4)
+	require.Nil(t, err)
+	value, _, _, err := (&roCollection{coll}).GetValues([]byte("other"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("2"), value)
+	_, err = cdb.collectionAt(3)
+	require.NotNil(t, err)
+}
+
 // TODO: Test good case, bad add case, bad remove case
+func TestCollectionDBForEachAfter(t *testing.T) {
+	tmpDB, err := ioutil.TempFile("", "tmpDB")
+	require.Nil(t, err)
+	tmpDB.Close()
+	defer os.Remove(tmpDB.Name())
+
+	db, err := bolt.Open(tmpDB.Name(), 0600, nil)
+	require.Nil(t, err)
+	cdb := newCollectionDB(db, testName)
+
+	var scs StateChanges
+	for _, k := range []string{"c", "a", "d", "b"} {
+		scs = append(scs, StateChange{StateAction: Create, InstanceID: []byte(k),
+			Value: []byte("v" + k), ContractID: []byte("myContract"),
+			DarcID: darc.ID("darc")})
+	}
+	require.Nil(t, cdb.StoreAll(scs, 0))
+
+	list := func(cursor string, n int) (keys []string) {
+		err := cdb.forEachAfter([]byte(cursor), func(key, value []byte, contractID string, darcID darc.ID) error {
+			require.Equal(t, "v"+string(key), string(value))
+			require.Equal(t, "myContract", contractID)
+			require.True(t, darcID.Equal(darc.ID("darc")))
+			if len(keys) == n {
+				return ErrStopIteration
+			}
+			keys = append(keys, string(key))
+			return nil
+		})
+		require.Nil(t, err)
+		return
+	}
+	require.Equal(t, []string{"a", "b", "c", "d"}, list("", 10))
+	require.Equal(t, []string{"a", "b"}, list("", 2))
+	require.Equal(t, []string{"c", "d"}, list("b", 2))
+	require.Equal(t, []string{"c"}, list("bb", 1))
+	require.Nil(t, list("d", 2))
+
+	// ForEach only visits the keys with the prefix.
+	require.Nil(t, cdb.StoreAll(StateChanges{{StateAction: Create, InstanceID: []byte("bb"),
+		Value: []byte("vbb"), ContractID: []byte("myContract"), DarcID: darc.ID("darc")}}, 1))
+	var keys []string
+	err = cdb.ForEach([]byte("b"), func(key, value []byte, contractID string, darcID darc.ID) error {
+		require.Equal(t, "v"+string(key), string(value))
+		keys = append(keys, string(key))
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{"b", "bb"}, keys)
+}
+
 func TestCollectionDBtryHash(t *testing.T) {
 	tmpDB, err := ioutil.TempFile("", "tmpDB")
 	require.Nil(t, err)
@@ -147,9 +280,9 @@ func TestCollectionDBtryHash(t *testing.T) {
 	mrTrial, err := cdb.tryHash(scs)
 	require.Nil(t, err)
 	_, _, _, err = cdb.GetValues([]byte("key1"))
-	require.Equal(t, err, errKeyNotSet)
+	require.Equal(t, err, ErrKeyNotSet)
 	_, _, _, err = cdb.GetValues([]byte("key2"))
-	require.Equal(t, err, errKeyNotSet)
+	require.Equal(t, err, ErrKeyNotSet)
 	cdb.StoreAll([]StateChange{scs[0]}, 0)
 	cdb.StoreAll([]StateChange{scs[1]}, 0)
 	mrReal := cdb.RootHash()
@@ -100,12 +100,92 @@ func (instr Instruction) Hash() []byte {
 		h.Write([]byte{2})
 	}
 	for _, a := range args {
+		// The arguments filled in by the inputs are only known once the
+		// earlier instructions ran, so the inputs are hashed instead.
+		if instr.isInput(a.Name) {
+			continue
+		}
 		h.Write([]byte(a.Name))
 		h.Write(a.Value)
 	}
+	// The counters are only hashed if they are present, so that the hash
+	// of instructions without counters doesn't change.
+	if len(instr.SignerCounter) > 0 {
+		cb := make([]byte, 8)
+		for _, c := range instr.SignerCounter {
+			binary.LittleEndian.PutUint64(cb, c)
+			h.Write(cb)
+		}
+	}
+	// Same for the inputs.
+	for _, in := range instr.Inputs {
+		binary.LittleEndian.PutUint32(b, uint32(in.Instruction))
+		h.Write(b)
+		h.Write([]byte(in.Name))
+		h.Write([]byte(in.Argument))
+	}
 	return h.Sum(nil)
 }
 
+// isInput returns whether the argument is filled in by one of the inputs of
+// the instruction.
+func (instr Instruction) isInput(argument string) bool {
+	for _, in := range instr.Inputs {
+		if in.Argument == argument {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveInputs returns a copy of the instruction, where the values
+// returned by the earlier instructions of the ClientTransaction are added
+// to the arguments, as requested by the inputs. results holds the values
+// returned by the earlier instructions.
+func (instr Instruction) resolveInputs(results []Arguments) (Instruction, error) {
+	if len(instr.Inputs) == 0 {
+		return instr, nil
+	}
+	var args *Arguments
+	switch instr.GetType() {
+	case SpawnType:
+		spawn := *instr.Spawn
+		instr.Spawn = &spawn
+		args = &instr.Spawn.Args
+	case InvokeType:
+		invoke := *instr.Invoke
+		instr.Invoke = &invoke
+		args = &instr.Invoke.Args
+	default:
+		return instr, errors.New("only spawn and invoke instructions can have inputs")
+	}
+	for _, a := range *args {
+		if instr.isInput(a.Name) {
+			return instr, fmt.Errorf("argument %s is given by an input", a.Name)
+		}
+	}
+
+	resolved := append(Arguments{}, *args...)
+	for _, in := range instr.Inputs {
+		if in.Instruction < 0 || in.Instruction >= len(results) {
+			return instr, fmt.Errorf("input refers to instruction %d, which didn't run before", in.Instruction)
+		}
+		var found bool
+		for _, r := range results[in.Instruction] {
+			if r.Name == in.Name {
+				resolved = append(resolved, Argument{Name: in.Argument, Value: r.Value})
+				found = true
+				break
+			}
+		}
+		if !found {
+			return instr, fmt.Errorf("instruction %d didn't return %s", in.Instruction, in.Name)
+		}
+	}
+	*args = resolved
+	return instr, nil
+}
+
 // DeriveID derives a new InstanceID from the hash of the instruction, its signatures,
 // and the given string.
 //
@@ -215,11 +295,13 @@ func (instr Instruction) String() string {
 	out += fmt.Sprintf("\tindex: %d\n\tlength: %d\n", instr.Index, instr.Length)
 	out += fmt.Sprintf("\taction: %s\n", instr.Action())
 	out += fmt.Sprintf("\tsignatures: %d\n", len(instr.Signatures))
+	out += fmt.Sprintf("\tsigner counters: %v\n", instr.SignerCounter)
 	return out
 }
 
 // SignBy gets one signature from each of the given signers
-// and adds them into the Instruction.
+// and adds them into the Instruction. The SignerCounter, if used, must be
+// set before calling SignBy, because it is part of the signed hash.
 func (instr *Instruction) SignBy(darcID darc.ID, signers ...darc.Signer) error {
 	// Create the request and populate it with the right identities.  We
 	// need to do this prior to signing because identities are a part of
@@ -255,6 +337,37 @@ func (instr *Instruction) SignBy(darcID darc.ID, signers ...darc.Signer) error {
 	return nil
 }
 
+// SignWith adds the signature of the signer to an instruction whose
+// Signatures already hold the identities of all its signers. As these
+// identities are part of the signed digest, they have to be set before the
+// first signature, but then the signers can sign one after the other, for
+// example on machines that are not connected to ByzCoin. The SignerCounter,
+// if used, must also be set before.
+func (instr *Instruction) SignWith(darcID darc.ID, signer darc.Signer) error {
+	id := signer.Identity()
+	idx := -1
+	for i := range instr.Signatures {
+		if instr.Signatures[i].Signer.Equal(&id) {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return errors.New("the signer is not one of the identities of the instruction: " + id.String())
+	}
+
+	req, err := instr.ToDarcRequest(darcID)
+	if err != nil {
+		return err
+	}
+	sig, err := signer.Sign(req.Hash())
+	if err != nil {
+		return err
+	}
+	instr.Signatures[idx].Signature = sig
+	return nil
+}
+
 // ToDarcRequest converts the Instruction content into a darc.Request.
 func (instr Instruction) ToDarcRequest(baseID darc.ID) (*darc.Request, error) {
 	action := instr.Action()
@@ -296,8 +409,19 @@ func (instr Instruction) VerifyDarcSignature(coll CollectionView) error {
 	}
 	// Verify the request is signed by appropriate identities.
 	// A callback is required to get any delegated DARC(s) during
-	// expression evaluation.
-	err = req.VerifyWithCB(d, func(str string, latest bool) *darc.Darc {
+	// expression evaluation, and the conditions of the rules need
+	// the instruction.
+	err = req.VerifyWithAttr(d, darcGetter(coll), darcAttributes(coll, instr))
+	if err != nil {
+		return errors.New("request verification failed: " + err.Error())
+	}
+	return nil
+}
+
+// darcGetter returns the callback that loads the delegated darcs from the
+// collection during the evaluation of an expression.
+func darcGetter(coll CollectionView) func(str string, latest bool) *darc.Darc {
+	return func(str string, latest bool) *darc.Darc {
 		if len(str) < 5 || string(str[0:5]) != "darc:" {
 			return nil
 		}
@@ -310,11 +434,76 @@ func (instr Instruction) VerifyDarcSignature(coll CollectionView) error {
 			return nil
 		}
 		return d
-	})
+	}
+}
+
+// signerCounterContractID is stored as the contract of the signer counters.
+// No contract is registered under this ID, so the counters cannot be changed
+// by instructions.
+const signerCounterContractID = "signercounter"
+
+// signerCounterKey returns the key under which the counter of the signer
+// with the given identity is stored in the collection.
+func signerCounterKey(id string) []byte {
+	h := sha256.New()
+	h.Write([]byte("signercounter_"))
+	h.Write([]byte(id))
+	return h.Sum(nil)
+}
+
+// getSignerCounter returns the latest counter of the signer, which is 0 if
+// the signer never used a counter.
+func getSignerCounter(coll CollectionView, id string) (uint64, error) {
+	buf, _, _, err := coll.GetValues(signerCounterKey(id))
+	if err == ErrKeyNotSet {
+		return 0, nil
+	}
 	if err != nil {
-		return errors.New("request verification failed: " + err.Error())
+		return 0, err
 	}
-	return nil
+	if len(buf) != 8 {
+		return 0, errors.New("invalid signer counter")
+	}
+	return binary.LittleEndian.Uint64(buf), nil
+}
+
+// verifySignerCounters checks that every counter of the instruction is one
+// more than the counter stored for its signer, and returns the state changes
+// that increase the stored counters. The darcID is stored together with the
+// counters. Instructions without counters return no state changes.
+func (instr Instruction) verifySignerCounters(coll CollectionView, darcID darc.ID) (StateChanges, error) {
+	if len(instr.SignerCounter) == 0 {
+		return nil, nil
+	}
+	if len(instr.SignerCounter) != len(instr.Signatures) {
+		return nil, errors.New("the number of signer counters and signatures differ")
+	}
+	var scs StateChanges
+	for i, sig := range instr.Signatures {
+		id := sig.Signer.String()
+		ctr, err := getSignerCounter(coll, id)
+		if err != nil {
+			return nil, err
+		}
+		if instr.SignerCounter[i] != ctr+1 {
+			return nil, fmt.Errorf("got signer counter %d for %s, but need %d",
+				instr.SignerCounter[i], id, ctr+1)
+		}
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, ctr+1)
+		action := Update
+		if ctr == 0 {
+			action = Create
+		}
+		scs = append(scs, StateChange{
+			StateAction: action,
+			InstanceID:  signerCounterKey(id),
+			ContractID:  []byte(signerCounterContractID),
+			Value:       buf,
+			DarcID:      darcID,
+		})
+	}
+	return scs, nil
 }
 
 // Instructions is a slice of Instruction
@@ -342,7 +531,8 @@ func NewTxResults(ct ...ClientTransaction) TxResults {
 	return out
 }
 
-// Hash returns the sha256 hash of all of the transactions.
+// Hash returns the sha256 hash of all of the transactions, including their
+// fees.
 func (txr TxResults) Hash() []byte {
 	one := []byte{1}
 	zero := []byte{0}
@@ -350,11 +540,30 @@ func (txr TxResults) Hash() []byte {
 	h := sha256.New()
 	for _, tx := range txr {
 		h.Write(tx.ClientTransaction.Instructions.Hash())
+		// The fee is only hashed if it is present, so that the hash of
+		// transactions without fee doesn't change.
+		if fee := tx.ClientTransaction.Fee; fee != nil {
+			h.Write(fee.Coin[:])
+			b := make([]byte, 8)
+			binary.LittleEndian.PutUint64(b, fee.Amount)
+			h.Write(b)
+			for _, sig := range fee.Signatures {
+				h.Write([]byte(sig.Signer.String()))
+				h.Write(sig.Signature)
+			}
+		}
 		if tx.Accepted {
 			h.Write(one[:])
 		} else {
 			h.Write(zero[:])
 		}
+		// Like the fee, the error is only hashed if it is present.
+		if tx.Error != "" {
+			b := make([]byte, 8)
+			binary.LittleEndian.PutUint64(b, uint64(len(tx.Error)))
+			h.Write(b)
+			h.Write([]byte(tx.Error))
+		}
 	}
 	return h.Sum(nil)
 }
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/dedis/cothority/byzcoin/darc"
+	"github.com/dedis/cothority/byzcoin/darc/expression"
 	"github.com/stretchr/testify/require"
 )
 
@@ -28,6 +29,37 @@ func TestTransaction_Signing(t *testing.T) {
 	require.Nil(t, req.Verify(d))
 }
 
+func TestTransaction_SignWith(t *testing.T) {
+	signers := []darc.Signer{darc.NewSignerEd25519(nil, nil), darc.NewSignerEd25519(nil, nil)}
+	ids := []darc.Identity{signers[0].Identity(), signers[1].Identity()}
+	d := darc.NewDarc(darc.InitRules(ids, ids), []byte("genesis darc"))
+	d.Rules.AddRule("spawn:dummy_kind", expression.InitAndExpr(ids[0].String(), ids[1].String()))
+
+	instr, err := createInstr(d.GetBaseID(), "dummy_kind", []byte("dummy_value"), signers[0])
+	require.Nil(t, err)
+	instr.Signatures = []darc.Signature{{Signer: ids[0]}, {Signer: ids[1]}}
+
+	// The signers sign one after the other, in any order.
+	require.Nil(t, instr.SignWith(d.GetBaseID(), signers[1]))
+	req, err := instr.ToDarcRequest(d.GetBaseID())
+	require.Nil(t, err)
+	require.NotNil(t, req.Verify(d))
+	require.Nil(t, instr.SignWith(d.GetBaseID(), signers[0]))
+	req, err = instr.ToDarcRequest(d.GetBaseID())
+	require.Nil(t, err)
+	require.Nil(t, req.Verify(d))
+
+	// The result is the same as signing with both at once.
+	signed := instr
+	signed.Signatures = nil
+	require.Nil(t, signed.SignBy(d.GetBaseID(), signers...))
+	req, err = signed.ToDarcRequest(d.GetBaseID())
+	require.Nil(t, err)
+	require.Nil(t, req.Verify(d))
+
+	require.NotNil(t, instr.SignWith(d.GetBaseID(), darc.NewSignerEd25519(nil, nil)))
+}
+
 func createOneClientTx(dID darc.ID, kind string, value []byte, signer darc.Signer) (ClientTransaction, error) {
 	instr, err := createInstr(dID, kind, value, signer)
 	if err != nil {
@@ -53,3 +85,39 @@ func createInstr(dID darc.ID, contractID string, value []byte, signer darc.Signe
 	err := instr.SignBy(dID, signer)
 	return instr, err
 }
+
+func TestTransaction_SignerCounterHash(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	instr, err := createInstr(darc.ID{}, "dummy_kind", []byte("dummy_value"), signer)
+	require.Nil(t, err)
+	h := instr.Hash()
+
+	instr.SignerCounter = []uint64{1}
+	h1 := instr.Hash()
+	require.NotEqual(t, h, h1)
+	instr.SignerCounter = []uint64{2}
+	require.NotEqual(t, h1, instr.Hash())
+	instr.SignerCounter = nil
+	require.Equal(t, h, instr.Hash())
+}
+
+func TestTransaction_FeeHash(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	instr, err := createInstr(darc.ID{}, "dummy_kind", []byte("dummy_value"), signer)
+	require.Nil(t, err)
+	txr := NewTxResults(ClientTransaction{Instructions: Instructions{instr}})
+	h := txr.Hash()
+
+	txr[0].ClientTransaction.Fee = &Fee{Amount: 1}
+	h1 := txr.Hash()
+	require.NotEqual(t, h, h1)
+	txr[0].ClientTransaction.Fee = &Fee{Amount: 2}
+	require.NotEqual(t, h1, txr.Hash())
+	txr[0].ClientTransaction.Fee.Signatures = []darc.Signature{{Signer: signer.Identity()}}
+	h2 := txr.Hash()
+	require.NotEqual(t, h1, h2)
+	txr[0].ClientTransaction.Fee.Signatures[0].Signature = []byte("signature")
+	require.NotEqual(t, h2, txr.Hash())
+	txr[0].ClientTransaction.Fee = nil
+	require.Equal(t, h, txr.Hash())
+}
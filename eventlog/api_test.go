@@ -250,6 +250,16 @@ func TestClient_Search(t *testing.T) {
 	require.False(t, resp.Truncated)
 	require.Equal(t, 10, len(resp.Events))
 
+	// The same search as a ByzCoin query.
+	reqBuf, err := protobuf.Encode(&SearchRequest{Topic: "a"})
+	require.Nil(t, err)
+	qr, err := c.ByzCoin.Query(c.Instance, "search", byzcoin.Arguments{{Name: "request", Value: reqBuf}})
+	require.Nil(t, err)
+	require.True(t, qr.Proof.InclusionProof.Match())
+	var qresp SearchResponse
+	require.Nil(t, protobuf.Decode(qr.Result, &qresp))
+	require.Equal(t, 10, len(qresp.Events))
+
 	// Search by time range and topic.
 	req = &SearchRequest{Instance: c.Instance, ID: c.ByzCoin.ID, Topic: "a", From: tm0 + 3, To: tm0 + 8}
 	resp, err = c.Search(req)
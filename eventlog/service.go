@@ -41,12 +41,15 @@ func (s *Service) Search(req *SearchRequest) (*SearchResponse, error) {
 	if req.ID.IsNull() {
 		return nil, errors.New("skipchain ID required")
 	}
+	return s.search(s.omni.GetCollectionView(req.ID), req)
+}
 
+// search runs the search request against the given view of the collection.
+func (s *Service) search(v byzcoin.CollectionView, req *SearchRequest) (*SearchResponse, error) {
 	if req.To == 0 {
 		req.To = time.Now().UnixNano()
 	}
 
-	v := s.omni.GetCollectionView(req.ID)
 	el := &eventLog{Instance: req.Instance, v: v}
 
 	id, b, err := el.getLatestBucket()
@@ -310,6 +313,28 @@ func (s *Service) contractFunction(v byzcoin.CollectionView, inst byzcoin.Instru
 	}
 }
 
+// query answers read-only queries on an eventlog instance. The only query
+// is "search", which takes a protobuf-encoded SearchRequest in the argument
+// "request" and returns a protobuf-encoded SearchResponse. The Instance and
+// ID of the SearchRequest are ignored.
+func (s *Service) query(v byzcoin.CollectionView, iID byzcoin.InstanceID, name string, args byzcoin.Arguments) ([]byte, error) {
+	if name != "search" {
+		return nil, errors.New("unknown query: " + name)
+	}
+	req := &SearchRequest{}
+	if buf := args.Search("request"); buf != nil {
+		if err := protobuf.Decode(buf, req); err != nil {
+			return nil, err
+		}
+	}
+	req.Instance = iID
+	resp, err := s.search(v, req)
+	if err != nil {
+		return nil, err
+	}
+	return protobuf.Encode(resp)
+}
+
 // newService receives the context that holds information about the node it's
 // running on. Saving and loading can be done using the context. The data will
 // be stored in memory for tests and simulations, and on disk for real
@@ -329,6 +354,7 @@ func newService(c *onet.Context) (onet.Service, error) {
 	}
 
 	byzcoin.RegisterContract(s, contractName, s.contractFunction)
+	byzcoin.RegisterQuery(s, contractName, s.query)
 	return s, nil
 }
 
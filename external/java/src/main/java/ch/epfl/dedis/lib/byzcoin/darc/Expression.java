@@ -0,0 +1,53 @@
+package ch.epfl.dedis.lib.byzcoin.darc;
+
+import java.util.List;
+import java.util.stream.Collectors;
+
+/**
+ * Expression builds the expressions of the darc rules. An expression is a
+ * combination of identities that must sign a request for the rule to be
+ * fulfilled.
+ */
+public class Expression {
+    private Expression() {
+    }
+
+    /**
+     * Creates an expression that is fulfilled if all the identities sign.
+     *
+     * @param ids the identities
+     * @return the expression
+     */
+    public static byte[] and(List<Identity> ids) {
+        return String.join(" & ", toStrings(ids)).getBytes();
+    }
+
+    /**
+     * Creates an expression that is fulfilled if any of the identities signs.
+     *
+     * @param ids the identities
+     * @return the expression
+     */
+    public static byte[] or(List<Identity> ids) {
+        return String.join(" | ", toStrings(ids)).getBytes();
+    }
+
+    /**
+     * Creates an expression that is fulfilled if at least threshold of the
+     * identities sign, e.g. any 3 of 5 keys.
+     *
+     * @param threshold the number of identities that must sign
+     * @param ids       the identities
+     * @return the expression
+     */
+    public static byte[] threshold(int threshold, List<Identity> ids) {
+        if (threshold < 1 || threshold > ids.size()) {
+            throw new IllegalArgumentException("threshold must be between 1 and the number of identities");
+        }
+        return ("[" + String.join(", ", toStrings(ids)) + "]/" + threshold).getBytes();
+    }
+
+    private static List<String> toStrings(List<Identity> ids) {
+        return ids.stream().map(Identity::toString).collect(Collectors.toList());
+    }
+}
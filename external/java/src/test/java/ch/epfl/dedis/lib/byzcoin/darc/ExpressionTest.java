@@ -0,0 +1,26 @@
+package ch.epfl.dedis.lib.byzcoin.darc;
+
+import org.junit.jupiter.api.Test;
+
+import java.util.Arrays;
+import java.util.List;
+
+import static org.junit.jupiter.api.Assertions.*;
+
+class ExpressionTest {
+    @Test
+    void threshold() throws Exception {
+        Identity a = new SignerEd25519().getIdentity();
+        Identity b = new SignerEd25519().getIdentity();
+        Identity c = new SignerEd25519().getIdentity();
+        List<Identity> ids = Arrays.asList(a, b, c);
+
+        String expected = "[" + a.toString() + ", " + b.toString() + ", " + c.toString() + "]/2";
+        assertEquals(expected, new String(Expression.threshold(2, ids)));
+        assertEquals(a.toString() + " & " + b.toString(), new String(Expression.and(Arrays.asList(a, b))));
+        assertEquals(a.toString() + " | " + b.toString(), new String(Expression.or(Arrays.asList(a, b))));
+
+        assertThrows(IllegalArgumentException.class, () -> Expression.threshold(0, ids));
+        assertThrows(IllegalArgumentException.class, () -> Expression.threshold(4, ids));
+    }
+}
@@ -0,0 +1,50 @@
+/**
+ * Expression builds the expressions of the darc rules. An expression is a
+ * combination of identities that must sign a request for the rule to be
+ * fulfilled.
+ */
+class Expression {
+  /**
+   * Creates an expression that is fulfilled if all the identities sign.
+   *
+   * @param {Identity[]} ids - the identities
+   * @return {Uint8Array} - the expression
+   */
+  static and(ids) {
+    return Expression._encode(ids.map(id => id.toString()).join(" & "));
+  }
+
+  /**
+   * Creates an expression that is fulfilled if any of the identities signs.
+   *
+   * @param {Identity[]} ids - the identities
+   * @return {Uint8Array} - the expression
+   */
+  static or(ids) {
+    return Expression._encode(ids.map(id => id.toString()).join(" | "));
+  }
+
+  /**
+   * Creates an expression that is fulfilled if at least threshold of the
+   * identities sign, e.g. any 3 of 5 keys.
+   *
+   * @param {number} threshold - the number of identities that must sign
+   * @param {Identity[]} ids - the identities
+   * @return {Uint8Array} - the expression
+   */
+  static threshold(threshold, ids) {
+    if (!Number.isInteger(threshold) || threshold < 1 || threshold > ids.length) {
+      throw new Error(
+        "threshold must be between 1 and the number of identities"
+      );
+    }
+    const list = ids.map(id => id.toString()).join(", ");
+    return Expression._encode("[" + list + "]/" + threshold);
+  }
+
+  static _encode(str) {
+    return new Uint8Array(Buffer.from(str));
+  }
+}
+
+module.exports = Expression;
@@ -1,5 +1,7 @@
 const SignerEd25519 = require("./SignerEd25519");
 const IdentityEd25519 = require("./IdentityEd25519");
+const Expression = require("./Expression");
 
 module.exports.SignerEd25519 = SignerEd25519;
 module.exports.IdentityEd25519 = IdentityEd25519;
+module.exports.Expression = Expression;
@@ -0,0 +1,26 @@
+const chai = require("chai");
+const expect = chai.expect;
+
+const curve = require("@dedis/kyber-js").curve.newCurve("edwards25519");
+const darc = require("../../lib/byzcoin/darc");
+
+describe("darc expressions", () => {
+  const ids = [1, 2, 3].map(
+    () => new darc.IdentityEd25519(curve.point().pick())
+  );
+  const strs = ids.map(id => id.toString());
+  const decode = buf => Buffer.from(buf).toString();
+
+  it("joins the identities with and and or", () => {
+    expect(decode(darc.Expression.and(ids))).to.equal(strs.join(" & "));
+    expect(decode(darc.Expression.or(ids))).to.equal(strs.join(" | "));
+  });
+
+  it("creates threshold expressions", () => {
+    expect(decode(darc.Expression.threshold(2, ids))).to.equal(
+      "[" + strs.join(", ") + "]/2"
+    );
+    expect(() => darc.Expression.threshold(0, ids)).to.throw();
+    expect(() => darc.Expression.threshold(4, ids)).to.throw();
+  });
+});
@@ -733,6 +733,23 @@ func (db *SkipBlockDB) Store(sb *SkipBlock) SkipBlockID {
 	return nil
 }
 
+// PrunePayload removes the payload of the given block. As the payload is not
+// part of the hash of the block, the block and its links stay valid, but the
+// application will not be able to read the payload anymore.
+func (db *SkipBlockDB) PrunePayload(sbID SkipBlockID) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		sb, err := db.getFromTx(tx, sbID)
+		if err != nil {
+			return err
+		}
+		if sb == nil {
+			return errors.New("no such block")
+		}
+		sb.Payload = nil
+		return db.storeToTx(tx, sb)
+	})
+}
+
 // HasForwardLink verififes if sb can be accepted in the database by searching
 // for a forwardlink of any level.
 func (db *SkipBlockDB) HasForwardLink(sb *SkipBlock) bool {
@@ -205,6 +205,27 @@ func TestSkipBlock_Payload(t *testing.T) {
 	require.Equal(t, h, sb.CalculateHash())
 }
 
+func TestSkipBlockDB_PrunePayload(t *testing.T) {
+	db, fname := setupSkipBlockDB(t)
+	defer db.Close()
+	defer os.Remove(fname)
+
+	sb := NewSkipBlock()
+	sb.Data = []byte{1}
+	sb.Payload = []byte{1, 2, 3}
+	sb.Hash = sb.CalculateHash()
+	require.NotNil(t, db.Store(sb))
+	require.Equal(t, sb.Payload, db.GetByID(sb.Hash).Payload)
+
+	require.Nil(t, db.PrunePayload(sb.Hash))
+	sb2 := db.GetByID(sb.Hash)
+	require.Equal(t, 0, len(sb2.Payload))
+	require.Equal(t, sb.Data, sb2.Data)
+	require.Equal(t, sb.Hash, sb2.CalculateHash())
+
+	require.NotNil(t, db.PrunePayload(SkipBlockID{1, 2, 3}))
+}
+
 // setupSkipBlockDB initialises a database with a bucket called 'skipblock-test' inside.
 // The caller is responsible to close and remove the database file after using it.
 func setupSkipBlockDB(t *testing.T) (*SkipBlockDB, string) {